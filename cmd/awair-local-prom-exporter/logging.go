@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	logFormatJSON    = "json"
+	logFormatConsole = "console"
+)
+
+// logOutput is where and how log messages are written.
+type logOutput struct {
+	Format string
+	// File, if set, receives log messages instead of stderr, unless Tee
+	// is also set.
+	File *lumberjack.Logger
+	Tee  bool
+}
+
+// newLogger builds a logger with zap's production settings at a level that
+// can be changed while the exporter runs. The console format swaps in zap's
+// human-readable development encoder, colored when writing only to a
+// terminal.
+func newLogger(level zap.AtomicLevel, output logOutput) (*zap.Logger, error) {
+	config := zap.NewProductionConfig()
+	toStderr := output.File == nil || output.Tee
+
+	var encoder zapcore.Encoder
+	switch output.Format {
+	case logFormatJSON:
+		encoder = zapcore.NewJSONEncoder(config.EncoderConfig)
+	case logFormatConsole:
+		encoderConfig := zap.NewDevelopmentEncoderConfig()
+		if output.File == nil && isatty.IsTerminal(os.Stderr.Fd()) {
+			encoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		}
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, fmt.Errorf("must be json or console")
+	}
+
+	writers := []zapcore.WriteSyncer{}
+	if toStderr {
+		writers = append(writers, zapcore.Lock(os.Stderr))
+	}
+	if output.File != nil {
+		writers = append(writers, zapcore.AddSync(output.File))
+	}
+
+	core := zapcore.NewCore(encoder, zapcore.NewMultiWriteSyncer(writers...), level)
+	core = zapcore.NewSamplerWithOptions(core, time.Second, config.Sampling.Initial, config.Sampling.Thereafter)
+	return zap.New(core, zap.AddCaller(), zap.AddStacktrace(zap.ErrorLevel), zap.ErrorOutput(zapcore.Lock(os.Stderr))), nil
+}
+
+func parseLogLevel(value string) (zapcore.Level, error) {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return level, err
+	}
+	switch level {
+	case zapcore.DebugLevel, zapcore.InfoLevel, zapcore.WarnLevel, zapcore.ErrorLevel:
+		return level, nil
+	}
+	return level, fmt.Errorf("must be one of debug, info, warn, error")
+}
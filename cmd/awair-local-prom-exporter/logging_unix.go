@@ -0,0 +1,50 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/exporter"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// reopenLogFileOnSIGUSR1 closes the log file on every SIGUSR1 so that the
+// next message reopens it, for logrotate setups that move the file aside.
+func reopenLogFileOnSIGUSR1(app *exporter.App, file *lumberjack.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		for range signals {
+			if err := file.Close(); err != nil {
+				app.Logger.Warnf("Failed to close log file (%+v) for reopening: %+v", file.Filename, err)
+				continue
+			}
+			app.Logger.Infof("Reopened log file (%+v)", file.Filename)
+		}
+	}()
+}
+
+// toggleDebugOnSIGUSR2 switches between debug logging and log_level on every
+// SIGUSR2, for chasing an intermittent problem without a restart.
+func toggleDebugOnSIGUSR2(app *exporter.App, logLevel zap.AtomicLevel) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		for range signals {
+			level := zapcore.DebugLevel
+			if logLevel.Level() == zapcore.DebugLevel {
+				level = app.LogLevel
+			}
+			logLevel.SetLevel(level)
+			app.Logger.Warnf("Received SIGUSR2, logging at level (%+v)", level)
+		}
+	}()
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/exporter"
+	"go.uber.org/zap"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// reopenLogFileOnSIGUSR1 does nothing, Windows has no SIGUSR1. log_file is
+// still rotated by size.
+func reopenLogFileOnSIGUSR1(app *exporter.App, file *lumberjack.Logger) {}
+
+// toggleDebugOnSIGUSR2 does nothing, Windows has no SIGUSR2. PUT
+// /-/log-level changes the level instead.
+func toggleDebugOnSIGUSR2(app *exporter.App, logLevel zap.AtomicLevel) {}
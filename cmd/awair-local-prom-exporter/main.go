@@ -0,0 +1,499 @@
+// Command awair-local-prom-exporter polls Awair devices and exports their readings as
+// Prometheus metrics. See pkg/exporter for embedding the exporter in another
+// program.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair/awairtest"
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mock" {
+		os.Exit(runMock(os.Args[2:]))
+	}
+
+	logLevel := zap.NewAtomicLevelAt(zap.InfoLevel)
+	rawLogger, err := newLogger(logLevel, logOutput{Format: logFormatJSON})
+	if err != nil {
+		panic(fmt.Sprintf("Failed to start logger: %+v", err))
+	}
+
+	app, err := exporter.NewApp(
+		exporter.WithLogger(rawLogger.Sugar(), logLevel),
+		exporter.WithRegisterer(prometheus.DefaultRegisterer, prometheus.DefaultGatherer),
+	)
+	if err != nil {
+		rawLogger.Sugar().Fatalf("Failed to create exporter: %+v", err)
+	}
+
+	// Initialize Flags for configuration
+	flag.StringVar(&app.ListenAddress, "listen", app.ListenAddress, "Listen address")
+	flag.Uint64Var(&app.ListenPort, "port", app.ListenPort, "Listen port number")
+	flag.StringVar(&app.ListenSocket, "listen_socket", app.ListenSocket, "Path of a unix socket to listen on instead of the TCP listen address and port")
+	listenSocketMode := flag.String("listen_socket_mode", "0660", "Permissions (octal) of the listen_socket file")
+	flag.StringVar(&app.TelemetryPath, "telemetry_path", app.TelemetryPath, "Path under which to expose metrics")
+	flag.StringVar(&app.TLSCertFile, "tls_cert_file", app.TLSCertFile, "Path to a PEM certificate to serve HTTPS with, reloaded on SIGHUP")
+	flag.StringVar(&app.TLSKeyFile, "tls_key_file", app.TLSKeyFile, "Path to the PEM private key for tls_cert_file")
+	flag.StringVar(&app.TLSClientCAFile, "tls_client_ca_file", app.TLSClientCAFile, "Path to a PEM CA bundle; when set, clients must present a certificate signed by it")
+	flag.StringVar(&app.HealthListen, "health_listen", app.HealthListen, "Separate plain HTTP address (e.g. 127.0.0.1:2113) to also serve /healthz and /readyz on")
+	flag.StringVar(&app.AllowedCIDRs, "allowed_cidrs", app.AllowedCIDRs, "Comma-separated list of CIDRs allowed to make requests; everyone else gets 403")
+	flag.StringVar(&app.TrustedProxies, "trusted_proxies", app.TrustedProxies, "Comma-separated list of CIDRs of reverse proxies whose trusted_proxy_header is honored")
+	flag.StringVar(&app.TrustedProxyHeader, "trusted_proxy_header", app.TrustedProxyHeader, "Header trusted proxies put the client address in")
+	flag.StringVar(&app.AuthUsername, "auth_username", app.AuthUsername, "Require basic auth with this username on metrics and data endpoints")
+	flag.StringVar(&app.AuthPasswordHashFile, "auth_password_hash_file", app.AuthPasswordHashFile, "Path to a file holding the bcrypt hash of the basic auth password (or set $AWAIR_EXPORTER_AUTH_PASSWORD_HASH)")
+	flag.StringVar(&app.AdminTokenFile, "admin_token_file", app.AdminTokenFile, "Path to a file holding the bearer token required by admin endpoints (or set $AWAIR_EXPORTER_ADMIN_TOKEN); admin endpoints are disabled without one")
+	flag.BoolVar(&app.EnablePprof, "enable_pprof", app.EnablePprof, "Serve net/http/pprof profiling endpoints under /debug/pprof/")
+	flag.StringVar(&app.PprofListen, "pprof_listen", app.PprofListen, "Separate address (e.g. localhost:6060) to serve pprof on instead of the main listener")
+	flag.DurationVar(&app.ServerReadHeaderTimeout, "server_read_header_timeout", app.ServerReadHeaderTimeout, "Time allowed to read a request's headers")
+	flag.DurationVar(&app.ServerReadTimeout, "server_read_timeout", app.ServerReadTimeout, "Time allowed to read a whole request")
+	flag.DurationVar(&app.ServerWriteTimeout, "server_write_timeout", app.ServerWriteTimeout, "Time allowed to write a response")
+	flag.DurationVar(&app.ServerIdleTimeout, "server_idle_timeout", app.ServerIdleTimeout, "Time to keep idle keep-alive connections open")
+	flag.IntVar(&app.ServerMaxHeaderBytes, "server_max_header_bytes", app.ServerMaxHeaderBytes, "Maximum size of request headers in bytes")
+	flag.DurationVar(&app.ShutdownGracePeriod, "shutdown_grace_period", app.ShutdownGracePeriod, "Time to let in-flight requests finish on SIGINT/SIGTERM")
+	flag.StringVar(&app.DeviceProxyURL, "device_proxy_url", app.DeviceProxyURL, "HTTP(S) or SOCKS5 proxy URL to reach local devices through, overriding $HTTP_PROXY and $HTTPS_PROXY")
+	flag.BoolVar(&app.DeviceTLSSkipVerify, "device_tls_skip_verify", app.DeviceTLSSkipVerify, "Skip verification of the TLS certificates of https device URLs (insecure)")
+	flag.StringVar(&app.DeviceCAFile, "device_ca_file", app.DeviceCAFile, "Path to a PEM bundle of the CA certificates to verify https device URLs against instead of the system roots")
+	flag.StringVar(&app.DeviceClientCert, "device_client_cert", app.DeviceClientCert, "Path to a PEM client certificate to present to https devices that require one, reloaded on SIGHUP")
+	flag.StringVar(&app.DeviceClientKey, "device_client_key", app.DeviceClientKey, "Path to the PEM private key of device_client_cert")
+	flag.Var((*stringList)(&app.DeviceHeaders), "device_header", "Header (\"Name: value\") to send with every request to a local device; repeat for more headers")
+	noProxy := flag.String("no_proxy", "", "Comma-separated list of hosts, domains and CIDRs of devices to dial directly rather than through a proxy, overriding $NO_PROXY")
+	corsAllowedOrigins := flag.String("cors_allowed_origins", "", "Comma-separated list of origins (or *) allowed to read the JSON API from a browser")
+	flag.BoolVar(&app.LogRequests, "log_requests", app.LogRequests, "Log every HTTP request")
+	logRequestsExclude := flag.String("log_requests_exclude", "/healthz,/readyz", "Comma-separated list of paths left out of the request log")
+	flag.BoolVar(&app.DisableGoMetrics, "disable_go_metrics", app.DisableGoMetrics, "Don't export the go_* Go runtime metrics")
+	flag.BoolVar(&app.DisableProcessMetrics, "disable_process_metrics", app.DisableProcessMetrics, "Don't export the process_* metrics")
+	flag.IntVar(&app.StreamMaxSubscribers, "stream_max_subscribers", app.StreamMaxSubscribers, "Maximum number of concurrent /api/v1/stream clients")
+	flag.DurationVar(&app.DeviceErrorLogInterval, "device_error_log_interval", app.DeviceErrorLogInterval, "Time between repeated error logs for a device that keeps failing; the first failure and the recovery are always logged")
+	flag.IntVar(&app.ErrorBufferSize, "error_buffer_size", app.ErrorBufferSize, "Number of recent poll errors kept for /debug/errors")
+	flag.StringVar(&app.MQTTBroker, "mqtt_broker", app.MQTTBroker, "MQTT broker URL (e.g. tcp://localhost:1883) to publish every reading to")
+	flag.StringVar(&app.MQTTClientID, "mqtt_client_id", app.MQTTClientID, "MQTT client ID")
+	flag.StringVar(&app.MQTTUsername, "mqtt_username", app.MQTTUsername, "MQTT username")
+	flag.StringVar(&app.MQTTPasswordFile, "mqtt_password_file", app.MQTTPasswordFile, "Path to a file holding the MQTT password (or set $AWAIR_EXPORTER_MQTT_PASSWORD)")
+	flag.StringVar(&app.MQTTTopic, "mqtt_topic", app.MQTTTopic, "MQTT topic template; {device_name} and {sensor} are replaced")
+	flag.StringVar(&app.MQTTAggregateTopic, "mqtt_aggregate_topic", app.MQTTAggregateTopic, "MQTT topic template for the aggregates across devices; {sensor} and {agg} are replaced, and empty disables them")
+	mqttQoS := flag.Uint("mqtt_qos", 0, "MQTT QoS level (0, 1 or 2) to publish with")
+	flag.BoolVar(&app.MQTTRetain, "mqtt_retain", app.MQTTRetain, "Publish MQTT messages as retained")
+	flag.BoolVar(&app.MQTTHomeAssistant, "mqtt_homeassistant", app.MQTTHomeAssistant, "Publish Home Assistant MQTT discovery configs and device availability")
+	flag.StringVar(&app.MQTTHomeAssistantPrefix, "mqtt_homeassistant_prefix", app.MQTTHomeAssistantPrefix, "Home Assistant MQTT discovery topic prefix")
+	flag.StringVar(&app.InfluxURL, "influx_url", app.InfluxURL, "InfluxDB v2 URL (e.g. http://localhost:8086) to write every reading to")
+	flag.StringVar(&app.InfluxTokenFile, "influx_token_file", app.InfluxTokenFile, "Path to a file holding the InfluxDB API token (or set $AWAIR_EXPORTER_INFLUX_TOKEN)")
+	flag.StringVar(&app.InfluxOrg, "influx_org", app.InfluxOrg, "InfluxDB organization to write to")
+	flag.StringVar(&app.InfluxBucket, "influx_bucket", app.InfluxBucket, "InfluxDB bucket to write to")
+	flag.StringVar(&app.RemoteWriteURL, "remote_write_url", app.RemoteWriteURL, "Prometheus remote write URL to push the awair_* series to after every poll cycle")
+	flag.StringVar(&app.RemoteWriteBearerTokenFile, "remote_write_bearer_token_file", app.RemoteWriteBearerTokenFile, "Path to a file holding a bearer token for remote_write_url (or set $AWAIR_EXPORTER_REMOTE_WRITE_TOKEN)")
+	flag.StringVar(&app.RemoteWriteUsername, "remote_write_username", app.RemoteWriteUsername, "Basic auth username for remote_write_url")
+	flag.StringVar(&app.RemoteWritePasswordFile, "remote_write_password_file", app.RemoteWritePasswordFile, "Path to a file holding the basic auth password for remote_write_url (or set $AWAIR_EXPORTER_REMOTE_WRITE_PASSWORD)")
+	flag.StringVar(&app.RemoteWriteJob, "remote_write_job", app.RemoteWriteJob, "job label added to remote written series")
+	flag.DurationVar(&app.RemoteWriteMaxAge, "remote_write_max_age", app.RemoteWriteMaxAge, "Time to keep retrying samples the remote write endpoint doesn't accept before dropping them")
+	flag.StringVar(&app.PushgatewayURL, "pushgateway_url", app.PushgatewayURL, "Pushgateway URL to push the awair_* metrics to after every poll cycle (and after --once)")
+	flag.StringVar(&app.PushgatewayJob, "pushgateway_job", app.PushgatewayJob, "job the Pushgateway group is pushed as")
+	flag.StringVar(&app.PushgatewayInstance, "pushgateway_instance", app.PushgatewayInstance, "instance label of the Pushgateway group (default the hostname)")
+	flag.StringVar(&app.StatsdAddress, "statsd_address", app.StatsdAddress, "StatsD server (udp://host:8125 or tcp://host:8125) to send every reading to as gauges")
+	flag.StringVar(&app.StatsdPrefix, "statsd_prefix", app.StatsdPrefix, "Prefix of StatsD gauge names, which are <prefix>.<device>.<sensor>")
+	flag.StringVar(&app.DogstatsdAddress, "dogstatsd_address", app.DogstatsdAddress, "DogStatsD agent (udp://host:8125 or unix:///var/run/datadog/dsd.socket) to send every reading to as tagged gauges")
+	flag.StringVar(&app.DogstatsdPrefix, "dogstatsd_prefix", app.DogstatsdPrefix, "Prefix of DogStatsD metric names, which are <prefix>.<metric>")
+	dogstatsdTags := flag.String("dogstatsd_tags", "", "Comma-separated list of tags (e.g. env:prod,site:hq) added to every DogStatsD metric")
+	flag.StringVar(&app.GraphiteAddress, "graphite_address", app.GraphiteAddress, "Carbon plaintext endpoint (host:2003) to send every reading to")
+	flag.StringVar(&app.GraphitePrefix, "graphite_prefix", app.GraphitePrefix, "Prefix of Graphite metric paths, which are <prefix>.<device>.<sensor>")
+	flag.StringVar(&app.OTLPEndpoint, "otlp_endpoint", app.OTLPEndpoint, "OTLP/HTTP endpoint (e.g. http://collector:4318) to export the latest readings to as gauges")
+	flag.StringVar(&app.OTLPHeaders, "otlp_headers", app.OTLPHeaders, "Comma-separated list of key=value headers sent with OTLP exports")
+	flag.DurationVar(&app.OTLPInterval, "otlp_interval", app.OTLPInterval, "Time between OTLP exports, independent of poll_frequency")
+	flag.StringVar(&app.TextfileOutput, "textfile_output", app.TextfileOutput, "Path of a .prom file to write the awair_* metrics to after every poll cycle, for node_exporter's textfile collector")
+	flag.BoolVar(&app.DisableHTTPServer, "disable_http_server", app.DisableHTTPServer, "Don't serve HTTP, only poll devices and push to the configured outputs (e.g. textfile_output)")
+	flag.StringVar(&app.CSVOutput, "csv_output", app.CSVOutput, "Path of a CSV file to append one row per device per poll to")
+	flag.Int64Var(&app.CSVMaxSize, "csv_max_size", app.CSVMaxSize, "Size in bytes at which csv_output is rotated (0 never rotates)")
+	flag.IntVar(&app.CSVMaxFiles, "csv_max_files", app.CSVMaxFiles, "Number of rotated CSV files to keep")
+	flag.StringVar(&app.HistoryDB, "history_db", app.HistoryDB, "Path of a SQLite database to store every reading in and serve /api/v1/history from")
+	flag.Var((*durationValue)(&app.HistoryRetention), "history_retention", "Time to keep readings in history_db before deleting them, accepting days (e.g. 90d) (0 keeps them forever)")
+	flag.Var((*sizeValue)(&app.HistoryMaxSize), "history_max_size", "Size history_db is kept under by deleting the oldest readings, in bytes or with a unit (e.g. 500MB) (0 doesn't limit it)")
+	flag.StringVar(&app.WebhookURL, "webhook_url", app.WebhookURL, "URL to POST a JSON notification to when a threshold from thresholds_file fires or resolves")
+	flag.StringVar(&app.ThresholdsFile, "thresholds_file", app.ThresholdsFile, "Path to a JSON list of thresholds ({\"sensor\", \"above\" or \"below\", \"clear\", \"for\", \"severity\", \"devices\"}) to export as awair_threshold_breached, notify webhook_url about and generate alerting rules from")
+	flag.StringVar(&app.ReadingsLog, "readings_log", app.ReadingsLog, "Path of a file to append every reading to as a line of JSON; SIGUSR1 reopens it")
+	flag.StringVar(&app.CloudWatchNamespace, "cloudwatch_namespace", app.CloudWatchNamespace, "CloudWatch namespace to publish readings to, using the region and credentials from the standard AWS configuration")
+	flag.DurationVar(&app.CloudWatchInterval, "cloudwatch_interval", app.CloudWatchInterval, "Time between CloudWatch publishes, independent of poll_frequency")
+	flag.BoolVar(&app.CloudWatchOnlyChanges, "cloudwatch_only_changes", app.CloudWatchOnlyChanges, "Only publish sensor values to CloudWatch that changed since they were last published")
+	flag.StringVar(&app.NATSURL, "nats_url", app.NATSURL, "NATS server URL(s), comma-separated (e.g. nats://localhost:4222), to publish readings to")
+	flag.StringVar(&app.NATSSubject, "nats_subject", app.NATSSubject, "NATS subject template; without {sensor}, each reading is published as one JSON message")
+	flag.StringVar(&app.NATSCredentialsFile, "nats_credentials_file", app.NATSCredentialsFile, "Path to a NATS user credentials (.creds) file")
+	flag.StringVar(&app.NATSNKeyFile, "nats_nkey_file", app.NATSNKeyFile, "Path to a NATS NKey seed file")
+	flag.StringVar(&app.ForwardURL, "forward_url", app.ForwardURL, "URL to POST each poll cycle's readings to as a JSON array")
+	flag.StringVar(&app.ForwardHeaders, "forward_headers", app.ForwardHeaders, "Comma-separated list of key=value headers sent with forward_url requests")
+	flag.StringVar(&app.CloudDevices, "cloud_devices", app.CloudDevices, "Comma-separated list of [name=]device_type/device_id devices to poll through the Awair cloud API, e.g. office=awair-glow-c/1234")
+	flag.StringVar(&app.CloudTokenFile, "cloud_token_file", app.CloudTokenFile, "Path to a file holding the Awair cloud API access token (or set $AWAIR_EXPORTER_CLOUD_TOKEN)")
+	flag.StringVar(&app.CloudAPIURL, "cloud_api_url", app.CloudAPIURL, "Base URL of the Awair cloud API")
+	flag.IntVar(&app.CloudDailyQuota, "cloud_daily_quota", app.CloudDailyQuota, "Awair cloud API calls the token may make per day; cloud devices are polled no faster than this allows")
+	awairAddresses := flag.String("awair_addresses", "http://localhost/air-data/latest", "Comma-separated list of Awair air-data URLs")
+	mockDevices := flag.Int("mock_devices", 0, "Serve this many fake Awair devices in-process and poll them instead of awair_addresses, unless it's set too; see also the mock subcommand")
+	mock := registerMockFlags(flag.CommandLine, "mock_")
+	simulateDevices := flag.Int("simulate_devices", 0, "Poll this many fake Awair devices, served in-process with the mock_ flags, and report poll cycle times, goroutines and memory on exit, for capacity testing")
+	simulateDuration := flag.Duration("simulate_duration", 0, "Time to run simulate_devices for before reporting and exiting (0 keeps serving until interrupted)")
+	flag.DurationVar(&app.RecentHistory, "recent_history", app.RecentHistory, "Time to keep each device's readings in memory for /api/v1/history/recent and the dashboard's sparklines, at most 10000 readings per device (0 disables)")
+	flag.StringVar(&app.StateFile, "state_file", app.StateFile, "Path to a JSON file to save each device's last reading to, and to restore them from on startup until the devices are polled")
+	flag.DurationVar(&app.StateMaxAge, "state_max_age", app.StateMaxAge, "Oldest reading, by the device's timestamp, restored from state_file")
+	flag.StringVar(&app.RecordDir, "record_dir", app.RecordDir, "Directory to save every raw device response to, one file per response under a directory per device, for replay_dir")
+	flag.StringVar(&app.ReplayDir, "replay_dir", app.ReplayDir, "Directory of responses saved by record_dir to answer device requests with instead of contacting the devices, which are polled instead of awair_addresses unless it's set too")
+	flag.Float64Var(&app.ReplaySpeed, "replay_speed", app.ReplaySpeed, "How much faster than recorded replay_dir is replayed, starting over at the end; 0 answers each request with the next response")
+	flag.StringVar(&app.DevicesFile, "devices_file", app.DevicesFile, "Path to a JSON list of devices ({\"url\", \"name\", \"labels\"}) to poll alongside awair_addresses")
+	flag.Var((*failFastValue)(&app.FailFast), "fail_fast", "Poll every device once at startup and exit non-zero if any (--fail_fast or --fail_fast=any) or all (--fail_fast=all) of them fail")
+	flag.StringVar(&app.CompositeScoreFile, "composite_score_file", app.CompositeScoreFile, "Path to a YAML file of the weights ({\"default_weight\", \"devices\": [{\"device\", \"weight\", \"schedule\"}]}) of each device's score in awair_composite_score")
+	flag.StringVar(&app.RelabelFile, "relabel_file", app.RelabelFile, "Path to a YAML file of rules ({\"source\", \"regex\", \"labels\"}) that add labels such as floor and room to every device's series from a regex over its address or name")
+	flag.StringVar(&app.GroupsFile, "groups_file", app.GroupsFile, "Path to a YAML file of polling groups, each with its own devices, poll_frequency, device_timeout, constant labels and metric namespace, served alongside the top-level devices")
+	flag.BoolVar(&app.PersistDevices, "persist_devices", app.PersistDevices, "Write devices added or deleted through the admin API back to devices_file")
+	pollFrequency := flag.String("poll_frequency", "30s", "Time (seconds) to wait between polling devices")
+	flag.DurationVar(&app.MinPollFrequency, "min_poll_frequency", app.MinPollFrequency, "Shortest poll_frequency allowed without allow_fast_polling")
+	flag.DurationVar(&app.DeviceTimeout, "device_timeout", app.DeviceTimeout, "Time allowed for each request to a device")
+	flag.DurationVar(&app.DeviceMaxRetryAfter, "device_max_retry_after", app.DeviceMaxRetryAfter, "Longest Retry-After honored from a device or proxy that answers 429, or 503 with Retry-After, before polling it again")
+	flag.BoolVar(&app.CrashOnPanic, "crash_on_panic", app.CrashOnPanic, "Exit on a panic while polling, for a supervisor to restart the exporter, instead of logging it and carrying on")
+	flag.BoolVar(&app.LegacyMetrics, "legacy_metrics", app.LegacyMetrics, "Also export each sensor gauge and histogram under its former awair_climate_* name; see print_metric_map")
+	flag.StringVar(&app.MetricStyle, "metric_style", app.MetricStyle, "How sensor readings are exported: split into a gauge per sensor, combined into awair_sensor_value with sensor and unit labels, or both")
+	metadataLabels := flag.String("metadata_labels", "", "Comma-separated list of device metadata (uuid, name, type, firmware) to add as labels to every sensor series, fixed from the first metadata each device reports")
+	flag.BoolVar(&app.Histograms, "histograms", app.Histograms, "Also observe every reading into a histogram per sensor, such as awair_air_quality_co2_ppm_histogram")
+	flag.Var((*stringList)(&app.HistogramBuckets), "histogram_buckets", "Bucket bounds of a sensor's histogram (\"sensor=bound,bound,...\", e.g. co2=400,1000,2000) instead of its defaults; repeat for more sensors")
+	flag.StringVar(&app.DeviceLabelSource, "device_label_source", app.DeviceLabelSource, "What identifies a device in the device_address label of its series, the JSON API and logs: url, host or name")
+	flag.IntVar(&app.DeviceDownAfter, "device_down_after", app.DeviceDownAfter, "Consecutive failed polls after which a degraded device is considered down")
+	flag.IntVar(&app.DeviceHealthyAfter, "device_healthy_after", app.DeviceHealthyAfter, "Consecutive successful polls after which a degraded or down device is considered healthy again")
+	flag.BoolVar(&app.AllowFastPolling, "allow_fast_polling", app.AllowFastPolling, "Allow a poll_frequency below min_poll_frequency")
+	flag.BoolVar(&app.DeviceDisableKeepAlive, "device_disable_keepalive", app.DeviceDisableKeepAlive, "Open a new connection, resolving the device's hostname again, for every request to a device instead of reusing connections")
+	flag.DurationVar(&app.DeviceDNSTTL, "device_dns_ttl", app.DeviceDNSTTL, "Close idle device connections this often so that device hostnames are resolved again (0 keeps them until the device closes them)")
+	flag.StringVar(&app.SourceInterface, "source_interface", app.SourceInterface, "Network interface device requests are sent from")
+	flag.StringVar(&app.SourceAddress, "source_address", app.SourceAddress, "Local IP address device requests are sent from")
+	flag.BoolVar(&app.DiscoverMDNS, "discover_mdns", app.DiscoverMDNS, "Discover Awair devices on the local network via mDNS and poll them alongside awair_addresses")
+	flag.DurationVar(&app.MDNSBrowseInterval, "mdns_browse_interval", app.MDNSBrowseInterval, "Time to wait between mDNS browses")
+	flag.DurationVar(&app.MDNSBrowseTimeout, "mdns_browse_timeout", app.MDNSBrowseTimeout, "Time to listen for mDNS responses on each browse")
+	flag.DurationVar(&app.MDNSGracePeriod, "mdns_grace_period", app.MDNSGracePeriod, "Time a discovered device may go unannounced before it stops being polled")
+	printConfigFlag := flag.Bool("print_config", false, "Print the effective configuration as YAML, with secrets masked, and exit")
+	checkConfig := flag.Bool("check_config", false, "Validate the configuration, print the effective settings and exit")
+	selfTest := flag.Bool("selftest", false, "Poll every device once, print whether each was reachable, answered 200, decoded, reported a sane reading and agrees with this host's clock, and exit non-zero if any failed")
+	flag.DurationVar(&app.SelfTestMaxClockSkew, "selftest_max_clock_skew", app.SelfTestMaxClockSkew, "Largest difference between a device's reading timestamp and this host's clock that passes selftest")
+	once := flag.Bool("once", false, "Poll every device once, print the metrics and exit without starting the HTTP server")
+	output := flag.String("output", "", "File to write metrics to in --once mode (default stdout)")
+	logFormat := flag.String("log_format", logFormatJSON, "Format of log messages: json, or console for human-readable output")
+	logFile := flag.String("log_file", "", "Path of a file to write logs to instead of stderr, rotated by size; SIGUSR1 reopens it")
+	logMaxSize := flag.Int("log_max_size_mb", 100, "Size in megabytes at which log_file is rotated")
+	logMaxBackups := flag.Int("log_max_backups", 5, "Number of rotated log files to keep, 0 to keep all")
+	logMaxAgeDays := flag.Int("log_max_age_days", 0, "Days to keep rotated log files, 0 to keep them regardless of age")
+	logTee := flag.Bool("log_tee", false, "Write logs to stderr as well as log_file")
+	logLevelFlag := flag.String("log_level", "info", "Minimum level of log messages: debug, info, warn or error; SIGUSR2 toggles debug")
+	printMetricMap := flag.Bool("print_metric_map", false, "Print the former name of each sensor metric next to its current name, then exit")
+	genRules := flag.Bool("gen_rules", false, "Print Prometheus alerting rules for thresholds_file and device failures, then exit")
+	healthcheck := flag.Bool("healthcheck", false, "Check /healthz of the instance running with the same flags, exit 0 if healthy and 1 otherwise")
+	watch := flag.Bool("watch", false, "Show a live table of readings in the terminal instead of starting the HTTP server")
+
+	flag.Parse()
+
+	if *printMetricMap {
+		exporter.WriteMetricMap(os.Stdout)
+		os.Exit(0)
+	}
+
+	// Switch log formats and outputs before anything else is logged, so
+	// that even startup failures use them
+	if *logFormat != logFormatJSON || *logFile != "" {
+		output := logOutput{Format: *logFormat, Tee: *logTee}
+		if *logFile != "" {
+			if *logMaxSize <= 0 || *logMaxBackups < 0 || *logMaxAgeDays < 0 {
+				app.Logger.Fatalf("Invalid configuration: log_max_size_mb must be positive, log_max_backups and log_max_age_days must not be negative")
+			}
+			output.File = &lumberjack.Logger{
+				Filename:   *logFile,
+				MaxSize:    *logMaxSize,
+				MaxBackups: *logMaxBackups,
+				MaxAge:     *logMaxAgeDays,
+			}
+		}
+		rawLogger, err := newLogger(logLevel, output)
+		if err != nil {
+			app.Logger.Fatalf("Invalid configuration: log_format (%q): %+v", *logFormat, err)
+		}
+		if err := app.Apply(exporter.WithLogger(rawLogger.Sugar(), logLevel)); err != nil {
+			app.Logger.Fatalf("Failed to switch loggers: %+v", err)
+		}
+		if output.File != nil {
+			reopenLogFileOnSIGUSR1(app, output.File)
+		}
+	}
+
+	app.LogRequestsExclude = splitList(*logRequestsExclude)
+	app.CORSAllowedOrigins = splitList(*corsAllowedOrigins)
+	app.NoProxy = splitList(*noProxy)
+	app.DogstatsdTags = splitList(*dogstatsdTags)
+	app.MetadataLabels = splitList(*metadataLabels)
+
+	configErrs := []error{}
+
+	app.LogLevel, err = parseLogLevel(*logLevelFlag)
+	if err != nil {
+		configErrs = append(configErrs, fmt.Errorf("log_level (%q): %w", *logLevelFlag, err))
+	} else {
+		logLevel.SetLevel(app.LogLevel)
+	}
+	toggleDebugOnSIGUSR2(app, logLevel)
+
+	addresses := splitList(*awairAddresses)
+	fakeFlag, fakeDevices := "mock_devices", *mockDevices
+	if *simulateDevices != 0 {
+		if *mockDevices != 0 {
+			configErrs = append(configErrs, fmt.Errorf("simulate_devices: mutually exclusive with mock_devices"))
+		}
+		fakeFlag, fakeDevices = "simulate_devices", *simulateDevices
+	}
+	if *simulateDuration < 0 {
+		configErrs = append(configErrs, fmt.Errorf("simulate_duration (%v): must not be negative", *simulateDuration))
+	}
+	if fakeDevices < 0 {
+		configErrs = append(configErrs, fmt.Errorf("%s (%d): must not be negative", fakeFlag, fakeDevices))
+	} else if fakeDevices > 0 {
+		server, err := awairtest.Start(mock.host, mock.port, fakeDevices, mock.options)
+		if err != nil {
+			configErrs = append(configErrs, fmt.Errorf("%s (%d): %w", fakeFlag, fakeDevices, err))
+		} else {
+			defer server.Close()
+			if !flagSet("awair_addresses") {
+				addresses = nil
+			}
+			addresses = append(addresses, server.URLs...)
+			app.Logger.Infof("Serving %d fake Awair devices, the first at (%s)", len(server.URLs), server.URLs[0])
+		}
+	}
+	// Configure reports a replay_dir that can't be replayed
+	if replayed, err := exporter.ReplayAddresses(app.ReplayDir); app.ReplayDir != "" && err == nil {
+		if !flagSet("awair_addresses") {
+			addresses = nil
+		}
+		addresses = append(addresses, replayed...)
+	}
+	if len(addresses) > 0 {
+		if err := app.Apply(exporter.WithAddresses(addresses...)); err != nil {
+			configErrs = append(configErrs, fmt.Errorf("awair_addresses (%q): %w", *awairAddresses, err))
+		}
+	}
+
+	// Parse time duration from poll frequency flag
+	pollInterval, err := parsePollFrequency(*pollFrequency)
+	if err == nil {
+		err = app.Apply(exporter.WithPollInterval(pollInterval))
+	}
+	if err != nil {
+		configErrs = append(configErrs, fmt.Errorf("poll_frequency (%q): %w", *pollFrequency, err))
+	}
+
+	socketMode, err := strconv.ParseUint(*listenSocketMode, 8, 32)
+	if err != nil || socketMode > 0777 {
+		configErrs = append(configErrs, fmt.Errorf("listen_socket_mode (%q): must be an octal permission such as 0660", *listenSocketMode))
+	}
+	app.ListenSocketMode = os.FileMode(socketMode)
+
+	if *mqttQoS > 2 {
+		configErrs = append(configErrs, fmt.Errorf("mqtt_qos (%d): must be 0, 1 or 2", *mqttQoS))
+	}
+	app.MQTTQoS = byte(*mqttQoS)
+
+	configErrs = append(configErrs, app.Configure()...)
+
+	if *checkConfig {
+		app.PrintConfig(os.Stdout)
+		for _, configErr := range configErrs {
+			fmt.Fprintf(os.Stderr, "FAILED: %v\n", configErr)
+		}
+		if len(configErrs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("SUCCESS: configuration is valid")
+		os.Exit(0)
+	}
+
+	for _, configErr := range configErrs {
+		app.Logger.Errorf("Invalid configuration: %+v", configErr)
+	}
+	if len(configErrs) > 0 {
+		app.Logger.Fatalf("Refusing to start with %d configuration error(s)", len(configErrs))
+	}
+
+	if *printConfigFlag {
+		app.PrintConfig(os.Stdout)
+		os.Exit(0)
+	}
+
+	if *genRules {
+		app.WriteAlertRules(os.Stdout)
+		os.Exit(0)
+	}
+
+	if *healthcheck {
+		if err := app.Healthcheck(); err != nil {
+			fmt.Fprintf(os.Stderr, "unhealthy: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		if !*watch {
+			app.Logger.Infow("Received signal, shutting down", "signal", sig.String())
+		}
+		cancel()
+	}()
+
+	if *selfTest {
+		if err := app.SelfTest(ctx, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("SUCCESS: every device passed")
+		os.Exit(0)
+	}
+
+	if *once {
+		err = app.RunOnce(ctx, *output)
+		if err != nil {
+			app.Logger.Errorf("Single poll failed: %+v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	switch {
+	case *simulateDevices > 0:
+		err = app.Simulate(ctx, os.Stdout, *simulateDuration)
+	case *watch:
+		err = app.Watch(ctx)
+	default:
+		err = app.Run(ctx)
+	}
+	if err != nil {
+		app.Logger.Fatalf("Failed to run exporter: %+v", err)
+	}
+}
+
+// stringList is a flag that may be repeated, collecting every value.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// failFastValue is the fail_fast flag, which may be given alone to mean
+// "any" or with a value of any or all.
+type failFastValue string
+
+func (v *failFastValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return string(*v)
+}
+
+func (v *failFastValue) Set(value string) error {
+	switch value {
+	case "true":
+		*v = exporter.FailFastAny
+	case "false":
+		*v = ""
+	default:
+		*v = failFastValue(value)
+	}
+	return nil
+}
+
+func (v *failFastValue) IsBoolFlag() bool { return true }
+
+// durationValue is a duration flag that also accepts a "d" suffix for days,
+// e.g. 90d.
+type durationValue time.Duration
+
+func (v *durationValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return time.Duration(*v).String()
+}
+
+func (v *durationValue) Set(value string) error {
+	d, err := exporter.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+// sizeValue is a size flag in bytes that also accepts a unit, e.g. 500MB.
+type sizeValue int64
+
+func (v *sizeValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+func (v *sizeValue) Set(value string) error {
+	size, err := exporter.ParseSize(value)
+	if err != nil {
+		return err
+	}
+	*v = sizeValue(size)
+	return nil
+}
+
+// splitList splits a comma-separated flag value, treating an empty value as
+// an empty list.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// flagSet reports whether the named flag was set on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// parsePollFrequency parses a duration, treating a bare number as seconds so
+// that "30" means what it looks like rather than failing.
+func parsePollFrequency(pollFrequency string) (time.Duration, error) {
+	d, err := time.ParseDuration(pollFrequency)
+	if err == nil {
+		return d, nil
+	}
+	seconds, convErr := strconv.ParseUint(pollFrequency, 10, 32)
+	if convErr != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair/awairtest"
+)
+
+// mockFlags are the flags of the fake devices, shared by mock_devices and
+// the mock subcommand.
+type mockFlags struct {
+	host    string
+	port    int
+	options awairtest.Options
+}
+
+// registerMockFlags registers the mock flags on fs, each name prefixed with
+// prefix.
+func registerMockFlags(fs *flag.FlagSet, prefix string) *mockFlags {
+	mock := &mockFlags{}
+	fs.StringVar(&mock.host, prefix+"host", "127.0.0.1", "Host the fake Awair devices listen on")
+	fs.IntVar(&mock.port, prefix+"port", 18080, "Port of the first fake Awair device, each further device listening on the next port (0 picks free ports)")
+	fs.DurationVar(&mock.options.Latency, prefix+"latency", 0, "Time each fake Awair device waits before answering")
+	fs.StringVar(&mock.options.LatencyDistribution, prefix+"latency_distribution", awairtest.LatencyFixed, "How "+prefix+"latency varies between responses: fixed, uniform (0 to twice it) or exponential (averaging it, with a long tail)")
+	fs.Float64Var(&mock.options.ErrorRate, prefix+"error_rate", 0, "Fraction of requests a fake Awair device answers with a 500")
+	fs.Float64Var(&mock.options.StaleRate, prefix+"stale_rate", 0, "Fraction of readings a fake Awair device repeats, stale timestamp and all")
+	return mock
+}
+
+// runMock serves fake Awair devices until SIGINT or SIGTERM, for the mock
+// subcommand, and returns the exit code.
+func runMock(args []string) int {
+	fs := flag.NewFlagSet("mock", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s mock [flags]\n\nServe fake Awair devices over the local API.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	devices := fs.Int("devices", 3, "Number of fake Awair devices to serve")
+	mock := registerMockFlags(fs, "")
+	fs.Parse(args)
+
+	server, err := awairtest.Start(mock.host, mock.port, *devices, mock.options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start fake devices: %v\n", err)
+		return 1
+	}
+	defer server.Close()
+
+	for _, url := range server.URLs {
+		fmt.Println(url)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	return 0
+}
@@ -0,0 +1,246 @@
+// Package awairtest serves fake Awair devices over the local API, with
+// readings that drift slowly as a room's would, for demos and for testing
+// against without hardware.
+package awairtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair"
+)
+
+// Latency distributions of a fake device.
+const (
+	// LatencyFixed delays every response by Latency.
+	LatencyFixed = "fixed"
+	// LatencyUniform delays responses by anywhere from 0 to twice Latency.
+	LatencyUniform = "uniform"
+	// LatencyExponential delays responses by Latency on average, most by
+	// less and a few by several times as much, as a busy network does.
+	LatencyExponential = "exponential"
+)
+
+// Options injects faults into the responses of a fake device.
+type Options struct {
+	// Latency delays every response, as drawn from LatencyDistribution.
+	Latency time.Duration
+
+	// LatencyDistribution is LatencyFixed, the default if empty,
+	// LatencyUniform or LatencyExponential.
+	LatencyDistribution string
+
+	// ErrorRate is the fraction of requests answered with a 500.
+	ErrorRate float64
+
+	// StaleRate is the fraction of readings that repeat the previous one,
+	// timestamp and all, as a device whose sensors have stalled does.
+	StaleRate float64
+}
+
+func (opts Options) validate() error {
+	if opts.Latency < 0 {
+		return fmt.Errorf("latency (%v) must not be negative", opts.Latency)
+	}
+	switch opts.LatencyDistribution {
+	case "", LatencyFixed, LatencyUniform, LatencyExponential:
+	default:
+		return fmt.Errorf("latency distribution (%q) must be fixed, uniform or exponential", opts.LatencyDistribution)
+	}
+	if opts.ErrorRate < 0 || opts.ErrorRate > 1 {
+		return fmt.Errorf("error rate (%v) must be between 0 and 1", opts.ErrorRate)
+	}
+	if opts.StaleRate < 0 || opts.StaleRate > 1 {
+		return fmt.Errorf("stale rate (%v) must be between 0 and 1", opts.StaleRate)
+	}
+	return nil
+}
+
+// Device is a fake device serving /air-data/latest and
+// /settings/config/data.
+type Device struct {
+	Config awair.DeviceConfig
+
+	opts  Options
+	start time.Time
+	phase float64
+
+	lock sync.Mutex
+	rand *rand.Rand
+	last *awair.AirData
+}
+
+// NewDevice returns the index'th fake device. Devices with different
+// indexes report different identities and readings that drift apart.
+func NewDevice(index int, opts Options) *Device {
+	return &Device{
+		Config: awair.DeviceConfig{
+			DeviceUUID: fmt.Sprintf("awair-element_%d", 90000+index),
+			WifiMAC:    fmt.Sprintf("70:88:6B:00:%02X:%02X", index>>8&0xff, index&0xff),
+			IP:         "127.0.0.1",
+			FwVersion:  "1.4.0",
+		},
+		opts:  opts,
+		start: time.Now(),
+		phase: float64(index) * 2 * math.Pi / 7,
+		rand:  rand.New(rand.NewSource(int64(index) + 1)),
+	}
+}
+
+func (device *Device) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	device.lock.Lock()
+	latency := device.latency()
+	failed := device.rand.Float64() < device.opts.ErrorRate
+	device.lock.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		}
+	}
+	if failed {
+		http.Error(w, "injected error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.URL.Path {
+	case awair.AirDataPath:
+		writeJSON(w, device.reading(time.Now()))
+	case awair.ConfigPath:
+		writeJSON(w, device.Config)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// latency draws the delay of a response. device.lock must be held.
+func (device *Device) latency() time.Duration {
+	switch device.opts.LatencyDistribution {
+	case LatencyUniform:
+		return time.Duration(device.rand.Float64() * 2 * float64(device.opts.Latency))
+	case LatencyExponential:
+		return time.Duration(device.rand.ExpFloat64() * float64(device.opts.Latency))
+	}
+	return device.opts.Latency
+}
+
+// reading returns the device's reading at now, or its previous one when
+// it's stale.
+func (device *Device) reading(now time.Time) awair.AirData {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	if device.last != nil && device.rand.Float64() < device.opts.StaleRate {
+		return *device.last
+	}
+
+	// Each sensor swings around a typical indoor level over a period of
+	// its own, with a little noise on top
+	elapsed := now.Sub(device.start).Hours()
+	wave := func(base, amplitude, periodHours, noise float64) float64 {
+		return base + amplitude*math.Sin(2*math.Pi*elapsed/periodHours+device.phase) + noise*device.rand.NormFloat64()
+	}
+	temp := round(wave(21.5, 1.5, 24, 0.05), 2)
+	humid := round(math.Max(0, wave(45, 8, 12, 0.2)), 2)
+	co2 := int(math.Max(400, wave(650, 250, 2, 5)))
+	voc := int(math.Max(0, wave(300, 200, 3, 10)))
+	pm25 := int(math.Max(0, wave(8, 6, 6, 0.5)))
+
+	reading := awair.AirData{
+		Timestamp:      now.UTC(),
+		Score:          score(temp, humid, co2, voc, pm25),
+		DewPoint:       round(temp-(100-humid)/5, 2),
+		Temp:           temp,
+		Humid:          humid,
+		AbsHumid:       round(humid*0.19, 2),
+		Co2:            co2,
+		Co2Est:         co2 - 50,
+		Co2EstBaseline: 35000,
+		Voc:            voc,
+		VocBaseline:    37000,
+		VocH2Raw:       26,
+		VocEthanolRaw:  37,
+		Pm25:           pm25,
+		Pm10Est:        pm25 + 1,
+	}
+	device.last = &reading
+	return reading
+}
+
+// score approximates the Awair score, taking points off for every sensor
+// outside its comfortable range.
+func score(temp, humid float64, co2, voc, pm25 int) int {
+	penalty := 5*math.Max(0, math.Max(18-temp, temp-25)) +
+		math.Max(0, math.Max(40-humid, humid-50)) +
+		math.Max(0, float64(co2-600)/40) +
+		math.Max(0, float64(voc-333)/60) +
+		1.5*math.Max(0, float64(pm25-12))
+	return int(math.Max(0, math.Round(100-penalty)))
+}
+
+func round(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Server serves fake devices, each on a port of its own.
+type Server struct {
+	// URLs are the air-data URLs of the devices, in order.
+	URLs []string
+
+	servers []*http.Server
+}
+
+// Start serves count fake devices on host, on sequential ports from port,
+// or on ports picked by the system if port is 0.
+func Start(host string, port, count int, opts Options) (*Server, error) {
+	if count <= 0 {
+		return nil, fmt.Errorf("count (%d) must be positive", count)
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	server := &Server{}
+	for i := 0; i < count; i++ {
+		devicePort := 0
+		if port != 0 {
+			devicePort = port + i
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(devicePort)))
+		if err != nil {
+			server.Close()
+			return nil, err
+		}
+
+		httpServer := &http.Server{Handler: NewDevice(i, opts), ReadHeaderTimeout: 5 * time.Second}
+		go httpServer.Serve(listener)
+		server.servers = append(server.servers, httpServer)
+		server.URLs = append(server.URLs, "http://"+listener.Addr().String()+awair.AirDataPath)
+	}
+	return server, nil
+}
+
+// Close stops serving every device.
+func (server *Server) Close() error {
+	for _, httpServer := range server.servers {
+		httpServer.Close()
+	}
+	return nil
+}
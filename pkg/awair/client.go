@@ -0,0 +1,140 @@
+// Package awair is a client for the local API of Awair air quality
+// monitors, which is enabled per device in the Awair Home app.
+package awair
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Paths of the local API endpoints.
+const (
+	AirDataPath = "/air-data/latest"
+	ConfigPath  = "/settings/config/data"
+)
+
+// Client talks to the local API of one device.
+type Client struct {
+	airDataURL string
+	configURL  string
+	httpClient *http.Client
+
+	// Header is added to every request, e.g. for a gateway in front of the
+	// device that requires an API key.
+	Header http.Header
+
+	// Username and Password, if Username is set, are sent as basic auth
+	// with every request.
+	Username string
+	Password string
+
+	// ResponseHook, if set, is called with every response and its body
+	// before the body is decoded, e.g. to keep the last response for
+	// debugging.
+	ResponseHook func(resp *http.Response, body []byte)
+}
+
+// NewClient returns a client for the device at baseURL, such as
+// http://192.168.1.50. A full air-data URL is accepted too, in which case
+// LatestAirData requests it as given. httpClient is used for every
+// request, or http.DefaultClient if nil.
+func NewClient(baseURL string, httpClient *http.Client) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	airData := *u
+	if airData.Path == "" || airData.Path == "/" {
+		airData.Path = AirDataPath
+	}
+	config := *u
+	config.Path = ConfigPath
+	config.RawQuery = ""
+
+	return &Client{
+		airDataURL: airData.String(),
+		configURL:  config.String(),
+		httpClient: httpClient,
+	}, nil
+}
+
+// LatestAirData returns the device's current reading.
+func (c *Client) LatestAirData(ctx context.Context) (AirData, error) {
+	body, statusCode, err := c.get(ctx, c.airDataURL)
+	if err != nil {
+		return AirData{}, err
+	}
+
+	data, err := ParseAirData(body)
+	if err != nil {
+		return AirData{}, &DecodeError{StatusCode: statusCode, Err: err}
+	}
+	return data, nil
+}
+
+// Config returns the device's identity and network settings.
+func (c *Client) Config(ctx context.Context) (DeviceConfig, error) {
+	body, statusCode, err := c.get(ctx, c.configURL)
+	if err != nil {
+		return DeviceConfig{}, err
+	}
+
+	config, err := ParseDeviceConfig(body)
+	if err != nil {
+		return DeviceConfig{}, &DecodeError{StatusCode: statusCode, Err: err}
+	}
+	return config, nil
+}
+
+// get requests a URL and returns the body of a 200 OK response. Errors
+// sending the request are returned as the HTTP client reports them.
+func (c *Client) get(ctx context.Context, address string) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	for name, values := range c.Header {
+		req.Header[name] = values
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, &ReadError{StatusCode: resp.StatusCode, Err: err}
+	}
+
+	if c.ResponseHook != nil {
+		c.ResponseHook(resp, body)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return body, resp.StatusCode, nil
+}
@@ -0,0 +1,87 @@
+package awair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("case") {
+		case "status":
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		case "short":
+			// The connection is closed before the promised body is sent
+			w.Header().Set("Content-Length", "100")
+			fmt.Fprint(w, `{"score": 9`)
+		case "json":
+			fmt.Fprint(w, `{"score": "ninety"}`)
+		default:
+			fmt.Fprint(w, `{"timestamp": "2022-06-01T12:00:00Z", "score": 92}`)
+		}
+	}))
+	defer server.Close()
+
+	fetch := func(query string) error {
+		t.Helper()
+		client, err := NewClient(server.URL+AirDataPath+"?case="+query, server.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.LatestAirData(context.Background())
+		return err
+	}
+
+	if err := fetch("ok"); err != nil {
+		t.Fatalf("fetching a valid reading: %v", err)
+	}
+
+	var statusErr *StatusError
+	if err := fetch("status"); !errors.As(err, &statusErr) {
+		t.Errorf("error of a 429 = %v (%T), want a *StatusError", err, err)
+	} else if statusErr.StatusCode != http.StatusTooManyRequests || statusErr.RetryAfter != 30*time.Second {
+		t.Errorf("status error = %+v, want status 429 and Retry-After 30s", statusErr)
+	}
+
+	var readErr *ReadError
+	if err := fetch("short"); !errors.As(err, &readErr) {
+		t.Errorf("error of a short read = %v (%T), want a *ReadError", err, err)
+	} else if readErr.StatusCode != http.StatusOK || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("read error = %+v, want status 200 wrapping io.ErrUnexpectedEOF", readErr)
+	}
+
+	var decodeErr *DecodeError
+	if err := fetch("json"); !errors.As(err, &decodeErr) {
+		t.Errorf("error of bad JSON = %v (%T), want a *DecodeError", err, err)
+	} else if decodeErr.StatusCode != http.StatusOK || decodeErr.Err == nil {
+		t.Errorf("decode error = %+v, want status 200 with the JSON error", decodeErr)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{"Wed, 01 Jun 2022 12:01:30 GMT", 90 * time.Second},
+		{"Wed, 01 Jun 2022 11:59:00 GMT", 0},
+		{"soon", 0},
+		{"1.5", 0},
+	} {
+		if got := parseRetryAfter(test.value, now); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package awair
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// StatusError is returned when the device answers with a status other
+// than 200 OK. RetryAfter is the delay asked for by the response's
+// Retry-After header, if it has one, as a rate-limiting proxy in front of
+// the device might send.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.Status)
+}
+
+// ReadError is returned when the response body can't be read.
+type ReadError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("failed to read body: %v", e.Err)
+}
+
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeError is returned when the response body isn't a payload the client
+// understands.
+type DecodeError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode body: %v", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date. It returns 0 if the header is missing, invalid
+// or in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+package awair
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// AirData is a reading as returned by a device's local API.
+type AirData struct {
+	Timestamp      time.Time `json:"timestamp"`
+	Score          int       `json:"score"`
+	DewPoint       float64   `json:"dew_point"`
+	Temp           float64   `json:"temp"`
+	Humid          float64   `json:"humid"`
+	AbsHumid       float64   `json:"abs_humid"`
+	Co2            int       `json:"co2"`
+	Co2Est         int       `json:"co2_est"`
+	Co2EstBaseline int       `json:"co2_est_baseline"`
+	Voc            int       `json:"voc"`
+	VocBaseline    int       `json:"voc_baseline"`
+	VocH2Raw       int       `json:"voc_h2_raw"`
+	VocEthanolRaw  int       `json:"voc_ethanol_raw"`
+	Pm25           int       `json:"pm25"`
+	Pm10Est        int       `json:"pm10_est"`
+}
+
+// DeviceConfig is the payload of the local API's /settings/config/data.
+type DeviceConfig struct {
+	DeviceUUID string `json:"device_uuid"`
+	WifiMAC    string `json:"wifi_mac"`
+	IP         string `json:"ip"`
+	FwVersion  string `json:"fw_version"`
+}
+
+// sensorsPayload is a reading with its values in a list of components, as
+// served by the Awair cloud API and some older firmware, optionally
+// wrapped in a data list whose first entry is the latest.
+type sensorsPayload struct {
+	Timestamp time.Time `json:"timestamp"`
+	Score     float64   `json:"score"`
+	Sensors   []struct {
+		Comp  string  `json:"comp"`
+		Value float64 `json:"value"`
+	} `json:"sensors"`
+}
+
+// ParseAirData decodes a reading in either of the shapes Awair serves: the
+// flat object of current firmware's local API, or a sensors list of
+// component/value pairs, optionally wrapped in a data list.
+func ParseAirData(body []byte) (AirData, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return AirData{}, err
+	}
+
+	if wrapped, ok := fields["data"]; ok {
+		var readings []sensorsPayload
+		if err := json.Unmarshal(wrapped, &readings); err != nil {
+			return AirData{}, err
+		}
+		if len(readings) == 0 {
+			return AirData{}, fmt.Errorf("no readings in payload")
+		}
+		return readings[0].airData(), nil
+	}
+
+	if _, ok := fields["sensors"]; ok {
+		var reading sensorsPayload
+		if err := json.Unmarshal(body, &reading); err != nil {
+			return AirData{}, err
+		}
+		return reading.airData(), nil
+	}
+
+	var data AirData
+	if err := json.Unmarshal(body, &data); err != nil {
+		return AirData{}, err
+	}
+	return data, nil
+}
+
+// airData maps a sensors list onto the local API's fields.
+func (reading sensorsPayload) airData() AirData {
+	data := AirData{
+		Timestamp: reading.Timestamp,
+		Score:     int(reading.Score),
+	}
+	for _, sensor := range reading.Sensors {
+		switch sensor.Comp {
+		case "temp":
+			data.Temp = sensor.Value
+		case "humid":
+			data.Humid = sensor.Value
+		case "co2":
+			data.Co2 = int(sensor.Value)
+		case "voc":
+			data.Voc = int(sensor.Value)
+		case "pm25":
+			data.Pm25 = int(sensor.Value)
+		case "pm10":
+			data.Pm10Est = int(sensor.Value)
+		}
+	}
+	return data
+}
+
+// ParseDeviceConfig decodes the payload of /settings/config/data.
+func ParseDeviceConfig(body []byte) (DeviceConfig, error) {
+	var config DeviceConfig
+	if err := json.Unmarshal(body, &config); err != nil {
+		return DeviceConfig{}, err
+	}
+	return config, nil
+}
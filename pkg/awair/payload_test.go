@@ -0,0 +1,41 @@
+package awair
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAirData(t *testing.T) {
+	timestamp := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	want := AirData{Timestamp: timestamp, Score: 92, Temp: 21.5, Humid: 40, Co2: 600, Voc: 150, Pm25: 3, Pm10Est: 4}
+
+	for _, test := range []struct {
+		name string
+		body string
+	}{
+		{"flat", `{"timestamp": "2022-06-01T12:00:00Z", "score": 92, "temp": 21.5, "humid": 40, "co2": 600, "voc": 150, "pm25": 3, "pm10_est": 4}`},
+		{"sensors", `{"timestamp": "2022-06-01T12:00:00Z", "score": 92, "sensors": [
+			{"comp": "temp", "value": 21.5}, {"comp": "humid", "value": 40}, {"comp": "co2", "value": 600},
+			{"comp": "voc", "value": 150}, {"comp": "pm25", "value": 3}, {"comp": "pm10", "value": 4}]}`},
+		{"data-wrapped", `{"data": [
+			{"timestamp": "2022-06-01T12:00:00Z", "score": 92, "sensors": [
+				{"comp": "temp", "value": 21.5}, {"comp": "humid", "value": 40}, {"comp": "co2", "value": 600},
+				{"comp": "voc", "value": 150}, {"comp": "pm25", "value": 3}, {"comp": "pm10", "value": 4}]},
+			{"timestamp": "2022-06-01T11:55:00Z", "score": 10, "sensors": [{"comp": "temp", "value": 30}]}]}`},
+	} {
+		got, err := ParseAirData([]byte(test.body))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: reading = %+v, want %+v", test.name, got, want)
+		}
+	}
+
+	for _, body := range []string{`not json`, `[]`, `{"data": []}`, `{"data": {}}`, `{"sensors": "temp"}`} {
+		if _, err := ParseAirData([]byte(body)); err == nil {
+			t.Errorf("ParseAirData(%s) succeeded, want an error", body)
+		}
+	}
+}
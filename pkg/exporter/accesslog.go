@@ -0,0 +1,62 @@
+package exporter
+
+import (
+	"net/http"
+	"time"
+)
+
+// statusRecorder captures the response status for the access log while
+// passing the body straight through.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// logRequests logs every request except those to excluded paths.
+func (app *App) logRequests(next http.Handler) http.Handler {
+	if !app.LogRequests {
+		return next
+	}
+
+	excluded := map[string]bool{}
+	for _, path := range app.LogRequestsExclude {
+		excluded[path] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if excluded[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		app.Logger.Infof("HTTP request: %s %s %d (%+v) from (%+v)", r.Method, r.URL.Path, status, time.Since(start), r.RemoteAddr)
+	})
+}
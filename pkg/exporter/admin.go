@@ -0,0 +1,236 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// devicesRoutes serves the device list to readers and registers new devices
+// for admins. The two need separate auth since both use the Authorization
+// header.
+func (app *App) devicesRoutes() http.Handler {
+	list := app.cors(app.requireAuth(http.HandlerFunc(app.devicesHandler)))
+	add := app.requireAdmin(http.HandlerFunc(app.addDeviceHandler))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			add.ServeHTTP(w, r)
+			return
+		}
+		list.ServeHTTP(w, r)
+	})
+}
+
+// maxDeviceEntryBytes bounds the body accepted by POST /api/v1/devices.
+const maxDeviceEntryBytes = 16 << 10
+
+func (app *App) addDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	entry := deviceEntry{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDeviceEntryBytes)).Decode(&entry); err != nil {
+		http.Error(w, fmt.Sprintf("invalid device: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateDeviceAddress(entry.URL); err != nil {
+		http.Error(w, fmt.Sprintf("invalid device url (%q): %v", entry.URL, err), http.StatusBadRequest)
+		return
+	}
+	if err := validateAPIDeviceEntry(entry); err != nil {
+		http.Error(w, fmt.Sprintf("invalid device: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateDeviceEntry(entry); err != nil {
+		http.Error(w, fmt.Sprintf("invalid device: %v", err), http.StatusBadRequest)
+		return
+	}
+	if entry.Name == "" {
+		entry.Name = deviceNameFromAddress(entry.URL)
+	}
+	if entry.Name == "poll" || strings.Contains(entry.Name, "/") {
+		http.Error(w, fmt.Sprintf("invalid device name (%q)", entry.Name), http.StatusBadRequest)
+		return
+	}
+	if _, err := app.relabel(entry.Name, entry.URL, entry.Labels); err != nil {
+		http.Error(w, fmt.Sprintf("invalid device: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	device, err := app.addDevice(entry.Name, deviceSourceAPI, entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err := app.saveDevicesFile(); err != nil {
+		app.Logger.Errorf("Failed to persist devices to (%+v): %+v", app.DevicesFile, err)
+	}
+
+	// Poll right away rather than waiting for the next cycle. A DELETE
+	// racing this request may have removed the device already, in which
+	// case the poll leaves it alone
+	app.pollDevice(app.runCtx, device)
+
+	writeJSON(w, http.StatusCreated, app.apiDevice(device))
+}
+
+// validateAPIDeviceEntry rejects the settings that read files or
+// environment variables of the exporter's host, which are only accepted from
+// devices_file and groups_file. Through the API they would let anyone with
+// the admin token have any secret the exporter can read sent to a URL of
+// their choosing.
+func validateAPIDeviceEntry(entry deviceEntry) error {
+	if entry.BasicAuth != nil {
+		return fmt.Errorf("basic_auth: only accepted from devices_file and groups_file")
+	}
+	if entry.ClientCert != "" || entry.ClientKey != "" {
+		return fmt.Errorf("client_cert and client_key: only accepted from devices_file and groups_file")
+	}
+	return nil
+}
+
+func (app *App) deleteDeviceHandler(w http.ResponseWriter, r *http.Request, device *Device) {
+	if device.Source != deviceSourceAPI && device.Source != deviceSourceFile {
+		http.Error(w, fmt.Sprintf("device (%q) comes from %s and can't be deleted at runtime", device.Name, device.Source), http.StatusConflict)
+		return
+	}
+
+	if !app.RemoveDevice(device.Address, device.Source) {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	if err := app.saveDevicesFile(); err != nil {
+		app.Logger.Errorf("Failed to persist devices to (%+v): %+v", app.DevicesFile, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deviceAdminHandler serves the mutating endpoints under /api/v1/devices/:
+// DELETE {name}, POST {name}/pause, {name}/resume, {name}/poll and poll for
+// every device.
+func (app *App) deviceAdminHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/devices/"), "/")
+	if len(parts) > 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 1 && parts[0] == "poll" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		app.pollAllHandler(w, r)
+		return
+	}
+
+	device, ok := app.LookupDevice(parts[0])
+	if !ok {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		app.deleteDeviceHandler(w, r, device)
+		return
+	}
+	action := parts[1]
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "pause":
+		app.SetDevicePaused(device, true)
+	case "resume":
+		app.SetDevicePaused(device, false)
+	case "poll":
+		app.pollHandler(w, r, device)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, app.apiDevice(device))
+}
+
+// adHocPollTimeout bounds how long an admin poll request waits for results:
+// a reading and a metadata refresh, each limited by device_timeout. A poll
+// that takes longer carries on in the background and is reported by
+// /api/v1/devices once it completes.
+func (app *App) adHocPollTimeout() time.Duration {
+	return 2 * app.DeviceTimeout
+}
+
+func (app *App) pollHandler(w http.ResponseWriter, r *http.Request, device *Device) {
+	if device.isPaused() {
+		http.Error(w, "device is paused", http.StatusConflict)
+		return
+	}
+	if err := device.throttledError(); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	call := app.pollDevice(app.runCtx, device)
+	select {
+	case <-call.done:
+	case <-time.After(app.adHocPollTimeout()):
+		http.Error(w, "timed out waiting for poll", http.StatusGatewayTimeout)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	status := http.StatusOK
+	if call.err != nil {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, app.apiDevice(device))
+}
+
+// pollAllHandler polls every unpaused device concurrently and returns their
+// states once all polls have completed or the timeout passes.
+func (app *App) pollAllHandler(w http.ResponseWriter, r *http.Request) {
+	timeout := time.After(app.adHocPollTimeout())
+
+	devices := []*Device{}
+	calls := []*pollCall{}
+	for _, device := range app.Devices() {
+		if device.isPaused() {
+			continue
+		}
+		devices = append(devices, device)
+		calls = append(calls, app.pollDevice(app.runCtx, device))
+	}
+
+	for _, call := range calls {
+		select {
+		case <-call.done:
+		case <-timeout:
+			http.Error(w, "timed out waiting for poll", http.StatusGatewayTimeout)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	results := []apiDevice{}
+	for _, device := range devices {
+		results = append(results, app.apiDevice(device))
+	}
+	writeJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,247 @@
+package exporter
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// aggregateFuncs are the values of the agg label of awair_aggregate.
+var aggregateFuncs = []string{"mean", "max", "min"}
+
+// sensorAggregate is the mean, max and min of a sensor across devices.
+type sensorAggregate struct {
+	Mean float64 `json:"mean"`
+	Max  float64 `json:"max"`
+	Min  float64 `json:"min"`
+}
+
+func (a sensorAggregate) value(agg string) float64 {
+	switch agg {
+	case "mean":
+		return a.Mean
+	case "max":
+		return a.Max
+	default:
+		return a.Min
+	}
+}
+
+// aggregates are the sensors aggregated across some devices, and the
+// devices included.
+type aggregates struct {
+	Devices []string                   `json:"devices"`
+	Sensors map[string]sensorAggregate `json:"sensors,omitempty"`
+}
+
+// aggregateSnapshot is the house-wide and per-group aggregates as of the end
+// of a poll cycle, as served by /api/v1/aggregates.
+type aggregateSnapshot struct {
+	aggregates
+	Groups         map[string]aggregates `json:"groups,omitempty"`
+	CompositeScore *float64              `json:"composite_score,omitempty"`
+	Time           time.Time             `json:"time"`
+}
+
+// aggregateState holds the gauges and the last aggregates of an exporter.
+type aggregateState struct {
+	gauge        *prometheus.GaugeVec
+	devices      prometheus.Gauge
+	groupGauge   *prometheus.GaugeVec
+	groupDevices *prometheus.GaugeVec
+	composite    *prometheus.GaugeVec
+
+	lock   sync.Mutex
+	latest aggregateSnapshot
+}
+
+// initializeAggregates registers the gauges of the aggregates across the
+// exporter's devices, and awair_composite_score with composite_score_file.
+func (app *App) initializeAggregates(factory promauto.Factory, namespace string) {
+	compositeFactory := factory
+	if app.composite == nil {
+		compositeFactory = promauto.With(nil)
+	}
+
+	app.aggregates = &aggregateState{
+		gauge: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "aggregate",
+			Help:      "The mean, max or min of a sensor across the healthy Awair devices, as of the last poll cycle",
+		}, []string{"sensor", "agg"}),
+		devices: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "aggregate_devices",
+			Help:      "The number of Awair devices included in awair_aggregate",
+		}),
+		groupGauge: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "group_aggregate",
+			Help:      "The mean, max or min of a sensor across the healthy Awair devices of a device group, as of the last poll cycle",
+		}, []string{"group", "sensor", "agg"}),
+		groupDevices: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "group_aggregate_devices",
+			Help:      "The number of Awair devices of a device group included in awair_group_aggregate",
+		}, []string{"group"}),
+		composite: compositeFactory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "composite_score",
+			Help:      "The mean of the scores of the healthy Awair devices, weighted as in composite_score_file, as of the last poll cycle",
+		}, nil),
+		latest: aggregateSnapshot{aggregates: aggregates{Devices: []string{}}},
+	}
+}
+
+// aggregated reports whether a device is included in the aggregates: it
+// must be healthy and not paused, so that a down, degraded or paused device
+// is left out rather than contributing a stale reading.
+func (device *Device) aggregated() bool {
+	return !device.isPaused() && device.Health() == healthHealthy
+}
+
+// aggregateReadings aggregates the last readings of the aggregated devices.
+func aggregateReadings(devices []*Device) aggregates {
+	result := aggregates{Devices: []string{}}
+	readings := []AwairStats{}
+	for _, device := range devices {
+		if !device.aggregated() {
+			continue
+		}
+		if reading := device.LastReading(); reading != nil {
+			result.Devices = append(result.Devices, device.Name)
+			readings = append(readings, *reading)
+		}
+	}
+	if len(readings) == 0 {
+		return result
+	}
+
+	result.Sensors = map[string]sensorAggregate{}
+	for _, sensor := range sensorReadings {
+		agg := sensorAggregate{Max: math.Inf(-1), Min: math.Inf(1)}
+		sum := 0.0
+		for _, reading := range readings {
+			value := sensor.Value(reading)
+			sum += value
+			agg.Max = math.Max(agg.Max, value)
+			agg.Min = math.Min(agg.Min, value)
+		}
+		agg.Mean = sum / float64(len(readings))
+		result.Sensors[sensor.Sensor] = agg
+	}
+	return result
+}
+
+// updateAggregates recomputes the aggregates over the given devices and
+// each of their device groups, and the composite score, and sets their
+// gauges. Without any device to aggregate, awair_aggregate and
+// awair_composite_score have no series, and a group left without devices
+// has no series at all. It returns the new aggregates for the caller to
+// publish to MQTT once it no longer holds devicesLock.
+func (app *App) updateAggregates(devices []*Device) aggregateSnapshot {
+	now := time.Now()
+	result := aggregateSnapshot{
+		aggregates:     aggregateReadings(devices),
+		Groups:         map[string]aggregates{},
+		CompositeScore: app.compositeScore(devices, now),
+		Time:           now,
+	}
+	members := map[string][]*Device{}
+	for _, device := range devices {
+		if device.Group != "" {
+			members[device.Group] = append(members[device.Group], device)
+		}
+	}
+	for group, devices := range members {
+		result.Groups[group] = aggregateReadings(devices)
+	}
+
+	app.aggregates.lock.Lock()
+	defer app.aggregates.lock.Unlock()
+	previous := app.aggregates.latest
+	app.aggregates.latest = result
+
+	app.aggregates.devices.Set(float64(len(result.Devices)))
+	if len(result.Sensors) == 0 {
+		app.aggregates.gauge.Reset()
+	}
+	for sensor, agg := range result.Sensors {
+		for _, name := range aggregateFuncs {
+			app.aggregates.gauge.WithLabelValues(sensor, name).Set(agg.value(name))
+		}
+	}
+	if result.CompositeScore != nil {
+		app.aggregates.composite.WithLabelValues().Set(*result.CompositeScore)
+	} else {
+		app.aggregates.composite.DeleteLabelValues()
+	}
+
+	for group := range previous.Groups {
+		if _, ok := result.Groups[group]; !ok {
+			app.aggregates.groupDevices.DeleteLabelValues(group)
+		}
+		if len(result.Groups[group].Sensors) == 0 {
+			for _, sensor := range sensorReadings {
+				for _, name := range aggregateFuncs {
+					app.aggregates.groupGauge.DeleteLabelValues(group, sensor.Sensor, name)
+				}
+			}
+		}
+	}
+	for group, groupResult := range result.Groups {
+		app.aggregates.groupDevices.WithLabelValues(group).Set(float64(len(groupResult.Devices)))
+		for sensor, agg := range groupResult.Sensors {
+			for _, name := range aggregateFuncs {
+				app.aggregates.groupGauge.WithLabelValues(group, sensor, name).Set(agg.value(name))
+			}
+		}
+	}
+
+	return result
+}
+
+// publishAggregatesMQTT publishes each aggregate to mqtt_aggregate_topic,
+// and the composite score as the score's composite aggregate.
+func (app *App) publishAggregatesMQTT(result aggregateSnapshot) {
+	if app.mqttClient == nil || app.MQTTAggregateTopic == "" {
+		return
+	}
+
+	for sensor, agg := range result.Sensors {
+		for _, name := range aggregateFuncs {
+			app.publishAggregateMQTT(sensor, name, agg.value(name))
+		}
+	}
+	if result.CompositeScore != nil {
+		app.publishAggregateMQTT("score", "composite", *result.CompositeScore)
+	}
+}
+
+func (app *App) publishAggregateMQTT(sensor, agg string, value float64) {
+	topic := strings.NewReplacer("{sensor}", sensor, "{agg}", agg).Replace(app.MQTTAggregateTopic)
+	payload := strconv.FormatFloat(value, 'f', -1, 64)
+	token := app.mqttClient.Publish(topic, app.MQTTQoS, app.MQTTRetain, payload)
+	go app.awaitMQTTPublish(topic, token)
+}
+
+// aggregatesHandler serves the aggregates of the last poll cycle.
+func (app *App) aggregatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	app.aggregates.lock.Lock()
+	result := app.aggregates.latest
+	app.aggregates.lock.Unlock()
+
+	writeJSON(w, http.StatusOK, result)
+}
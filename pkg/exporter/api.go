@@ -0,0 +1,160 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type apiReading struct {
+	Name          string            `json:"name"`
+	Address       string            `json:"address"`
+	DeviceAddress string            `json:"device_address"`
+	Up            bool              `json:"up"`
+	LastPoll      time.Time         `json:"last_poll"`
+	Reading       *AwairStats       `json:"reading"`
+	Breaches      []thresholdBreach `json:"breaches,omitempty"`
+}
+
+func (device *Device) recordReading(stats AwairStats) {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	device.lastReading = &stats
+	if device.history != nil {
+		device.history.add(stats)
+	}
+}
+
+func (device *Device) LastReading() *AwairStats {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	return device.lastReading
+}
+
+type apiDevice struct {
+	Name                string            `json:"name"`
+	Address             string            `json:"address"`
+	DeviceAddress       string            `json:"device_address"`
+	Source              string            `json:"source"`
+	Group               string            `json:"group,omitempty"`
+	Labels              map[string]string `json:"labels,omitempty"`
+	FallbackURLs        []string          `json:"fallback_urls,omitempty"`
+	Endpoint            string            `json:"endpoint,omitempty"`
+	Metadata            *DeviceMetadata   `json:"metadata"`
+	State               string            `json:"state"`
+	Health              string            `json:"health"`
+	Paused              bool              `json:"paused"`
+	ConsecutiveFailures int               `json:"consecutive_failures"`
+	LastPoll            *time.Time        `json:"last_poll"`
+	LastSuccess         *time.Time        `json:"last_success"`
+	LastError           string            `json:"last_error,omitempty"`
+	NextPoll            *time.Time        `json:"next_poll"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// devicesHandler serves the operational view of every registered device.
+func (app *App) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	devices := []apiDevice{}
+	for _, device := range app.Devices() {
+		devices = append(devices, app.apiDevice(device))
+	}
+
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (app *App) apiDevice(device *Device) apiDevice {
+	status := device.Status()
+
+	state := "pending"
+	if !status.LastPoll.IsZero() {
+		state = "down"
+		if status.Up {
+			state = "up"
+		}
+	}
+
+	// Devices are polled in turn once per cycle, starting an interval after
+	// the previous cycle completes
+	nextPoll := optionalTime(app.lastCycleTime().Add(app.TimeBetweenChecks))
+	if nextPoll != nil && status.ThrottledUntil.After(*nextPoll) {
+		nextPoll = optionalTime(status.ThrottledUntil)
+	}
+	if status.Paused {
+		state = "paused"
+		nextPoll = nil
+	}
+
+	// Only devices with fallback URLs may be read through another URL than
+	// their address
+	endpoint := ""
+	if len(device.Fallbacks) > 0 && !status.LastSuccess.IsZero() {
+		endpoint = redactAddress(device.activeEndpoint())
+	}
+
+	return apiDevice{
+		Name:                status.Name,
+		Address:             status.Address,
+		DeviceAddress:       status.Label,
+		Source:              status.Source,
+		Group:               device.Group,
+		Labels:              status.Labels,
+		FallbackURLs:        redactAddresses(device.Fallbacks),
+		Endpoint:            endpoint,
+		Metadata:            status.Metadata,
+		State:               state,
+		Health:              device.Health(),
+		Paused:              status.Paused,
+		ConsecutiveFailures: status.Failures,
+		LastPoll:            optionalTime(status.LastPoll),
+		LastSuccess:         optionalTime(status.LastSuccess),
+		LastError:           status.LastError,
+		NextPoll:            nextPoll,
+	}
+}
+
+// readingsHandler serves the cached readings of every device that has been
+// polled at least once. It never contacts a device.
+func (app *App) readingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	readings := []apiReading{}
+	for _, device := range app.Devices() {
+		status := device.Status()
+		if status.LastPoll.IsZero() {
+			continue
+		}
+		readings = append(readings, apiReading{
+			Name:          status.Name,
+			Address:       status.Address,
+			DeviceAddress: status.Label,
+			Up:            status.Up,
+			LastPoll:      status.LastPoll,
+			Reading:       device.LastReading(),
+			Breaches:      app.thresholdBreaches(device),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, readings)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
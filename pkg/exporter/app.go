@@ -0,0 +1,1160 @@
+// Package exporter polls Awair devices and exports their readings as
+// Prometheus metrics and to the configured outputs.
+//
+// Create an App with New, set its exported configuration fields, call
+// Configure to load and check them, then Run it until its context is
+// cancelled. The awair-local-prom-exporter command is a thin wrapper that
+// does this from flags.
+package exporter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// App is an exporter. Its exported fields hold the configuration, matching
+// the awair-local-prom-exporter flags of the same names, and must not be
+// changed once it is running. Metrics are registered with Registerer and
+// served from Gatherer, which default to a registry of the exporter's own.
+type App struct {
+	// lastCycleEnd is the UnixNano time the poll loop last completed a cycle.
+	// It's accessed atomically so it must stay first for 64-bit alignment.
+	lastCycleEnd int64
+
+	// ready is set to 1 once any device has been polled successfully
+	ready int32
+
+	// stateChanged is set to 1 when a reading changes, for saveState.
+	stateChanged int32
+
+	ListenAddress              string
+	ListenPort                 uint64
+	ListenSocket               string
+	ListenSocketMode           os.FileMode
+	TelemetryPath              string
+	TLSCertFile                string
+	TLSKeyFile                 string
+	TLSClientCAFile            string
+	HealthListen               string
+	AllowedCIDRs               string
+	TrustedProxies             string
+	TrustedProxyHeader         string
+	AuthUsername               string
+	AuthPasswordHashFile       string
+	AdminTokenFile             string
+	EnablePprof                bool
+	PprofListen                string
+	ServerReadHeaderTimeout    time.Duration
+	ServerReadTimeout          time.Duration
+	ServerWriteTimeout         time.Duration
+	ServerIdleTimeout          time.Duration
+	ServerMaxHeaderBytes       int
+	ShutdownGracePeriod        time.Duration
+	CORSAllowedOrigins         []string
+	DisableGoMetrics           bool
+	DisableProcessMetrics      bool
+	Registerer                 prometheus.Registerer
+	Gatherer                   prometheus.Gatherer
+	LogRequests                bool
+	StreamMaxSubscribers       int
+	ErrorBufferSize            int
+	DeviceErrorLogInterval     time.Duration
+	MQTTBroker                 string
+	MQTTClientID               string
+	MQTTUsername               string
+	MQTTPasswordFile           string
+	MQTTTopic                  string
+	MQTTAggregateTopic         string
+	MQTTQoS                    byte
+	MQTTRetain                 bool
+	MQTTHomeAssistant          bool
+	MQTTHomeAssistantPrefix    string
+	InfluxURL                  string
+	InfluxTokenFile            string
+	InfluxOrg                  string
+	InfluxBucket               string
+	RemoteWriteURL             string
+	RemoteWriteBearerTokenFile string
+	RemoteWriteUsername        string
+	RemoteWritePasswordFile    string
+	RemoteWriteJob             string
+	RemoteWriteMaxAge          time.Duration
+	PushgatewayURL             string
+	PushgatewayJob             string
+	PushgatewayInstance        string
+	StatsdAddress              string
+	StatsdPrefix               string
+	DogstatsdAddress           string
+	DogstatsdPrefix            string
+	DogstatsdTags              []string
+	GraphiteAddress            string
+	GraphitePrefix             string
+	OTLPEndpoint               string
+	OTLPHeaders                string
+	OTLPInterval               time.Duration
+	TextfileOutput             string
+	DisableHTTPServer          bool
+	CSVOutput                  string
+	CSVMaxSize                 int64
+	CSVMaxFiles                int
+	HistoryDB                  string
+	HistoryRetention           time.Duration
+	HistoryMaxSize             int64
+	WebhookURL                 string
+	ThresholdsFile             string
+	ReadingsLog                string
+	CloudDevices               string
+	CloudTokenFile             string
+	ForwardURL                 string
+	ForwardHeaders             string
+	NATSURL                    string
+	CloudWatchNamespace        string
+	CloudWatchInterval         time.Duration
+	CloudWatchOnlyChanges      bool
+	NATSSubject                string
+	NATSCredentialsFile        string
+	NATSNKeyFile               string
+	CloudAPIURL                string
+	CloudDailyQuota            int
+	LogRequestsExclude         []string
+	AwairAddresses             []string
+	DevicesFile                string
+	GroupsFile                 string
+	RelabelFile                string
+	CompositeScoreFile         string
+	RecordDir                  string
+	ReplayDir                  string
+	ReplaySpeed                float64
+	SelfTestMaxClockSkew       time.Duration
+	RecentHistory              time.Duration
+	StateFile                  string
+	StateMaxAge                time.Duration
+	PersistDevices             bool
+	FailFast                   string
+	TimeBetweenChecks          time.Duration
+	MinPollFrequency           time.Duration
+	DeviceTimeout              time.Duration
+	DeviceDownAfter            int
+	DeviceHealthyAfter         int
+	AllowFastPolling           bool
+	SourceInterface            string
+	SourceAddress              string
+	DeviceProxyURL             string
+	NoProxy                    []string
+	DeviceHeaders              []string
+	DeviceTLSSkipVerify        bool
+	DeviceCAFile               string
+	DeviceClientCert           string
+	DeviceClientKey            string
+	DeviceDisableKeepAlive     bool
+	DeviceDNSTTL               time.Duration
+	DeviceMaxRetryAfter        time.Duration
+	DeviceLabelSource          string
+	MetricStyle                string
+	LegacyMetrics              bool
+	MetadataLabels             []string
+	Histograms                 bool
+	HistogramBuckets           []string
+	CrashOnPanic               bool
+	Logger                     *zap.SugaredLogger
+	LogLevel                   zapcore.Level
+
+	DiscoverMDNS       bool
+	MDNSBrowseInterval time.Duration
+	MDNSBrowseTimeout  time.Duration
+	MDNSGracePeriod    time.Duration
+
+	// httpClient sends device requests, and deviceClient polls local
+	// devices through it unless WithDeviceClient replaced it.
+	httpClient   *http.Client
+	deviceClient DeviceClient
+
+	tempGauge          *prometheus.GaugeVec
+	humidityGauge      *prometheus.GaugeVec
+	co2Gauge           *prometheus.GaugeVec
+	vocGauge           *prometheus.GaugeVec
+	pm25Gauge          *prometheus.GaugeVec
+	scoreGauge         *prometheus.GaugeVec
+	discoveryInfoGauge *prometheus.GaugeVec
+	deviceInfoGauge    *prometheus.GaugeVec
+	pausedGauge        *prometheus.GaugeVec
+	upGauge            *prometheus.GaugeVec
+	sensorValueGauge   *prometheus.GaugeVec
+	thresholdGauge     *prometheus.GaugeVec
+	healthStateGauge   *prometheus.GaugeVec
+	endpointInfoGauge  *prometheus.GaugeVec
+	pollErrorsCounter  *prometheus.CounterVec
+
+	discoveredDevices map[string]*discoveredDevice
+	discoveredLock    sync.Mutex
+
+	devices     map[string]*Device
+	devicesLock sync.RWMutex
+
+	// runCtx is the context Run was called with, which ad-hoc polls from
+	// the admin API run in since they outlive the request that started them.
+	runCtx context.Context
+
+	// panics counts the panics recovered from while polling.
+	panics prometheus.Counter
+
+	// sdWatchdog is set when each poll cycle notifies the systemd watchdog.
+	sdWatchdog bool
+
+	fileDevices     []deviceEntry
+	deviceHeader    http.Header
+	devicesFileLock sync.Mutex
+
+	// namespace prefixes the device metrics of a polling group that sets
+	// its own; it's defaultNamespace otherwise.
+	namespace    string
+	groupEntries []groupEntry
+	groups       []*pollGroup
+
+	// relabelRules add labels to every device from its address or name,
+	// as the sorted relabelNames to its sensor and up series.
+	relabelRules []relabelRule
+	relabelNames []string
+
+	// histograms observe every reading per sensor with histograms, into
+	// the histogramBuckets from histogram_buckets.
+	histogramBuckets map[string][]float64
+	histograms       map[string]*prometheus.HistogramVec
+
+	// sensorGauges are the gauges of each sensor with the split
+	// metric_style: its own, and its legacy one with legacy_metrics.
+	sensorGauges map[string][]*prometheus.GaugeVec
+
+	// aggregates are the readings aggregated across the healthy devices at
+	// the end of every poll cycle.
+	aggregates *aggregateState
+
+	// composite weighs the devices' scores into awair_composite_score.
+	composite *compositeFile
+
+	// replay answers device requests from replay_dir.
+	replay *replayTransport
+
+	// simulation tracks the poll cycles while simulating.
+	simulation *simulation
+
+	// state is the state_file read at startup, until it's restored.
+	state *stateFile
+
+	cloudDevices  []cloudDevice
+	cloudToken    string
+	cloudClient   *http.Client
+	cloudBudget   *cloudBudget
+	cloudRequests *prometheus.CounterVec
+
+	sourceIP     net.IP
+	certReloader *certReloader
+	tlsClientCAs *x509.CertPool
+	deviceCAs    *x509.CertPool
+
+	// deviceClientCert is device_client_cert, and deviceCertsOnce starts
+	// reloading it and the devices' own client certificates on SIGHUP.
+	deviceClientCert *certReloader
+	deviceCertsOnce  sync.Once
+
+	allowedCIDRs   []*net.IPNet
+	trustedProxies []*net.IPNet
+
+	streamSubscribers map[chan streamEvent]struct{}
+	streamLock        sync.Mutex
+
+	recentErrors *errorRing
+
+	authPasswordHash []byte
+	adminToken       []byte
+
+	outputs     []output
+	outputsLock sync.RWMutex
+	pushClient  *http.Client
+
+	logLevel zap.AtomicLevel
+
+	influxToken    string
+	otlpHeaders    http.Header
+	forwardHeaders http.Header
+	historyDB      *sql.DB
+	thresholds     []threshold
+
+	// thresholdStates tracks every threshold on every device, keyed by
+	// device address and threshold name. webhook, if set, is notified as
+	// they fire and resolve.
+	thresholdStates map[string]*thresholdState
+	thresholdsLock  sync.Mutex
+	webhook         *webhookOutput
+
+	remoteWriteToken    string
+	remoteWritePassword string
+
+	mqttPassword  string
+	mqttClient    mqtt.Client
+	mqttPublishes *prometheus.CounterVec
+	mqttConnected prometheus.Gauge
+
+	// mqttGeneration counts broker connections so that Home Assistant
+	// discovery is re-published after every reconnect.
+	mqttGeneration int32
+}
+
+// AwairStats is a reading as returned by a device's local API.
+type AwairStats = awair.AirData
+
+// NewApp returns an exporter with the same defaults as the standalone
+// binary, changed by the given options. It returns an error, and no
+// exporter, if any option is invalid.
+func NewApp(opts ...Option) (*App, error) {
+	logLevel := zap.NewAtomicLevelAt(zap.InfoLevel)
+	app := &App{
+		Logger:            zap.NewNop().Sugar(),
+		logLevel:          logLevel,
+		LogLevel:          logLevel.Level(),
+		discoveredDevices: map[string]*discoveredDevice{},
+		devices:           map[string]*Device{},
+		thresholdStates:   map[string]*thresholdState{},
+		streamSubscribers: map[chan streamEvent]struct{}{},
+
+		ListenSocketMode:        0660,
+		LogRequestsExclude:      []string{"/healthz", "/readyz"},
+		TimeBetweenChecks:       30 * time.Second,
+		ListenAddress:           "0.0.0.0",
+		ListenPort:              2112,
+		TelemetryPath:           "/metrics",
+		TrustedProxyHeader:      "X-Forwarded-For",
+		ServerReadHeaderTimeout: 5 * time.Second,
+		ServerReadTimeout:       10 * time.Second,
+		ServerWriteTimeout:      time.Minute,
+		ServerIdleTimeout:       2 * time.Minute,
+		ServerMaxHeaderBytes:    16 << 10,
+		ShutdownGracePeriod:     5 * time.Second,
+		StreamMaxSubscribers:    16,
+		DeviceErrorLogInterval:  5 * time.Minute,
+		ErrorBufferSize:         100,
+		MQTTClientID:            "awair-exporter",
+		MQTTTopic:               "awair/{device_name}/{sensor}",
+		MQTTAggregateTopic:      "awair/aggregate/{sensor}/{agg}",
+		MQTTRetain:              true,
+		MQTTHomeAssistantPrefix: "homeassistant",
+		RemoteWriteJob:          "awair",
+		RemoteWriteMaxAge:       time.Hour,
+		PushgatewayJob:          "awair",
+		StatsdPrefix:            "awair",
+		DogstatsdPrefix:         "awair",
+		GraphitePrefix:          "awair",
+		OTLPInterval:            time.Minute,
+		CSVMaxFiles:             5,
+		CloudWatchInterval:      5 * time.Minute,
+		NATSSubject:             "awair.{device}.{sensor}",
+		CloudAPIURL:             "https://developer-apis.awair.is",
+		CloudDailyQuota:         300,
+		MinPollFrequency:        10 * time.Second,
+		DeviceTimeout:           10 * time.Second,
+		DeviceMaxRetryAfter:     5 * time.Minute,
+		DeviceLabelSource:       DeviceLabelURL,
+		MetricStyle:             MetricStyleSplit,
+		LegacyMetrics:           true,
+		ReplaySpeed:             1,
+		SelfTestMaxClockSkew:    2 * time.Minute,
+		RecentHistory:           6 * time.Hour,
+		StateMaxAge:             time.Hour,
+		DeviceDownAfter:         3,
+		DeviceHealthyAfter:      2,
+		MDNSBrowseInterval:      time.Minute,
+		MDNSBrowseTimeout:       5 * time.Second,
+		MDNSGracePeriod:         5 * time.Minute,
+	}
+
+	if err := app.Apply(opts...); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// Configure loads the files and secrets the configuration refers to and
+// checks it, returning one error per problem found, each naming the flag
+// at fault. It must be called before Run, RunOnce or Watch, after the last
+// option has been applied.
+func (app *App) Configure() []error {
+	configErrs := []error{}
+	var err error
+
+	app.sourceIP, err = app.resolveSourceIP()
+	if err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if (app.TLSCertFile == "") != (app.TLSKeyFile == "") {
+		configErrs = append(configErrs, fmt.Errorf("tls_cert_file and tls_key_file must be set together"))
+	} else if app.TLSCertFile != "" {
+		app.certReloader, err = newCertReloader(app.TLSCertFile, app.TLSKeyFile)
+		if err != nil {
+			configErrs = append(configErrs, err)
+		}
+	}
+
+	if app.TLSClientCAFile != "" {
+		if app.TLSCertFile == "" {
+			configErrs = append(configErrs, fmt.Errorf("tls_client_ca_file: requires tls_cert_file and tls_key_file"))
+		}
+		app.tlsClientCAs, err = loadCertPool(app.TLSClientCAFile)
+		if err != nil {
+			configErrs = append(configErrs, fmt.Errorf("tls_client_ca_file (%q): %w", app.TLSClientCAFile, err))
+		}
+	}
+
+	if app.DeviceCAFile != "" {
+		app.deviceCAs, err = loadCertPool(app.DeviceCAFile)
+		if err != nil {
+			configErrs = append(configErrs, fmt.Errorf("device_ca_file (%q): %w", app.DeviceCAFile, err))
+		}
+	}
+
+	if (app.DeviceClientCert == "") != (app.DeviceClientKey == "") {
+		configErrs = append(configErrs, fmt.Errorf("device_client_cert and device_client_key must be set together"))
+	} else if app.DeviceClientCert != "" {
+		app.deviceClientCert, err = newCertReloader(app.DeviceClientCert, app.DeviceClientKey)
+		if err != nil {
+			configErrs = append(configErrs, fmt.Errorf("device_client_cert (%q): %w", app.DeviceClientCert, err))
+		}
+	}
+
+	app.allowedCIDRs, err = parseCIDRs("allowed_cidrs", app.AllowedCIDRs)
+	if err != nil {
+		configErrs = append(configErrs, err)
+	}
+	app.trustedProxies, err = parseCIDRs("trusted_proxies", app.TrustedProxies)
+	if err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadAuthPasswordHash(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadAdminToken(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadDevicesFile(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadRelabelFile(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadGroupsFile(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadCompositeScoreFile(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.createRecordDir(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadReplayDir(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadStateFile(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadMQTTPassword(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadInfluxToken(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadRemoteWriteCredentials(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	if err := app.loadThresholds(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	app.cloudDevices, err = parseCloudDevices(app.CloudDevices)
+	if err != nil {
+		configErrs = append(configErrs, fmt.Errorf("cloud_devices: %w", err))
+	}
+
+	if err := app.loadCloudToken(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	app.otlpHeaders, err = parseHeaders(app.OTLPHeaders)
+	if err != nil {
+		configErrs = append(configErrs, fmt.Errorf("otlp_headers: %w", err))
+	}
+
+	app.forwardHeaders, err = parseHeaders(app.ForwardHeaders)
+	if err != nil {
+		configErrs = append(configErrs, fmt.Errorf("forward_headers: %w", err))
+	}
+
+	app.deviceHeader, err = parseDeviceHeaders(app.DeviceHeaders)
+	if err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	app.histogramBuckets, err = parseHistogramBuckets(app.HistogramBuckets)
+	if err != nil {
+		configErrs = append(configErrs, err)
+	}
+
+	return append(configErrs, app.validateConfig()...)
+}
+
+// setup creates the registry, gauges and outputs and registers the
+// configured devices. once is set for a single poll, after which the
+// outputs are flushed rather than left to their schedule.
+func (app *App) setup(once bool) error {
+	if app.TimeBetweenChecks < app.MinPollFrequency {
+		app.Logger.Warnf("Polling every (%+v), faster than the Awair local API refreshes (%+v); devices may become unreliable", app.TimeBetweenChecks, app.MinPollFrequency)
+	}
+
+	if app.httpClient == nil {
+		app.httpClient = app.newHTTPClient()
+		if app.DeviceTLSSkipVerify {
+			app.Logger.Warnw("TLS certificate verification is disabled for all devices; anyone on the network path can impersonate them", "flag", "device_tls_skip_verify")
+		}
+		if app.deviceClientCert != nil {
+			app.warnExpiredCert(app.deviceClientCert)
+			app.deviceCertsOnce.Do(app.reloadDeviceCertsOnSIGHUP)
+		}
+	}
+	if app.deviceClient == nil {
+		app.deviceClient = &httpDeviceClient{httpClient: app.deviceHTTPClient, prepare: app.prepareClient, onResponse: app.recordResponse}
+	}
+	app.recentErrors = newErrorRing(app.ErrorBufferSize)
+
+	// Initialize the Prometheus registry and Gauges
+	if err := app.initializeRegistry(); err != nil {
+		return err
+	}
+	app.initializeGauges()
+	app.publishExpvar()
+
+	// Set up the outputs readings are pushed to
+	app.pushClient = newPushClient()
+	if app.InfluxURL != "" {
+		app.outputs = append(app.outputs, app.newInfluxOutput())
+	}
+	if app.RemoteWriteURL != "" {
+		app.outputs = append(app.outputs, app.newRemoteWriteOutput())
+	}
+	if app.PushgatewayURL != "" {
+		app.outputs = append(app.outputs, app.newPushgatewayOutput(!once))
+	}
+	if app.StatsdAddress != "" {
+		app.outputs = append(app.outputs, app.newStatsdOutput())
+	}
+	if app.DogstatsdAddress != "" {
+		app.outputs = append(app.outputs, app.newDogstatsdOutput())
+	}
+	if app.GraphiteAddress != "" {
+		app.outputs = append(app.outputs, app.newGraphiteOutput())
+	}
+	if app.OTLPEndpoint != "" {
+		app.outputs = append(app.outputs, app.newOTLPOutput())
+	}
+	if app.TextfileOutput != "" {
+		app.outputs = append(app.outputs, app.newTextfileOutput())
+	}
+	if app.CSVOutput != "" {
+		app.outputs = append(app.outputs, app.newCSVOutput())
+	}
+	if app.WebhookURL != "" {
+		app.webhook = app.newWebhookOutput()
+		app.outputs = append(app.outputs, app.webhook)
+	}
+	if app.ReadingsLog != "" {
+		app.outputs = append(app.outputs, app.newReadingsLogOutput())
+	}
+	if app.ForwardURL != "" {
+		app.outputs = append(app.outputs, app.newForwardOutput())
+	}
+	if app.CloudWatchNamespace != "" {
+		cloudwatchOutput, err := app.newCloudWatchOutput()
+		if err != nil {
+			return fmt.Errorf("failed to set up CloudWatch: %w", err)
+		}
+		app.outputs = append(app.outputs, cloudwatchOutput)
+	}
+	if app.NATSURL != "" {
+		natsOutput, err := app.newNATSOutput()
+		if err != nil {
+			return fmt.Errorf("failed to set up NATS (%s): %w", redactAddress(app.NATSURL), err)
+		}
+		app.outputs = append(app.outputs, natsOutput)
+	}
+	if app.HistoryDB != "" {
+		historyDB, err := openHistory(app.HistoryDB)
+		if err != nil {
+			return fmt.Errorf("failed to open history database (%s): %w", app.HistoryDB, err)
+		}
+		app.historyDB = historyDB
+		app.outputs = append(app.outputs, app.newHistoryOutput(app.historyDB))
+	}
+
+	var effective strings.Builder
+	app.PrintConfig(&effective)
+	app.Logger.Debugw("Effective configuration", "config", effective.String())
+
+	// Register the statically configured devices
+	for _, awairAddress := range app.AwairAddresses {
+		app.AddDevice(deviceNameFromAddress(awairAddress), awairAddress, deviceSourceStatic, nil)
+	}
+	for _, entry := range app.fileDevices {
+		name := entry.Name
+		if name == "" {
+			name = deviceNameFromAddress(entry.URL)
+		}
+		app.addDevice(name, deviceSourceFile, entry)
+	}
+	if len(app.cloudDevices) > 0 {
+		app.registerCloudDevices()
+	}
+
+	// Polling groups only run alongside the server; a single poll or the
+	// watch table cover the top-level devices
+	if !once {
+		if err := app.setupGroups(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run polls the configured devices and serves HTTP until ctx is cancelled,
+// then drains connections and flushes the outputs, giving both
+// ShutdownGracePeriod to finish.
+func (app *App) Run(ctx context.Context) error {
+	app.runCtx = ctx
+	if err := app.setup(false); err != nil {
+		return err
+	}
+	app.restoreState()
+
+	if app.MQTTBroker != "" {
+		app.connectMQTT()
+	}
+
+	if app.FailFast != "" {
+		if err := app.checkReachability(ctx); err != nil {
+			// The readings of the devices that did answer are flushed
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), app.ShutdownGracePeriod)
+			defer cancel()
+			app.closeOutputs(shutdownCtx)
+			return err
+		}
+	}
+
+	// Start the metrics recording goroutine, counting startup as the first
+	// heartbeat so the loop gets a grace period before it's deemed unhealthy
+	app.markCycleComplete()
+	app.startWatchdog()
+	app.recordMetrics(ctx)
+	app.startGroups(ctx)
+	if app.DeviceDNSTTL > 0 && !app.DeviceDisableKeepAlive {
+		app.flushDeviceConnections(ctx)
+	}
+
+	// Start the mDNS discovery goroutine
+	if app.DiscoverMDNS {
+		app.discoverDevices(ctx)
+	}
+
+	if app.DisableHTTPServer {
+		app.Logger.Infow("Awair Poller started without an HTTP server", "devices", len(app.Devices()), "poll_frequency", app.TimeBetweenChecks.String(), "groups", len(app.groups))
+		app.notifySystemd("READY=1")
+		<-ctx.Done()
+
+		app.notifySystemd("STOPPING=1")
+		app.Logger.Infow("Flushing outputs", "grace_period", app.ShutdownGracePeriod.String())
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), app.ShutdownGracePeriod)
+		defer cancel()
+		app.saveState()
+		app.closeOutputs(shutdownCtx)
+		app.Logger.Infof("Shutdown complete")
+		return nil
+	}
+
+	mux := app.routes()
+
+	if app.HealthListen != "" {
+		app.serveHealth()
+	}
+
+	if app.pprofOnMainServer() {
+		registerPprof(mux, app.requireAuth)
+	} else if app.EnablePprof {
+		app.servePprof()
+	}
+
+	listener, err := app.listen()
+	if err != nil {
+		return fmt.Errorf("failed to start server: %w", err)
+	}
+
+	if app.certReloader != nil {
+		listener = tls.NewListener(listener, app.tlsConfig())
+		app.reloadCertsOnSIGHUP()
+	}
+
+	app.Logger.Infow("Awair Poller started", "listen", listener.Addr().String(), "devices", len(app.Devices()), "poll_frequency", app.TimeBetweenChecks.String(), "device_timeout", app.DeviceTimeout.String(), "groups", len(app.groups))
+
+	server := app.newHTTPServer(app.logRequests(app.filterIPs(mux)))
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	app.notifySystemd("READY=1")
+
+	select {
+	case err = <-serveErr:
+		return fmt.Errorf("server failed: %w", err)
+	case <-ctx.Done():
+	}
+
+	app.notifySystemd("STOPPING=1")
+	app.Logger.Infow("Draining connections", "grace_period", app.ShutdownGracePeriod.String())
+
+	// Shutdown closes the listener, which also removes the unix socket
+	// file, then waits for in-flight requests to finish
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), app.ShutdownGracePeriod)
+	defer cancel()
+
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		app.Logger.Warnf("Connections still open after the grace period were closed: %+v", err)
+		server.Close()
+	}
+	app.saveState()
+	app.closeOutputs(shutdownCtx)
+	app.Logger.Infof("Shutdown complete")
+	return nil
+}
+
+// routes registers the metrics handler and the API, leaving the health
+// endpoints unauthenticated so that probes keep working.
+func (app *App) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	metricsHandler := promhttp.InstrumentMetricHandler(app.Registerer, promhttp.HandlerFor(app.Gatherer, promhttp.HandlerOpts{}))
+	mux.Handle(app.TelemetryPath, app.requireAuth(metricsHandler))
+	mux.Handle("/api/v1/readings", app.cors(app.requireAuth(http.HandlerFunc(app.readingsHandler))))
+	mux.Handle("/api/v1/devices/", app.requireAdmin(http.HandlerFunc(app.deviceAdminHandler)))
+	mux.Handle("/api/v1/devices", app.devicesRoutes())
+	mux.Handle("/api/v1/aggregates", app.cors(app.requireAuth(http.HandlerFunc(app.aggregatesHandler))))
+	mux.Handle("/api/v1/groups", app.cors(app.requireAuth(http.HandlerFunc(app.groupsHandler))))
+	if app.historyDB != nil {
+		mux.Handle("/api/v1/history", app.cors(app.requireAuth(http.HandlerFunc(app.historyHandler))))
+	}
+	if app.RecentHistory > 0 {
+		mux.Handle("/api/v1/history/recent", app.cors(app.requireAuth(http.HandlerFunc(app.recentHistoryHandler))))
+	}
+	if app.historyDB != nil || app.RecentHistory > 0 {
+		mux.Handle("/api/v1/history/aggregate", app.cors(app.requireAuth(http.HandlerFunc(app.historyAggregateHandler))))
+	}
+	mux.Handle("/api/v1/alert-rules", app.requireAuth(http.HandlerFunc(app.alertRulesHandler)))
+	mux.Handle("/api/v1/grafana-dashboard", app.requireAuth(http.HandlerFunc(app.grafanaDashboardHandler)))
+	mux.Handle("/api/v1/stream", app.cors(app.requireAuth(http.HandlerFunc(app.streamHandler))))
+	mux.Handle("/dashboard", app.requireAuth(http.HandlerFunc(app.dashboardHandler)))
+	mux.Handle("/debug/errors", app.requireAuth(http.HandlerFunc(app.debugErrorsHandler)))
+	mux.Handle("/debug/last", app.requireAuth(http.HandlerFunc(app.debugLastHandler)))
+	mux.Handle("/debug/vars", app.requireAuth(http.HandlerFunc(expvarHandler)))
+	mux.Handle("/-/log-level", app.logLevelRoutes())
+	mux.HandleFunc("/healthz", app.healthzHandler)
+	mux.HandleFunc("/readyz", app.readyzHandler)
+	mux.Handle("/", app.requireAuth(http.HandlerFunc(app.landingPageHandler)))
+	return mux
+}
+
+// initializeRegistry creates a registry of the exporter's own unless a
+// Registerer was given, so that several exporters can share a process.
+// With a given Registerer, disabling the Go or process metrics removes
+// those collectors from it.
+func (app *App) initializeRegistry() error {
+	if app.Registerer == nil {
+		registry := prometheus.NewRegistry()
+		if !app.DisableGoMetrics {
+			registry.MustRegister(collectors.NewGoCollector())
+		}
+		if !app.DisableProcessMetrics {
+			registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		}
+		app.Registerer = registry
+		app.Gatherer = registry
+		return nil
+	}
+
+	if app.Gatherer == nil {
+		gatherer, ok := app.Registerer.(prometheus.Gatherer)
+		if !ok {
+			return fmt.Errorf("a Gatherer is required for a Registerer that isn't also one")
+		}
+		app.Gatherer = gatherer
+	}
+	if app.DisableGoMetrics {
+		app.Registerer.Unregister(collectors.NewGoCollector())
+	}
+	if app.DisableProcessMetrics {
+		app.Registerer.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+	return nil
+}
+
+func (app *App) initializeGauges() {
+	factory := promauto.With(app.Registerer)
+	namespace := app.namespace
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+
+	// The sensor gauges carry the labels of relabel_file, the device's
+	// group and metadata_labels after their own
+	sensorLabelNames := append([]string{"device_address", "source"}, app.relabelNames...)
+	sensorLabelNames = append(sensorLabelNames, "group")
+	sensorLabelNames = append(sensorLabelNames, app.metadataLabelKeys()...)
+
+	// The sensor gauges of the metric_style not in use are left
+	// unregistered, so that setting them is harmless
+	splitFactory, combinedFactory := factory, factory
+	if !app.exportsSplit() {
+		splitFactory = promauto.With(nil)
+	}
+	if !app.exportsCombined() {
+		combinedFactory = promauto.With(nil)
+	}
+
+	// Each sensor's gauge is also registered under its legacy name with
+	// legacy_metrics, and both are set and deleted together through
+	// sensorGauges so that they can't drift apart
+	app.sensorGauges = map[string][]*prometheus.GaugeVec{}
+	for _, sensor := range sensorReadings {
+		names := app.sensorMetricNames(sensor, namespace)
+		for i, name := range names {
+			help := sensor.Help
+			if i > 0 {
+				help = fmt.Sprintf("Deprecated: use %s, which has the same value", names[0])
+			}
+			gauge := splitFactory.NewGaugeVec(prometheus.GaugeOpts{
+				Name: name,
+				Help: help,
+			}, sensorLabelNames)
+			app.sensorGauges[sensor.Sensor] = append(app.sensorGauges[sensor.Sensor], gauge)
+		}
+	}
+
+	sensorValueGauge := combinedFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sensor_value",
+		Help:      "The current reading of each sensor of an Awair device, with metric_style combined or both",
+	}, append([]string{"device_address", "source", "sensor", "unit"}, sensorLabelNames[2:]...))
+
+	discoveryInfoGauge := factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "discovery",
+		Name:      "device_info",
+		Help:      "Set to 1 for each Awair device found via mDNS discovery",
+	}, []string{"device_address", "mdns_instance"})
+
+	deviceInfoGauge := factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "device",
+		Name:      "info",
+		Help:      "Set to 1 with the identity each Awair device reports about itself",
+	}, []string{"device_address", "device_uuid", "device_type", "firmware_version"})
+
+	pausedGauge := factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "device",
+		Name:      "paused",
+		Help:      "Set to 1 while polling of an Awair device is paused through the admin API",
+	}, []string{"device_address"})
+
+	upGauge := factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "device",
+		Name:      "up",
+		Help:      "Set to 1 if the last poll of an Awair device succeeded, 0 if it failed",
+	}, append([]string{"device_address", "device_name"}, app.relabelNames...))
+
+	healthStateGauge := factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "device",
+		Name:      "health_state",
+		Help:      "Set to 1 for an Awair device's current health state (healthy, degraded or down) and 0 for the others",
+	}, []string{"device_address", "state"})
+
+	endpointInfoGauge := factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "device",
+		Name:      "endpoint_info",
+		Help:      "Set to 1 with the URL that served the last reading of an Awair device that has fallback URLs",
+	}, []string{"device_address", "endpoint"})
+
+	thresholdBreachedGauge := factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "threshold_breached",
+		Help:      "Set to 1 while a threshold from thresholds_file is firing for an Awair device, 0 otherwise",
+	}, append([]string{"device_address", "device_name", "threshold", "sensor", "severity"}, app.relabelNames...))
+
+	pollErrorsCounter := factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "device",
+		Name:      "poll_errors_total",
+		Help:      "Failed polls of an Awair device by reason (request, proxy, tls, timeout, read, status, throttled, decode, quota_exhausted or panic)",
+	}, []string{"device_address", "reason"})
+
+	panics := factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "panics_total",
+		Help:      "Panics recovered from while polling",
+	})
+
+	app.tempGauge = app.sensorGauges["temp"][0]
+	app.humidityGauge = app.sensorGauges["humid"][0]
+	app.co2Gauge = app.sensorGauges["co2"][0]
+	app.vocGauge = app.sensorGauges["voc"][0]
+	app.pm25Gauge = app.sensorGauges["pm25"][0]
+	app.scoreGauge = app.sensorGauges["score"][0]
+	if app.Histograms {
+		app.initializeHistograms(factory, namespace, sensorLabelNames)
+	}
+	app.initializeAggregates(factory, namespace)
+	app.initializeSimulation(factory, namespace)
+
+	app.discoveryInfoGauge = discoveryInfoGauge
+	app.sensorValueGauge = sensorValueGauge
+	app.deviceInfoGauge = deviceInfoGauge
+	app.pausedGauge = pausedGauge
+	app.upGauge = upGauge
+	app.healthStateGauge = healthStateGauge
+	app.endpointInfoGauge = endpointInfoGauge
+	app.thresholdGauge = thresholdBreachedGauge
+	app.pollErrorsCounter = pollErrorsCounter
+	app.panics = panics
+}
+
+func (app *App) recordMetrics(ctx context.Context) {
+	go func() {
+		for {
+			app.pollCycle(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(app.TimeBetweenChecks):
+			}
+		}
+	}()
+}
+
+// pollDevices runs a single poll cycle over every registered device.
+// Cancelling ctx aborts the requests in flight.
+func (app *App) pollDevices(ctx context.Context) {
+	start := time.Now()
+	for _, device := range app.Devices() {
+		if ctx.Err() != nil {
+			break
+		}
+		if device.isPaused() || device.isThrottled() || !app.cloudPollDue(device) {
+			continue
+		}
+		<-app.pollDevice(ctx, device).done
+	}
+	app.publishAggregatesMQTT(app.updateAggregates(app.Devices()))
+	app.flushOutputs()
+	app.saveState()
+	app.markCycleComplete()
+	app.observeCycle(time.Since(start))
+	if app.sdWatchdog {
+		app.notifySystemd("WATCHDOG=1")
+	}
+}
+
+// pollCall is a poll of one device that callers can wait on.
+type pollCall struct {
+	done chan struct{}
+	err  error
+}
+
+// pollDevice starts polling a device unless a poll of it is already in
+// flight, in which case that poll is returned instead so that an ad-hoc
+// poll racing the scheduled one doesn't update the device twice. A device
+// that asked to be polled less often isn't polled before it said to; the
+// call returned then has already failed.
+func (app *App) pollDevice(ctx context.Context, device *Device) *pollCall {
+	if err := device.throttledError(); err != nil {
+		call := &pollCall{done: make(chan struct{}), err: err}
+		close(call.done)
+		return call
+	}
+
+	device.stateLock.Lock()
+	if call := device.inflight; call != nil {
+		device.stateLock.Unlock()
+		return call
+	}
+	call := &pollCall{done: make(chan struct{})}
+	device.inflight = call
+	device.stateLock.Unlock()
+
+	go func() {
+		call.err = app.getAwairData(ctx, device)
+
+		device.stateLock.Lock()
+		device.inflight = nil
+		device.stateLock.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// getAwairData polls a device, giving each request DeviceTimeout within ctx.
+// A poll aborted by cancelling ctx isn't recorded as a failure of the device.
+func (app *App) getAwairData(ctx context.Context, device *Device) (err error) {
+	awairAddress := device.Address
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			err = &deviceError{Reason: pollReasonPanic, Err: app.recoverPanic(r, "device", redactAddress(device.label), "device_name", device.Name)}
+		}
+		if err != nil && ctx.Err() != nil && pollReason(err) != pollReasonPanic {
+			// The poll was abandoned, on shutdown say, rather than failing,
+			// so it's left out of the device's state and error counts
+			app.Logger.Debugw("Abandoned poll of Awair device", append(pollLogFields(device, time.Since(start), nil), "cause", ctx.Err().Error())...)
+			return
+		}
+		device.recordPoll(err)
+		app.recordUp(device, err == nil)
+		app.updateHealth(device, err)
+		app.logPollResult(device, time.Since(start), err)
+		if err != nil {
+			app.recordError(device, err)
+		}
+		app.publishHomeAssistant(device)
+	}()
+
+	var awairStats AwairStats
+	if device.Source == deviceSourceCloud {
+		fetchCtx, cancel := context.WithTimeout(ctx, app.DeviceTimeout)
+		awairStats, err = app.fetchCloudData(fetchCtx, device)
+		cancel()
+	} else {
+		awairStats, err = app.fetchLocalData(ctx, device)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The sensor series need the device's metadata_labels from its first
+	// reading on, so its metadata is read first until it's known
+	awaitsMetadata := device.Source != deviceSourceCloud && app.awaitsMetadataLabels(device)
+	if awaitsMetadata {
+		app.refreshMetadata(ctx, device)
+	}
+
+	if !app.updateDevice(device, awairStats) {
+		return nil
+	}
+	app.Logger.Debugw("Polled Awair device", append(pollLogFields(device, time.Since(start), nil), "reading", awairStats)...)
+
+	app.markReady(awairAddress)
+	if device.Source != deviceSourceCloud && !awaitsMetadata {
+		app.refreshMetadata(ctx, device)
+	}
+
+	return nil
+}
+
+// updateDevice records a reading and sets the device's gauges. It returns
+// false without touching anything if the device was removed while it was
+// being polled.
+func (app *App) updateDevice(device *Device, awairStats AwairStats) bool {
+	source := device.dataSource()
+
+	app.devicesLock.RLock()
+	if device.removed || device.isPaused() {
+		app.devicesLock.RUnlock()
+		return false
+	}
+
+	if !app.awaitsMetadataLabels(device) {
+		labels := app.sensorLabels(device, source)
+		app.setSensorGauges(labels, awairStats)
+		app.setSensorValues(device, awairStats)
+		app.observeHistograms(labels, awairStats)
+	}
+
+	device.recordReading(awairStats)
+	app.markStateChanged()
+	app.evaluateThresholds(device, awairStats)
+	app.publishReading(device, awairStats)
+	app.recordOutputs(device, awairStats)
+	app.devicesLock.RUnlock()
+
+	// Publish blocks while the MQTT client's queue is full, which mustn't
+	// hold up adding or removing devices
+	app.publishMQTT(device, awairStats)
+	return true
+}
+
+// recordUp sets the device's up gauge unless it was removed while it was
+// being polled.
+func (app *App) recordUp(device *Device, up bool) {
+	app.devicesLock.RLock()
+	defer app.devicesLock.RUnlock()
+
+	if device.removed {
+		return
+	}
+	value := 0.0
+	if up {
+		value = 1
+	}
+	app.upGauge.WithLabelValues(device.seriesLabels(device.Name)...).Set(value)
+}
+
+func (app *App) deleteDeviceSeries(device *Device) {
+	if app.awaitsMetadataLabels(device) {
+		return
+	}
+	labels := app.sensorLabels(device, device.dataSource())
+
+	app.deleteSensorGauges(labels)
+	app.deleteSensorValues(device)
+	app.deleteHistograms(labels)
+	app.deleteThresholdSeries(device)
+}
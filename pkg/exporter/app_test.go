@@ -0,0 +1,151 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeDeviceClient answers polls from readings and errors set per address
+// instead of a device's local API.
+type fakeDeviceClient struct {
+	lock     sync.Mutex
+	readings map[string]AwairStats
+	errs     map[string]error
+	fetches  map[string]int
+
+	// fetch, if set, answers every poll instead.
+	fetch func(ctx context.Context, address string) (AwairStats, error)
+}
+
+func newFakeDeviceClient() *fakeDeviceClient {
+	return &fakeDeviceClient{
+		readings: map[string]AwairStats{},
+		errs:     map[string]error{},
+		fetches:  map[string]int{},
+	}
+}
+
+func (c *fakeDeviceClient) Fetch(ctx context.Context, address string) (AwairStats, error) {
+	c.lock.Lock()
+	c.fetches[address]++
+	fetch, reading, err := c.fetch, c.readings[address], c.errs[address]
+	c.lock.Unlock()
+
+	if fetch != nil {
+		return fetch(ctx, address)
+	}
+	if err != nil {
+		return AwairStats{}, err
+	}
+	return reading, nil
+}
+
+func (c *fakeDeviceClient) set(address string, reading AwairStats, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readings[address] = reading
+	c.errs[address] = err
+}
+
+func (c *fakeDeviceClient) fetchCount(address string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.fetches[address]
+}
+
+// offlineTransport fails every request, standing in for the network in
+// tests that only poll through a fakeDeviceClient.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("offline")
+}
+
+// newTestApp returns a configured exporter with a registry of its own that
+// polls the given addresses through client.
+func newTestApp(t *testing.T, client DeviceClient, configure func(app *App), addresses ...string) *App {
+	t.Helper()
+
+	opts := []Option{
+		WithRegisterer(prometheus.NewRegistry(), nil),
+		WithHTTPClient(&http.Client{Transport: offlineTransport{}}),
+		WithPollInterval(time.Hour),
+	}
+	if client != nil {
+		opts = append(opts, WithDeviceClient(client))
+	}
+	if len(addresses) > 0 {
+		opts = append(opts, WithAddresses(addresses...))
+	}
+	app, err := NewApp(opts...)
+	if err != nil {
+		t.Fatalf("NewApp: %v", err)
+	}
+	app.DeviceTimeout = time.Second
+	if configure != nil {
+		configure(app)
+	}
+	if errs := app.Configure(); len(errs) > 0 {
+		t.Fatalf("Configure: %v", errs)
+	}
+	app.runCtx = context.Background()
+	if err := app.setup(false); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	return app
+}
+
+// metricValue returns the value of the series of the named metric that
+// has all of the given labels.
+func metricValue(t *testing.T, app *App, name string, labels map[string]string) (float64, bool) {
+	t.Helper()
+
+	families, err := app.Gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if !hasLabels(metric, labels) {
+				continue
+			}
+			switch {
+			case metric.Gauge != nil:
+				return metric.Gauge.GetValue(), true
+			case metric.Counter != nil:
+				return metric.Counter.GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func hasLabels(metric *dto.Metric, labels map[string]string) bool {
+	for name, value := range labels {
+		found := false
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == name && pair.GetValue() == value {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// pollOnce polls every registered device once.
+func pollOnce(app *App) {
+	app.pollDevices(context.Background())
+}
@@ -0,0 +1,139 @@
+package exporter
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authPasswordHashEnv holds the bcrypt hash of the basic auth password when
+// auth_password_hash_file isn't used.
+const authPasswordHashEnv = "AWAIR_EXPORTER_AUTH_PASSWORD_HASH"
+
+// adminTokenEnv holds the admin bearer token when admin_token_file isn't used.
+const adminTokenEnv = "AWAIR_EXPORTER_ADMIN_TOKEN"
+
+// loadAuthPasswordHash reads the bcrypt password hash from the configured
+// file or the environment. Plaintext passwords are never accepted.
+func (app *App) loadAuthPasswordHash() error {
+	if app.AuthUsername == "" {
+		if app.AuthPasswordHashFile != "" {
+			return fmt.Errorf("auth_password_hash_file: requires auth_username")
+		}
+		return nil
+	}
+
+	hash := os.Getenv(authPasswordHashEnv)
+	if app.AuthPasswordHashFile != "" {
+		contents, err := ioutil.ReadFile(app.AuthPasswordHashFile)
+		if err != nil {
+			return fmt.Errorf("auth_password_hash_file (%q): %w", app.AuthPasswordHashFile, err)
+		}
+		hash = strings.TrimSpace(string(contents))
+	}
+
+	if hash == "" {
+		return fmt.Errorf("auth_username: requires a password hash in auth_password_hash_file or $%s", authPasswordHashEnv)
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("auth password hash: not a bcrypt hash: %w", err)
+	}
+
+	app.authPasswordHash = []byte(hash)
+	return nil
+}
+
+// requireAuth wraps a handler with basic auth when auth_username is set.
+func (app *App) requireAuth(next http.Handler) http.Handler {
+	if app.AuthUsername == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		// Always run the bcrypt comparison so a wrong username takes as long
+		// as a wrong password
+		usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(app.AuthUsername)) == 1
+		passwordOK := bcrypt.CompareHashAndPassword(app.authPasswordHash, []byte(password)) == nil
+
+		if !ok || !usernameOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="awair-exporter", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadAdminToken reads the admin bearer token from the configured file or the
+// environment. Without one the admin endpoints are disabled.
+func (app *App) loadAdminToken() error {
+	if app.AdminTokenFile != "" {
+		contents, err := ioutil.ReadFile(app.AdminTokenFile)
+		if err != nil {
+			return fmt.Errorf("admin_token_file (%q): %w", app.AdminTokenFile, err)
+		}
+		token := strings.TrimSpace(string(contents))
+		if token == "" {
+			return fmt.Errorf("admin_token_file (%q): file is empty", app.AdminTokenFile)
+		}
+		app.adminToken = []byte(token)
+		return nil
+	}
+
+	// Trimmed as the file is, since a trailing newline easily ends up in a
+	// variable set from a file or a mounted secret
+	env := os.Getenv(adminTokenEnv)
+	token := strings.TrimSpace(env)
+	if token == "" && env != "" {
+		return fmt.Errorf("%s: only whitespace", adminTokenEnv)
+	}
+	app.adminToken = []byte(token)
+	return nil
+}
+
+// requireAdmin guards a mutating endpoint with the admin bearer token. This
+// is independent of the basic auth on the read-only endpoints, and the
+// endpoint doesn't exist at all unless an admin token is configured.
+func (app *App) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(app.adminToken) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="awair-exporter-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		if subtle.ConstantTimeCompare(token, app.adminToken) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readSecret reads a credential from the file named by a flag, falling back
+// to an environment variable so it needn't appear on the command line.
+func readSecret(flagName string, path string, env string) (string, error) {
+	if path == "" {
+		return os.Getenv(env), nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s (%q): %w", flagName, path, err)
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
@@ -0,0 +1,163 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testAuthUsername = "prometheus"
+	testAuthPassword = "metrics-secret"
+	testAdminToken   = "admin-secret"
+)
+
+// newAuthTestServer serves an exporter with basic auth on its read-only
+// endpoints and, if adminToken is set, an admin token.
+func newAuthTestServer(t *testing.T, adminToken string) *httptest.Server {
+	t.Helper()
+	t.Setenv(authPasswordHashEnv, "")
+	t.Setenv(adminTokenEnv, "")
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testAuthPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	hashFile := filepath.Join(dir, "hash")
+	if err := ioutil.WriteFile(hashFile, hash, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if adminToken != "" {
+		if err := ioutil.WriteFile(tokenFile, []byte(adminToken), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := newTestApp(t, newFakeDeviceClient(), func(app *App) {
+		app.AuthUsername = testAuthUsername
+		app.AuthPasswordHashFile = hashFile
+		if adminToken != "" {
+			app.AdminTokenFile = tokenFile
+		}
+	}, "http://static/air-data/latest")
+
+	server := httptest.NewServer(app.routes())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// adminRequests are a request to each admin endpoint.
+var adminRequests = []struct {
+	method string
+	path   string
+	body   string
+}{
+	{http.MethodPost, "/api/v1/devices", `{"url": "http://added/air-data/latest"}`},
+	{http.MethodDelete, "/api/v1/devices/static", ""},
+	{http.MethodPost, "/api/v1/devices/static/pause", ""},
+	{http.MethodPost, "/api/v1/devices/static/resume", ""},
+	{http.MethodPost, "/api/v1/devices/static/poll", ""},
+	{http.MethodPost, "/api/v1/devices/poll", ""},
+	{http.MethodPut, "/-/log-level", "level=debug"},
+}
+
+func doRequest(t *testing.T, server *httptest.Server, method, path, body string, authorize func(r *http.Request)) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorize != nil {
+		authorize(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func metricsAuth(r *http.Request) {
+	r.SetBasicAuth(testAuthUsername, testAuthPassword)
+}
+
+func TestMetricsAuthDoesNotGrantAdmin(t *testing.T) {
+	server := newAuthTestServer(t, testAdminToken)
+
+	if resp := doRequest(t, server, http.MethodGet, "/metrics", "", metricsAuth); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics with basic auth = %d, want 200", resp.StatusCode)
+	}
+
+	for _, request := range adminRequests {
+		resp := doRequest(t, server, request.method, request.path, request.body, metricsAuth)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s with the metrics credentials = %d, want 401", request.method, request.path, resp.StatusCode)
+		}
+
+		// Nor is the metrics password accepted as the admin token
+		resp = doRequest(t, server, request.method, request.path, request.body, func(r *http.Request) {
+			metricsAuth(r)
+			r.Header.Set("Authorization", "Bearer "+testAuthPassword)
+		})
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s with the metrics password as bearer token = %d, want 403", request.method, request.path, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminEndpointsDisabledWithoutToken(t *testing.T) {
+	server := newAuthTestServer(t, "")
+
+	for _, request := range adminRequests {
+		resp := doRequest(t, server, request.method, request.path, request.body, metricsAuth)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s without an admin token configured = %d, want 404", request.method, request.path, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	server := newAuthTestServer(t, testAdminToken)
+
+	admin := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	}
+	if resp := doRequest(t, server, http.MethodPost, "/api/v1/devices/static/pause", "", admin); resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /api/v1/devices/static/pause with the admin token = %d, want 200", resp.StatusCode)
+	}
+
+	// The admin token doesn't open the read-only endpoints either
+	if resp := doRequest(t, server, http.MethodGet, "/metrics", "", admin); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /metrics with the admin token = %d, want 401", resp.StatusCode)
+	}
+}
+
+// A token from the environment is trimmed like one from a file, so that a
+// trailing newline doesn't lock the admin out.
+func TestAdminTokenFromEnvironment(t *testing.T) {
+	t.Setenv(authPasswordHashEnv, "")
+	t.Setenv(adminTokenEnv, testAdminToken+"\n")
+	app := newTestApp(t, newFakeDeviceClient(), nil, "http://static/air-data/latest")
+	server := httptest.NewServer(app.routes())
+	defer server.Close()
+
+	admin := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	}
+	if resp := doRequest(t, server, http.MethodPost, "/api/v1/devices/static/pause", "", admin); resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /api/v1/devices/static/pause with the trimmed token = %d, want 200", resp.StatusCode)
+	}
+
+	t.Setenv(adminTokenEnv, " \n")
+	if err := app.loadAdminToken(); err == nil {
+		t.Errorf("loading a whitespace-only admin token succeeded, want an error")
+	}
+}
@@ -0,0 +1,174 @@
+package exporter
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair"
+)
+
+// resolveSourceIP returns the local address device requests should egress
+// from, or nil if neither source_interface nor source_address is set.
+func (app *App) resolveSourceIP() (net.IP, error) {
+	if app.SourceInterface != "" && app.SourceAddress != "" {
+		return nil, fmt.Errorf("source_interface and source_address are mutually exclusive")
+	}
+
+	if app.SourceInterface != "" {
+		iface, err := net.InterfaceByName(app.SourceInterface)
+		if err != nil {
+			return nil, fmt.Errorf("source_interface (%q): %w", app.SourceInterface, err)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("source_interface (%q): %w", app.SourceInterface, err)
+		}
+		// Prefer IPv4 since that's what the devices speak
+		var fallback net.IP
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipNet.IP.To4() != nil {
+				return ipNet.IP, nil
+			}
+			if fallback == nil {
+				fallback = ipNet.IP
+			}
+		}
+		if fallback == nil {
+			return nil, fmt.Errorf("source_interface (%q): interface has no addresses", app.SourceInterface)
+		}
+		return fallback, nil
+	}
+
+	if app.SourceAddress != "" {
+		ip := net.ParseIP(app.SourceAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("source_address (%q): not an IP address", app.SourceAddress)
+		}
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("source_address (%q): %w", app.SourceAddress, err)
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return ip, nil
+			}
+		}
+		return nil, fmt.Errorf("source_address (%q): not assigned to any local interface", app.SourceAddress)
+	}
+
+	return nil, nil
+}
+
+// newHTTPClient builds the client shared by all device requests.
+func (app *App) newHTTPClient() *http.Client {
+	return app.buildHTTPClient(app.deviceTLSConfig(app.DeviceTLSSkipVerify, app.deviceClientCert))
+}
+
+// buildHTTPClient builds a client for device requests with the given TLS
+// settings.
+func (app *App) buildHTTPClient(tlsConfig *tls.Config) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if app.sourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: app.sourceIP}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = app.deviceProxy()
+	transport.GetProxyConnectHeader = markProxyConnect
+	transport.TLSClientConfig = tlsConfig
+	transport.DisableKeepAlives = app.DeviceDisableKeepAlive
+
+	return &http.Client{Transport: app.deviceTransport(&proxyConnectTransport{next: transport}), Timeout: app.DeviceTimeout}
+}
+
+// flushDeviceConnections closes idle device connections every
+// device_dns_ttl, so that devices addressed by a hostname whose address
+// changed are reached at the new one within that time rather than over a
+// kept-alive connection to the old one.
+func (app *App) flushDeviceConnections(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(app.DeviceDNSTTL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				app.closeIdleDeviceConnections()
+				for _, group := range app.groups {
+					group.app.closeIdleDeviceConnections()
+				}
+			}
+		}
+	}()
+}
+
+// closeIdleDeviceConnections closes the idle connections of the shared
+// client and of the devices that have a client of their own.
+func (app *App) closeIdleDeviceConnections() {
+	if app.httpClient != nil {
+		app.httpClient.CloseIdleConnections()
+	}
+	for _, device := range app.Devices() {
+		if device.httpClient != nil {
+			device.httpClient.CloseIdleConnections()
+		}
+	}
+}
+
+// DeviceClient fetches the latest reading of the device at an address. The
+// exporter polls local devices through it, so that polling can be driven by
+// something other than a live device.
+type DeviceClient interface {
+	Fetch(ctx context.Context, address string) (AwairStats, error)
+}
+
+// httpDeviceClient fetches readings from the devices' local API.
+type httpDeviceClient struct {
+	// httpClient returns the client to send requests to the device at
+	// address with.
+	httpClient func(address string) *http.Client
+	// prepare sets up a client for the device at address, e.g. with the
+	// headers and credentials to send it.
+	prepare func(address string, client *awair.Client)
+	// onResponse is called with every response a device answers with.
+	onResponse func(address string, resp *http.Response, body []byte)
+}
+
+func (c *httpDeviceClient) Fetch(ctx context.Context, address string) (AwairStats, error) {
+	client, err := awair.NewClient(address, c.httpClient(address))
+	if err != nil {
+		return AwairStats{}, err
+	}
+	if c.prepare != nil {
+		c.prepare(address, client)
+	}
+	if c.onResponse != nil {
+		client.ResponseHook = func(resp *http.Response, body []byte) {
+			c.onResponse(address, resp, body)
+		}
+	}
+	return client.LatestAirData(ctx)
+}
+
+// pushTimeout bounds each request made by the push outputs.
+const pushTimeout = 30 * time.Second
+
+// newPushClient builds the client used by the push outputs. Unlike device
+// requests it isn't bound to the source interface, since outputs are
+// usually reached over a different network than the devices.
+func newPushClient() *http.Client {
+	return &http.Client{Timeout: pushTimeout}
+}
@@ -0,0 +1,150 @@
+package exporter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair"
+)
+
+const testAddress = "http://living-room/air-data/latest"
+
+func sensorValue(t *testing.T, app *App, metric string) (float64, bool) {
+	t.Helper()
+	return metricValue(t, app, metric, map[string]string{"device_address": testAddress})
+}
+
+func TestPollSetsGauges(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Temp: 21.5, Humid: 40, Co2: 600, Voc: 150, Pm25: 3, Score: 92}, nil)
+	app := newTestApp(t, client, nil, testAddress)
+
+	pollOnce(app)
+
+	want := map[string]float64{
+		"awair_air_quality_temperature_celsius":             21.5,
+		"awair_air_quality_relative_humidity_percent":       40,
+		"awair_air_quality_co2_ppm":                         600,
+		"awair_air_quality_voc_ppb":                         150,
+		"awair_air_quality_pm25_micrograms_per_cubic_meter": 3,
+		"awair_air_quality_score":                           92,
+		"awair_device_up":                                   1,
+	}
+	for metric, value := range want {
+		if got, ok := sensorValue(t, app, metric); !ok || got != value {
+			t.Errorf("%s = %v (exported %v), want %v", metric, got, ok, value)
+		}
+	}
+}
+
+// A payload missing some sensors, as older firmware sends, still updates
+// the sensors it has, and the missing ones read zero rather than keeping
+// the previous reading's values.
+func TestPollPartialPayload(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Temp: 21.5, Co2: 600, Score: 92}, nil)
+	app := newTestApp(t, client, nil, testAddress)
+	pollOnce(app)
+
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Temp: 22}, nil)
+	pollOnce(app)
+
+	if got, _ := sensorValue(t, app, "awair_air_quality_temperature_celsius"); got != 22 {
+		t.Errorf("temperature = %v, want 22", got)
+	}
+	if got, ok := sensorValue(t, app, "awair_air_quality_co2_ppm"); !ok || got != 0 {
+		t.Errorf("co2 = %v (exported %v), want 0", got, ok)
+	}
+	if got, _ := sensorValue(t, app, "awair_device_up"); got != 1 {
+		t.Errorf("awair_device_up = %v, want 1", got)
+	}
+}
+
+// A failed poll marks the device down and counts the failure by reason,
+// leaving the last reading in place until the device is deemed down.
+func TestPollFailure(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Temp: 21.5, Score: 92}, nil)
+	app := newTestApp(t, client, nil, testAddress)
+	pollOnce(app)
+
+	client.set(testAddress, AwairStats{}, &awair.DecodeError{StatusCode: 200, Err: errors.New("unexpected EOF")})
+	pollOnce(app)
+
+	if got, _ := sensorValue(t, app, "awair_device_up"); got != 0 {
+		t.Errorf("awair_device_up = %v, want 0", got)
+	}
+	reasons := map[string]string{"device_address": testAddress, "reason": pollReasonDecode}
+	if got, _ := metricValue(t, app, "awair_device_poll_errors_total", reasons); got != 1 {
+		t.Errorf("awair_device_poll_errors_total{reason=%q} = %v, want 1", pollReasonDecode, got)
+	}
+	if got, _ := sensorValue(t, app, "awair_air_quality_score"); got != 92 {
+		t.Errorf("score after one failure = %v, want the last reading's 92", got)
+	}
+
+	device, _ := app.LookupDevice(testAddress)
+	status := device.Status()
+	if status.Up || status.LastError == "" || status.Failures != 1 {
+		t.Errorf("status = %+v, want down with the error recorded", status)
+	}
+	if reading := device.LastReading(); reading == nil || reading.Score != 92 {
+		t.Errorf("last reading = %+v, want the one before the failure", reading)
+	}
+
+	for i := 1; i < app.DeviceDownAfter; i++ {
+		pollOnce(app)
+	}
+	if device.Health() != healthDown {
+		t.Errorf("health after %d failures = %s, want %s", app.DeviceDownAfter, device.Health(), healthDown)
+	}
+	app.aggregates.lock.Lock()
+	aggregated := app.aggregates.latest.Devices
+	app.aggregates.lock.Unlock()
+	if len(aggregated) != 0 {
+		t.Errorf("aggregated devices = %v, want none once down", aggregated)
+	}
+
+	// And it's back up with the next reading
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Temp: 21.5, Score: 80}, nil)
+	pollOnce(app)
+	if got, _ := sensorValue(t, app, "awair_device_up"); got != 1 {
+		t.Errorf("awair_device_up after recovering = %v, want 1", got)
+	}
+	if got, _ := sensorValue(t, app, "awair_air_quality_score"); got != 80 {
+		t.Errorf("score after recovering = %v, want 80", got)
+	}
+}
+
+// A device whose clock is off or that keeps answering with the same
+// reading has it exported with the timestamp it reported, not the time it
+// was polled, so that its age can be told.
+func TestPollStaleTimestamp(t *testing.T) {
+	stale := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Timestamp: stale, Temp: 21.5, Score: 92}, nil)
+	app := newTestApp(t, client, nil, testAddress)
+
+	pollOnce(app)
+	pollOnce(app)
+
+	device, _ := app.LookupDevice(testAddress)
+	if reading := device.LastReading(); reading == nil || !reading.Timestamp.Equal(stale) {
+		t.Errorf("last reading = %+v, want the timestamp %v", reading, stale)
+	}
+	if got, _ := sensorValue(t, app, "awair_air_quality_score"); got != 92 {
+		t.Errorf("score = %v, want 92", got)
+	}
+	if samples := device.history.since(time.Now().Add(-3 * time.Hour)); len(samples) != 2 || !samples[0].Time.Equal(stale) {
+		t.Errorf("history = %+v, want two samples at %v", samples, stale)
+	}
+
+	// A reading without a timestamp is kept as of when it was polled
+	client.set(testAddress, AwairStats{Temp: 21.5, Score: 92}, nil)
+	before := time.Now()
+	pollOnce(app)
+	samples := device.history.since(before.Add(-time.Second))
+	if len(samples) != 1 || samples[0].Time.Before(before.Add(-time.Second)) {
+		t.Errorf("history since the untimestamped reading = %+v, want one sample at poll time", samples)
+	}
+}
@@ -0,0 +1,216 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	cloudTokenEnv = "AWAIR_EXPORTER_CLOUD_TOKEN"
+
+	// cloudQuotaWindow is the period the Awair cloud API's quotas apply to.
+	cloudQuotaWindow = 24 * time.Hour
+)
+
+// errCloudQuotaExhausted is returned instead of polling a cloud device once
+// the token's daily budget is spent or the API has answered 429.
+var errCloudQuotaExhausted = errors.New("awair cloud API quota exhausted")
+
+// cloudDevice is an entry of cloud_devices: [name=]device_type/device_id.
+type cloudDevice struct {
+	Name string
+	Type string
+	ID   string
+}
+
+func parseCloudDevices(value string) ([]cloudDevice, error) {
+	devices := []cloudDevice{}
+	if value == "" {
+		return devices, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		name, spec, named := strings.Cut(entry, "=")
+		if !named {
+			spec = name
+		}
+		deviceType, id, ok := strings.Cut(spec, "/")
+		if !ok || deviceType == "" || id == "" || strings.Contains(id, "/") {
+			return nil, fmt.Errorf("entry (%q): must be [name=]device_type/device_id, such as awair-glow-c/1234", entry)
+		}
+		device := cloudDevice{Name: name, Type: deviceType, ID: id}
+		if !named {
+			device.Name = device.uuid()
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// uuid is the device UUID the cloud API uses, such as "awair-glow-c_1234".
+func (device cloudDevice) uuid() string {
+	return device.Type + "_" + device.ID
+}
+
+func (device cloudDevice) address(apiURL string) string {
+	return fmt.Sprintf("%s/v1/users/self/devices/%s/%s/air-data/latest", strings.TrimSuffix(apiURL, "/"), device.Type, device.ID)
+}
+
+func (app *App) loadCloudToken() error {
+	var err error
+	app.cloudToken, err = readSecret("cloud_token_file", app.CloudTokenFile, cloudTokenEnv)
+	return err
+}
+
+// cloudBudget spends the token's daily quota of cloud API calls.
+type cloudBudget struct {
+	lock           sync.Mutex
+	quota          int
+	used           int
+	windowStart    time.Time
+	exhaustedUntil time.Time
+}
+
+func (budget *cloudBudget) take(now time.Time) error {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+
+	if now.Sub(budget.windowStart) >= cloudQuotaWindow {
+		budget.windowStart = now
+		budget.used = 0
+	}
+	if now.Before(budget.exhaustedUntil) {
+		return fmt.Errorf("%w, retrying in %v", errCloudQuotaExhausted, budget.exhaustedUntil.Sub(now).Round(time.Second))
+	}
+	if budget.used >= budget.quota {
+		return fmt.Errorf("%w, %d calls used, resetting in %v", errCloudQuotaExhausted, budget.used, budget.windowStart.Add(cloudQuotaWindow).Sub(now).Round(time.Second))
+	}
+	budget.used++
+	return nil
+}
+
+// exhaust stops calls until the given time, after the API has rejected one.
+func (budget *cloudBudget) exhaust(until time.Time) {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	budget.exhaustedUntil = until
+}
+
+func (budget *cloudBudget) remaining() int {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	return budget.quota - budget.used
+}
+
+// registerCloudDevices adds the cloud_devices to the registry. Their
+// identity comes from the configuration, so it's recorded straight away.
+func (app *App) registerCloudDevices() {
+	factory := promauto.With(app.Registerer)
+	app.cloudRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "awair",
+		Subsystem: "cloud",
+		Name:      "requests_total",
+		Help:      "Requests made to the Awair cloud API by result (success, error or quota_exhausted)",
+	}, []string{"result"})
+	app.cloudBudget = &cloudBudget{quota: app.CloudDailyQuota}
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "awair",
+		Subsystem: "cloud",
+		Name:      "quota_remaining",
+		Help:      "Calls left in the Awair cloud API token's current daily budget",
+	}, func() float64 { return float64(app.cloudBudget.remaining()) })
+
+	app.cloudClient = &http.Client{Timeout: app.DeviceTimeout}
+
+	for _, entry := range app.cloudDevices {
+		address := entry.address(app.CloudAPIURL)
+		if !app.AddDevice(entry.Name, address, deviceSourceCloud, nil) {
+			continue
+		}
+		device, _ := app.LookupDevice(address)
+		app.setMetadata(device, &DeviceMetadata{UUID: entry.uuid(), Type: entry.Type})
+	}
+}
+
+// cloudPollInterval spreads the daily quota over the cloud devices, so that
+// polling at poll_frequency doesn't spend it all by mid-morning.
+func (app *App) cloudPollInterval() time.Duration {
+	if app.CloudDailyQuota <= 0 {
+		return app.TimeBetweenChecks
+	}
+	interval := cloudQuotaWindow * time.Duration(len(app.cloudDevices)) / time.Duration(app.CloudDailyQuota)
+	if interval < app.TimeBetweenChecks {
+		return app.TimeBetweenChecks
+	}
+	return interval
+}
+
+// cloudPollDue reports whether a device should be polled this cycle. Local
+// devices always are.
+func (app *App) cloudPollDue(device *Device) bool {
+	if device.Source != deviceSourceCloud {
+		return true
+	}
+	return time.Since(device.Status().LastPoll) >= app.cloudPollInterval()
+}
+
+// fetchCloudData reads the latest reading of a device from the Awair cloud
+// API and maps it onto the local API's fields.
+func (app *App) fetchCloudData(ctx context.Context, device *Device) (AwairStats, error) {
+	awairStats := AwairStats{}
+
+	if err := app.cloudBudget.take(time.Now()); err != nil {
+		app.cloudRequests.WithLabelValues("quota_exhausted").Inc()
+		return awairStats, &deviceError{Reason: pollReasonQuota, Err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, device.Address, nil)
+	if err != nil {
+		return awairStats, err
+	}
+	req.Header.Set("Authorization", "Bearer "+app.cloudToken)
+
+	resp, err := app.cloudClient.Do(req)
+	if err != nil {
+		app.cloudRequests.WithLabelValues("error").Inc()
+		return awairStats, requestError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		app.cloudRequests.WithLabelValues("error").Inc()
+		return awairStats, &deviceError{Reason: pollReasonRead, StatusCode: resp.StatusCode, Err: fmt.Errorf("failed to read body: %w", err)}
+	}
+
+	device.recordResponse(resp, body)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := retryAfter(resp, time.Hour)
+		app.cloudBudget.exhaust(time.Now().Add(wait))
+		app.cloudRequests.WithLabelValues("quota_exhausted").Inc()
+		return awairStats, &deviceError{Reason: pollReasonQuota, StatusCode: resp.StatusCode, Err: fmt.Errorf("%w, rejected by the API, retrying in %v", errCloudQuotaExhausted, wait)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		app.cloudRequests.WithLabelValues("error").Inc()
+		return awairStats, &deviceError{Reason: pollReasonStatus, StatusCode: resp.StatusCode, Err: fmt.Errorf("unexpected status %s", resp.Status)}
+	}
+
+	awairStats, err = awair.ParseAirData(body)
+	if err != nil {
+		app.cloudRequests.WithLabelValues("error").Inc()
+		return awairStats, &deviceError{Reason: pollReasonDecode, StatusCode: resp.StatusCode, Err: fmt.Errorf("failed to decode body: %w", err)}
+	}
+	app.cloudRequests.WithLabelValues("success").Inc()
+
+	return awairStats, nil
+}
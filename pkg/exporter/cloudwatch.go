@@ -0,0 +1,187 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// cloudwatchMaxDatums is the number of datapoints sent per PutMetricData
+// call, within the API's limits on metrics per request.
+const cloudwatchMaxDatums = 20
+
+// cloudwatchUnits are the CloudWatch units of sensors that have one.
+var cloudwatchUnits = map[string]types.StandardUnit{
+	"humid": types.StandardUnitPercent,
+}
+
+// cloudwatchAPI is the part of the CloudWatch client the output uses.
+type cloudwatchAPI interface {
+	PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+// cloudwatchOutput publishes the latest reading of every device to CloudWatch
+// on its own interval, which is usually much longer than poll_frequency
+// since every datapoint is billed.
+type cloudwatchOutput struct {
+	app    *App
+	client cloudwatchAPI
+
+	// lastSent is the value last published per device address and sensor,
+	// used to skip unchanged values with cloudwatch_only_changes. Values are
+	// only committed to it once CloudWatch has accepted them, so that a
+	// failed call is retried on the next interval.
+	lastSent map[string]float64
+
+	closed chan struct{}
+	done   chan struct{}
+
+	apiCalls   *prometheus.CounterVec
+	datapoints prometheus.Counter
+}
+
+func (app *App) newCloudWatchOutput() (*cloudwatchOutput, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("no AWS region configured, set $AWS_REGION or a region in the AWS config file")
+	}
+
+	factory := promauto.With(app.Registerer)
+	out := &cloudwatchOutput{
+		app:      app,
+		client:   cloudwatch.NewFromConfig(cfg),
+		lastSent: map[string]float64{},
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+		apiCalls: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "cloudwatch",
+			Name:      "api_calls_total",
+			Help:      "PutMetricData calls made to CloudWatch, by result",
+		}, []string{"result"}),
+		datapoints: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "cloudwatch",
+			Name:      "datapoints_total",
+			Help:      "Datapoints published to CloudWatch",
+		}),
+	}
+
+	go out.run()
+	return out, nil
+}
+
+// Record and Flush are no-ops: publishing runs on cloudwatch_interval rather
+// than per poll cycle.
+func (out *cloudwatchOutput) Record(device *Device, stats AwairStats) {}
+
+func (out *cloudwatchOutput) Flush() {}
+
+func (out *cloudwatchOutput) Close(ctx context.Context) {
+	close(out.closed)
+
+	select {
+	case <-out.done:
+	case <-ctx.Done():
+	}
+}
+
+func (out *cloudwatchOutput) run() {
+	defer close(out.done)
+
+	ticker := time.NewTicker(out.app.CloudWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-out.closed:
+			return
+		}
+		out.publish()
+	}
+}
+
+func (out *cloudwatchOutput) publish() {
+	datums, keys := out.datums()
+	for start := 0; start < len(datums); start += cloudwatchMaxDatums {
+		end := start + cloudwatchMaxDatums
+		if end > len(datums) {
+			end = len(datums)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+		_, err := out.client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(out.app.CloudWatchNamespace),
+			MetricData: datums[start:end],
+		})
+		cancel()
+		if err != nil {
+			out.apiCalls.WithLabelValues("failure").Inc()
+			out.app.Logger.Errorf("Failed to publish (%+v) datapoints to CloudWatch: %+v", end-start, err)
+			continue
+		}
+		out.apiCalls.WithLabelValues("success").Inc()
+		out.datapoints.Add(float64(end - start))
+		for i := start; i < end; i++ {
+			out.lastSent[keys[i]] = *datums[i].Value
+		}
+	}
+}
+
+// datums builds a datapoint per sensor of every device that's up, leaving
+// out values that haven't changed when cloudwatch_only_changes is set, along
+// with the lastSent key of each.
+func (out *cloudwatchOutput) datums() ([]types.MetricDatum, []string) {
+	datums := []types.MetricDatum{}
+	keys := []string{}
+
+	for _, device := range out.app.Devices() {
+		status := device.Status()
+		reading := device.LastReading()
+		if !status.Up || status.Paused || reading == nil {
+			continue
+		}
+		// A reading without a timestamp is published as of when it was
+		// polled, not as of year 1, which CloudWatch rejects
+		timestamp := reading.Timestamp
+		if timestamp.IsZero() {
+			timestamp = status.LastSuccess
+		}
+
+		for _, sensor := range sensorReadings {
+			value := sensor.Value(*reading)
+			key := device.Address + "\x00" + sensor.Sensor
+			if last, ok := out.lastSent[key]; ok && last == value && out.app.CloudWatchOnlyChanges {
+				continue
+			}
+
+			unit, ok := cloudwatchUnits[sensor.Sensor]
+			if !ok {
+				unit = types.StandardUnitNone
+			}
+			datums = append(datums, types.MetricDatum{
+				MetricName: aws.String(sensor.Sensor),
+				Dimensions: []types.Dimension{{Name: aws.String("Device"), Value: aws.String(device.Name)}},
+				Timestamp:  aws.Time(timestamp),
+				Value:      aws.Float64(value),
+				Unit:       unit,
+			})
+			keys = append(keys, key)
+		}
+	}
+	return datums, keys
+}
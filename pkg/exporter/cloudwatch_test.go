@@ -0,0 +1,82 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeCloudWatch records the datapoints put to it, failing while err is set.
+type fakeCloudWatch struct {
+	err    error
+	datums []types.MetricDatum
+}
+
+func (fake *fakeCloudWatch) PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	if fake.err != nil {
+		return nil, fake.err
+	}
+	fake.datums = append(fake.datums, params.MetricData...)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func newTestCloudWatchOutput(app *App, client cloudwatchAPI) *cloudwatchOutput {
+	return &cloudwatchOutput{
+		app:        app,
+		client:     client,
+		lastSent:   map[string]float64{},
+		apiCalls:   prometheus.NewCounterVec(prometheus.CounterOpts{Name: "api_calls_total"}, []string{"result"}),
+		datapoints: prometheus.NewCounter(prometheus.CounterOpts{Name: "datapoints_total"}),
+	}
+}
+
+// With cloudwatch_only_changes, values that failed to publish are sent
+// again on the next interval rather than taken as sent.
+func TestCloudWatchRetriesFailedValues(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Score: 92}, nil)
+	app := newTestApp(t, client, func(app *App) {
+		app.CloudWatchOnlyChanges = true
+	}, testAddress)
+	pollOnce(app)
+
+	api := &fakeCloudWatch{err: errors.New("throttled")}
+	out := newTestCloudWatchOutput(app, api)
+	out.publish()
+
+	api.err = nil
+	out.publish()
+	if len(api.datums) != len(sensorReadings) {
+		t.Fatalf("datapoints after a failed call = %d, want all %d sensors", len(api.datums), len(sensorReadings))
+	}
+
+	out.publish()
+	if len(api.datums) != len(sensorReadings) {
+		t.Errorf("datapoints after an unchanged reading = %d, want none more", len(api.datums)-len(sensorReadings))
+	}
+}
+
+// A reading without a timestamp is published as of when it was polled.
+func TestCloudWatchReadingWithoutTimestamp(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Score: 92}, nil)
+	app := newTestApp(t, client, nil, testAddress)
+	before := time.Now()
+	pollOnce(app)
+
+	api := &fakeCloudWatch{}
+	newTestCloudWatchOutput(app, api).publish()
+	if len(api.datums) == 0 {
+		t.Fatal("no datapoints published")
+	}
+	for _, datum := range api.datums {
+		if datum.Timestamp.Before(before) {
+			t.Errorf("timestamp of %s = %v, want the time it was polled", *datum.MetricName, *datum.Timestamp)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// compositeFile is composite_score_file: the weight each device's score
+// carries in awair_composite_score.
+type compositeFile struct {
+	DefaultWeight *float64          `yaml:"default_weight"`
+	Devices       []compositeDevice `yaml:"devices"`
+}
+
+// compositeDevice is the weight of a device, by name or URL, and the
+// weights that replace it at some times of day.
+type compositeDevice struct {
+	Device   string           `yaml:"device"`
+	Weight   *float64         `yaml:"weight"`
+	Schedule []compositeEntry `yaml:"schedule"`
+}
+
+// compositeEntry is a weight that applies from From until To, local time,
+// wrapping past midnight when To is earlier.
+type compositeEntry struct {
+	From   string  `yaml:"from"`
+	To     string  `yaml:"to"`
+	Weight float64 `yaml:"weight"`
+
+	from, to time.Duration
+}
+
+// loadCompositeScoreFile reads and checks the weights kept in
+// composite_score_file.
+func (app *App) loadCompositeScoreFile() error {
+	if app.CompositeScoreFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(app.CompositeScoreFile)
+	if err != nil {
+		return fmt.Errorf("composite_score_file (%q): %w", app.CompositeScoreFile, err)
+	}
+
+	file := compositeFile{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("composite_score_file (%q): %w", app.CompositeScoreFile, err)
+	}
+	if file.DefaultWeight == nil {
+		one := 1.0
+		file.DefaultWeight = &one
+	}
+	if *file.DefaultWeight < 0 {
+		return fmt.Errorf("composite_score_file (%q): default_weight (%v) must not be negative", app.CompositeScoreFile, *file.DefaultWeight)
+	}
+
+	seen := map[string]bool{}
+	for i := range file.Devices {
+		device := &file.Devices[i]
+		if device.Device == "" {
+			return fmt.Errorf("composite_score_file (%q): entry %d: device is required", app.CompositeScoreFile, i)
+		}
+		if seen[device.Device] {
+			return fmt.Errorf("composite_score_file (%q): entry %d (%q): device listed more than once", app.CompositeScoreFile, i, device.Device)
+		}
+		seen[device.Device] = true
+		if device.Weight == nil {
+			device.Weight = file.DefaultWeight
+		}
+		if *device.Weight < 0 {
+			return fmt.Errorf("composite_score_file (%q): entry %d (%q): weight (%v) must not be negative", app.CompositeScoreFile, i, device.Device, *device.Weight)
+		}
+		for j := range device.Schedule {
+			if err := device.Schedule[j].parse(); err != nil {
+				return fmt.Errorf("composite_score_file (%q): entry %d (%q): schedule %d: %w", app.CompositeScoreFile, i, device.Device, j, err)
+			}
+		}
+	}
+
+	app.composite = &file
+	return nil
+}
+
+// parse checks an entry of a schedule and reads its times of day.
+func (entry *compositeEntry) parse() error {
+	var err error
+	if entry.from, err = parseTimeOfDay(entry.From); err != nil {
+		return fmt.Errorf("from (%q): %w", entry.From, err)
+	}
+	if entry.to, err = parseTimeOfDay(entry.To); err != nil {
+		return fmt.Errorf("to (%q): %w", entry.To, err)
+	}
+	if entry.from == entry.to {
+		return fmt.Errorf("from and to (%q) must differ", entry.From)
+	}
+	if entry.Weight < 0 {
+		return fmt.Errorf("weight (%v) must not be negative", entry.Weight)
+	}
+	return nil
+}
+
+// parseTimeOfDay parses a time of day such as "22:30" into the time since
+// midnight.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("must be HH:MM")
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// covers reports whether the entry applies at a time since midnight.
+func (entry compositeEntry) covers(timeOfDay time.Duration) bool {
+	if entry.from < entry.to {
+		return timeOfDay >= entry.from && timeOfDay < entry.to
+	}
+	return timeOfDay >= entry.from || timeOfDay < entry.to
+}
+
+// weight returns the weight of a device's score at a time: that of the
+// first entry of its schedule covering the time of day, its own weight
+// otherwise, or default_weight if it isn't listed.
+func (file *compositeFile) weight(device *Device, now time.Time) float64 {
+	timeOfDay := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	for _, entry := range file.Devices {
+		if entry.Device != device.Name && entry.Device != device.Address {
+			continue
+		}
+		for _, scheduled := range entry.Schedule {
+			if scheduled.covers(timeOfDay) {
+				return scheduled.Weight
+			}
+		}
+		return *entry.Weight
+	}
+	return *file.DefaultWeight
+}
+
+// compositeScore is the weighted mean of the scores of the aggregated
+// devices, or nil when none of them carries any weight.
+func (app *App) compositeScore(devices []*Device, now time.Time) *float64 {
+	if app.composite == nil {
+		return nil
+	}
+
+	sum, total := 0.0, 0.0
+	for _, device := range devices {
+		if !device.aggregated() {
+			continue
+		}
+		reading := device.LastReading()
+		if reading == nil {
+			continue
+		}
+		weight := app.composite.weight(device, now)
+		sum += weight * float64(reading.Score)
+		total += weight
+	}
+	if total == 0 {
+		return nil
+	}
+	score := sum / total
+	return &score
+}
+
+// describe summarizes a device's weights for print_config.
+func (device compositeDevice) describe() string {
+	description := fmt.Sprintf("%s: %v", device.Device, *device.Weight)
+	for _, entry := range device.Schedule {
+		description += fmt.Sprintf(", %v from %s to %s", entry.Weight, entry.From, entry.To)
+	}
+	return description
+}
@@ -0,0 +1,711 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// validateConfig checks the parsed configuration and returns one error per
+// problem found, each naming the flag (and device entry) at fault.
+func (app *App) validateConfig() []error {
+	errs := []error{}
+
+	if app.ListenPort > 65535 {
+		errs = append(errs, fmt.Errorf("port (%d): must be between 0 and 65535", app.ListenPort))
+	}
+
+	switch app.TelemetryPath {
+	case "", "/", "/healthz", "/readyz":
+		errs = append(errs, fmt.Errorf("telemetry_path (%q): conflicts with another endpoint", app.TelemetryPath))
+	default:
+		if !strings.HasPrefix(app.TelemetryPath, "/") {
+			errs = append(errs, fmt.Errorf("telemetry_path (%q): must start with /", app.TelemetryPath))
+		}
+	}
+
+	if app.ServerMaxHeaderBytes <= 0 {
+		errs = append(errs, fmt.Errorf("server_max_header_bytes (%d): must be positive", app.ServerMaxHeaderBytes))
+	}
+
+	if app.DeviceErrorLogInterval < 0 {
+		errs = append(errs, fmt.Errorf("device_error_log_interval (%v): must not be negative", app.DeviceErrorLogInterval))
+	}
+
+	if app.ErrorBufferSize < 0 {
+		errs = append(errs, fmt.Errorf("error_buffer_size (%d): must not be negative", app.ErrorBufferSize))
+	}
+
+	if app.RecentHistory < 0 {
+		errs = append(errs, fmt.Errorf("recent_history (%v): must not be negative", app.RecentHistory))
+	}
+
+	if app.HistoryRetention < 0 {
+		errs = append(errs, fmt.Errorf("history_retention (%v): must not be negative", app.HistoryRetention))
+	}
+
+	if app.HistoryMaxSize < 0 {
+		errs = append(errs, fmt.Errorf("history_max_size (%d): must not be negative", app.HistoryMaxSize))
+	}
+
+	if app.PprofListen != "" && !app.EnablePprof {
+		errs = append(errs, fmt.Errorf("pprof_listen (%q): requires enable_pprof", app.PprofListen))
+	}
+
+	if app.TimeBetweenChecks > 0 && app.TimeBetweenChecks < app.MinPollFrequency && !app.AllowFastPolling {
+		errs = append(errs, fmt.Errorf("poll_frequency (%v): below min_poll_frequency (%v), the Awair local API only refreshes about every 10s; pass --allow_fast_polling to override", app.TimeBetweenChecks, app.MinPollFrequency))
+	}
+
+	if app.DeviceTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("device_timeout (%v): must be positive", app.DeviceTimeout))
+	}
+
+	errs = append(errs, app.validateDeviceLabels()...)
+	errs = append(errs, app.validateRelabeling()...)
+
+	if err := app.validateMetricStyle(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, app.validateMetadataLabels()...)
+
+	if len(app.HistogramBuckets) > 0 && !app.Histograms {
+		errs = append(errs, fmt.Errorf("histogram_buckets: requires histograms"))
+	}
+
+	if app.DeviceMaxRetryAfter < 0 {
+		errs = append(errs, fmt.Errorf("device_max_retry_after (%v): must not be negative", app.DeviceMaxRetryAfter))
+	}
+
+	if app.DeviceDNSTTL < 0 {
+		errs = append(errs, fmt.Errorf("device_dns_ttl (%v): must not be negative", app.DeviceDNSTTL))
+	}
+
+	if app.DeviceDownAfter < 1 {
+		errs = append(errs, fmt.Errorf("device_down_after (%d): must be at least 1", app.DeviceDownAfter))
+	}
+
+	if app.DeviceHealthyAfter < 1 {
+		errs = append(errs, fmt.Errorf("device_healthy_after (%d): must be at least 1", app.DeviceHealthyAfter))
+	}
+
+	if app.FailFast != "" && app.FailFast != FailFastAny && app.FailFast != FailFastAll {
+		errs = append(errs, fmt.Errorf("fail_fast (%q): must be one of any, all", app.FailFast))
+	}
+
+	if len(app.AwairAddresses) == 0 && len(app.fileDevices) == 0 && app.GroupsFile == "" && len(app.cloudDevices) == 0 && !app.DiscoverMDNS && len(app.adminToken) == 0 {
+		errs = append(errs, fmt.Errorf("no devices configured: set awair_addresses, devices_file, groups_file, cloud_devices or discover_mdns, or admin_token_file to add them at runtime"))
+	}
+
+	for i, awairAddress := range app.AwairAddresses {
+		if err := validateDeviceAddress(awairAddress); err != nil {
+			errs = append(errs, fmt.Errorf("awair_addresses[%d] (%q): %w", i, awairAddress, err))
+		}
+	}
+
+	if app.ForwardURL != "" {
+		if u, err := url.Parse(app.ForwardURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("forward_url (%q): must be an http:// or https:// URL", app.ForwardURL))
+		}
+	}
+
+	if app.CloudWatchNamespace != "" && app.CloudWatchInterval < time.Minute {
+		errs = append(errs, fmt.Errorf("cloudwatch_interval (%v): must be at least 1m, CloudWatch's standard resolution", app.CloudWatchInterval))
+	}
+
+	if app.NATSURL != "" {
+		for _, server := range strings.Split(app.NATSURL, ",") {
+			if u, err := url.Parse(server); err != nil || u.Host == "" {
+				errs = append(errs, fmt.Errorf("nats_url (%q): must be a URL such as nats://localhost:4222", server))
+			}
+		}
+		if strings.Contains(app.NATSSubject, "{sensor}") && !strings.Contains(app.NATSSubject, "{device}") {
+			errs = append(errs, fmt.Errorf("nats_subject (%q): must contain {device} alongside {sensor}", app.NATSSubject))
+		}
+		if strings.ContainsAny(app.NATSSubject, "*> \t") {
+			errs = append(errs, fmt.Errorf("nats_subject (%q): must not contain wildcards or whitespace", app.NATSSubject))
+		}
+		if app.NATSCredentialsFile != "" && app.NATSNKeyFile != "" {
+			errs = append(errs, fmt.Errorf("nats_credentials_file and nats_nkey_file are mutually exclusive"))
+		}
+	} else if app.NATSCredentialsFile != "" || app.NATSNKeyFile != "" {
+		errs = append(errs, fmt.Errorf("nats_credentials_file and nats_nkey_file: require nats_url"))
+	}
+
+	if len(app.cloudDevices) > 0 {
+		if app.cloudToken == "" {
+			errs = append(errs, fmt.Errorf("cloud_devices: requires cloud_token_file or $%s", cloudTokenEnv))
+		}
+		if u, err := url.Parse(app.CloudAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("cloud_api_url (%q): must be an http:// or https:// URL", app.CloudAPIURL))
+		}
+		if app.CloudDailyQuota <= 0 {
+			errs = append(errs, fmt.Errorf("cloud_daily_quota (%d): must be positive", app.CloudDailyQuota))
+		}
+	}
+
+	if app.PersistDevices && app.DevicesFile == "" {
+		errs = append(errs, fmt.Errorf("persist_devices: requires devices_file"))
+	}
+
+	if app.MQTTBroker != "" {
+		if u, err := url.Parse(app.MQTTBroker); err != nil {
+			errs = append(errs, fmt.Errorf("mqtt_broker (%q): %w", app.MQTTBroker, err))
+		} else if u.Scheme != "tcp" && u.Scheme != "ssl" && u.Scheme != "ws" && u.Scheme != "wss" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("mqtt_broker (%q): must be a tcp://, ssl://, ws:// or wss:// URL", app.MQTTBroker))
+		}
+		if strings.ContainsAny(app.MQTTTopic, "+#") {
+			errs = append(errs, fmt.Errorf("mqtt_topic (%q): must not contain wildcards", app.MQTTTopic))
+		}
+		if strings.ContainsAny(app.MQTTAggregateTopic, "+#") {
+			errs = append(errs, fmt.Errorf("mqtt_aggregate_topic (%q): must not contain wildcards", app.MQTTAggregateTopic))
+		} else if app.MQTTAggregateTopic != "" && (!strings.Contains(app.MQTTAggregateTopic, "{sensor}") || !strings.Contains(app.MQTTAggregateTopic, "{agg}")) {
+			errs = append(errs, fmt.Errorf("mqtt_aggregate_topic (%q): must contain {sensor} and {agg}", app.MQTTAggregateTopic))
+		}
+		if app.MQTTHomeAssistant && !strings.Contains(app.MQTTTopic, "{sensor}") {
+			errs = append(errs, fmt.Errorf("mqtt_topic (%q): must contain {sensor} for mqtt_homeassistant", app.MQTTTopic))
+		}
+	} else if app.MQTTHomeAssistant {
+		errs = append(errs, fmt.Errorf("mqtt_homeassistant: requires mqtt_broker"))
+	}
+
+	if app.InfluxURL != "" {
+		if u, err := url.Parse(app.InfluxURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("influx_url (%q): must be an http:// or https:// URL", app.InfluxURL))
+		}
+		if app.InfluxOrg == "" {
+			errs = append(errs, fmt.Errorf("influx_org: required with influx_url"))
+		}
+		if app.InfluxBucket == "" {
+			errs = append(errs, fmt.Errorf("influx_bucket: required with influx_url"))
+		}
+	}
+
+	if app.RemoteWriteURL != "" {
+		if u, err := url.Parse(app.RemoteWriteURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("remote_write_url (%q): must be an http:// or https:// URL", app.RemoteWriteURL))
+		}
+		if app.RemoteWriteMaxAge <= 0 {
+			errs = append(errs, fmt.Errorf("remote_write_max_age (%v): must be positive", app.RemoteWriteMaxAge))
+		}
+	}
+
+	if app.PushgatewayURL != "" {
+		if u, err := url.Parse(app.PushgatewayURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("pushgateway_url (%q): must be an http:// or https:// URL", app.PushgatewayURL))
+		}
+		if app.PushgatewayJob == "" {
+			errs = append(errs, fmt.Errorf("pushgateway_job: must not be empty"))
+		}
+	}
+
+	if app.StatsdAddress != "" {
+		if _, _, err := parseStatsdAddress(app.StatsdAddress); err != nil {
+			errs = append(errs, fmt.Errorf("statsd_address (%q): %w", app.StatsdAddress, err))
+		}
+	}
+
+	if app.DogstatsdAddress != "" {
+		if _, _, err := parseDogstatsdAddress(app.DogstatsdAddress); err != nil {
+			errs = append(errs, fmt.Errorf("dogstatsd_address (%q): %w", app.DogstatsdAddress, err))
+		}
+	}
+
+	if app.GraphiteAddress != "" {
+		if err := validateGraphiteAddress(app.GraphiteAddress); err != nil {
+			errs = append(errs, fmt.Errorf("graphite_address (%q): %w", app.GraphiteAddress, err))
+		}
+	}
+
+	if app.OTLPEndpoint != "" {
+		if u, err := url.Parse(app.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("otlp_endpoint (%q): must be an http:// or https:// URL", app.OTLPEndpoint))
+		}
+		if app.OTLPInterval <= 0 {
+			errs = append(errs, fmt.Errorf("otlp_interval (%v): must be positive", app.OTLPInterval))
+		}
+	}
+
+	if app.TextfileOutput != "" && !strings.HasSuffix(app.TextfileOutput, ".prom") {
+		errs = append(errs, fmt.Errorf("textfile_output (%q): must end in .prom to be read by node_exporter", app.TextfileOutput))
+	}
+
+	if app.CSVOutput != "" {
+		if app.CSVMaxSize < 0 {
+			errs = append(errs, fmt.Errorf("csv_max_size (%d): must not be negative", app.CSVMaxSize))
+		}
+		if app.CSVMaxFiles < 0 {
+			errs = append(errs, fmt.Errorf("csv_max_files (%d): must not be negative", app.CSVMaxFiles))
+		}
+	}
+
+	if app.WebhookURL != "" {
+		if u, err := url.Parse(app.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("webhook_url (%q): must be an http:// or https:// URL", app.WebhookURL))
+		}
+		if app.ThresholdsFile == "" {
+			errs = append(errs, fmt.Errorf("webhook_url: requires thresholds_file"))
+		}
+	}
+
+	if app.DiscoverMDNS {
+		if app.MDNSBrowseInterval <= 0 {
+			errs = append(errs, fmt.Errorf("mdns_browse_interval (%v): must be positive", app.MDNSBrowseInterval))
+		}
+		if app.MDNSBrowseTimeout <= 0 {
+			errs = append(errs, fmt.Errorf("mdns_browse_timeout (%v): must be positive", app.MDNSBrowseTimeout))
+		}
+		if app.MDNSGracePeriod < app.MDNSBrowseInterval {
+			errs = append(errs, fmt.Errorf("mdns_grace_period (%v): must be at least mdns_browse_interval (%v)", app.MDNSGracePeriod, app.MDNSBrowseInterval))
+		}
+	}
+
+	errs = append(errs, app.validateProxy()...)
+
+	return errs
+}
+
+func validateDeviceAddress(awairAddress string) error {
+	u, err := url.Parse(awairAddress)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	return nil
+}
+
+// maskedSecret stands in for secrets in the printed configuration.
+const maskedSecret = "<redacted>"
+
+// effectiveConfig is the resolved configuration as printed by print_config
+// and check_config. Secrets are masked and device URLs redacted.
+type effectiveConfig struct {
+	Listen          string                  `yaml:"listen,omitempty"`
+	ListenSocket    string                  `yaml:"listen_socket,omitempty"`
+	TelemetryPath   string                  `yaml:"telemetry_path"`
+	TLS             map[string]string       `yaml:"tls,omitempty"`
+	HealthListen    string                  `yaml:"health_listen,omitempty"`
+	AllowedCIDRs    string                  `yaml:"allowed_cidrs,omitempty"`
+	TrustedProxies  string                  `yaml:"trusted_proxies,omitempty"`
+	Auth            map[string]string       `yaml:"auth,omitempty"`
+	AdminEndpoints  bool                    `yaml:"admin_endpoints_enabled"`
+	CORSOrigins     []string                `yaml:"cors_allowed_origins,omitempty"`
+	Server          serverConfig            `yaml:"server"`
+	GoMetrics       bool                    `yaml:"go_metrics"`
+	ProcessMetrics  bool                    `yaml:"process_metrics"`
+	Pprof           string                  `yaml:"pprof,omitempty"`
+	HTTPServer      bool                    `yaml:"http_server"`
+	LogLevel        string                  `yaml:"log_level"`
+	PollFrequency   time.Duration           `yaml:"poll_frequency"`
+	DeviceTimeout   time.Duration           `yaml:"device_timeout"`
+	DownAfter       int                     `yaml:"device_down_after"`
+	HealthyAfter    int                     `yaml:"device_healthy_after"`
+	MaxRetryAfter   time.Duration           `yaml:"device_max_retry_after"`
+	CrashOnPanic    bool                    `yaml:"crash_on_panic,omitempty"`
+	LabelSource     string                  `yaml:"device_label_source"`
+	MetricStyle     string                  `yaml:"metric_style"`
+	LegacyMetrics   bool                    `yaml:"legacy_metrics"`
+	MetaLabels      []string                `yaml:"metadata_labels,omitempty"`
+	Histograms      map[string][]float64    `yaml:"histograms,omitempty"`
+	SourceInterface string                  `yaml:"source_interface,omitempty"`
+	SourceAddress   string                  `yaml:"source_address,omitempty"`
+	DeviceProxyURL  string                  `yaml:"device_proxy_url,omitempty"`
+	NoProxy         []string                `yaml:"no_proxy,omitempty"`
+	DeviceHeaders   map[string]string       `yaml:"device_headers,omitempty"`
+	DeviceTLSSkip   bool                    `yaml:"device_tls_skip_verify,omitempty"`
+	DeviceCAFile    string                  `yaml:"device_ca_file,omitempty"`
+	DeviceCert      string                  `yaml:"device_client_cert,omitempty"`
+	NoKeepAlive     bool                    `yaml:"device_disable_keepalive,omitempty"`
+	DeviceDNSTTL    time.Duration           `yaml:"device_dns_ttl,omitempty"`
+	DiscoverMDNS    *mdnsConfig             `yaml:"discover_mdns,omitempty"`
+	DevicesFile     string                  `yaml:"devices_file,omitempty"`
+	RelabelFile     string                  `yaml:"relabel_file,omitempty"`
+	PersistDevices  bool                    `yaml:"persist_devices,omitempty"`
+	FailFast        string                  `yaml:"fail_fast,omitempty"`
+	Devices         []deviceConfig          `yaml:"devices"`
+	GroupsFile      string                  `yaml:"groups_file,omitempty"`
+	Groups          []groupConfig           `yaml:"groups,omitempty"`
+	ThresholdsFile  string                  `yaml:"thresholds_file,omitempty"`
+	Thresholds      []string                `yaml:"thresholds,omitempty"`
+	CompositeFile   string                  `yaml:"composite_score_file,omitempty"`
+	CompositeScore  []string                `yaml:"composite_score,omitempty"`
+	RecentHistory   time.Duration           `yaml:"recent_history"`
+	StateFile       string                  `yaml:"state_file,omitempty"`
+	StateMaxAge     time.Duration           `yaml:"state_max_age,omitempty"`
+	RecordDir       string                  `yaml:"record_dir,omitempty"`
+	ReplayDir       string                  `yaml:"replay_dir,omitempty"`
+	ReplaySpeed     *float64                `yaml:"replay_speed,omitempty"`
+	Outputs         map[string]outputConfig `yaml:"outputs,omitempty"`
+}
+
+type serverConfig struct {
+	ReadHeaderTimeout   time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout         time.Duration `yaml:"read_timeout"`
+	WriteTimeout        time.Duration `yaml:"write_timeout"`
+	IdleTimeout         time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes      int           `yaml:"max_header_bytes"`
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+}
+
+type mdnsConfig struct {
+	BrowseInterval time.Duration `yaml:"browse_interval"`
+	BrowseTimeout  time.Duration `yaml:"browse_timeout"`
+	GracePeriod    time.Duration `yaml:"grace_period"`
+}
+
+type deviceConfig struct {
+	Name          string            `yaml:"name"`
+	URL           string            `yaml:"url"`
+	Source        string            `yaml:"source"`
+	Group         string            `yaml:"group,omitempty"`
+	Labels        map[string]string `yaml:"labels,omitempty"`
+	FallbackURLs  []string          `yaml:"fallback_urls,omitempty"`
+	Headers       map[string]string `yaml:"headers,omitempty"`
+	BasicAuth     string            `yaml:"basic_auth,omitempty"`
+	TLSSkipVerify *bool             `yaml:"tls_skip_verify,omitempty"`
+	ClientCert    string            `yaml:"client_cert,omitempty"`
+	ClientKey     string            `yaml:"client_key,omitempty"`
+	PollInterval  time.Duration     `yaml:"poll_interval"`
+}
+
+type groupConfig struct {
+	Name          string            `yaml:"name"`
+	Namespace     string            `yaml:"namespace"`
+	Labels        map[string]string `yaml:"labels,omitempty"`
+	PollFrequency time.Duration     `yaml:"poll_frequency"`
+	DeviceTimeout time.Duration     `yaml:"device_timeout"`
+	Devices       []deviceConfig    `yaml:"devices"`
+}
+
+// outputConfig holds an enabled output's settings, keyed by the flag name
+// without the output's prefix.
+type outputConfig map[string]interface{}
+
+// masked returns maskedSecret if a secret is set, for outputs to show that
+// credentials are in use without showing them.
+func masked(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return maskedSecret
+}
+
+// maskedHeaders lists header names with their values masked.
+func maskedHeaders(headers http.Header) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	out := map[string]string{}
+	for name := range headers {
+		out[name] = maskedSecret
+	}
+	return out
+}
+
+// configLabels returns a device's labels including those relabel_file gives
+// it, or just its own if the rules don't give it all of them.
+func (app *App) configLabels(name, address string, labels map[string]string) map[string]string {
+	if relabeled, err := app.relabel(name, address, labels); err == nil {
+		return relabeled
+	}
+	return labels
+}
+
+// effectiveConfig resolves the configuration for printing.
+func (app *App) effectiveConfig() effectiveConfig {
+	config := effectiveConfig{
+		TelemetryPath:  app.TelemetryPath,
+		HealthListen:   app.HealthListen,
+		AllowedCIDRs:   app.AllowedCIDRs,
+		TrustedProxies: app.TrustedProxies,
+		AdminEndpoints: len(app.adminToken) > 0,
+		CORSOrigins:    app.CORSAllowedOrigins,
+		GoMetrics:      !app.DisableGoMetrics,
+		ProcessMetrics: !app.DisableProcessMetrics,
+		HTTPServer:     !app.DisableHTTPServer,
+		LogLevel:       app.LogLevel.String(),
+		PollFrequency:  app.TimeBetweenChecks,
+		DeviceTimeout:  app.DeviceTimeout,
+		DownAfter:      app.DeviceDownAfter,
+		HealthyAfter:   app.DeviceHealthyAfter,
+		MaxRetryAfter:  app.DeviceMaxRetryAfter,
+		CrashOnPanic:   app.CrashOnPanic,
+		LabelSource:    app.DeviceLabelSource,
+		MetricStyle:    app.MetricStyle,
+		LegacyMetrics:  app.LegacyMetrics,
+		MetaLabels:     app.MetadataLabels,
+		SourceAddress:  app.SourceAddress,
+		DeviceProxyURL: redactAddress(app.DeviceProxyURL),
+		NoProxy:        app.NoProxy,
+		DeviceHeaders:  maskedHeaders(app.deviceHeader),
+		DeviceTLSSkip:  app.DeviceTLSSkipVerify,
+		DeviceCAFile:   app.DeviceCAFile,
+		NoKeepAlive:    app.DeviceDisableKeepAlive,
+		DeviceDNSTTL:   app.DeviceDNSTTL,
+		DevicesFile:    app.DevicesFile,
+		RelabelFile:    app.RelabelFile,
+		GroupsFile:     app.GroupsFile,
+		ThresholdsFile: app.ThresholdsFile,
+		CompositeFile:  app.CompositeScoreFile,
+		RecentHistory:  app.RecentHistory,
+		StateFile:      app.StateFile,
+		RecordDir:      app.RecordDir,
+		ReplayDir:      app.ReplayDir,
+		PersistDevices: app.PersistDevices,
+		FailFast:       app.FailFast,
+		Devices:        []deviceConfig{},
+		Outputs:        map[string]outputConfig{},
+		Server: serverConfig{
+			ReadHeaderTimeout:   app.ServerReadHeaderTimeout,
+			ReadTimeout:         app.ServerReadTimeout,
+			WriteTimeout:        app.ServerWriteTimeout,
+			IdleTimeout:         app.ServerIdleTimeout,
+			MaxHeaderBytes:      app.ServerMaxHeaderBytes,
+			ShutdownGracePeriod: app.ShutdownGracePeriod,
+		},
+	}
+
+	if app.ListenSocket != "" {
+		config.ListenSocket = fmt.Sprintf("%s (%04o)", app.ListenSocket, app.ListenSocketMode)
+	} else {
+		config.Listen = net.JoinHostPort(app.ListenAddress, strconv.FormatUint(app.ListenPort, 10))
+	}
+	if app.TLSCertFile != "" || app.TLSClientCAFile != "" {
+		config.TLS = map[string]string{"cert_file": app.TLSCertFile, "key_file": app.TLSKeyFile}
+		if app.TLSClientCAFile != "" {
+			config.TLS["client_ca_file"] = app.TLSClientCAFile
+		}
+	}
+	if app.TrustedProxies != "" {
+		config.TrustedProxies = fmt.Sprintf("%s (%s)", app.TrustedProxies, app.TrustedProxyHeader)
+	}
+	if app.AuthUsername != "" {
+		config.Auth = map[string]string{"username": app.AuthUsername, "password_hash": maskedSecret}
+	}
+	if app.EnablePprof {
+		config.Pprof = "/debug/pprof/"
+		if app.PprofListen != "" {
+			config.Pprof = app.PprofListen
+		}
+	}
+	if app.DeviceClientCert != "" {
+		config.DeviceCert = fmt.Sprintf("%s (%s)", app.DeviceClientCert, app.DeviceClientKey)
+	}
+	if app.SourceInterface != "" {
+		config.SourceInterface = fmt.Sprintf("%s (%v)", app.SourceInterface, app.sourceIP)
+	}
+	if app.Histograms {
+		config.Histograms = app.histogramBuckets
+	}
+	if app.DiscoverMDNS {
+		config.DiscoverMDNS = &mdnsConfig{
+			BrowseInterval: app.MDNSBrowseInterval,
+			BrowseTimeout:  app.MDNSBrowseTimeout,
+			GracePeriod:    app.MDNSGracePeriod,
+		}
+	}
+
+	for _, awairAddress := range app.AwairAddresses {
+		config.Devices = append(config.Devices, deviceConfig{
+			Name:         deviceNameFromAddress(awairAddress),
+			URL:          redactAddress(awairAddress),
+			Source:       deviceSourceStatic,
+			Labels:       app.configLabels(deviceNameFromAddress(awairAddress), awairAddress, nil),
+			PollInterval: app.TimeBetweenChecks,
+		})
+	}
+	for _, entry := range app.fileDevices {
+		name := entry.Name
+		if name == "" {
+			name = deviceNameFromAddress(entry.URL)
+		}
+		config.Devices = append(config.Devices, deviceConfig{
+			Name:          name,
+			URL:           redactAddress(entry.URL),
+			Source:        deviceSourceFile,
+			Group:         entry.Group,
+			Labels:        app.configLabels(name, entry.URL, entry.Labels),
+			FallbackURLs:  redactAddresses(entry.FallbackURLs),
+			Headers:       maskedHeaders(newDeviceHeader(entry.Headers)),
+			BasicAuth:     entry.BasicAuth.masked(),
+			TLSSkipVerify: entry.TLSSkipVerify,
+			ClientCert:    entry.ClientCert,
+			ClientKey:     entry.ClientKey,
+			PollInterval:  app.TimeBetweenChecks,
+		})
+	}
+	for _, entry := range app.cloudDevices {
+		config.Devices = append(config.Devices, deviceConfig{
+			Name:         entry.Name,
+			URL:          app.CloudAPIURL + "/" + entry.uuid(),
+			Source:       deviceSourceCloud,
+			Labels:       app.configLabels(entry.Name, entry.address(app.CloudAPIURL), nil),
+			PollInterval: app.cloudPollInterval(),
+		})
+	}
+
+	for _, entry := range app.groupEntries {
+		group := groupConfig{
+			Name:          entry.Name,
+			Namespace:     entry.Namespace,
+			Labels:        entry.Labels,
+			PollFrequency: entry.PollFrequency,
+			DeviceTimeout: entry.DeviceTimeout,
+			Devices:       []deviceConfig{},
+		}
+		for _, device := range entry.Devices {
+			name := device.Name
+			if name == "" {
+				name = deviceNameFromAddress(device.URL)
+			}
+			group.Devices = append(group.Devices, deviceConfig{
+				Name:          name,
+				URL:           redactAddress(device.URL),
+				Source:        deviceSourceGroup,
+				Group:         device.Group,
+				Labels:        app.configLabels(name, device.URL, device.Labels),
+				FallbackURLs:  redactAddresses(device.FallbackURLs),
+				Headers:       maskedHeaders(newDeviceHeader(device.Headers)),
+				BasicAuth:     device.BasicAuth.masked(),
+				TLSSkipVerify: device.TLSSkipVerify,
+				ClientCert:    device.ClientCert,
+				ClientKey:     device.ClientKey,
+				PollInterval:  entry.PollFrequency,
+			})
+		}
+		config.Groups = append(config.Groups, group)
+	}
+
+	for _, t := range app.thresholds {
+		description := fmt.Sprintf("%s (%s, for %v)", t.Name, t.Severity, t.forDuration)
+		if t.Clear != nil {
+			description = fmt.Sprintf("%s (%s, for %v, clear at %v)", t.Name, t.Severity, t.forDuration, *t.Clear)
+		}
+		if len(t.Devices) > 0 {
+			description += " on " + strings.Join(t.Devices, ", ")
+		}
+		config.Thresholds = append(config.Thresholds, description)
+	}
+
+	if app.composite != nil {
+		config.CompositeScore = []string{fmt.Sprintf("default: %v", *app.composite.DefaultWeight)}
+		for _, device := range app.composite.Devices {
+			config.CompositeScore = append(config.CompositeScore, device.describe())
+		}
+	}
+
+	if app.ReplayDir != "" {
+		config.ReplaySpeed = &app.ReplaySpeed
+	}
+	if app.StateFile != "" {
+		config.StateMaxAge = app.StateMaxAge
+	}
+
+	app.addOutputConfigs(config.Outputs)
+	return config
+}
+
+// addOutputConfigs adds the settings of every enabled output.
+func (app *App) addOutputConfigs(outputs map[string]outputConfig) {
+	if app.MQTTBroker != "" {
+		mqttConfig := outputConfig{
+			"broker":    redactAddress(app.MQTTBroker),
+			"client_id": app.MQTTClientID,
+			"topic":     app.MQTTTopic,
+			"qos":       app.MQTTQoS,
+			"retain":    app.MQTTRetain,
+		}
+		if app.MQTTAggregateTopic != "" {
+			mqttConfig["aggregate_topic"] = app.MQTTAggregateTopic
+		}
+		if app.MQTTUsername != "" {
+			mqttConfig["username"] = app.MQTTUsername
+			mqttConfig["password"] = masked(app.mqttPassword)
+		}
+		if app.MQTTHomeAssistant {
+			mqttConfig["homeassistant_prefix"] = app.MQTTHomeAssistantPrefix
+		}
+		outputs["mqtt"] = mqttConfig
+	}
+	if app.InfluxURL != "" {
+		outputs["influx"] = outputConfig{"url": redactAddress(app.InfluxURL), "org": app.InfluxOrg, "bucket": app.InfluxBucket, "token": masked(app.influxToken)}
+	}
+	if app.RemoteWriteURL != "" {
+		remoteWriteConfig := outputConfig{"url": redactAddress(app.RemoteWriteURL), "job": app.RemoteWriteJob, "max_age": app.RemoteWriteMaxAge}
+		if app.remoteWriteToken != "" {
+			remoteWriteConfig["bearer_token"] = maskedSecret
+		}
+		if app.RemoteWriteUsername != "" {
+			remoteWriteConfig["username"] = app.RemoteWriteUsername
+			remoteWriteConfig["password"] = masked(app.remoteWritePassword)
+		}
+		outputs["remote_write"] = remoteWriteConfig
+	}
+	if app.PushgatewayURL != "" {
+		outputs["pushgateway"] = outputConfig{"url": redactAddress(app.PushgatewayURL), "job": app.PushgatewayJob, "instance": app.PushgatewayInstance}
+	}
+	if app.StatsdAddress != "" {
+		outputs["statsd"] = outputConfig{"address": app.StatsdAddress, "prefix": app.StatsdPrefix}
+	}
+	if app.DogstatsdAddress != "" {
+		outputs["dogstatsd"] = outputConfig{"address": app.DogstatsdAddress, "prefix": app.DogstatsdPrefix, "tags": app.DogstatsdTags}
+	}
+	if app.GraphiteAddress != "" {
+		outputs["graphite"] = outputConfig{"address": app.GraphiteAddress, "prefix": app.GraphitePrefix}
+	}
+	if app.OTLPEndpoint != "" {
+		outputs["otlp"] = outputConfig{"endpoint": redactAddress(app.OTLPEndpoint), "interval": app.OTLPInterval, "headers": maskedHeaders(app.otlpHeaders)}
+	}
+	if app.TextfileOutput != "" {
+		outputs["textfile"] = outputConfig{"path": app.TextfileOutput}
+	}
+	if app.CSVOutput != "" {
+		outputs["csv"] = outputConfig{"path": app.CSVOutput, "max_size": app.CSVMaxSize, "max_files": app.CSVMaxFiles}
+	}
+	if app.HistoryDB != "" {
+		outputs["history"] = outputConfig{"path": app.HistoryDB, "retention": app.HistoryRetention, "max_size": app.HistoryMaxSize}
+	}
+	if app.WebhookURL != "" {
+		outputs["webhook"] = outputConfig{"url": redactAddress(app.WebhookURL), "thresholds_file": app.ThresholdsFile}
+	}
+	if app.ForwardURL != "" {
+		outputs["forward"] = outputConfig{"url": redactAddress(app.ForwardURL), "headers": maskedHeaders(app.forwardHeaders)}
+	}
+	if app.CloudWatchNamespace != "" {
+		outputs["cloudwatch"] = outputConfig{"namespace": app.CloudWatchNamespace, "interval": app.CloudWatchInterval, "only_changes": app.CloudWatchOnlyChanges}
+	}
+	if app.NATSURL != "" {
+		natsConfig := outputConfig{"url": redactAddress(app.NATSURL), "subject": app.NATSSubject}
+		if app.NATSCredentialsFile != "" {
+			natsConfig["credentials_file"] = app.NATSCredentialsFile
+		}
+		if app.NATSNKeyFile != "" {
+			natsConfig["nkey_file"] = app.NATSNKeyFile
+		}
+		outputs["nats"] = natsConfig
+	}
+	if app.ReadingsLog != "" {
+		outputs["readings_log"] = outputConfig{"path": app.ReadingsLog}
+	}
+}
+
+// PrintConfig writes the effective configuration as YAML.
+func (app *App) PrintConfig(w io.Writer) {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(app.effectiveConfig()); err != nil {
+		fmt.Fprintf(w, "# failed to render configuration: %v\n", err)
+	}
+	encoder.Close()
+}
@@ -0,0 +1,47 @@
+package exporter
+
+import (
+	"net/http"
+)
+
+// corsOriginAllowed reports whether a browser origin may read the JSON API.
+func (app *App) corsOriginAllowed(origin string) bool {
+	for _, allowed := range app.CORSAllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// cors adds CORS headers for allowed origins and answers preflight requests.
+// It wraps the auth middleware since browsers send preflights without
+// credentials.
+func (app *App) cors(next http.Handler) http.Handler {
+	if len(app.CORSAllowedOrigins) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		if origin != "" && app.corsOriginAllowed(origin) {
+			if len(app.CORSAllowedOrigins) == 1 && app.CORSAllowedOrigins[0] == "*" {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,240 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const csvQueueSize = 16
+
+// csvOutput appends one row per device per poll to a CSV file, rotating it
+// by size.
+type csvOutput struct {
+	app *App
+
+	lock sync.Mutex
+	rows [][]string
+
+	queue chan [][]string
+	done  chan struct{}
+	file  *os.File
+	size  int64
+}
+
+func (app *App) newCSVOutput() *csvOutput {
+	out := &csvOutput{
+		app:   app,
+		queue: make(chan [][]string, csvQueueSize),
+		done:  make(chan struct{}),
+	}
+	go out.run()
+	return out
+}
+
+func csvHeader() []string {
+	header := []string{"timestamp", "device"}
+	for _, reading := range sensorReadings {
+		header = append(header, reading.Sensor)
+	}
+	return header
+}
+
+func (out *csvOutput) Record(device *Device, stats AwairStats) {
+	timestamp := stats.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	row := []string{timestamp.UTC().Format(time.RFC3339), device.Name}
+	for _, reading := range sensorReadings {
+		row = append(row, strconv.FormatFloat(reading.Value(stats), 'f', -1, 64))
+	}
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	out.rows = append(out.rows, row)
+}
+
+func (out *csvOutput) Flush() {
+	out.lock.Lock()
+	rows := out.rows
+	out.rows = nil
+	out.lock.Unlock()
+
+	if len(rows) == 0 {
+		return
+	}
+
+	select {
+	case out.queue <- rows:
+	default:
+		out.app.Logger.Warnf("Dropped (%+v) CSV rows, the write queue is full", len(rows))
+	}
+}
+
+func (out *csvOutput) Close(ctx context.Context) {
+	out.Flush()
+	close(out.queue)
+
+	select {
+	case <-out.done:
+	case <-ctx.Done():
+	}
+}
+
+func (out *csvOutput) run() {
+	defer close(out.done)
+	for rows := range out.queue {
+		if err := out.write(rows); err != nil {
+			out.app.Logger.Errorf("Failed to write (%+v) rows to CSV file (%+v): %+v", len(rows), out.app.CSVOutput, err)
+		}
+	}
+	if out.file != nil {
+		out.file.Close()
+	}
+}
+
+// write appends a cycle's rows with a single write so that a crash can't
+// leave a partial row behind them, and a failed write is cut back off.
+func (out *csvOutput) write(rows [][]string) error {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if err := writer.WriteAll(rows); err != nil {
+		return err
+	}
+
+	if out.file == nil {
+		if err := out.open(); err != nil {
+			return err
+		}
+	}
+	if out.app.CSVMaxSize > 0 && out.size+int64(buf.Len()) > out.app.CSVMaxSize {
+		if err := out.rotate(); err != nil {
+			return err
+		}
+		if err := out.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := out.file.Write(buf.Bytes())
+	if err != nil && n > 0 {
+		out.discardPartialWrite()
+		return err
+	}
+	out.size += int64(n)
+	return err
+}
+
+// discardPartialWrite cuts the file back to the end of the last complete
+// write after a write failed partway, such as on a full disk, so the next
+// rows don't follow a partial one. If that fails too, the file is closed
+// and open drops the partial row when it's reopened.
+func (out *csvOutput) discardPartialWrite() {
+	if err := out.file.Truncate(out.size); err == nil {
+		if _, err = out.file.Seek(out.size, io.SeekStart); err == nil {
+			return
+		}
+	}
+	out.file.Close()
+	out.file = nil
+}
+
+// open opens the file for appending, writing the header if it's new and
+// dropping a partial last row left by a crash mid-write.
+func (out *csvOutput) open() error {
+	file, err := os.OpenFile(out.app.CSVOutput, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if size > 0 {
+		size, err = truncatePartialLine(file, size)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	out.file = file
+	out.size = size
+	if size == 0 {
+		var buf bytes.Buffer
+		writer := csv.NewWriter(&buf)
+		writer.Write(csvHeader())
+		writer.Flush()
+		n, err := out.file.Write(buf.Bytes())
+		if err != nil && n > 0 {
+			out.discardPartialWrite()
+			return err
+		}
+		out.size += int64(n)
+		return err
+	}
+	return nil
+}
+
+// truncatePartialLine cuts the file back to just after its last newline and
+// leaves the offset at the new end.
+func truncatePartialLine(file *os.File, size int64) (int64, error) {
+	const chunk = 4 << 10
+	buf := make([]byte, chunk)
+
+	end := size
+	for end > 0 {
+		start := end - chunk
+		if start < 0 {
+			start = 0
+		}
+		n, err := file.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+
+	if end != size {
+		if err := file.Truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	return file.Seek(end, io.SeekStart)
+}
+
+// rotate shifts path.1 to path.2 and so on, dropping the oldest beyond
+// csv_max_files, and moves the current file to path.1.
+func (out *csvOutput) rotate() error {
+	out.file.Close()
+	out.file = nil
+
+	path := out.app.CSVOutput
+	keep := out.app.CSVMaxFiles
+	if keep < 1 {
+		return os.Remove(path)
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(path, path+".1")
+}
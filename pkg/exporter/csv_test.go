@@ -0,0 +1,43 @@
+package exporter
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The part of a row a failed write left behind is cut off before the next
+// rows are written.
+func TestCSVDiscardsPartialWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings.csv")
+	out := &csvOutput{app: &App{CSVOutput: path}}
+	row := []string{"2022-06-01T12:00:00Z", "bedroom", "21.5", "40", "600", "150", "3", "92"}
+	if err := out.write([][]string{row}); err != nil {
+		t.Fatal(err)
+	}
+
+	// As a write cut short by a full disk would leave it
+	if _, err := out.file.Write([]byte("2022-06-01T12:00:30Z,bedro")); err != nil {
+		t.Fatal(err)
+	}
+	out.discardPartialWrite()
+
+	if err := out.write([][]string{row}); err != nil {
+		t.Fatal(err)
+	}
+	out.file.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("CSV file doesn't parse: %v", err)
+	}
+	if len(records) != 3 || records[1][1] != "bedroom" || records[2][1] != "bedroom" {
+		t.Errorf("records = %v, want the header and two rows", records)
+	}
+}
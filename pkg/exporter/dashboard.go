@@ -0,0 +1,143 @@
+package exporter
+
+import (
+	"html/template"
+	"net/http"
+)
+
+type dashboardPage struct {
+	RefreshMillis int64
+	Bands         map[string]severityBand
+	History       bool
+}
+
+// The dashboard is a single self-contained page with no external assets so
+// it works on networks without internet access. It renders the JSON API
+// client-side and re-fetches it every poll interval. With recent_history,
+// each device gets a sparkline of its CO2 over the last hour.
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Awair Dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.4em 1em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.good { background: #d4f4d4; }
+.fair { background: #fbeec1; }
+.poor { background: #f6c6c6; }
+.down { color: #999; }
+svg polyline { fill: none; stroke: #555; stroke-width: 1.5; }
+.aggregate td { font-weight: bold; border-top: 2px solid #999; }
+#updated { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Awair Dashboard</h1>
+<table>
+<thead>
+<tr><th>Device</th><th>Temp (&deg;C)</th><th>Humidity (%)</th><th>CO2 (ppm)</th><th>VOC (ppb)</th><th>PM2.5 (&micro;g/m&sup3;)</th><th>Score</th>{{if .History}}<th>CO2, last hour</th>{{end}}</tr>
+</thead>
+<tbody id="readings"><tr><td colspan="{{if .History}}8{{else}}7{{end}}">Waiting for the first poll...</td></tr></tbody>
+</table>
+<p id="updated"></p>
+<script>
+const bands = {{.Bands}};
+const sensors = ["temp", "humid", "co2", "voc", "pm25", "score"];
+const history = {{.History}};
+
+function severity(sensor, value) {
+  const band = bands[sensor];
+  if (!band) return "";
+  if (value >= band.good[0] && value <= band.good[1]) return "good";
+  if (value >= band.fair[0] && value <= band.fair[1]) return "fair";
+  return "poor";
+}
+
+function cell(text, className) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  if (className) td.className = className;
+  return td;
+}
+
+async function sparkline(name) {
+  const td = cell("-");
+  const resp = await fetch("/api/v1/history/recent?device=" + encodeURIComponent(name) + "&duration=1h", {credentials: "same-origin"});
+  if (!resp.ok) return td;
+  const values = (await resp.json()).samples.map(sample => sample.co2);
+  if (values.length < 2) return td;
+  const min = Math.min(...values), max = Math.max(...values), span = max - min || 1;
+  const points = values.map((value, i) => (i * 100 / (values.length - 1)).toFixed(1) + "," + (19 - (value - min) * 18 / span).toFixed(1));
+  td.innerHTML = '<svg width="100" height="20" viewBox="0 0 100 20"><polyline points="' + points.join(" ") + '"/></svg>';
+  td.title = "min " + min + ", max " + max;
+  return td;
+}
+
+async function refresh() {
+  try {
+    const resp = await fetch("/api/v1/readings", {credentials: "same-origin"});
+    if (!resp.ok) throw new Error(resp.status + " " + resp.statusText);
+    const devices = await resp.json();
+    const sparklines = history ? await Promise.all(devices.map(device => sparkline(device.name))) : [];
+    const body = document.getElementById("readings");
+    body.replaceChildren();
+    for (const [i, device] of devices.entries()) {
+      const row = document.createElement("tr");
+      if (!device.up) row.className = "down";
+      row.appendChild(cell(device.name + (device.up ? "" : " (down)")));
+      for (const sensor of sensors) {
+        if (!device.reading) {
+          row.appendChild(cell("-"));
+          continue;
+        }
+        const value = device.reading[sensor];
+        row.appendChild(cell(value, device.up ? severity(sensor, value) : ""));
+      }
+      if (history) row.appendChild(sparklines[i]);
+      body.appendChild(row);
+    }
+    const aggResp = await fetch("/api/v1/aggregates", {credentials: "same-origin"});
+    if (!aggResp.ok) throw new Error(aggResp.status + " " + aggResp.statusText);
+    const agg = await aggResp.json();
+    if (agg.sensors) {
+      const row = document.createElement("tr");
+      row.className = "aggregate";
+      row.appendChild(cell("Whole home (mean of " + agg.devices.length + ")"));
+      for (const sensor of sensors) {
+        const value = Math.round(agg.sensors[sensor].mean * 10) / 10;
+        const td = cell(value, severity(sensor, value));
+        td.title = "min " + agg.sensors[sensor].min + ", max " + agg.sensors[sensor].max;
+        row.appendChild(td);
+      }
+      if (history) row.appendChild(cell(""));
+      body.appendChild(row);
+    }
+    document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+  } catch (err) {
+    document.getElementById("updated").textContent = "Failed to refresh: " + err.message;
+  }
+}
+
+refresh();
+setInterval(refresh, {{.RefreshMillis}});
+</script>
+</body>
+</html>
+`))
+
+func (app *App) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	page := dashboardPage{
+		RefreshMillis: app.TimeBetweenChecks.Milliseconds(),
+		Bands:         severityBands,
+		History:       app.RecentHistory > 0,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, page); err != nil {
+		app.Logger.Errorf("Failed to render dashboard: %+v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// maxCapturedBodyBytes caps how much of each device's last response body is
+// kept in memory for /debug/last.
+const maxCapturedBodyBytes = 64 << 10
+
+// capturedHeaders are the response headers kept alongside the body. Anything
+// else, cookies in particular, is dropped.
+var capturedHeaders = []string{"Content-Type", "Content-Length", "Date", "Server"}
+
+type capturedResponse struct {
+	CapturedAt time.Time         `json:"captured_at"`
+	Status     string            `json:"status"`
+	Headers    map[string]string `json:"headers"`
+	Truncated  bool              `json:"truncated"`
+	Body       string            `json:"body"`
+}
+
+type debugLastResponse struct {
+	Device  string `json:"device"`
+	Address string `json:"address"`
+	*capturedResponse
+}
+
+// recordResponse keeps the last response of the device at an address.
+func (app *App) recordResponse(address string, resp *http.Response, body []byte) {
+	if device, ok := app.deviceForEndpoint(address); ok {
+		device.recordResponse(resp, body)
+	}
+}
+
+func (device *Device) recordResponse(resp *http.Response, body []byte) {
+	captured := &capturedResponse{
+		CapturedAt: time.Now(),
+		Status:     resp.Status,
+		Headers:    map[string]string{},
+	}
+	for _, header := range capturedHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			captured.Headers[header] = value
+		}
+	}
+	if len(body) > maxCapturedBodyBytes {
+		body = body[:maxCapturedBodyBytes]
+		captured.Truncated = true
+	}
+	captured.Body = string(body)
+
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	device.lastResponse = captured
+}
+
+func (app *App) debugLastHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("device")
+	if name == "" {
+		http.Error(w, "missing device parameter", http.StatusBadRequest)
+		return
+	}
+
+	device, ok := app.LookupDevice(name)
+	if !ok {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	device.stateLock.Lock()
+	captured := device.lastResponse
+	device.stateLock.Unlock()
+
+	if captured == nil {
+		http.Error(w, "no response captured from device yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(debugLastResponse{
+		Device:           device.Name,
+		Address:          redactAddress(device.Address),
+		capturedResponse: captured,
+	})
+}
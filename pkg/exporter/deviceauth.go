@@ -0,0 +1,64 @@
+package exporter
+
+import (
+	"fmt"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair"
+)
+
+// deviceBasicAuth is the basic auth a device is polled with, such as for an
+// nginx in front of it. The password is only ever read from a file or an
+// environment variable, never given inline, so it can't end up in the
+// devices file, the JSON API or the device's URL. It's only accepted from
+// devices_file and groups_file, not POST /api/v1/devices.
+type deviceBasicAuth struct {
+	Username     string `json:"username" yaml:"username"`
+	PasswordFile string `json:"password_file,omitempty" yaml:"password_file"`
+	PasswordEnv  string `json:"password_env,omitempty" yaml:"password_env"`
+
+	password string
+}
+
+// load checks the credentials and reads the password.
+func (auth *deviceBasicAuth) load() error {
+	if auth.Username == "" {
+		return fmt.Errorf("basic_auth: username is required")
+	}
+	if (auth.PasswordFile == "") == (auth.PasswordEnv == "") {
+		return fmt.Errorf("basic_auth: exactly one of password_file and password_env is required")
+	}
+
+	password, err := readSecret("basic_auth: password_file", auth.PasswordFile, auth.PasswordEnv)
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("basic_auth: password is empty")
+	}
+	auth.password = password
+	return nil
+}
+
+// String keeps the password out of anything that formats the credentials.
+func (auth *deviceBasicAuth) String() string {
+	return auth.masked()
+}
+
+// masked shows the username with the password masked, or nothing if auth
+// is nil.
+func (auth *deviceBasicAuth) masked() string {
+	if auth == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s", auth.Username, maskedSecret)
+}
+
+// prepareClient sets the headers and credentials of the device polled
+// through address on a client for it.
+func (app *App) prepareClient(address string, client *awair.Client) {
+	client.Header = app.requestHeaders(address)
+	if device, ok := app.deviceForEndpoint(address); ok && device.basicAuth != nil {
+		client.Username = device.basicAuth.Username
+		client.Password = device.basicAuth.password
+	}
+}
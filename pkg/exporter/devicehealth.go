@@ -0,0 +1,134 @@
+package exporter
+
+import "fmt"
+
+// Device health states. A device starts out unknown until its first poll,
+// turns degraded on its first failed poll and down after
+// device_down_after consecutive failures, and only turns healthy again
+// after device_healthy_after consecutive successful polls.
+const (
+	healthUnknown  = "unknown"
+	healthHealthy  = "healthy"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+// healthStates are the values of the state label of
+// awair_device_health_state, which is 1 for a device's current state.
+var healthStates = []string{healthHealthy, healthDegraded, healthDown}
+
+// healthTransition is a change of a device's health state.
+type healthTransition struct {
+	From   string
+	To     string
+	Reason string
+}
+
+// nextHealth works out the health state after a poll, given the state
+// before it and the consecutive failures or successes including it.
+func nextHealth(state string, err error, failures, successes, downAfter, healthyAfter int) (string, string) {
+	if err != nil {
+		if failures >= downAfter {
+			if state == healthDown {
+				return state, ""
+			}
+			return healthDown, fmt.Sprintf("%d consecutive failed polls: %v", failures, err)
+		}
+		if state == healthDegraded || state == healthDown {
+			return state, ""
+		}
+		return healthDegraded, fmt.Sprintf("failed poll: %v", err)
+	}
+
+	if state == healthUnknown {
+		return healthHealthy, "first poll succeeded"
+	}
+	if successes >= healthyAfter {
+		if state == healthHealthy {
+			return state, ""
+		}
+		return healthHealthy, fmt.Sprintf("%d consecutive successful polls", successes)
+	}
+	if state == healthDown {
+		return healthDegraded, "successful poll"
+	}
+	return state, ""
+}
+
+// recordHealth advances the device's health state machine with a poll's
+// result and returns the transition it made, if any.
+func (device *Device) recordHealth(err error, downAfter, healthyAfter int) *healthTransition {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+
+	if err != nil {
+		device.successes = 0
+	} else {
+		device.successes++
+	}
+
+	from := device.health
+	if from == "" {
+		from = healthUnknown
+	}
+	to, reason := nextHealth(from, err, device.failures, device.successes, downAfter, healthyAfter)
+	if to == from {
+		return nil
+	}
+	device.health = to
+	return &healthTransition{From: from, To: to, Reason: reason}
+}
+
+// Health returns the device's health state.
+func (device *Device) Health() string {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	if device.health == "" {
+		return healthUnknown
+	}
+	return device.health
+}
+
+// updateHealth records a poll's result in the device's health state, and
+// logs and exports the transition if it made one.
+func (app *App) updateHealth(device *Device, err error) {
+	transition := device.recordHealth(err, app.DeviceDownAfter, app.DeviceHealthyAfter)
+	if transition == nil {
+		return
+	}
+
+	app.devicesLock.RLock()
+	if !device.removed {
+		for _, state := range healthStates {
+			value := 0.0
+			if state == transition.To {
+				value = 1
+			}
+			app.healthStateGauge.WithLabelValues(device.label, state).Set(value)
+		}
+	}
+	app.devicesLock.RUnlock()
+
+	fields := []interface{}{
+		"device", redactAddress(device.label),
+		"device_name", device.Name,
+		"from", transition.From,
+		"to", transition.To,
+		"reason", transition.Reason,
+	}
+	if transition.To == healthHealthy {
+		app.Logger.Infow("Awair device health changed", fields...)
+	} else {
+		app.Logger.Warnw("Awair device health changed", fields...)
+	}
+	if transition.To == healthDown {
+		app.holdThresholds(device)
+	}
+}
+
+// deleteHealthSeries removes a device's awair_device_health_state series.
+func (app *App) deleteHealthSeries(label string) {
+	for _, state := range healthStates {
+		app.healthStateGauge.DeleteLabelValues(label, state)
+	}
+}
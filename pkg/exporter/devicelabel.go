@@ -0,0 +1,67 @@
+package exporter
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Sources of the value of the device_address label that identifies a
+// device in its series, chosen with device_label_source.
+const (
+	DeviceLabelURL  = "url"
+	DeviceLabelHost = "host"
+	DeviceLabelName = "name"
+)
+
+// deviceLabel returns the device_address label of a device: its URL, the
+// host (and port, if any) of its URL, or its name. Cloud devices all share
+// the cloud API's host, so they're labelled by name instead of host.
+func (app *App) deviceLabel(name, address, source string) string {
+	switch app.DeviceLabelSource {
+	case DeviceLabelHost:
+		if source == deviceSourceCloud {
+			return name
+		}
+		if u, err := url.Parse(address); err == nil && u.Host != "" {
+			return u.Host
+		}
+	case DeviceLabelName:
+		return name
+	}
+	return address
+}
+
+// validateDeviceLabels checks device_label_source and that the devices
+// known at startup each get a device_address label of their own.
+func (app *App) validateDeviceLabels() []error {
+	switch app.DeviceLabelSource {
+	case DeviceLabelURL, DeviceLabelHost, DeviceLabelName:
+	default:
+		return []error{fmt.Errorf("device_label_source (%q): must be one of url, host, name", app.DeviceLabelSource)}
+	}
+
+	errs := []error{}
+	seen := map[string]string{}
+	check := func(name, address, source string) {
+		label := app.deviceLabel(name, address, source)
+		if other, ok := seen[label]; ok && other != address {
+			errs = append(errs, fmt.Errorf("device_label_source (%q): devices (%s) and (%s) would both be labelled (%s)", app.DeviceLabelSource, redactAddress(other), redactAddress(address), redactAddress(label)))
+			return
+		}
+		seen[label] = address
+	}
+	for _, address := range app.AwairAddresses {
+		check(deviceNameFromAddress(address), address, deviceSourceStatic)
+	}
+	for _, entry := range app.fileDevices {
+		name := entry.Name
+		if name == "" {
+			name = deviceNameFromAddress(entry.URL)
+		}
+		check(name, entry.URL, deviceSourceFile)
+	}
+	for _, entry := range app.cloudDevices {
+		check(entry.Name, entry.address(app.CloudAPIURL), deviceSourceCloud)
+	}
+	return errs
+}
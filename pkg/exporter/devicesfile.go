@@ -0,0 +1,168 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// deviceEntry is a device as listed in the devices file and accepted by
+// POST /api/v1/devices.
+type deviceEntry struct {
+	URL           string            `json:"url" yaml:"url"`
+	Name          string            `json:"name,omitempty" yaml:"name"`
+	Group         string            `json:"group,omitempty" yaml:"group"`
+	Labels        map[string]string `json:"labels,omitempty" yaml:"labels"`
+	FallbackURLs  []string          `json:"fallback_urls,omitempty" yaml:"fallback_urls"`
+	Headers       map[string]string `json:"headers,omitempty" yaml:"headers"`
+	BasicAuth     *deviceBasicAuth  `json:"basic_auth,omitempty" yaml:"basic_auth"`
+	TLSSkipVerify *bool             `json:"tls_skip_verify,omitempty" yaml:"tls_skip_verify"`
+	ClientCert    string            `json:"client_cert,omitempty" yaml:"client_cert"`
+	ClientKey     string            `json:"client_key,omitempty" yaml:"client_key"`
+}
+
+// validateDeviceEntry checks the settings of an entry besides its URL and
+// reads its basic auth password.
+func validateDeviceEntry(entry deviceEntry) error {
+	if err := validateFallbackURLs(entry.FallbackURLs); err != nil {
+		return err
+	}
+	if err := validateDeviceHeaders(entry.Headers); err != nil {
+		return err
+	}
+	if err := validateClientCert(entry.ClientCert, entry.ClientKey); err != nil {
+		return err
+	}
+	if entry.BasicAuth != nil {
+		if u, err := url.Parse(entry.URL); err == nil && u.User != nil {
+			return fmt.Errorf("basic_auth: can't be combined with credentials in the url")
+		}
+		return entry.BasicAuth.load()
+	}
+	return nil
+}
+
+// loadDevicesFile reads the JSON list of devices kept in devices_file. A
+// missing file is treated as empty so that persist_devices can create it.
+func (app *App) loadDevicesFile() error {
+	if app.DevicesFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(app.DevicesFile)
+	if os.IsNotExist(err) && app.PersistDevices {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("devices_file (%q): %w", app.DevicesFile, err)
+	}
+
+	entries := []deviceEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("devices_file (%q): %w", app.DevicesFile, err)
+	}
+	for i, entry := range entries {
+		if err := validateDeviceAddress(entry.URL); err != nil {
+			return fmt.Errorf("devices_file (%q): entry %d (%q): %w", app.DevicesFile, i, entry.URL, err)
+		}
+		if err := validateDeviceEntry(entry); err != nil {
+			return fmt.Errorf("devices_file (%q): entry %d (%q): %w", app.DevicesFile, i, entry.URL, err)
+		}
+	}
+
+	app.fileDevices = entries
+	return nil
+}
+
+// saveDevicesFile writes the devices added from the file or the API back to
+// devices_file, replacing it atomically so a crash can't leave it truncated.
+func (app *App) saveDevicesFile() error {
+	if !app.PersistDevices {
+		return nil
+	}
+
+	app.devicesFileLock.Lock()
+	defer app.devicesFileLock.Unlock()
+
+	entries := []deviceEntry{}
+	for _, device := range app.Devices() {
+		if device.Source != deviceSourceFile && device.Source != deviceSourceAPI {
+			continue
+		}
+		entry := deviceEntry{
+			URL:           device.Address,
+			Name:          device.Name,
+			Group:         device.Group,
+			Labels:        device.ownLabels,
+			FallbackURLs:  device.Fallbacks,
+			Headers:       deviceHeaderMap(device.Headers),
+			BasicAuth:     device.basicAuth,
+			TLSSkipVerify: device.tlsSkipVerify,
+		}
+		if device.clientCert != nil {
+			entry.ClientCert = device.clientCert.certFile
+			entry.ClientKey = device.clientCert.keyFile
+		}
+		entries = append(entries, entry)
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The file keeps the mode the operator gave it, rather than the 0600 of
+	// a temporary file
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(app.DevicesFile); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	dir := filepath.Dir(app.DevicesFile)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(app.DevicesFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// The data must be on disk before the rename is, or a crash can leave
+	// an empty file in place of the old one
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), app.DevicesFile); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory's entries to disk, so that a file renamed
+// into it survives a crash. Windows can't open a directory to sync it.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
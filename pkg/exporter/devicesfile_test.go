@@ -0,0 +1,59 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Saving devices_file keeps the mode the operator gave it.
+func TestSaveDevicesFileKeepsMode(t *testing.T) {
+	devicesFile := filepath.Join(t.TempDir(), "devices.json")
+	if err := ioutil.WriteFile(devicesFile, []byte(`[{"url": "http://bedroom/air-data/latest"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(devicesFile, 0640); err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, newFakeDeviceClient(), func(app *App) {
+		app.DevicesFile = devicesFile
+		app.PersistDevices = true
+	})
+
+	if err := app.saveDevicesFile(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(devicesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("mode after saving = %v, want -rw-r-----", info.Mode().Perm())
+	}
+	data, err := ioutil.ReadFile(devicesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "http://bedroom/air-data/latest") {
+		t.Errorf("saved devices file = %s, want the bedroom device", data)
+	}
+
+	// A file that went missing is written readable by all, as a new file is
+	if err := os.Remove(devicesFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.saveDevicesFile(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(devicesFile); err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("mode of a new devices file = %v, want -rw-r--r--", info.Mode().Perm())
+	}
+	if leftovers, _ := filepath.Glob(devicesFile + ".tmp*"); len(leftovers) > 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+}
@@ -0,0 +1,177 @@
+package exporter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// deviceTLSConfig returns the TLS settings of requests to https device
+// URLs. Their certificates are verified against device_ca_file if set, or
+// the system roots otherwise. skipVerify accepts any certificate the device
+// presents, such as a gateway's self-signed one, and clientCert, if set, is
+// presented to devices that ask for a client certificate.
+func (app *App) deviceTLSConfig(skipVerify bool, clientCert *certReloader) *tls.Config {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		RootCAs:            app.deviceCAs,
+		InsecureSkipVerify: skipVerify, //nolint:gosec // opted into with device_tls_skip_verify
+	}
+	if clientCert != nil {
+		config.GetClientCertificate = clientCert.GetClientCertificate
+	}
+	return config
+}
+
+// validateClientCert checks the client certificate of a device entry.
+func validateClientCert(certFile, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("client_cert and client_key must be set together")
+	}
+	if certFile != "" {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return fmt.Errorf("client_cert: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadDeviceClientCert loads the client certificate of a device entry, if
+// it has one, and has it reloaded on SIGHUP along with the others.
+func (app *App) loadDeviceClientCert(name, label string, entry deviceEntry) *certReloader {
+	if entry.ClientCert == "" {
+		return nil
+	}
+	clientCert, err := newCertReloader(entry.ClientCert, entry.ClientKey)
+	if err != nil {
+		app.Logger.Errorw("Failed to load client certificate of Awair device, polling it without one", "device", redactAddress(label), "device_name", name, "error", err.Error())
+		return nil
+	}
+	app.warnExpiredCert(clientCert, "device_name", name)
+	app.deviceCertsOnce.Do(app.reloadDeviceCertsOnSIGHUP)
+	return clientCert
+}
+
+// newDeviceHTTPClient builds a client of the device's own if its TLS
+// settings differ from the device_tls_skip_verify and device_client_cert
+// flags, so that one insecure device doesn't weaken the client the others
+// share. It returns nil otherwise.
+func (app *App) newDeviceHTTPClient(entry deviceEntry, clientCert *certReloader) *http.Client {
+	skipVerify := app.DeviceTLSSkipVerify
+	if entry.TLSSkipVerify != nil {
+		skipVerify = *entry.TLSSkipVerify
+	}
+	if skipVerify == app.DeviceTLSSkipVerify && clientCert == nil {
+		return nil
+	}
+	if clientCert == nil {
+		clientCert = app.deviceClientCert
+	}
+	return app.buildHTTPClient(app.deviceTLSConfig(skipVerify, clientCert))
+}
+
+// deviceHTTPClient returns the client requests to the device polled through
+// address are sent with.
+func (app *App) deviceHTTPClient(address string) *http.Client {
+	if device, ok := app.deviceForEndpoint(address); ok && device.httpClient != nil {
+		return device.httpClient
+	}
+	return app.httpClient
+}
+
+// reloadDeviceCertsOnSIGHUP re-reads the client certificates presented to
+// devices on every SIGHUP, so short-lived certificates are picked up
+// without a restart.
+func (app *App) reloadDeviceCertsOnSIGHUP() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		for range hangups {
+			app.reloadDeviceCerts()
+		}
+	}()
+}
+
+// reloadDeviceCerts re-reads device_client_cert and the client certificates
+// of the devices, keeping the previous certificate of any that can't be
+// loaded. Idle connections are closed so that the next poll of each device
+// handshakes with the new certificate.
+func (app *App) reloadDeviceCerts() {
+	// Polling groups share their parent's device_client_cert, which the
+	// parent reloads
+	if app.DeviceClientCert != "" && app.deviceClientCert != nil {
+		if err := app.deviceClientCert.reload(); err != nil {
+			app.Logger.Errorf("Failed to reload device client certificate, keeping the previous one: %+v", err)
+		} else {
+			app.Logger.Infof("Reloaded device client certificate from (%+v)", app.DeviceClientCert)
+			app.warnExpiredCert(app.deviceClientCert)
+		}
+		if app.httpClient != nil {
+			app.httpClient.CloseIdleConnections()
+		}
+	}
+
+	for _, device := range app.Devices() {
+		if device.clientCert == nil {
+			continue
+		}
+		if err := device.clientCert.reload(); err != nil {
+			app.Logger.Errorf("Failed to reload client certificate of Awair device (%+v), keeping the previous one: %+v", device.Name, err)
+			continue
+		}
+		app.Logger.Infof("Reloaded client certificate of Awair device (%+v) from (%+v)", device.Name, device.clientCert.certFile)
+		app.warnExpiredCert(device.clientCert, "device_name", device.Name)
+		device.httpClient.CloseIdleConnections()
+	}
+}
+
+// warnExpiredCert logs if a client certificate has expired or isn't valid
+// yet, since devices will reject every handshake with it.
+func (app *App) warnExpiredCert(clientCert *certReloader, fields ...interface{}) {
+	cert, _ := clientCert.GetClientCertificate(nil)
+	if cert == nil || len(cert.Certificate) == 0 {
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+		fields = append(fields, "cert_file", clientCert.certFile, "not_before", leaf.NotBefore, "not_after", leaf.NotAfter)
+		app.Logger.Warnw("Client certificate for devices isn't valid at this time; devices will reject it", fields...)
+	}
+}
+
+// tlsErrorDetail explains why a TLS handshake with a device failed, or
+// returns "" if err isn't a TLS failure.
+func tlsErrorDetail(err error) string {
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var recordErr tls.RecordHeaderError
+
+	switch {
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return "the device's certificate has expired or isn't valid yet"
+	case errors.As(err, &invalidErr):
+		return "the device's certificate is invalid"
+	case errors.As(err, &authorityErr):
+		return "the device's certificate is signed by an unknown CA, see device_ca_file"
+	case errors.As(err, &hostnameErr):
+		return "the device's certificate isn't valid for its host"
+	case errors.As(err, &recordErr):
+		return "the device didn't answer with TLS"
+	case strings.Contains(err.Error(), "remote error: tls: "):
+		return "the device rejected the handshake, check that the client certificate is set, valid and signed by a CA it trusts"
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package exporter
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dogstatsdMetricNames names each sensor's metric after the matching
+// Prometheus gauge, e.g. awair.co2_ppm.
+var dogstatsdMetricNames = map[string]string{
+	"temp":  "temp_c",
+	"humid": "relative_humidity",
+	"co2":   "co2_ppm",
+	"voc":   "voc_ppb",
+	"pm25":  "pm25_ug_m3",
+	"score": "score",
+}
+
+// parseDogstatsdAddress accepts udp://host:8125, a bare host:port, or
+// unix:///path/to/dsd.socket for the agent's unix domain socket.
+func parseDogstatsdAddress(address string) (string, string, error) {
+	if strings.HasPrefix(address, "unix://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return "", "", err
+		}
+		if u.Path == "" {
+			return "", "", fmt.Errorf("missing socket path")
+		}
+		return "unixgram", u.Path, nil
+	}
+
+	network, hostPort, err := parseStatsdAddress(address)
+	if err == nil && network != "udp" {
+		err = fmt.Errorf("scheme must be udp or unix")
+	}
+	return network, hostPort, err
+}
+
+var dogstatsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", " ", "_", "\n", "_")
+
+// newDogstatsdOutput sends readings in the DogStatsD dialect, with the device
+// name, its labels and the global tags as tags rather than in the name.
+func (app *App) newDogstatsdOutput() *statsdOutput {
+	network, address, _ := parseDogstatsdAddress(app.DogstatsdAddress)
+	prefix := app.DogstatsdPrefix
+
+	globalTags := []string{}
+	for _, tag := range app.DogstatsdTags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			globalTags = append(globalTags, dogstatsdTagEscaper.Replace(tag))
+		}
+	}
+	// Lets the agent attribute metrics to this container when origin
+	// detection over the socket isn't available
+	if entityID := os.Getenv("DD_ENTITY_ID"); entityID != "" {
+		globalTags = append(globalTags, "dd.internal.entity_id:"+dogstatsdTagEscaper.Replace(entityID))
+	}
+
+	out := app.newStatsdSink("dogstatsd", network, address)
+	out.format = func(device *Device, sensor string, value float64, _ time.Time) string {
+		tags := []string{"device:" + dogstatsdTagEscaper.Replace(device.Name)}
+		for key, label := range device.Labels {
+			tags = append(tags, dogstatsdTagEscaper.Replace(key)+":"+dogstatsdTagEscaper.Replace(label))
+		}
+		sort.Strings(tags[1:])
+		tags = append(tags, globalTags...)
+
+		return fmt.Sprintf("%s.%s:%s|g|#%s", prefix, dogstatsdMetricNames[sensor], strconv.FormatFloat(value, 'f', -1, 64), strings.Join(tags, ","))
+	}
+
+	go out.run()
+	return out
+}
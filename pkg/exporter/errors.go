@@ -0,0 +1,240 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair"
+)
+
+// Reasons a poll failed, as logged in the reason field and counted in
+// awair_device_poll_errors_total.
+const (
+	pollReasonRequest   = "request"
+	pollReasonProxy     = "proxy"
+	pollReasonTLS       = "tls"
+	pollReasonTimeout   = "timeout"
+	pollReasonRead      = "read"
+	pollReasonStatus    = "status"
+	pollReasonThrottled = "throttled"
+	pollReasonDecode    = "decode"
+	pollReasonQuota     = "quota_exhausted"
+	pollReasonPanic     = "panic"
+)
+
+var pollReasons = []string{pollReasonRequest, pollReasonProxy, pollReasonTLS, pollReasonTimeout, pollReasonRead, pollReasonStatus, pollReasonThrottled, pollReasonDecode, pollReasonQuota, pollReasonPanic}
+
+// pollReason returns the reason a poll failed.
+func pollReason(err error) string {
+	var devErr *deviceError
+	if errors.As(err, &devErr) {
+		return devErr.Reason
+	}
+	return pollReasonRequest
+}
+
+// deviceError is a failed poll along with why it failed and the HTTP status
+// the device answered with, if it got that far.
+type deviceError struct {
+	Reason     string
+	StatusCode int
+	Err        error
+}
+
+func (e *deviceError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *deviceError) Unwrap() error {
+	return e.Err
+}
+
+// requestError classifies an error returned by the HTTP client. Failing to
+// reach a proxy is told apart from failing to reach the device, even when
+// the proxy timed out, and a failed TLS handshake is explained.
+func requestError(err error) *deviceError {
+	reason := pollReasonRequest
+	var netErr net.Error
+	switch {
+	case isProxyError(err):
+		reason = pollReasonProxy
+	case tlsErrorDetail(err) != "":
+		reason = pollReasonTLS
+		err = fmt.Errorf("%w (%s)", err, tlsErrorDetail(err))
+	case errors.As(err, &netErr) && netErr.Timeout():
+		reason = pollReasonTimeout
+	}
+	return &deviceError{Reason: reason, Err: err}
+}
+
+// clientError classifies an error returned by the Awair client.
+func (app *App) clientError(err error) *deviceError {
+	var statusErr *awair.StatusError
+	var readErr *awair.ReadError
+	var decodeErr *awair.DecodeError
+
+	switch {
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusProxyAuthRequired:
+		// Only a proxy answers 407, refusing a request sent through it
+		// without a tunnel
+		return &deviceError{Reason: pollReasonProxy, StatusCode: statusErr.StatusCode, Err: err}
+	case errors.As(err, &statusErr) && isThrottled(statusErr):
+		return &deviceError{Reason: pollReasonThrottled, StatusCode: statusErr.StatusCode, Err: err}
+	case errors.As(err, &statusErr):
+		return &deviceError{Reason: pollReasonStatus, StatusCode: statusErr.StatusCode, Err: err}
+	case errors.As(err, &readErr):
+		return &deviceError{Reason: pollReasonRead, StatusCode: readErr.StatusCode, Err: err}
+	case errors.As(err, &decodeErr):
+		return &deviceError{Reason: pollReasonDecode, StatusCode: decodeErr.StatusCode, Err: err}
+	}
+
+	if app.sourceIP != nil {
+		err = fmt.Errorf("%w (bound to source address %s)", err, app.sourceIP)
+	}
+	return requestError(err)
+}
+
+type pollError struct {
+	Time   time.Time `json:"time"`
+	Device string    `json:"device"`
+	Error  string    `json:"error"`
+}
+
+// errorRing keeps the most recent poll errors, overwriting the oldest once
+// it's full.
+type errorRing struct {
+	lock    sync.Mutex
+	entries []pollError
+	next    int
+	full    bool
+	dropped uint64
+}
+
+func newErrorRing(size int) *errorRing {
+	return &errorRing{entries: make([]pollError, size)}
+}
+
+func (ring *errorRing) add(entry pollError) {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	if len(ring.entries) == 0 {
+		ring.dropped++
+		return
+	}
+	if ring.full {
+		ring.dropped++
+	}
+	ring.entries[ring.next] = entry
+	ring.next = (ring.next + 1) % len(ring.entries)
+	if ring.next == 0 {
+		ring.full = true
+	}
+}
+
+// snapshot returns the buffered errors oldest first and the number of errors
+// that have been overwritten.
+func (ring *errorRing) snapshot() ([]pollError, uint64) {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	entries := []pollError{}
+	if ring.full {
+		entries = append(entries, ring.entries[ring.next:]...)
+	}
+	entries = append(entries, ring.entries[:ring.next]...)
+	return entries, ring.dropped
+}
+
+type debugErrorsResponse struct {
+	Size    int         `json:"size"`
+	Dropped uint64      `json:"dropped"`
+	Errors  []pollError `json:"errors"`
+}
+
+func (app *App) recordError(device *Device, err error) {
+	app.recentErrors.add(pollError{
+		Time:   time.Now(),
+		Device: device.Name,
+		Error:  boundedError(err),
+	})
+
+	app.devicesLock.RLock()
+	defer app.devicesLock.RUnlock()
+	if !device.removed {
+		app.pollErrorsCounter.WithLabelValues(device.label, pollReason(err)).Inc()
+	}
+}
+
+// pollLogFields are the structured fields logged with every poll result.
+func pollLogFields(device *Device, duration time.Duration, err error) []interface{} {
+	fields := []interface{}{
+		"device", redactAddress(device.label),
+		"device_name", device.Name,
+		"duration_ms", duration.Milliseconds(),
+	}
+	var devErr *deviceError
+	if errors.As(err, &devErr) {
+		fields = append(fields, "reason", devErr.Reason)
+		if devErr.StatusCode != 0 {
+			fields = append(fields, "status_code", devErr.StatusCode)
+		}
+	}
+	if err != nil {
+		fields = append(fields, "error", err.Error())
+	}
+	return fields
+}
+
+// logPollResult logs the first failed poll of a device, then a summary at
+// most every device_error_log_interval while it keeps failing, and its
+// recovery, instead of an identical line every poll.
+func (app *App) logPollResult(device *Device, duration time.Duration, err error) {
+	now := time.Now()
+
+	device.stateLock.Lock()
+	failingSince := device.failingSince
+	first := err != nil && failingSince.IsZero()
+	summary := err != nil && !first && now.Sub(device.errorLoggedAt) >= app.DeviceErrorLogInterval
+	recovered := err == nil && !failingSince.IsZero()
+	if err != nil {
+		device.failingErrors++
+	}
+	failingErrors := device.failingErrors
+	switch {
+	case first:
+		device.failingSince = now
+		device.errorLoggedAt = now
+	case summary:
+		device.errorLoggedAt = now
+	case recovered:
+		device.failingSince = time.Time{}
+		device.failingErrors = 0
+	}
+	device.stateLock.Unlock()
+
+	fields := pollLogFields(device, duration, err)
+	switch {
+	case first:
+		app.Logger.Errorw("Failed to poll Awair device", fields...)
+	case summary:
+		fields = append(fields, "errors", failingErrors, "failing_since", failingSince)
+		app.Logger.Errorw("Awair device still failing", fields...)
+	case recovered:
+		fields = append(fields, "errors", failingErrors, "failing_since", failingSince)
+		app.Logger.Infow("Awair device recovered", fields...)
+	}
+}
+
+func (app *App) debugErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	entries, dropped := app.recentErrors.snapshot()
+	writeJSON(w, http.StatusOK, debugErrorsResponse{
+		Size:    len(app.recentErrors.entries),
+		Dropped: dropped,
+		Errors:  entries,
+	})
+}
@@ -0,0 +1,88 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newBlockingDevice serves a device that never answers, closing started
+// when a request arrives and aborted once the client gives up on it.
+func newBlockingDevice(t *testing.T) (server *httptest.Server, started, aborted chan struct{}) {
+	t.Helper()
+	started = make(chan struct{})
+	aborted = make(chan struct{})
+	var once sync.Once
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(started) })
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	t.Cleanup(server.Close)
+	return server, started, aborted
+}
+
+func TestCancelAbortsInflightPoll(t *testing.T) {
+	server, started, aborted := newBlockingDevice(t)
+	address := server.URL + "/air-data/latest"
+	app := newTestApp(t, nil, func(app *App) {
+		app.httpClient = server.Client()
+		app.DeviceTimeout = time.Minute
+	}, address)
+	device, _ := app.LookupDevice(address)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	call := app.pollDevice(ctx, device)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("poll never reached the device")
+	}
+	cancel()
+
+	select {
+	case <-call.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("poll still running after its context was cancelled")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request still open on the device after its context was cancelled")
+	}
+	if !errors.Is(call.err, context.Canceled) {
+		t.Errorf("poll error = %v, want context.Canceled", call.err)
+	}
+
+	// Abandoning a poll isn't a failure of the device
+	for _, reason := range pollReasons {
+		labels := map[string]string{"device_address": address, "reason": reason}
+		if got, ok := metricValue(t, app, "awair_device_poll_errors_total", labels); ok && got != 0 {
+			t.Errorf("awair_device_poll_errors_total{reason=%q} = %v, want 0", reason, got)
+		}
+	}
+	if status := device.Status(); status.Failures != 0 || status.LastError != "" {
+		t.Errorf("status = %+v, want no failure recorded", status)
+	}
+}
+
+// Unlike a cancelled poll, one that runs out of device_timeout is a failure.
+func TestDeviceTimeoutCountsAsTimeout(t *testing.T) {
+	server, _, _ := newBlockingDevice(t)
+	address := server.URL + "/air-data/latest"
+	app := newTestApp(t, nil, func(app *App) {
+		app.httpClient = server.Client()
+		app.DeviceTimeout = 50 * time.Millisecond
+	}, address)
+
+	pollOnce(app)
+
+	labels := map[string]string{"device_address": address, "reason": pollReasonTimeout}
+	if got, _ := metricValue(t, app, "awair_device_poll_errors_total", labels); got != 1 {
+		t.Errorf("awair_device_poll_errors_total{reason=%q} = %v, want 1", pollReasonTimeout, got)
+	}
+}
@@ -0,0 +1,113 @@
+package exporter
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type expvarDevice struct {
+	Address     string            `json:"address"`
+	Source      string            `json:"source"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Up          bool              `json:"up"`
+	Paused      bool              `json:"paused"`
+	Polls       int               `json:"polls"`
+	PollErrors  int               `json:"poll_errors"`
+	Failures    int               `json:"consecutive_failures"`
+	LastPoll    time.Time         `json:"last_poll"`
+	LastSuccess time.Time         `json:"last_success"`
+	LastError   string            `json:"last_error,omitempty"`
+	LastReading *AwairStats       `json:"last_reading"`
+}
+
+type expvarConfig struct {
+	Version         string `json:"version"`
+	PollFrequency   string `json:"poll_frequency"`
+	DeviceTimeout   string `json:"device_timeout"`
+	TelemetryPath   string `json:"telemetry_path"`
+	DiscoverMDNS    bool   `json:"discover_mdns"`
+	DevicesFile     string `json:"devices_file,omitempty"`
+	Outputs         int    `json:"outputs"`
+	AdminEndpoints  bool   `json:"admin_endpoints_enabled"`
+	AuthEnabled     bool   `json:"auth_enabled"`
+	HistoryDatabase string `json:"history_db,omitempty"`
+}
+
+type expvarState struct {
+	Config  expvarConfig            `json:"config"`
+	Devices map[string]expvarDevice `json:"devices"`
+}
+
+// publishExpvar publishes the exporter's state under the "awair" expvar.
+// It must only be called once per process.
+func (app *App) publishExpvar() {
+	// expvar names are global, so only the first exporter in a process is
+	// published
+	if expvar.Get("awair") != nil {
+		return
+	}
+	expvar.Publish("awair", expvar.Func(func() interface{} { return app.expvarState() }))
+}
+
+func (app *App) expvarState() expvarState {
+	app.outputsLock.RLock()
+	outputs := len(app.outputs)
+	app.outputsLock.RUnlock()
+
+	state := expvarState{
+		Config: expvarConfig{
+			Version:         exporterVersion(),
+			PollFrequency:   app.TimeBetweenChecks.String(),
+			DeviceTimeout:   app.DeviceTimeout.String(),
+			TelemetryPath:   app.TelemetryPath,
+			DiscoverMDNS:    app.DiscoverMDNS,
+			DevicesFile:     app.DevicesFile,
+			Outputs:         outputs,
+			AdminEndpoints:  len(app.adminToken) > 0,
+			AuthEnabled:     app.AuthUsername != "",
+			HistoryDatabase: app.HistoryDB,
+		},
+		Devices: map[string]expvarDevice{},
+	}
+
+	for _, device := range app.Devices() {
+		device.stateLock.Lock()
+		state.Devices[device.Name] = expvarDevice{
+			Address:     redactAddress(device.Address),
+			Source:      device.Source,
+			Labels:      device.Labels,
+			Up:          device.up,
+			Paused:      device.paused,
+			Polls:       device.polls,
+			PollErrors:  device.pollErrors,
+			Failures:    device.failures,
+			LastPoll:    device.lastPoll,
+			LastSuccess: device.lastSuccess,
+			LastError:   device.lastError,
+			LastReading: device.lastReading,
+		}
+		device.stateLock.Unlock()
+	}
+	return state
+}
+
+// expvarHandler serves /debug/vars like expvar.Handler, minus the "cmdline"
+// var: device URLs on the command line may carry passwords.
+func expvarHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
@@ -0,0 +1,57 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// FailFast values, which decide how many devices must fail their startup
+// poll for Run to give up.
+const (
+	FailFastAny = "any"
+	FailFastAll = "all"
+)
+
+// checkReachability polls every configured device once, in parallel and
+// each within DeviceTimeout, and returns an error naming the devices that
+// failed if FailFast deems that fatal. The polls count as the devices'
+// first, so their series are filled in straight away.
+func (app *App) checkReachability(ctx context.Context) error {
+	type startupPoll struct {
+		device *Device
+		call   *pollCall
+	}
+
+	apps := []*App{app}
+	for _, group := range app.groups {
+		apps = append(apps, group.app)
+	}
+
+	polls := []startupPoll{}
+	for _, a := range apps {
+		for _, device := range a.Devices() {
+			if device.isPaused() {
+				continue
+			}
+			polls = append(polls, startupPoll{device: device, call: a.pollDevice(ctx, device)})
+		}
+	}
+
+	failed := []string{}
+	for _, poll := range polls {
+		<-poll.call.done
+		if poll.call.err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", redactAddress(poll.device.Address), poll.call.err))
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	if app.FailFast == FailFastAll && len(failed) < len(polls) {
+		app.Logger.Warnw("Some devices failed their startup poll", "failed", len(failed), "devices", len(polls))
+		return nil
+	}
+	return fmt.Errorf("%d of %d devices failed their startup poll: %s", len(failed), len(polls), strings.Join(failed, ", "))
+}
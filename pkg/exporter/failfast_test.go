@@ -0,0 +1,51 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// When fail_fast stops the exporter, the outputs are still closed, flushing
+// the readings of the devices that answered.
+func TestFailFastClosesOutputs(t *testing.T) {
+	const failing = "http://bedroom/air-data/latest"
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Score: 92}, nil)
+	client.set(failing, AwairStats{}, errors.New("offline"))
+
+	csvPath := filepath.Join(t.TempDir(), "readings.csv")
+	app, err := NewApp(
+		WithRegisterer(prometheus.NewRegistry(), nil),
+		WithHTTPClient(&http.Client{Transport: offlineTransport{}}),
+		WithDeviceClient(client),
+		WithAddresses(testAddress, failing),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.FailFast = FailFastAny
+	app.CSVOutput = csvPath
+	app.ListenPort = 0
+	if errs := app.Configure(); len(errs) > 0 {
+		t.Fatalf("Configure: %v", errs)
+	}
+
+	if err := app.Run(context.Background()); err == nil {
+		t.Fatal("Run succeeded with a device failing its startup poll")
+	}
+	data, err := ioutil.ReadFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), ",living-room,") {
+		t.Errorf("CSV output = %q, want the reading of the device that answered", data)
+	}
+}
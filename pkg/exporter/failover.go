@@ -0,0 +1,140 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// validateFallbackURLs checks the fallback URLs of a device entry.
+func validateFallbackURLs(fallbacks []string) error {
+	for i, fallback := range fallbacks {
+		if err := validateDeviceAddress(fallback); err != nil {
+			return fmt.Errorf("fallback_urls[%d] (%q): %w", i, fallback, err)
+		}
+	}
+	return nil
+}
+
+// redactAddresses redacts a list of device URLs for display.
+func redactAddresses(addresses []string) []string {
+	if len(addresses) == 0 {
+		return nil
+	}
+	redacted := make([]string, len(addresses))
+	for i, address := range addresses {
+		redacted[i] = redactAddress(address)
+	}
+	return redacted
+}
+
+// endpoints lists the URLs a device is polled through in the order they're
+// tried: its address, then its fallback URLs.
+func (device *Device) endpoints() []string {
+	return append([]string{device.Address}, device.Fallbacks...)
+}
+
+// activeEndpoint is the URL that served the device's last reading, or its
+// address if it hasn't been read yet.
+func (device *Device) activeEndpoint() string {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	if device.endpoint == "" {
+		return device.Address
+	}
+	return device.endpoint
+}
+
+// fetchLocalData reads the latest reading from a device's local API, trying
+// its fallback URLs in turn if its address fails, each within
+// DeviceTimeout. If every URL fails the address's error is returned, and
+// the device is left alone for as long as any of them asked with
+// Retry-After.
+func (app *App) fetchLocalData(ctx context.Context, device *Device) (AwairStats, error) {
+	var firstErr error
+	var wait time.Duration
+	for _, endpoint := range device.endpoints() {
+		fetchCtx, cancel := context.WithTimeout(ctx, app.DeviceTimeout)
+		awairStats, err := app.deviceClient.Fetch(fetchCtx, endpoint)
+		cancel()
+		if err == nil {
+			app.recordEndpoint(device, endpoint)
+			device.clearThrottle()
+			return awairStats, nil
+		}
+
+		err = app.clientError(err)
+		if firstErr == nil {
+			firstErr = err
+		}
+		if delay := app.throttleDelay(device, err); delay > wait {
+			wait = delay
+		}
+		if len(device.Fallbacks) > 0 {
+			app.Logger.Debugw("Failed to poll Awair device endpoint", "device_name", device.Name, "endpoint", redactAddress(endpoint), "error", err.Error())
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(device.Fallbacks) > 0 {
+		firstErr = fmt.Errorf("%w (fallback URLs failed too)", firstErr)
+	}
+	if wait > 0 {
+		firstErr = app.throttle(device, wait, firstErr)
+	} else {
+		device.clearThrottle()
+	}
+	return AwairStats{}, firstErr
+}
+
+// recordEndpoint notes which URL served a device's reading, logging when a
+// device with fallback URLs switches between them.
+func (app *App) recordEndpoint(device *Device, endpoint string) {
+	device.stateLock.Lock()
+	previous := device.endpoint
+	device.endpoint = endpoint
+	device.stateLock.Unlock()
+
+	if previous == endpoint || len(device.Fallbacks) == 0 {
+		return
+	}
+
+	app.devicesLock.RLock()
+	if !device.removed {
+		if previous != "" {
+			app.endpointInfoGauge.DeleteLabelValues(device.label, redactAddress(previous))
+		}
+		app.endpointInfoGauge.WithLabelValues(device.label, redactAddress(endpoint)).Set(1)
+	}
+	app.devicesLock.RUnlock()
+
+	fields := []interface{}{
+		"device", redactAddress(device.label),
+		"device_name", device.Name,
+		"endpoint", redactAddress(endpoint),
+	}
+	switch {
+	case endpoint != device.Address:
+		app.Logger.Warnw("Awair device failed over to a fallback URL", fields...)
+	case previous != "":
+		app.Logger.Infow("Awair device is reachable through its address again", fields...)
+	}
+}
+
+// deviceForEndpoint finds the device polled through a URL, which may be one
+// of its fallback URLs.
+func (app *App) deviceForEndpoint(endpoint string) (*Device, bool) {
+	if device, ok := app.LookupDevice(endpoint); ok {
+		return device, true
+	}
+	for _, device := range app.Devices() {
+		for _, fallback := range device.Fallbacks {
+			if fallback == endpoint {
+				return device, true
+			}
+		}
+	}
+	return nil, false
+}
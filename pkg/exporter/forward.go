@@ -0,0 +1,162 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// forwardQueueSize is the number of cycles' batches held while forward_url
+// is slow or unavailable before new batches are dropped.
+const forwardQueueSize = 16
+
+// forwardOutput POSTs each cycle's readings to forward_url as a JSON array.
+type forwardOutput struct {
+	app *App
+
+	lock  sync.Mutex
+	batch []jsonReading
+
+	queue chan []jsonReading
+	done  chan struct{}
+
+	readingsForwarded prometheus.Counter
+	readingsDropped   prometheus.Counter
+	postErrors        prometheus.Counter
+}
+
+func (app *App) newForwardOutput() *forwardOutput {
+	factory := promauto.With(app.Registerer)
+	out := &forwardOutput{
+		app:   app,
+		queue: make(chan []jsonReading, forwardQueueSize),
+		done:  make(chan struct{}),
+		readingsForwarded: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "forward",
+			Name:      "readings_forwarded_total",
+			Help:      "Readings POSTed to forward_url",
+		}),
+		readingsDropped: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "forward",
+			Name:      "readings_dropped_total",
+			Help:      "Readings given up on after failed POSTs or a full queue",
+		}),
+		postErrors: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "forward",
+			Name:      "post_errors_total",
+			Help:      "Failed POSTs to forward_url, including ones later retried",
+		}),
+	}
+
+	go out.run()
+	return out
+}
+
+func (out *forwardOutput) Record(device *Device, stats AwairStats) {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	out.batch = append(out.batch, jsonReading{Device: device.Name, Labels: device.Labels, AwairStats: stats})
+}
+
+func (out *forwardOutput) Flush() {
+	out.lock.Lock()
+	batch := out.batch
+	out.batch = nil
+	out.lock.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	select {
+	case out.queue <- batch:
+	default:
+		out.readingsDropped.Add(float64(len(batch)))
+		out.app.Logger.Warnf("Dropped (%+v) forwarded readings, the queue is full", len(batch))
+	}
+}
+
+func (out *forwardOutput) Close(ctx context.Context) {
+	out.Flush()
+	close(out.queue)
+
+	select {
+	case <-out.done:
+	case <-ctx.Done():
+		out.app.Logger.Warnf("Gave up on queued forwarded readings at shutdown")
+	}
+}
+
+func (out *forwardOutput) run() {
+	defer close(out.done)
+	for batch := range out.queue {
+		if err := out.send(batch); err != nil {
+			out.readingsDropped.Add(float64(len(batch)))
+			out.app.Logger.Errorf("Failed to forward (%+v) readings to (%+v): %+v", len(batch), out.app.ForwardURL, err)
+			continue
+		}
+		out.readingsForwarded.Add(float64(len(batch)))
+	}
+}
+
+// send POSTs a batch, retrying network errors, 429s and 5xx responses.
+func (out *forwardOutput) send(batch []jsonReading) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	backoff := outputRetryBackoff
+
+	for attempt := 1; attempt <= outputMaxAttempts; attempt++ {
+		var resp *http.Response
+		resp, err = out.post(body)
+		if err == nil {
+			return nil
+		}
+		out.postErrors.Inc()
+
+		if resp != nil && !retryableStatus(resp.StatusCode) {
+			return err
+		}
+		if attempt < outputMaxAttempts {
+			time.Sleep(retryAfter(resp, backoff))
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+func (out *forwardOutput) post(body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, out.app.ForwardURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range out.app.forwardHeaders {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := out.app.pushClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return resp, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return resp, nil
+}
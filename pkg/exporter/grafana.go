@@ -0,0 +1,155 @@
+package exporter
+
+import (
+	"net/http"
+)
+
+// Units of the dashboard's panels, in Grafana's unit IDs.
+var grafanaUnits = map[string]string{
+	"temp":  "celsius",
+	"humid": "percent",
+	"co2":   "ppm",
+	"voc":   "ppb",
+	"pm25":  "conµgm3",
+	"score": "none",
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaTarget struct {
+	Datasource   grafanaDatasource `json:"datasource"`
+	Expr         string            `json:"expr"`
+	LegendFormat string            `json:"legendFormat"`
+	RefID        string            `json:"refId"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Datasource  grafanaDatasource      `json:"datasource"`
+	GridPos     grafanaGridPos         `json:"gridPos"`
+	FieldConfig map[string]interface{} `json:"fieldConfig"`
+	Targets     []grafanaTarget        `json:"targets"`
+}
+
+type grafanaVariable struct {
+	Name       string             `json:"name"`
+	Label      string             `json:"label"`
+	Type       string             `json:"type"`
+	Query      interface{}        `json:"query"`
+	Datasource *grafanaDatasource `json:"datasource,omitempty"`
+	Multi      bool               `json:"multi,omitempty"`
+	IncludeAll bool               `json:"includeAll,omitempty"`
+	Refresh    int                `json:"refresh,omitempty"`
+}
+
+type grafanaDashboard struct {
+	UID           string                       `json:"uid"`
+	Title         string                       `json:"title"`
+	Tags          []string                     `json:"tags"`
+	Timezone      string                       `json:"timezone"`
+	SchemaVersion int                          `json:"schemaVersion"`
+	Refresh       string                       `json:"refresh"`
+	Time          map[string]string            `json:"time"`
+	Templating    map[string][]grafanaVariable `json:"templating"`
+	Panels        []grafanaPanel               `json:"panels"`
+}
+
+// grafanaDashboard builds a dashboard with a time series panel per sensor
+// and a device state panel, all filtered by a device_name variable. The
+// sensor series take device_name from awair_device_up, the only series that
+// carries it whatever metadata_labels are. Without a datasource UID, the
+// dashboard asks for a Prometheus datasource through a variable instead.
+func (app *App) grafanaDashboard(datasourceUID string) grafanaDashboard {
+	datasource := grafanaDatasource{Type: "prometheus", UID: "${datasource}"}
+	variables := []grafanaVariable{}
+	if datasourceUID != "" {
+		datasource.UID = datasourceUID
+	} else {
+		variables = append(variables, grafanaVariable{Name: "datasource", Label: "Datasource", Type: "datasource", Query: "prometheus"})
+	}
+	variables = append(variables, grafanaVariable{
+		Name:       "device_name",
+		Label:      "Device",
+		Type:       "query",
+		Query:      map[string]string{"query": "label_values(awair_device_up, device_name)", "refId": "devices"},
+		Datasource: &datasource,
+		Multi:      true,
+		IncludeAll: true,
+		Refresh:    2,
+	})
+
+	names := `group by (device_address, device_name) (awair_device_up{device_name=~"$device_name"})`
+	panels := []grafanaPanel{}
+	for i, sensor := range sensorReadings {
+		panels = append(panels, grafanaPanel{
+			ID:         i + 1,
+			Type:       "timeseries",
+			Title:      sensor.Name,
+			Datasource: datasource,
+			GridPos:    grafanaGridPos{H: 8, W: 12, X: (i % 2) * 12, Y: (i / 2) * 8},
+			FieldConfig: map[string]interface{}{
+				"defaults":  map[string]string{"unit": grafanaUnits[sensor.Sensor]},
+				"overrides": []interface{}{},
+			},
+			Targets: []grafanaTarget{{
+				Datasource:   datasource,
+				Expr:         app.sensorSelector(sensor) + " * on (device_address) group_left (device_name) " + names,
+				LegendFormat: "{{device_name}}",
+				RefID:        "A",
+			}},
+		})
+	}
+	panels = append(panels, grafanaPanel{
+		ID:         len(sensorReadings) + 1,
+		Type:       "state-timeline",
+		Title:      "Device up",
+		Datasource: datasource,
+		GridPos:    grafanaGridPos{H: 6, W: 24, X: 0, Y: (len(sensorReadings) + 1) / 2 * 8},
+		FieldConfig: map[string]interface{}{
+			"defaults": map[string]interface{}{
+				"mappings": []interface{}{map[string]interface{}{
+					"type": "value",
+					"options": map[string]interface{}{
+						"0": map[string]string{"text": "down", "color": "red"},
+						"1": map[string]string{"text": "up", "color": "green"},
+					},
+				}},
+			},
+			"overrides": []interface{}{},
+		},
+		Targets: []grafanaTarget{{
+			Datasource:   datasource,
+			Expr:         `awair_device_up{device_name=~"$device_name"}`,
+			LegendFormat: "{{device_name}}",
+			RefID:        "A",
+		}},
+	})
+
+	return grafanaDashboard{
+		UID:           "awair-local-prom-exporter",
+		Title:         "Awair",
+		Tags:          []string{"awair"},
+		Timezone:      "browser",
+		SchemaVersion: 36,
+		Refresh:       "1m",
+		Time:          map[string]string{"from": "now-24h", "to": "now"},
+		Templating:    map[string][]grafanaVariable{"list": variables},
+		Panels:        panels,
+	}
+}
+
+func (app *App) grafanaDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.grafanaDashboard(r.URL.Query().Get("datasource_uid")))
+}
@@ -0,0 +1,30 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+)
+
+// The dashboard is templated on device_name, which the sensor series get
+// from awair_device_up.
+func TestGrafanaDashboardDeviceName(t *testing.T) {
+	app := newTestApp(t, newFakeDeviceClient(), nil, testAddress)
+	dashboard := app.grafanaDashboard("")
+
+	variables := dashboard.Templating["list"]
+	if last := variables[len(variables)-1]; last.Name != "device_name" {
+		t.Errorf("device variable = %q, want device_name", last.Name)
+	}
+	for _, panel := range dashboard.Panels {
+		for _, target := range panel.Targets {
+			if !strings.Contains(target.Expr, `device_name=~"$device_name"`) || target.LegendFormat != "{{device_name}}" {
+				t.Errorf("panel %q queries %s with legend %s, want it filtered and named by device_name", panel.Title, target.Expr, target.LegendFormat)
+			}
+		}
+	}
+
+	pollOnce(app)
+	if _, ok := metricValue(t, app, "awair_device_up", map[string]string{"device_address": testAddress, "device_name": "living-room"}); !ok {
+		t.Errorf("awair_device_up has no device_name for the dashboard to template on")
+	}
+}
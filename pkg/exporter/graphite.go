@@ -0,0 +1,37 @@
+package exporter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// newGraphiteOutput sends readings over the Graphite plaintext protocol as
+// <prefix>.<device>.<sensor> <value> <timestamp>, timestamped with the
+// device's own clock.
+func (app *App) newGraphiteOutput() *statsdOutput {
+	prefix := app.GraphitePrefix
+
+	out := app.newStatsdSink("graphite", "tcp", app.GraphiteAddress)
+	out.format = func(device *Device, sensor string, value float64, timestamp time.Time) string {
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		return fmt.Sprintf("%s.%s.%s %s %d", prefix, metricPathSegment(device.Name), sensor, strconv.FormatFloat(value, 'f', -1, 64), timestamp.Unix())
+	}
+
+	go out.run()
+	return out
+}
+
+func validateGraphiteAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "" || port == "" {
+		return fmt.Errorf("must be host:port")
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultNamespace is the namespace of the device metrics unless a polling
+// group sets its own.
+const defaultNamespace = "awair"
+
+// groupEntry is a polling group as listed in groups_file. Unset durations
+// are inherited from the top-level configuration.
+type groupEntry struct {
+	Name          string            `yaml:"name"`
+	Namespace     string            `yaml:"namespace"`
+	PollFrequency time.Duration     `yaml:"poll_frequency"`
+	DeviceTimeout time.Duration     `yaml:"device_timeout"`
+	Labels        map[string]string `yaml:"labels"`
+	Devices       []deviceEntry     `yaml:"devices"`
+}
+
+type groupsFile struct {
+	Groups []groupEntry `yaml:"groups"`
+}
+
+// pollGroup is a set of devices polled on its own schedule by an exporter
+// of its own, whose metrics are served alongside the top-level ones.
+type pollGroup struct {
+	entry groupEntry
+	app   *App
+}
+
+// reservedGroupLabels are the labels of the device metrics, which a group's
+// constant labels can't reuse.
+var reservedGroupLabels = map[string]bool{
+	"device_address":   true,
+	"source":           true,
+	"mdns_instance":    true,
+	"device_uuid":      true,
+	"device_type":      true,
+	"device_name":      true,
+	"firmware_version": true,
+	"group":            true,
+	"sensor":           true,
+	"unit":             true,
+	"threshold":        true,
+	"severity":         true,
+	"le":               true,
+}
+
+// loadGroupsFile reads and checks the polling groups kept in groups_file.
+func (app *App) loadGroupsFile() error {
+	if app.GroupsFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(app.GroupsFile)
+	if err != nil {
+		return fmt.Errorf("groups_file (%q): %w", app.GroupsFile, err)
+	}
+
+	file := groupsFile{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("groups_file (%q): %w", app.GroupsFile, err)
+	}
+	if len(file.Groups) == 0 {
+		return fmt.Errorf("groups_file (%q): no groups defined", app.GroupsFile)
+	}
+
+	// Each group's series must be told apart from the top-level ones and
+	// every other group's by their namespace or constant labels
+	names := map[string]bool{}
+	series := map[string]string{seriesKey(defaultNamespace, nil): "the top-level devices"}
+	for i, entry := range file.Groups {
+		if err := app.checkGroup(&file.Groups[i]); err != nil {
+			return fmt.Errorf("groups_file (%q): group %d (%q): %w", app.GroupsFile, i, entry.Name, err)
+		}
+		entry = file.Groups[i]
+		if names[entry.Name] {
+			return fmt.Errorf("groups_file (%q): group %d (%q): name used by another group", app.GroupsFile, i, entry.Name)
+		}
+		names[entry.Name] = true
+
+		key := seriesKey(entry.Namespace, entry.Labels)
+		if other, ok := series[key]; ok {
+			return fmt.Errorf("groups_file (%q): group %d (%q): metrics would collide with %s; set a different namespace or labels", app.GroupsFile, i, entry.Name, other)
+		}
+		series[key] = fmt.Sprintf("group %q", entry.Name)
+	}
+
+	app.groupEntries = file.Groups
+	return nil
+}
+
+// checkGroup validates a group and fills in its defaults.
+func (app *App) checkGroup(entry *groupEntry) error {
+	if entry.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if entry.Namespace == "" {
+		entry.Namespace = defaultNamespace
+	}
+	if !model.IsValidMetricName(model.LabelValue(prometheus.BuildFQName(entry.Namespace, "air_quality", "score"))) {
+		return fmt.Errorf("namespace (%q): not a valid metric name prefix", entry.Namespace)
+	}
+	for name := range entry.Labels {
+		if reservedGroupLabels[name] || !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("labels: %q is not a usable label name", name)
+		}
+	}
+
+	if entry.PollFrequency == 0 {
+		entry.PollFrequency = app.TimeBetweenChecks
+	}
+	if entry.PollFrequency < 0 || (entry.PollFrequency < app.MinPollFrequency && !app.AllowFastPolling) {
+		return fmt.Errorf("poll_frequency (%v): below min_poll_frequency (%v)", entry.PollFrequency, app.MinPollFrequency)
+	}
+	if entry.DeviceTimeout == 0 {
+		entry.DeviceTimeout = app.DeviceTimeout
+	}
+	if entry.DeviceTimeout < 0 {
+		return fmt.Errorf("device_timeout (%v): must be positive", entry.DeviceTimeout)
+	}
+
+	if len(entry.Devices) == 0 {
+		return fmt.Errorf("no devices listed")
+	}
+	for i, device := range entry.Devices {
+		if err := validateDeviceAddress(device.URL); err != nil {
+			return fmt.Errorf("device %d (%q): %w", i, device.URL, err)
+		}
+		if err := validateDeviceEntry(device); err != nil {
+			return fmt.Errorf("device %d (%q): %w", i, device.URL, err)
+		}
+	}
+	return nil
+}
+
+// seriesKey identifies the series a group's metrics are exported as.
+func seriesKey(namespace string, labels map[string]string) string {
+	pairs := []string{}
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return namespace + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// setupGroups creates an exporter per polling group, registering each
+// group's metrics with a registry of its own under the group's labels and
+// serving them from the top-level Gatherer. A group takes the parent's
+// device settings, so that devices with TLS settings of their own build
+// their client the way the parent's do, and its thresholds notify the
+// parent's webhook_url. It has no outputs, history_db or MQTT client of its
+// own, so its readings are only exported as metrics.
+func (app *App) setupGroups() error {
+	gatherers := prometheus.Gatherers{app.Gatherer}
+	for _, entry := range app.groupEntries {
+		registry := prometheus.NewRegistry()
+		opts := []Option{
+			WithLogger(app.Logger.With("group", entry.Name), app.logLevel),
+			WithRegisterer(prometheus.WrapRegistererWith(entry.Labels, registry), registry),
+			WithPollInterval(entry.PollFrequency),
+			WithHTTPClient(app.httpClient),
+		}
+		// A group builds its own client for the local API so that it finds
+		// its own devices' headers, unless polling was replaced altogether
+		if _, ok := app.deviceClient.(*httpDeviceClient); !ok {
+			opts = append(opts, WithDeviceClient(app.deviceClient))
+		}
+		group, err := NewApp(opts...)
+		if err != nil {
+			return fmt.Errorf("failed to set up group (%s): %w", entry.Name, err)
+		}
+		group.namespace = entry.Namespace
+		group.DeviceTimeout = entry.DeviceTimeout
+		group.MinPollFrequency = app.MinPollFrequency
+		group.DeviceErrorLogInterval = app.DeviceErrorLogInterval
+		group.DeviceDownAfter = app.DeviceDownAfter
+		group.DeviceHealthyAfter = app.DeviceHealthyAfter
+		group.DeviceMaxRetryAfter = app.DeviceMaxRetryAfter
+		group.CrashOnPanic = app.CrashOnPanic
+		group.DeviceLabelSource = app.DeviceLabelSource
+		group.MetricStyle = app.MetricStyle
+		group.LegacyMetrics = app.LegacyMetrics
+		group.MetadataLabels = app.MetadataLabels
+		group.Histograms = app.Histograms
+		group.histogramBuckets = app.histogramBuckets
+		group.thresholds = app.thresholds
+		group.composite = app.composite
+		group.RecordDir = app.RecordDir
+		group.RecentHistory = app.RecentHistory
+		group.replay = app.replay
+		group.relabelRules = app.relabelRules
+		group.relabelNames = app.relabelNames
+		group.deviceHeader = app.deviceHeader
+		group.sourceIP = app.sourceIP
+		group.DeviceProxyURL = app.DeviceProxyURL
+		group.NoProxy = app.NoProxy
+		group.DeviceTLSSkipVerify = app.DeviceTLSSkipVerify
+		group.DeviceDisableKeepAlive = app.DeviceDisableKeepAlive
+		group.deviceCAs = app.deviceCAs
+		group.deviceClientCert = app.deviceClientCert
+		group.ErrorBufferSize = app.ErrorBufferSize
+		group.AwairAddresses = nil
+		group.DisableHTTPServer = true
+
+		if err := group.setup(false); err != nil {
+			return fmt.Errorf("failed to set up group (%s): %w", entry.Name, err)
+		}
+		group.webhook = app.webhook
+		for _, device := range entry.Devices {
+			name := device.Name
+			if name == "" {
+				name = deviceNameFromAddress(device.URL)
+			}
+			group.addDevice(name, deviceSourceGroup, device)
+		}
+
+		app.groups = append(app.groups, &pollGroup{entry: entry, app: group})
+		gatherers = append(gatherers, registry)
+	}
+
+	if len(app.groups) > 0 {
+		app.Gatherer = gatherers
+	}
+	return nil
+}
+
+// startGroups starts the poll loop of every group.
+func (app *App) startGroups(ctx context.Context) {
+	for _, group := range app.groups {
+		group.app.runCtx = ctx
+		group.app.markCycleComplete()
+		group.app.recordMetrics(ctx)
+		group.app.Logger.Infow("Polling group started", "devices", len(group.app.Devices()), "poll_frequency", group.app.TimeBetweenChecks.String())
+	}
+}
+
+type apiGroup struct {
+	Name          string            `json:"name"`
+	Namespace     string            `json:"namespace"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	PollFrequency string            `json:"poll_frequency"`
+	Devices       []apiDevice       `json:"devices"`
+}
+
+// groupsHandler serves the operational view of the devices of every
+// polling group, one section per group.
+func (app *App) groupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groups := []apiGroup{}
+	for _, group := range app.groups {
+		devices := []apiDevice{}
+		for _, device := range group.app.Devices() {
+			devices = append(devices, group.app.apiDevice(device))
+		}
+		groups = append(groups, apiGroup{
+			Name:          group.entry.Name,
+			Namespace:     group.entry.Namespace,
+			Labels:        group.entry.Labels,
+			PollFrequency: group.entry.PollFrequency.String(),
+			Devices:       devices,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, groups)
+}
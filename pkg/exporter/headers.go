@@ -0,0 +1,87 @@
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// parseDeviceHeaders parses the device_header flags, each "Name: value".
+func parseDeviceHeaders(values []string) (http.Header, error) {
+	headers := http.Header{}
+	for i, value := range values {
+		name, headerValue, ok := strings.Cut(value, ":")
+		if !ok {
+			return nil, fmt.Errorf("device_header[%d]: must be \"Name: value\"", i)
+		}
+		name = strings.TrimSpace(name)
+		headerValue = strings.TrimSpace(headerValue)
+		if err := validateHeader(name, headerValue); err != nil {
+			return nil, fmt.Errorf("device_header[%d] (%q): %w", i, name, err)
+		}
+		headers.Add(name, headerValue)
+	}
+	return headers, nil
+}
+
+// validateDeviceHeaders checks the headers of a device entry.
+func validateDeviceHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if err := validateHeader(name, value); err != nil {
+			return fmt.Errorf("headers (%q): %w", name, err)
+		}
+	}
+	return nil
+}
+
+func validateHeader(name, value string) error {
+	if !httpguts.ValidHeaderFieldName(name) {
+		return fmt.Errorf("not a valid header name")
+	}
+	if !httpguts.ValidHeaderFieldValue(value) {
+		return fmt.Errorf("value contains invalid characters")
+	}
+	return nil
+}
+
+// newDeviceHeader converts a device entry's headers.
+func newDeviceHeader(headers map[string]string) http.Header {
+	if len(headers) == 0 {
+		return nil
+	}
+	header := http.Header{}
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+	return header
+}
+
+// deviceHeaderMap converts a device's headers back for the devices file.
+func deviceHeaderMap(header http.Header) map[string]string {
+	if len(header) == 0 {
+		return nil
+	}
+	headers := map[string]string{}
+	for name := range header {
+		headers[name] = header.Get(name)
+	}
+	return headers
+}
+
+// requestHeaders returns the headers sent with every request to the device
+// polled through address: the device_header flags, overridden by the
+// device's own headers.
+func (app *App) requestHeaders(address string) http.Header {
+	headers := app.deviceHeader.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	if device, ok := app.deviceForEndpoint(address); ok {
+		for name, values := range device.Headers {
+			headers[name] = values
+		}
+	}
+	return headers
+}
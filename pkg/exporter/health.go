@@ -0,0 +1,123 @@
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// healthzStaleCycles is how many poll cycles may pass without one completing
+// before the poll loop is considered wedged.
+const healthzStaleCycles = 3
+
+type healthResponse struct {
+	Status       string    `json:"status"`
+	Reason       string    `json:"reason,omitempty"`
+	LastCycleEnd time.Time `json:"last_cycle_end"`
+}
+
+// markCycleComplete records a heartbeat from the poll loop.
+func (app *App) markCycleComplete() {
+	atomic.StoreInt64(&app.lastCycleEnd, time.Now().UnixNano())
+}
+
+func (app *App) lastCycleTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&app.lastCycleEnd))
+}
+
+// staleLimit is how long the poll loop may go without completing a cycle.
+// Devices are polled one after another, each reading taking up to
+// device_timeout per endpoint tried and its metadata as long again, so a
+// cycle over unreachable devices can run well past poll_frequency.
+func (app *App) staleLimit() time.Duration {
+	cycle := app.TimeBetweenChecks
+	for _, device := range app.Devices() {
+		cycle += time.Duration(len(device.Fallbacks)+2) * app.DeviceTimeout
+	}
+	return healthzStaleCycles * cycle
+}
+
+func (app *App) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	lastCycle := app.lastCycleTime()
+	limit := app.staleLimit()
+
+	response := healthResponse{
+		Status:       "ok",
+		LastCycleEnd: lastCycle,
+	}
+	status := http.StatusOK
+
+	if age := time.Since(lastCycle); age > limit {
+		response.Status = "unhealthy"
+		response.Reason = fmt.Sprintf("poll loop has not completed a cycle in %v (limit %v)", age.Round(time.Second), limit)
+		status = http.StatusServiceUnavailable
+	}
+	for _, group := range app.groups {
+		groupLimit := group.app.staleLimit()
+		if age := time.Since(group.app.lastCycleTime()); status == http.StatusOK && age > groupLimit {
+			response.Status = "unhealthy"
+			response.Reason = fmt.Sprintf("poll loop of group %q has not completed a cycle in %v (limit %v)", group.entry.Name, age.Round(time.Second), groupLimit)
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	writeJSON(w, status, response)
+}
+
+// markReady flips the exporter to ready after the first successful poll of
+// any device. Readiness never reverts; that's what /healthz is for.
+func (app *App) markReady(awairAddress string) {
+	if atomic.CompareAndSwapInt32(&app.ready, 0, 1) {
+		app.Logger.Infof("Exporter is ready after the first successful poll of (%+v)", redactAddress(awairAddress))
+	}
+}
+
+// isReady reports whether a device of the exporter or any of its polling
+// groups has been polled successfully.
+func (app *App) isReady() bool {
+	if atomic.LoadInt32(&app.ready) == 1 {
+		return true
+	}
+	for _, group := range app.groups {
+		if atomic.LoadInt32(&group.app.ready) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	response := healthResponse{
+		Status:       "ready",
+		LastCycleEnd: app.lastCycleTime(),
+	}
+	status := http.StatusOK
+
+	if !app.isReady() {
+		response.Status = "not ready"
+		response.Reason = "no device has been polled successfully yet"
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, response)
+}
+
+// serveHealth serves only the health endpoints on a separate plain HTTP
+// listener, so probes keep working when the main listener requires client
+// certificates.
+func (app *App) serveHealth() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", app.healthzHandler)
+	mux.HandleFunc("/readyz", app.readyzHandler)
+
+	go func() {
+		app.Logger.Infof("Serving health endpoints on (%+v)", app.HealthListen)
+		server := app.newHTTPServer(mux)
+		server.Addr = app.HealthListen
+		err := server.ListenAndServe()
+		if err != nil {
+			app.Logger.Errorf("Health server failed: %+v", err)
+		}
+	}()
+}
@@ -0,0 +1,44 @@
+package exporter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Devices that each take most of device_timeout to answer stretch a poll
+// cycle well past poll_frequency without the loop being wedged.
+func TestHealthzAllowsSlowDevices(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.fetch = func(ctx context.Context, address string) (AwairStats, error) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+		}
+		return AwairStats{Timestamp: time.Now(), Score: 92}, nil
+	}
+	app := newTestApp(t, client, func(app *App) {
+		app.TimeBetweenChecks = 10 * time.Millisecond
+		app.AllowFastPolling = true
+		app.DeviceTimeout = 200 * time.Millisecond
+	}, "http://living-room/air-data/latest", "http://bedroom/air-data/latest", "http://office/air-data/latest")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app.markCycleComplete()
+	app.recordMetrics(ctx)
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		recorder := httptest.NewRecorder()
+		app.healthzHandler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("GET /healthz during a slow cycle = %d, want 200: %s", recorder.Code, recorder.Body)
+		}
+	}
+
+	if want := 3 * (10*time.Millisecond + 3*2*200*time.Millisecond); app.staleLimit() != want {
+		t.Errorf("stale limit = %v, want %v", app.staleLimit(), want)
+	}
+}
@@ -0,0 +1,81 @@
+package exporter
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// healthcheckTimeout is the hard limit on --healthcheck so that a wedged
+// server can't hang a container runtime's health probe.
+const healthcheckTimeout = 5 * time.Second
+
+// Healthcheck requests /healthz from the running instance configured by
+// the same flags and returns nil if it reports healthy.
+func (app *App) Healthcheck() error {
+	transport := &http.Transport{}
+	scheme := "http"
+	host := ""
+
+	switch {
+	case app.HealthListen != "":
+		// The separate health listener is plain HTTP and never asks for a
+		// client certificate, so prefer it when configured
+		host = loopbackAddress(app.HealthListen)
+	case app.ListenSocket != "":
+		host = "localhost"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", app.ListenSocket)
+		}
+	default:
+		host = loopbackAddress(net.JoinHostPort(app.ListenAddress, strconv.FormatUint(app.ListenPort, 10)))
+	}
+
+	if app.HealthListen == "" && app.TLSCertFile != "" {
+		if app.TLSClientCAFile != "" {
+			return fmt.Errorf("the listener requires client certificates; set --health_listen to check health over plain HTTP")
+		}
+		scheme = "https"
+		// The serving certificate is issued for the exporter's public name,
+		// not the loopback address the check connects to
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	client := &http.Client{Transport: transport, Timeout: healthcheckTimeout}
+	url := fmt.Sprintf("%s://%s/healthz", scheme, host)
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s: %s", url, resp.Status, body)
+	}
+	return nil
+}
+
+// loopbackAddress rewrites a wildcard listen address to the loopback address
+// so the instance can be reached from inside its own container.
+func loopbackAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port)
+}
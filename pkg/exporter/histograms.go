@@ -0,0 +1,96 @@
+package exporter
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultHistogramBuckets are the upper bounds of the histogram buckets of
+// each sensor unless histogram_buckets overrides them, placed around the
+// levels the Awair score considers good and bad.
+var defaultHistogramBuckets = map[string][]float64{
+	"temp":  {10, 15, 18, 20, 22, 24, 26, 28, 30, 35},
+	"humid": {20, 30, 40, 50, 60, 70, 80},
+	"co2":   {400, 600, 800, 1000, 1200, 1500, 2000, 2500, 5000},
+	"voc":   {100, 250, 500, 1000, 2000, 4000, 8000},
+	"pm25":  {5, 10, 15, 25, 35, 55, 150},
+	"score": {20, 40, 60, 70, 80, 90},
+}
+
+// parseHistogramBuckets parses the histogram_buckets flags, each a sensor
+// and its comma-separated increasing bucket bounds such as
+// "co2=400,1000,2000", over the defaults of the other sensors.
+func parseHistogramBuckets(flags []string) (map[string][]float64, error) {
+	buckets := map[string][]float64{}
+	for sensor, bounds := range defaultHistogramBuckets {
+		buckets[sensor] = bounds
+	}
+
+	for _, value := range flags {
+		sensor, list, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("histogram_buckets (%q): must be sensor=bound,bound,...", value)
+		}
+		if _, ok := lookupSensor(sensor); !ok {
+			return nil, fmt.Errorf("histogram_buckets (%q): sensor (%q) must be one of temp, humid, co2, voc, pm25, score", value, sensor)
+		}
+
+		bounds := []float64{}
+		for _, field := range strings.Split(list, ",") {
+			bound, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				return nil, fmt.Errorf("histogram_buckets (%q): bound (%q) must be a number", value, field)
+			}
+			bounds = append(bounds, bound)
+		}
+		if !sort.Float64sAreSorted(bounds) || hasDuplicates(bounds) {
+			return nil, fmt.Errorf("histogram_buckets (%q): bounds must be increasing", value)
+		}
+		buckets[sensor] = bounds
+	}
+	return buckets, nil
+}
+
+func hasDuplicates(sorted []float64) bool {
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] == sorted[i-1] {
+			return true
+		}
+	}
+	return false
+}
+
+// initializeHistograms registers a histogram per sensor, named after the
+// sensor's gauge, that every reading is observed into. The histograms are
+// new, so unlike the gauges they have no legacy names.
+func (app *App) initializeHistograms(factory promauto.Factory, namespace string, labels []string) {
+	app.histograms = map[string]*prometheus.HistogramVec{}
+	for _, sensor := range sensorReadings {
+		app.histograms[sensor.Sensor] = factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    namespace + strings.TrimPrefix(sensor.Metric, defaultNamespace) + "_histogram",
+			Help:    fmt.Sprintf("The distribution of %s readings, observed once per poll", sensor.Name),
+			Buckets: app.histogramBuckets[sensor.Sensor],
+		}, labels)
+	}
+}
+
+// observeHistograms feeds a reading into the sensor histograms.
+func (app *App) observeHistograms(labels []string, stats AwairStats) {
+	for _, sensor := range sensorReadings {
+		if histogram, ok := app.histograms[sensor.Sensor]; ok {
+			histogram.WithLabelValues(labels...).Observe(sensor.Value(stats))
+		}
+	}
+}
+
+// deleteHistograms deletes a device's series of the sensor histograms.
+func (app *App) deleteHistograms(labels []string) {
+	for _, histogram := range app.histograms {
+		histogram.DeleteLabelValues(labels...)
+	}
+}
@@ -0,0 +1,41 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The histograms are only exported under their current names, even with
+// legacy_metrics.
+func TestHistogramsHaveNoLegacyNames(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Co2: 600}, nil)
+	app := newTestApp(t, client, func(app *App) {
+		app.Histograms = true
+		app.LegacyMetrics = true
+	}, testAddress)
+	pollOnce(app)
+
+	families, err := app.Gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, family := range families {
+		name := family.GetName()
+		if strings.HasPrefix(name, "awair_climate_") && strings.HasSuffix(name, "_histogram") {
+			t.Errorf("legacy histogram %s is exported", name)
+		}
+		found = found || name == "awair_air_quality_co2_ppm_histogram"
+	}
+	if !found {
+		t.Errorf("awair_air_quality_co2_ppm_histogram isn't exported")
+	}
+
+	var metricMap strings.Builder
+	WriteMetricMap(&metricMap)
+	if strings.Contains(metricMap.String(), "_histogram") {
+		t.Errorf("metric map lists histograms:\n%s", metricMap.String())
+	}
+}
@@ -0,0 +1,344 @@
+package exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const historyQueueSize = 16
+
+// historyMaxPoints bounds the points a single history query may return.
+const historyMaxPoints = 10000
+
+// historyMigrations are applied in order on startup; the database's
+// user_version records how many have been applied. Never edit an entry,
+// only append new ones.
+var historyMigrations = []string{
+	`CREATE TABLE readings (
+		device TEXT NOT NULL,
+		time INTEGER NOT NULL,
+		temp REAL,
+		humid REAL,
+		co2 REAL,
+		voc REAL,
+		pm25 REAL,
+		score REAL
+	);
+	CREATE INDEX readings_device_time ON readings (device, time);`,
+	`CREATE INDEX readings_time ON readings (time);`,
+}
+
+type historyRow struct {
+	Device string
+	Time   int64
+	Values []float64
+}
+
+// historyOutput stores every reading in SQLite. Rows are inserted by a
+// background goroutine in one transaction per cycle so that the poll loop
+// never waits on the disk.
+type historyOutput struct {
+	app *App
+	db  *sql.DB
+
+	lock sync.Mutex
+	rows []historyRow
+
+	queue chan []historyRow
+	done  chan struct{}
+
+	pruner *historyPruner
+}
+
+// openHistory opens the history database and brings its schema up to date.
+func openHistory(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes writes and reads, which SQLite would
+	// do anyway, and keeps the pragmas below in effect
+	db.SetMaxOpenConns(1)
+
+	// auto_vacuum only takes effect on a new database, before its tables are
+	// created; historyPruner converts older ones
+	for _, pragma := range []string{"PRAGMA auto_vacuum = INCREMENTAL", "PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000"} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if err := migrateHistory(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func migrateHistory(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(historyMigrations) {
+		return fmt.Errorf("database schema version %d is newer than this exporter supports (%d)", version, len(historyMigrations))
+	}
+
+	for i := version; i < len(historyMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(historyMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// PRAGMA doesn't take bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *App) newHistoryOutput(db *sql.DB) *historyOutput {
+	out := &historyOutput{
+		app:   app,
+		db:    db,
+		queue: make(chan []historyRow, historyQueueSize),
+		done:  make(chan struct{}),
+	}
+	out.pruner = app.newHistoryPruner(db)
+	go out.run()
+	return out
+}
+
+func (out *historyOutput) Record(device *Device, stats AwairStats) {
+	timestamp := stats.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	row := historyRow{Device: device.Name, Time: timestamp.Unix()}
+	for _, reading := range sensorReadings {
+		row.Values = append(row.Values, reading.Value(stats))
+	}
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	out.rows = append(out.rows, row)
+}
+
+func (out *historyOutput) Flush() {
+	out.lock.Lock()
+	rows := out.rows
+	out.rows = nil
+	out.lock.Unlock()
+
+	if len(rows) == 0 {
+		return
+	}
+
+	select {
+	case out.queue <- rows:
+	default:
+		out.app.Logger.Warnf("Dropped (%+v) history rows, the write queue is full", len(rows))
+	}
+}
+
+func (out *historyOutput) Close(ctx context.Context) {
+	out.Flush()
+	close(out.queue)
+
+	stopped := make(chan struct{})
+	go func() {
+		out.pruner.close()
+		<-out.done
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		out.db.Close()
+	case <-ctx.Done():
+	}
+}
+
+func (out *historyOutput) run() {
+	defer close(out.done)
+	for rows := range out.queue {
+		if err := out.insert(rows); err != nil {
+			out.app.Logger.Errorf("Failed to store (%+v) readings in history database: %+v", len(rows), err)
+			continue
+		}
+		out.pruner.rows.Add(float64(len(rows)))
+	}
+}
+
+func (out *historyOutput) insert(rows []historyRow) error {
+	columns := []string{"device", "time"}
+	placeholders := []string{"?", "?"}
+	for _, reading := range sensorReadings {
+		columns = append(columns, reading.Sensor)
+		placeholders = append(placeholders, "?")
+	}
+	query := fmt.Sprintf("INSERT INTO readings (%s) VALUES (%s)", strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+
+	tx, err := out.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		args := []interface{}{row.Device, row.Time}
+		for _, value := range row.Values {
+			args = append(args, value)
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type historyPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type historyResponse struct {
+	Device string         `json:"device"`
+	Sensor string         `json:"sensor"`
+	Since  time.Time      `json:"since"`
+	Step   string         `json:"step"`
+	Points []historyPoint `json:"points"`
+}
+
+func validHistorySensor(sensor string) bool {
+	_, ok := lookupSensor(sensor)
+	return ok
+}
+
+// historyHandler serves GET /api/v1/history?device=&sensor=&since=&step=,
+// averaging the readings stored in history_db into one point per step.
+func (app *App) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	device := query.Get("device")
+	sensor := query.Get("sensor")
+	if device == "" {
+		http.Error(w, "device is required", http.StatusBadRequest)
+		return
+	}
+	if !validHistorySensor(sensor) {
+		http.Error(w, fmt.Sprintf("sensor (%q) must be one of temp, humid, co2, voc, pm25, score", sensor), http.StatusBadRequest)
+		return
+	}
+
+	since, err := historyDuration(query.Get("since"), 24*time.Hour)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("since: %v", err), http.StatusBadRequest)
+		return
+	}
+	step, err := historyDuration(query.Get("step"), 5*time.Minute)
+	if err != nil || step < time.Second || step%time.Second != 0 {
+		http.Error(w, "step: must be a whole number of seconds, at least 1s", http.StatusBadRequest)
+		return
+	}
+	if since/step > historyMaxPoints {
+		http.Error(w, fmt.Sprintf("since/step would return more than %d points", historyMaxPoints), http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now().Add(-since)
+	stepSeconds := int64(step / time.Second)
+
+	// The sensor is one of a fixed set of column names, so it's safe to
+	// format into the query
+	rows, err := app.historyDB.QueryContext(r.Context(), fmt.Sprintf(
+		`SELECT (time / ?) * ? AS bucket, avg(%s) FROM readings
+		WHERE device = ? AND time >= ? GROUP BY bucket ORDER BY bucket`, sensor),
+		stepSeconds, stepSeconds, device, start.Unix())
+	if err != nil {
+		app.Logger.Errorf("Failed to query history: %+v", err)
+		http.Error(w, "failed to query history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	response := historyResponse{
+		Device: device,
+		Sensor: sensor,
+		Since:  start.UTC().Truncate(time.Second),
+		Step:   step.String(),
+		Points: []historyPoint{},
+	}
+	for rows.Next() {
+		var bucket int64
+		var value float64
+		if err := rows.Scan(&bucket, &value); err != nil {
+			app.Logger.Errorf("Failed to read history: %+v", err)
+			http.Error(w, "failed to query history", http.StatusInternalServerError)
+			return
+		}
+		response.Points = append(response.Points, historyPoint{Time: time.Unix(bucket, 0).UTC(), Value: value})
+	}
+	if err := rows.Err(); err != nil {
+		app.Logger.Errorf("Failed to read history: %+v", err)
+		http.Error(w, "failed to query history", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// historyDuration parses a positive duration, accepting a "d" suffix for days
+// since history is often asked for in days.
+func historyDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return d, nil
+}
+
+// ParseDuration parses a duration as time.ParseDuration does, also accepting
+// a "d" suffix for days (e.g. 90d), as history_retention and the history
+// endpoints do.
+func ParseDuration(value string) (time.Duration, error) {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		d, err := time.ParseDuration(days + "h")
+		return d * 24, err
+	}
+	return time.ParseDuration(value)
+}
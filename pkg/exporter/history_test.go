@@ -0,0 +1,188 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getJSON(t *testing.T, server *httptest.Server, path string, v interface{}) int {
+	t.Helper()
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// The readings kept in memory and those in history_db are served from
+// separate paths, each with a single schema.
+func TestHistoryEndpoints(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Co2: 600, Score: 92}, nil)
+	app := newTestApp(t, client, func(app *App) {
+		app.HistoryDB = filepath.Join(t.TempDir(), "history.db")
+	}, testAddress)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		app.closeOutputs(ctx)
+	})
+	server := httptest.NewServer(app.routes())
+	defer server.Close()
+	pollOnce(app)
+
+	var recent recentHistoryResponse
+	if status := getJSON(t, server, "/api/v1/history/recent?device=living-room&duration=1h", &recent); status != http.StatusOK {
+		t.Fatalf("GET /api/v1/history/recent = %d, want 200", status)
+	}
+	if len(recent.Samples) != 1 || recent.Samples[0].Co2 != 600 {
+		t.Errorf("recent samples = %+v, want the one reading", recent.Samples)
+	}
+
+	if status := getJSON(t, server, "/api/v1/history?device=living-room", nil); status != http.StatusBadRequest {
+		t.Errorf("GET /api/v1/history without a sensor = %d, want 400", status)
+	}
+	var stored historyResponse
+	if status := getJSON(t, server, "/api/v1/history?device=living-room&sensor=co2", &stored); status != http.StatusOK {
+		t.Fatalf("GET /api/v1/history = %d, want 200", status)
+	}
+	if stored.Sensor != "co2" {
+		t.Errorf("sensor = %q, want co2", stored.Sensor)
+	}
+}
+
+func TestHistoryEndpointsWithoutHistoryDB(t *testing.T) {
+	app := newTestApp(t, newFakeDeviceClient(), nil, testAddress)
+	server := httptest.NewServer(app.routes())
+	defer server.Close()
+
+	if status := getJSON(t, server, "/api/v1/history?device=living-room&duration=1h", nil); status != http.StatusNotFound {
+		t.Errorf("GET /api/v1/history without history_db = %d, want 404", status)
+	}
+	if status := getJSON(t, server, "/api/v1/history/recent?device=living-room", nil); status != http.StatusOK {
+		t.Errorf("GET /api/v1/history/recent = %d, want 200", status)
+	}
+}
+
+// A step that isn't a whole number of seconds would be truncated, to zero
+// for one under a second, so it's rejected.
+func TestHistoryAggregateRejectsFractionalStep(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Co2: 600}, nil)
+	app := newTestApp(t, client, nil, testAddress)
+	pollOnce(app)
+	server := httptest.NewServer(app.routes())
+	defer server.Close()
+
+	for _, step := range []string{"500ms", "1.5s", "0s", "-1m"} {
+		path := "/api/v1/history/aggregate?device=living-room&sensor=co2&since=1h&step=" + step
+		if status := getJSON(t, server, path, nil); status != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", path, status)
+		}
+	}
+	path := "/api/v1/history/aggregate?device=living-room&sensor=co2&since=1h&step=90s"
+	if status := getJSON(t, server, path, nil); status != http.StatusOK {
+		t.Errorf("GET %s = %d, want 200", path, status)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, want := range map[string]int64{
+		"524288000": 524288000,
+		"500MB":     500e6,
+		"500 mb":    500e6,
+		"2GiB":      2 << 30,
+		"1.5KiB":    1536,
+		"10B":       10,
+	} {
+		if got, err := ParseSize(value); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "MB", "500XB", "five"} {
+		if _, err := ParseSize(value); err == nil {
+			t.Errorf("ParseSize(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"90d":  90 * 24 * time.Hour,
+		"1.5d": 36 * time.Hour,
+		"6h":   6 * time.Hour,
+		"0":    0,
+	} {
+		if got, err := ParseDuration(value); err != nil || got != want {
+			t.Errorf("ParseDuration(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+}
+
+// awair_history_db_rows follows the readings inserted and pruned.
+func TestHistoryRowCount(t *testing.T) {
+	client := newFakeDeviceClient()
+	app := newTestApp(t, client, func(app *App) {
+		app.HistoryDB = filepath.Join(t.TempDir(), "history.db")
+		app.HistoryRetention = 24 * time.Hour
+	}, testAddress)
+	out := app.outputs[len(app.outputs)-1].(*historyOutput)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		app.closeOutputs(ctx)
+	}()
+
+	rows := func() float64 {
+		value, _ := metricValue(t, app, "awair_history_db_rows", nil)
+		return value
+	}
+	waitForRows := func(want float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for rows() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("awair_history_db_rows = %v, want %v", rows(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Let the pass on startup finish first, so that the pruning is this
+	// test's own
+	pruned := func() float64 {
+		value, _ := metricValue(t, app, "awair_history_db_prune_runs_total", map[string]string{"result": "success"})
+		return value
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pruned() < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("history database wasn't pruned on startup")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client.set(testAddress, AwairStats{Timestamp: time.Now().Add(-48 * time.Hour), Score: 80}, nil)
+	pollOnce(app)
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Score: 92}, nil)
+	pollOnce(app)
+	waitForRows(2)
+
+	if err := out.pruner.prune(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rows(); got != 1 {
+		t.Errorf("awair_history_db_rows after pruning = %v, want 1", got)
+	}
+}
@@ -0,0 +1,237 @@
+package exporter
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyAggregateFuncs are the fn values /api/v1/history/aggregate
+// accepts, each also the name of the SQLite aggregate function it runs.
+var historyAggregateFuncs = []string{"avg", "min", "max"}
+
+type historyBucket struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Count int       `json:"count"`
+}
+
+type historyAggregateResponse struct {
+	Device  string          `json:"device"`
+	Sensor  string          `json:"sensor"`
+	Fn      string          `json:"fn"`
+	Source  string          `json:"source"`
+	Since   time.Time       `json:"since"`
+	Step    string          `json:"step"`
+	Buckets []historyBucket `json:"buckets"`
+}
+
+// historyAggregateHandler serves GET
+// /api/v1/history/aggregate?device=&sensor=&fn=&since=&step=, the avg, min
+// or max of a sensor per step, from history_db if it's set or else from
+// the readings kept in memory. Buckets are aligned to multiples of step
+// since the Unix epoch, so hourly buckets start on the hour in UTC and
+// repeated queries return the same buckets. Answers with CSV instead of
+// JSON if the request accepts text/csv.
+func (app *App) historyAggregateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("device")
+	if name == "" {
+		http.Error(w, "device is required", http.StatusBadRequest)
+		return
+	}
+	sensor, ok := lookupSensor(query.Get("sensor"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("sensor (%q) must be one of temp, humid, co2, voc, pm25, score", query.Get("sensor")), http.StatusBadRequest)
+		return
+	}
+	fn := query.Get("fn")
+	if fn == "" {
+		fn = "avg"
+	}
+	if !validHistoryAggregateFunc(fn) {
+		http.Error(w, fmt.Sprintf("fn (%q) must be one of %s", fn, strings.Join(historyAggregateFuncs, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	since, err := historyDuration(query.Get("since"), 24*time.Hour)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("since: %v", err), http.StatusBadRequest)
+		return
+	}
+	step, err := historyDuration(query.Get("step"), time.Hour)
+	if err != nil || step < time.Second || step%time.Second != 0 {
+		http.Error(w, "step: must be a whole number of seconds, at least 1s", http.StatusBadRequest)
+		return
+	}
+
+	device, known := app.lookupHistoryDevice(name)
+	source := "database"
+	if app.historyDB == nil {
+		source = "memory"
+		if !known {
+			http.Error(w, fmt.Sprintf("unknown device (%q)", name), http.StatusNotFound)
+			return
+		}
+		if since > app.RecentHistory {
+			since = app.RecentHistory
+		}
+	}
+	if since/step > historyMaxPoints {
+		http.Error(w, fmt.Sprintf("since/step would return more than %d buckets", historyMaxPoints), http.StatusBadRequest)
+		return
+	}
+
+	// The first bucket starts on the step boundary at or before since ago
+	stepSeconds := int64(step / time.Second)
+	start := time.Unix(time.Now().Add(-since).Unix()/stepSeconds*stepSeconds, 0).UTC()
+
+	response := historyAggregateResponse{
+		Device: name,
+		Sensor: sensor.Sensor,
+		Fn:     fn,
+		Source: source,
+		Since:  start,
+		Step:   step.String(),
+	}
+	if known {
+		response.Device = device.Name
+	}
+	if app.historyDB != nil {
+		response.Buckets, err = app.queryHistoryAggregate(r.Context(), response.Device, sensor.Sensor, fn, start, stepSeconds)
+		if err != nil {
+			app.Logger.Errorf("Failed to query history: %+v", err)
+			http.Error(w, "failed to query history", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		response.Buckets = aggregateHistorySamples(device.history, sensor, fn, start, stepSeconds)
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		writeHistoryAggregateCSV(w, response)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func validHistoryAggregateFunc(fn string) bool {
+	for _, valid := range historyAggregateFuncs {
+		if fn == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupHistoryDevice finds a device by name or address, its polling
+// groups' included.
+func (app *App) lookupHistoryDevice(name string) (*Device, bool) {
+	device, ok := app.LookupDevice(name)
+	for _, group := range app.groups {
+		if !ok {
+			device, ok = group.app.LookupDevice(name)
+		}
+	}
+	return device, ok
+}
+
+func (app *App) queryHistoryAggregate(ctx context.Context, device, sensor, fn string, start time.Time, stepSeconds int64) ([]historyBucket, error) {
+	// The sensor and fn are each one of a fixed set of names, so they're
+	// safe to format into the query
+	rows, err := app.historyDB.QueryContext(ctx, fmt.Sprintf(
+		`SELECT (time / ?) * ? AS bucket, %s(%s), count(%s) FROM readings
+		WHERE device = ? AND time >= ? GROUP BY bucket ORDER BY bucket`, fn, sensor, sensor),
+		stepSeconds, stepSeconds, device, start.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []historyBucket{}
+	for rows.Next() {
+		var bucket int64
+		var value float64
+		var count int
+		if err := rows.Scan(&bucket, &value, &count); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, historyBucket{Time: time.Unix(bucket, 0).UTC(), Value: value, Count: count})
+	}
+	return buckets, rows.Err()
+}
+
+// aggregateHistorySamples buckets the readings kept in memory as
+// queryHistoryAggregate does those in history_db.
+func aggregateHistorySamples(ring *historyRing, sensor sensorReading, fn string, start time.Time, stepSeconds int64) []historyBucket {
+	buckets := []historyBucket{}
+	if ring == nil {
+		return buckets
+	}
+	for _, sample := range ring.since(start) {
+		value := sensor.Value(sample.stats())
+		bucketTime := time.Unix(sample.Time.Unix()/stepSeconds*stepSeconds, 0).UTC()
+
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Time.Equal(bucketTime) {
+			buckets = append(buckets, historyBucket{Time: bucketTime, Value: value, Count: 1})
+			continue
+		}
+		bucket := &buckets[len(buckets)-1]
+		switch fn {
+		case "avg":
+			// Summed here, divided by the count below
+			bucket.Value += value
+		case "min":
+			bucket.Value = math.Min(bucket.Value, value)
+		case "max":
+			bucket.Value = math.Max(bucket.Value, value)
+		}
+		bucket.Count++
+	}
+	if fn == "avg" {
+		for i := range buckets {
+			buckets[i].Value /= float64(buckets[i].Count)
+		}
+	}
+	return buckets
+}
+
+// stats returns the reading a sample was kept from, for the sensor values.
+func (sample historySample) stats() AwairStats {
+	return AwairStats{
+		Timestamp: sample.Time,
+		Temp:      sample.Temp,
+		Humid:     sample.Humid,
+		Co2:       sample.Co2,
+		Voc:       sample.Voc,
+		Pm25:      sample.Pm25,
+		Score:     sample.Score,
+	}
+}
+
+func writeHistoryAggregateCSV(w http.ResponseWriter, response historyAggregateResponse) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"time", response.Fn + "_" + response.Sensor, "count"})
+	for _, bucket := range response.Buckets {
+		out.Write([]string{
+			bucket.Time.Format(time.RFC3339),
+			strconv.FormatFloat(bucket.Value, 'f', -1, 64),
+			strconv.Itoa(bucket.Count),
+		})
+	}
+	out.Flush()
+}
@@ -0,0 +1,338 @@
+package exporter
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The history database is measured, and pruned to history_retention and
+// history_max_size, every historyPruneInterval. Rows are deleted
+// historyPruneBatch at a time and freed pages returned to the filesystem
+// historyVacuumPages at a time, pausing historyPrunePause between batches so
+// that inserts and /api/v1/history queries, which share the single
+// connection, are never held up for long.
+const (
+	historyPruneInterval = 10 * time.Minute
+	historyPruneBatch    = 1000
+	historyVacuumPages   = 256
+	historyPrunePause    = 50 * time.Millisecond
+)
+
+// historyPruner keeps the history database within its retention and size
+// limits in the background.
+type historyPruner struct {
+	app *App
+	db  *sql.DB
+
+	stop chan struct{}
+	done chan struct{}
+
+	size      prometheus.Gauge
+	rows      prometheus.Gauge
+	pruned    *prometheus.CounterVec
+	reclaimed prometheus.Counter
+	runs      *prometheus.CounterVec
+}
+
+func (app *App) newHistoryPruner(db *sql.DB) *historyPruner {
+	factory := promauto.With(app.Registerer)
+	pruner := &historyPruner{
+		app:  app,
+		db:   db,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		size: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: "awair",
+			Subsystem: "history_db",
+			Name:      "size_bytes",
+			Help:      "Size of the history database, excluding its write-ahead log",
+		}),
+		rows: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: "awair",
+			Subsystem: "history_db",
+			Name:      "rows",
+			Help:      "Readings stored in the history database",
+		}),
+		pruned: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "history_db",
+			Name:      "pruned_rows_total",
+			Help:      "Readings deleted from the history database, by reason (retention or max_size)",
+		}, []string{"reason"}),
+		reclaimed: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "history_db",
+			Name:      "reclaimed_bytes_total",
+			Help:      "Bytes returned to the filesystem by incremental vacuum of the history database",
+		}),
+		runs: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "history_db",
+			Name:      "prune_runs_total",
+			Help:      "Passes over the history database to prune and measure it, by result",
+		}, []string{"result"}),
+	}
+
+	// The row count is kept up to date from the rows inserted and deleted
+	// rather than counted again every pass, which reads the whole index
+	var rows int64
+	if err := db.QueryRow("SELECT count(*) FROM readings").Scan(&rows); err != nil {
+		app.Logger.Errorf("Failed to count readings in history database: %+v", err)
+	}
+	pruner.rows.Set(float64(rows))
+
+	go pruner.run()
+	return pruner
+}
+
+func (pruner *historyPruner) pruning() bool {
+	return pruner.app.HistoryRetention > 0 || pruner.app.HistoryMaxSize > 0
+}
+
+func (pruner *historyPruner) close() {
+	close(pruner.stop)
+	<-pruner.done
+}
+
+func (pruner *historyPruner) run() {
+	defer close(pruner.done)
+
+	if pruner.pruning() {
+		pruner.checkIncrementalVacuum()
+	}
+
+	ticker := time.NewTicker(historyPruneInterval)
+	defer ticker.Stop()
+	for {
+		if err := pruner.prune(); err != nil {
+			pruner.app.Logger.Errorf("Failed to prune history database: %+v", err)
+			pruner.runs.WithLabelValues("error").Inc()
+		} else {
+			pruner.runs.WithLabelValues("success").Inc()
+		}
+		select {
+		case <-pruner.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkIncrementalVacuum warns if the database was created before pruning
+// was supported. Its deleted readings' pages are reused for new ones, but
+// the file never shrinks until it's converted offline, since converting it
+// rewrites the whole file.
+func (pruner *historyPruner) checkIncrementalVacuum() {
+	var mode int
+	if err := pruner.db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		pruner.app.Logger.Errorf("Failed to read auto_vacuum of history database: %+v", err)
+		return
+	}
+	// 2 is INCREMENTAL
+	if mode != 2 {
+		pruner.app.Logger.Warnw("History database predates incremental vacuum, so pruning won't shrink the file; stop the exporter and run sqlite3 on it with \"PRAGMA auto_vacuum = INCREMENTAL; VACUUM;\" to convert it", "path", pruner.app.HistoryDB)
+	}
+}
+
+// prune deletes the readings older than history_retention, then the
+// oldest readings until the database fits history_max_size, returns the
+// freed pages to the filesystem and updates the size and row gauges.
+func (pruner *historyPruner) prune() error {
+	app := pruner.app
+	start := time.Now()
+	var expired, oversize, reclaimed int64
+
+	if app.HistoryRetention > 0 {
+		cutoff := time.Now().Add(-app.HistoryRetention).Unix()
+		for {
+			deleted, err := pruner.deleteBatch(
+				`DELETE FROM readings WHERE rowid IN (SELECT rowid FROM readings WHERE time < ? LIMIT ?)`,
+				cutoff, historyPruneBatch)
+			if err != nil {
+				return err
+			}
+			expired += deleted
+			pruner.pruned.WithLabelValues("retention").Add(float64(deleted))
+			if deleted < historyPruneBatch || !pruner.pause() {
+				break
+			}
+		}
+	}
+
+	if app.HistoryMaxSize > 0 {
+		for {
+			used, err := pruner.usedBytes()
+			if err != nil {
+				return err
+			}
+			if used <= app.HistoryMaxSize {
+				break
+			}
+			deleted, err := pruner.deleteBatch(
+				`DELETE FROM readings WHERE rowid IN (SELECT rowid FROM readings ORDER BY time LIMIT ?)`,
+				historyPruneBatch)
+			if err != nil {
+				return err
+			}
+			oversize += deleted
+			pruner.pruned.WithLabelValues("max_size").Add(float64(deleted))
+			if deleted == 0 || !pruner.pause() {
+				break
+			}
+		}
+	}
+
+	if pruner.pruning() {
+		var err error
+		if reclaimed, err = pruner.vacuum(); err != nil {
+			return err
+		}
+	}
+	if expired > 0 || oversize > 0 || reclaimed > 0 {
+		app.Logger.Infow("Pruned history database", "expired", expired, "over_max_size", oversize, "reclaimed_bytes", reclaimed, "took", time.Since(start).Round(time.Millisecond).String())
+	}
+
+	size, err := pruner.sizeBytes()
+	if err != nil {
+		return err
+	}
+	pruner.size.Set(float64(size))
+	return nil
+}
+
+func (pruner *historyPruner) deleteBatch(query string, args ...interface{}) (int64, error) {
+	result, err := pruner.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	pruner.rows.Sub(float64(deleted))
+	return deleted, nil
+}
+
+// vacuum returns the pages freed by deleted readings to the filesystem, a
+// batch at a time, and returns the bytes reclaimed.
+func (pruner *historyPruner) vacuum() (int64, error) {
+	var pageSize, reclaimed int64
+	if err := pruner.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	for {
+		var free int64
+		if err := pruner.db.QueryRow("PRAGMA freelist_count").Scan(&free); err != nil {
+			return reclaimed, err
+		}
+		if free == 0 {
+			return reclaimed, nil
+		}
+		pages := free
+		if pages > historyVacuumPages {
+			pages = historyVacuumPages
+		}
+		// PRAGMA doesn't take bound parameters, and incremental_vacuum
+		// frees pages as its result is stepped through
+		rows, err := pruner.db.Query(fmt.Sprintf("PRAGMA incremental_vacuum(%d)", pages))
+		if err != nil {
+			return reclaimed, err
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return reclaimed, err
+		}
+
+		var after int64
+		if err := pruner.db.QueryRow("PRAGMA freelist_count").Scan(&after); err != nil {
+			return reclaimed, err
+		}
+		reclaimed += (free - after) * pageSize
+		pruner.reclaimed.Add(float64((free - after) * pageSize))
+		// A database that isn't in incremental mode never frees pages
+		if after >= free || !pruner.pause() {
+			return reclaimed, nil
+		}
+	}
+}
+
+// sizeBytes is the size of the database file.
+func (pruner *historyPruner) sizeBytes() (int64, error) {
+	var pages, pageSize int64
+	if err := pruner.db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, err
+	}
+	if err := pruner.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return pages * pageSize, nil
+}
+
+// usedBytes is the size of the database file once its free pages are
+// vacuumed.
+func (pruner *historyPruner) usedBytes() (int64, error) {
+	size, err := pruner.sizeBytes()
+	if err != nil {
+		return 0, err
+	}
+	var free, pageSize int64
+	if err := pruner.db.QueryRow("PRAGMA freelist_count").Scan(&free); err != nil {
+		return 0, err
+	}
+	if err := pruner.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return size - free*pageSize, nil
+}
+
+// pause waits between batches, returning false if the pruner is stopping.
+func (pruner *historyPruner) pause() bool {
+	select {
+	case <-pruner.stop:
+		return false
+	case <-time.After(historyPrunePause):
+		return true
+	}
+}
+
+// sizeUnits are the suffixes ParseSize accepts.
+var sizeUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseSize parses a size in bytes with an optional unit, e.g. 500MB or
+// 2GiB, as history_max_size does. KB, MB, GB and TB are powers of 1000 and
+// KiB, MiB, GiB and TiB powers of 1024.
+func ParseSize(value string) (int64, error) {
+	number, multiplier := value, 1.0
+	for _, unit := range sizeUnits {
+		if len(value) > len(unit.suffix) && strings.EqualFold(value[len(value)-len(unit.suffix):], unit.suffix) {
+			number, multiplier = strings.TrimSpace(value[:len(value)-len(unit.suffix)]), unit.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q, want bytes or a number with one of the units B, KB, MB, GB, TB, KiB, MiB, GiB, TiB", value)
+	}
+	return int64(n * multiplier), nil
+}
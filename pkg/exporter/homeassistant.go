@@ -0,0 +1,134 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// homeAssistantSensor describes how Home Assistant should present a sensor.
+type homeAssistantSensor struct {
+	Name        string
+	DeviceClass string
+	Unit        string
+	Icon        string
+}
+
+var homeAssistantSensors = map[string]homeAssistantSensor{
+	"temp":  {Name: "Temperature", DeviceClass: "temperature", Unit: "°C"},
+	"humid": {Name: "Humidity", DeviceClass: "humidity", Unit: "%"},
+	"co2":   {Name: "CO2", DeviceClass: "carbon_dioxide", Unit: "ppm"},
+	"voc":   {Name: "VOC", DeviceClass: "volatile_organic_compounds_parts", Unit: "ppb"},
+	"pm25":  {Name: "PM2.5", DeviceClass: "pm25", Unit: "µg/m³"},
+	"score": {Name: "Score", Icon: "mdi:air-filter"},
+}
+
+type homeAssistantDevice struct {
+	Identifiers  []string   `json:"identifiers"`
+	Connections  [][]string `json:"connections,omitempty"`
+	Name         string     `json:"name"`
+	Manufacturer string     `json:"manufacturer"`
+	Model        string     `json:"model,omitempty"`
+	SWVersion    string     `json:"sw_version,omitempty"`
+}
+
+type homeAssistantConfig struct {
+	Name              string              `json:"name"`
+	UniqueID          string              `json:"unique_id"`
+	ObjectID          string              `json:"object_id"`
+	StateTopic        string              `json:"state_topic"`
+	AvailabilityTopic string              `json:"availability_topic"`
+	DeviceClass       string              `json:"device_class,omitempty"`
+	StateClass        string              `json:"state_class"`
+	Unit              string              `json:"unit_of_measurement,omitempty"`
+	Icon              string              `json:"icon,omitempty"`
+	Device            homeAssistantDevice `json:"device"`
+}
+
+// onMQTTConnect re-announces every device to Home Assistant, since a broker
+// restart may have lost the retained discovery messages.
+func (app *App) onMQTTConnect() {
+	if !app.MQTTHomeAssistant {
+		return
+	}
+	atomic.AddInt32(&app.mqttGeneration, 1)
+	for _, device := range app.Devices() {
+		app.publishHomeAssistant(device)
+	}
+}
+
+// mqttAvailabilityTopic is the device's topic with the sensor replaced by
+// "availability", e.g. awair/{device_name}/availability.
+func (app *App) mqttAvailabilityTopic(device *Device) string {
+	return app.mqttTopic(device, "availability")
+}
+
+// publishHomeAssistant publishes the device's availability after a poll, and
+// its discovery config once per broker connection. Devices are keyed by
+// their UUID, so a device is only announced once its metadata is known.
+func (app *App) publishHomeAssistant(device *Device) {
+	if app.mqttClient == nil || !app.MQTTHomeAssistant {
+		return
+	}
+
+	generation := atomic.LoadInt32(&app.mqttGeneration)
+	device.stateLock.Lock()
+	metadata := device.metadata
+	announce := metadata != nil && device.haGeneration != generation
+	if announce {
+		device.haGeneration = generation
+	}
+	polled, up := !device.lastPoll.IsZero(), device.up
+	device.stateLock.Unlock()
+
+	if announce {
+		for _, reading := range sensorReadings {
+			topic, payload := app.homeAssistantConfig(device, metadata, reading.Sensor)
+			token := app.mqttClient.Publish(topic, app.MQTTQoS, true, payload)
+			go app.awaitMQTTPublish(topic, token)
+		}
+	}
+
+	if polled {
+		availability := "offline"
+		if up {
+			availability = "online"
+		}
+		topic := app.mqttAvailabilityTopic(device)
+		token := app.mqttClient.Publish(topic, app.MQTTQoS, true, availability)
+		go app.awaitMQTTPublish(topic, token)
+	}
+}
+
+func (app *App) homeAssistantConfig(device *Device, metadata *DeviceMetadata, sensor string) (string, []byte) {
+	id := strings.NewReplacer("-", "_", ":", "_").Replace(strings.ToLower(metadata.UUID))
+	uniqueID := fmt.Sprintf("%s_%s", id, sensor)
+	presentation := homeAssistantSensors[sensor]
+
+	config := homeAssistantConfig{
+		Name:              presentation.Name,
+		UniqueID:          uniqueID,
+		ObjectID:          uniqueID,
+		StateTopic:        app.mqttTopic(device, sensor),
+		AvailabilityTopic: app.mqttAvailabilityTopic(device),
+		DeviceClass:       presentation.DeviceClass,
+		StateClass:        "measurement",
+		Unit:              presentation.Unit,
+		Icon:              presentation.Icon,
+		Device: homeAssistantDevice{
+			Identifiers:  []string{metadata.UUID},
+			Name:         device.Name,
+			Manufacturer: "Awair",
+			Model:        metadata.Type,
+			SWVersion:    metadata.Firmware,
+		},
+	}
+	if metadata.MAC != "" {
+		config.Device.Connections = [][]string{{"mac", strings.ToLower(metadata.MAC)}}
+	}
+
+	// Marshalling a struct of strings can't fail
+	payload, _ := json.Marshal(config)
+	return fmt.Sprintf("%s/sensor/%s/config", app.MQTTHomeAssistantPrefix, uniqueID), payload
+}
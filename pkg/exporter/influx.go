@@ -0,0 +1,238 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	influxTokenEnv    = "AWAIR_EXPORTER_INFLUX_TOKEN"
+	influxMeasurement = "awair"
+
+	// influxQueueSize is the number of cycles' batches held while InfluxDB
+	// is slow or unavailable before new batches are dropped.
+	influxQueueSize = 16
+)
+
+func (app *App) loadInfluxToken() error {
+	token := os.Getenv(influxTokenEnv)
+	if app.InfluxTokenFile != "" {
+		contents, err := ioutil.ReadFile(app.InfluxTokenFile)
+		if err != nil {
+			return fmt.Errorf("influx_token_file (%q): %w", app.InfluxTokenFile, err)
+		}
+		token = strings.TrimSpace(string(contents))
+	}
+
+	app.influxToken = token
+	return nil
+}
+
+// influxOutput writes readings to the InfluxDB v2 write API as line protocol,
+// one point per device per poll.
+type influxOutput struct {
+	app      *App
+	writeURL string
+
+	lock  sync.Mutex
+	batch []string
+
+	queue chan []string
+	done  chan struct{}
+
+	pointsWritten prometheus.Counter
+	pointsDropped prometheus.Counter
+	writeErrors   prometheus.Counter
+}
+
+func (app *App) newInfluxOutput() *influxOutput {
+	query := url.Values{}
+	query.Set("org", app.InfluxOrg)
+	query.Set("bucket", app.InfluxBucket)
+	query.Set("precision", "ms")
+
+	factory := promauto.With(app.Registerer)
+	out := &influxOutput{
+		app:      app,
+		writeURL: strings.TrimSuffix(app.InfluxURL, "/") + "/api/v2/write?" + query.Encode(),
+		queue:    make(chan []string, influxQueueSize),
+		done:     make(chan struct{}),
+		pointsWritten: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "influx",
+			Name:      "points_written_total",
+			Help:      "Points written to InfluxDB",
+		}),
+		pointsDropped: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "influx",
+			Name:      "points_dropped_total",
+			Help:      "Points given up on after failed writes or a full queue",
+		}),
+		writeErrors: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "influx",
+			Name:      "write_errors_total",
+			Help:      "Failed InfluxDB write attempts, including ones later retried",
+		}),
+	}
+
+	go out.run()
+	return out
+}
+
+func (out *influxOutput) Record(device *Device, stats AwairStats) {
+	point := influxPoint(device, stats)
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	out.batch = append(out.batch, point)
+}
+
+func (out *influxOutput) Flush() {
+	out.lock.Lock()
+	batch := out.batch
+	out.batch = nil
+	out.lock.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	select {
+	case out.queue <- batch:
+	default:
+		out.pointsDropped.Add(float64(len(batch)))
+		out.app.Logger.Warnf("Dropped (%+v) InfluxDB points, the write queue is full", len(batch))
+	}
+}
+
+func (out *influxOutput) Close(ctx context.Context) {
+	out.Flush()
+	close(out.queue)
+
+	select {
+	case <-out.done:
+	case <-ctx.Done():
+		out.app.Logger.Warnf("Gave up on queued InfluxDB writes at shutdown")
+	}
+}
+
+func (out *influxOutput) run() {
+	defer close(out.done)
+	for batch := range out.queue {
+		if err := out.write(batch); err != nil {
+			out.pointsDropped.Add(float64(len(batch)))
+			out.app.Logger.Errorf("Failed to write (%+v) points to InfluxDB: %+v", len(batch), err)
+			continue
+		}
+		out.pointsWritten.Add(float64(len(batch)))
+	}
+}
+
+// write sends a batch, retrying network errors, 429s and 5xx responses.
+func (out *influxOutput) write(batch []string) error {
+	body := []byte(strings.Join(batch, "\n") + "\n")
+	backoff := outputRetryBackoff
+
+	var err error
+	for attempt := 1; attempt <= outputMaxAttempts; attempt++ {
+		var resp *http.Response
+		resp, err = out.post(body)
+		if err == nil {
+			return nil
+		}
+		out.writeErrors.Inc()
+
+		if resp != nil && !retryableStatus(resp.StatusCode) {
+			return err
+		}
+		if attempt < outputMaxAttempts {
+			time.Sleep(retryAfter(resp, backoff))
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+func (out *influxOutput) post(body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, out.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if out.app.influxToken != "" {
+		req.Header.Set("Authorization", "Token "+out.app.influxToken)
+	}
+
+	resp, err := out.app.pushClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return resp, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return resp, nil
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxPoint formats a reading as a line protocol point tagged with the
+// device's name and labels, timestamped with the device's own clock.
+func influxPoint(device *Device, stats AwairStats) string {
+	var line strings.Builder
+	line.WriteString(influxMeasurementEscaper.Replace(influxMeasurement))
+
+	tags := map[string]string{}
+	for key, value := range device.Labels {
+		tags[key] = value
+	}
+	tags["device"] = device.Name
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		if tags[key] != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&line, ",%s=%s", influxTagEscaper.Replace(key), influxTagEscaper.Replace(tags[key]))
+	}
+
+	for i, reading := range sensorReadings {
+		separator := ","
+		if i == 0 {
+			separator = " "
+		}
+		fmt.Fprintf(&line, "%s%s=%s", separator, reading.Sensor, strconv.FormatFloat(reading.Value(stats), 'f', -1, 64))
+	}
+
+	timestamp := stats.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	fmt.Fprintf(&line, " %d", timestamp.UnixNano()/int64(time.Millisecond))
+
+	return line.String()
+}
@@ -0,0 +1,101 @@
+package exporter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseCIDRs parses a comma-separated list of CIDRs, accepting bare IPs as
+// single-address networks.
+func parseCIDRs(flagName string, list string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	if list == "" {
+		return networks, nil
+	}
+
+	for i, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%s[%d] (%q): not an IP address or CIDR", flagName, i, entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d] (%q): %w", flagName, i, entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client a request originates from. The
+// trusted proxy header is only honored when the direct peer is a trusted
+// proxy, and is walked from the right so that a client can't spoof its
+// address by prepending entries. It returns nil for non-IP peers such as
+// unix socket connections.
+func (app *App) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(app.trustedProxies, ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values(app.TrustedProxyHeader), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(app.trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// filterIPs rejects requests from clients outside allowed_cidrs. Connections
+// over the unix socket are governed by its file permissions instead.
+func (app *App) filterIPs(next http.Handler) http.Handler {
+	if len(app.allowedCIDRs) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isUnixConn(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := app.clientIP(r)
+		if ip == nil || !containsIP(app.allowedCIDRs, ip) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
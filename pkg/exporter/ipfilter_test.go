@@ -0,0 +1,119 @@
+package exporter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := parseCIDRs("allowed_cidrs", "192.168.1.0/24, 10.10.0.5,fd00::/8,2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.77", true},
+		{"192.168.2.1", false},
+		{"10.10.0.5", true},
+		{"10.10.0.6", false},
+		{"::ffff:10.10.0.5", true},
+		{"fd12:3456::1", true},
+		{"fe80::1", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+	} {
+		if got := containsIP(networks, net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("%s allowed = %v, want %v", test.ip, got, test.want)
+		}
+	}
+
+	for _, list := range []string{"192.168.1.0/33", "not-an-ip", "10.0.0.1,", "fd00::/129"} {
+		if _, err := parseCIDRs("allowed_cidrs", list); err == nil {
+			t.Errorf("parseCIDRs(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	app := newTestApp(t, newFakeDeviceClient(), func(app *App) {
+		app.TrustedProxies = "10.0.0.0/8,fd00::/8"
+	}, testAddress)
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct client", "192.168.1.5:5000", nil, "192.168.1.5"},
+		{"untrusted peer can't forward", "192.168.1.5:5000", []string{"203.0.113.9"}, "192.168.1.5"},
+		{"trusted proxy", "10.0.0.2:5000", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"spoofed leftmost entry", "10.0.0.2:5000", []string{"192.168.1.5, 203.0.113.9"}, "203.0.113.9"},
+		{"chain of trusted proxies", "10.0.0.2:5000", []string{"203.0.113.9, 10.0.0.3", "10.0.0.4"}, "203.0.113.9"},
+		{"untrusted proxy hop", "10.0.0.2:5000", []string{"192.168.1.5, 198.51.100.7, 10.0.0.3"}, "198.51.100.7"},
+		{"garbage hop", "10.0.0.2:5000", []string{"192.168.1.5, unknown"}, "10.0.0.2"},
+		{"IPv6 proxy and client", "[fd00::2]:5000", []string{"2001:db8::9"}, "2001:db8::9"},
+		{"unix socket peer", "@", nil, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		got := app.clientIP(r)
+		if (got == nil && test.want != "") || (got != nil && !got.Equal(net.ParseIP(test.want))) {
+			t.Errorf("%s: client IP = %v, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// A unix socket passed by systemd socket activation is exempt from
+// allowed_cidrs like listen_socket, though listen_socket isn't set.
+func TestFilterIPsExemptsUnixSocket(t *testing.T) {
+	app := newTestApp(t, newFakeDeviceClient(), func(app *App) {
+		app.AllowedCIDRs = "192.168.1.0/24"
+	}, testAddress)
+
+	socket := filepath.Join(t.TempDir(), "awair.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := app.newHTTPServer(app.filterIPs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://localhost/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /metrics over the unix socket = %d, want 200", resp.StatusCode)
+	}
+
+	// Over TCP, the loopback client is outside allowed_cidrs
+	tcp := httptest.NewServer(app.filterIPs(http.NotFoundHandler()))
+	defer tcp.Close()
+	resp, err = http.Get(tcp.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /metrics over TCP from loopback = %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,127 @@
+package exporter
+
+import (
+	"html/template"
+	"net/http"
+	"runtime/debug"
+)
+
+// version is set at build time with -ldflags
+// "-X github.com/ericvolp12/awair-local-prom-exporter/pkg/exporter.version=v1.2.3"
+var version = ""
+
+func exporterVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+type landingLink struct {
+	Path        string
+	Description string
+}
+
+type landingPage struct {
+	Version string
+	Links   []landingLink
+	Devices []DeviceStatus
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Awair Local Prometheus Exporter</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.up { color: #2a7d2a; }
+.down { color: #b22222; }
+</style>
+</head>
+<body>
+<h1>Awair Local Prometheus Exporter</h1>
+<p>Version: {{.Version}}</p>
+<ul>
+{{- range .Links}}
+<li><a href="{{.Path}}">{{.Path}}</a> - {{.Description}}</li>
+{{- end}}
+</ul>
+<h2>Devices</h2>
+<table>
+<tr><th>Name</th><th>Address</th><th>Source</th><th>Status</th><th>Last Poll</th><th>Last Error</th></tr>
+{{- range .Devices}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{.Address}}</td>
+<td>{{.Source}}</td>
+{{- if .LastPoll.IsZero}}
+<td>pending</td>
+<td>never</td>
+{{- else}}
+<td class="{{if .Up}}up{{else}}down{{end}}">{{if .Up}}up{{else}}down{{end}}</td>
+<td>{{.LastPoll.Format "2006-01-02 15:04:05 MST"}}</td>
+{{- end}}
+<td>{{.LastError}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+func (app *App) landingLinks() []landingLink {
+	links := []landingLink{
+		{Path: app.TelemetryPath, Description: "Prometheus metrics"},
+		{Path: "/healthz", Description: "Liveness of the exporter and its poll loop"},
+		{Path: "/readyz", Description: "Readiness, once any device has been polled successfully"},
+		{Path: "/dashboard", Description: "Live table of current readings"},
+		{Path: "/api/v1/devices", Description: "Identity and polling state of every device as JSON"},
+		{Path: "/api/v1/readings", Description: "Latest readings of every device as JSON"},
+		{Path: "/api/v1/aggregates", Description: "Mean, max and min of each sensor across the healthy devices as JSON"},
+		{Path: "/api/v1/alert-rules", Description: "Prometheus alerting rules for the configured thresholds"},
+		{Path: "/api/v1/grafana-dashboard", Description: "Grafana dashboard JSON matching this exporter's metrics"},
+		{Path: "/api/v1/stream", Description: "Server-sent events with each new reading"},
+		{Path: "/debug/errors", Description: "Most recent poll errors"},
+		{Path: "/debug/last?device=", Description: "Last raw response from a device, by name or address"},
+		{Path: "/debug/vars", Description: "Internal state of the exporter and its devices as expvar JSON"},
+	}
+	if app.RecentHistory > 0 {
+		links = append(links, landingLink{Path: "/api/v1/history/recent?device=&duration=1h", Description: "Readings of a device kept in memory, up to recent_history back"})
+	}
+	if app.historyDB != nil {
+		links = append(links, landingLink{Path: "/api/v1/history?device=&sensor=co2", Description: "Stored readings of a device, averaged per step"})
+	}
+	if app.RecentHistory > 0 || app.historyDB != nil {
+		links = append(links, landingLink{Path: "/api/v1/history/aggregate?device=&sensor=co2&fn=avg&step=1h", Description: "Average, min or max of a sensor per step, as JSON or CSV"})
+	}
+	if app.pprofOnMainServer() {
+		links = append(links, landingLink{Path: "/debug/pprof/", Description: "Go runtime profiling"})
+	}
+	return links
+}
+
+func (app *App) landingPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := landingPage{
+		Version: exporterVersion(),
+		Links:   app.landingLinks(),
+	}
+	for _, device := range app.Devices() {
+		page.Devices = append(page.Devices, device.Status())
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingTemplate.Execute(w, page); err != nil {
+		app.Logger.Errorf("Failed to render landing page: %+v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package exporter
+
+import (
+	"net/http"
+)
+
+// logLevelRoutes serves the current log level to readers and lets admins
+// change it with a PUT of {"level": "debug"}.
+func (app *App) logLevelRoutes() http.Handler {
+	get := app.requireAuth(app.logLevel)
+	put := app.requireAdmin(app.logLevel)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			put.ServeHTTP(w, r)
+			return
+		}
+		get.ServeHTTP(w, r)
+	})
+}
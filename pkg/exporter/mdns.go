@@ -0,0 +1,142 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+// Awair Elements advertise their local API as a plain HTTP service with an
+// instance name such as "AWAIR-ELEM-1419E1". Other Awair products announce
+// themselves too, but don't serve the local API.
+const (
+	mdnsService        = "_http._tcp"
+	mdnsInstancePrefix = "awair-elem-"
+)
+
+type discoveredDevice struct {
+	Address  string
+	Instance string
+	LastSeen time.Time
+}
+
+func (app *App) discoverDevices(ctx context.Context) {
+	go func() {
+		for {
+			app.browseMDNS()
+			app.retireDiscoveredDevices()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(app.MDNSBrowseInterval):
+			}
+		}
+	}()
+}
+
+func (app *App) browseMDNS() {
+	entries := make(chan *mdns.ServiceEntry, 32)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for entry := range entries {
+			app.handleMDNSEntry(entry)
+		}
+	}()
+
+	params := mdns.DefaultParams(mdnsService)
+	params.Timeout = app.MDNSBrowseTimeout
+	params.Entries = entries
+	params.DisableIPv6 = true
+
+	err := mdns.Query(params)
+	close(entries)
+	<-done
+
+	if err != nil {
+		app.Logger.Errorf("Failed to browse mDNS for Awair devices: %+v", err)
+	}
+}
+
+func (app *App) handleMDNSEntry(entry *mdns.ServiceEntry) {
+	instance := strings.TrimSuffix(entry.Name, "."+mdnsService+".local.")
+	if !strings.HasPrefix(strings.ToLower(instance), mdnsInstancePrefix) {
+		return
+	}
+
+	ip := entry.AddrV4
+	if ip == nil {
+		ip = entry.AddrV6
+	}
+	if ip == nil {
+		app.Logger.Warnf("Ignoring mDNS announcement from (%+v) without an address", instance)
+		return
+	}
+
+	host := ip.String()
+	if entry.Port != 0 && entry.Port != 80 {
+		host = net.JoinHostPort(host, fmt.Sprint(entry.Port))
+	} else if ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	address := fmt.Sprintf("http://%s/air-data/latest", host)
+
+	app.discoveredLock.Lock()
+	defer app.discoveredLock.Unlock()
+
+	device, known := app.discoveredDevices[instance]
+	if known && device.Address == address {
+		device.LastSeen = time.Now()
+		return
+	}
+	if known {
+		delete(app.discoveredDevices, instance)
+		app.forgetDiscoveredDevice(device)
+	}
+
+	// A device already polled from another source, such as awair_addresses,
+	// stays with it and isn't counted as discovered
+	if !app.AddDevice(instance, address, deviceSourceMDNS, nil) {
+		app.Logger.Debugf("Not registering discovered Awair device (%+v) at (%+v), which is already registered", instance, address)
+		return
+	}
+	if known {
+		app.Logger.Infof("Discovered Awair device (%+v) moved from (%+v) to (%+v)", instance, device.Address, address)
+	} else {
+		app.Logger.Infof("Discovered Awair device (%+v) at (%+v)", instance, address)
+	}
+
+	app.discoveredDevices[instance] = &discoveredDevice{
+		Address:  address,
+		Instance: instance,
+		LastSeen: time.Now(),
+	}
+	app.discoveryInfoGauge.WithLabelValues(app.deviceLabel(instance, address, deviceSourceMDNS), instance).Set(1)
+}
+
+// retireDiscoveredDevices drops devices that haven't announced themselves
+// within the grace period so that a single missed browse doesn't flap them.
+func (app *App) retireDiscoveredDevices() {
+	app.discoveredLock.Lock()
+	defer app.discoveredLock.Unlock()
+
+	for instance, device := range app.discoveredDevices {
+		if time.Since(device.LastSeen) < app.MDNSGracePeriod {
+			continue
+		}
+		app.Logger.Infof("Retiring Awair device (%+v) at (%+v), last seen %+v ago", instance, device.Address, time.Since(device.LastSeen).Round(time.Second))
+		delete(app.discoveredDevices, instance)
+		app.forgetDiscoveredDevice(device)
+	}
+}
+
+func (app *App) forgetDiscoveredDevice(device *discoveredDevice) {
+	app.discoveryInfoGauge.DeleteLabelValues(app.deviceLabel(device.Instance, device.Address, deviceSourceMDNS), device.Instance)
+	app.RemoveDevice(device.Address, deviceSourceMDNS)
+}
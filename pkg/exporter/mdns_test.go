@@ -0,0 +1,48 @@
+package exporter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/mdns"
+)
+
+func TestHandleMDNSEntry(t *testing.T) {
+	const static = "http://192.168.1.50/air-data/latest"
+	app := newTestApp(t, newFakeDeviceClient(), nil, static)
+
+	announce := func(instance, ip string) {
+		app.handleMDNSEntry(&mdns.ServiceEntry{
+			Name:   instance + "." + mdnsService + ".local.",
+			AddrV4: net.ParseIP(ip),
+			Port:   80,
+		})
+	}
+	// Another Awair product, without the local API
+	announce("AWAIR-OMNI-0A1B2C", "192.168.1.60")
+	// An Element already configured in awair_addresses
+	announce("AWAIR-ELEM-1419E1", "192.168.1.50")
+	// And one found only through discovery
+	announce("AWAIR-ELEM-2A2B2C", "192.168.1.51")
+
+	if _, ok := app.LookupDevice("http://192.168.1.60/air-data/latest"); ok {
+		t.Errorf("an AWAIR-OMNI instance was registered")
+	}
+	if device, ok := app.LookupDevice(static); !ok || device.Source != deviceSourceStatic {
+		t.Errorf("the configured device was taken over by discovery")
+	}
+	if device, ok := app.LookupDevice("http://192.168.1.51/air-data/latest"); !ok || device.Source != deviceSourceMDNS {
+		t.Errorf("the discovered Element wasn't registered")
+	}
+
+	for instance, want := range map[string]bool{
+		"AWAIR-OMNI-0A1B2C": false,
+		"AWAIR-ELEM-1419E1": false,
+		"AWAIR-ELEM-2A2B2C": true,
+	} {
+		_, ok := metricValue(t, app, "awair_discovery_device_info", map[string]string{"mdns_instance": instance})
+		if ok != want {
+			t.Errorf("awair_discovery_device_info{mdns_instance=%q} exported = %v, want %v", instance, ok, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package exporter
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair"
+)
+
+// metadataRefreshInterval is how often a device's identity is re-read, which
+// picks up firmware upgrades without a restart.
+const metadataRefreshInterval = time.Hour
+
+// AwairConfig is the payload of the local API's /settings/config/data.
+type AwairConfig = awair.DeviceConfig
+
+type DeviceMetadata struct {
+	UUID     string `json:"uuid"`
+	Type     string `json:"type"`
+	Firmware string `json:"firmware"`
+	MAC      string `json:"mac"`
+}
+
+// deviceType extracts the model from a device UUID such as "awair-element_1234".
+func deviceType(uuid string) string {
+	if i := strings.LastIndex(uuid, "_"); i > 0 {
+		return uuid[:i]
+	}
+	return uuid
+}
+
+// refreshMetadata re-reads the device's identity if it's due. Failures are
+// logged and retried on the next refresh without affecting the poll.
+func (app *App) refreshMetadata(ctx context.Context, device *Device) {
+	device.stateLock.Lock()
+	due := time.Since(device.metadataAttempt) >= metadataRefreshInterval || (len(app.MetadataLabels) > 0 && device.metadataLabels == nil)
+	if due {
+		device.metadataAttempt = time.Now()
+	}
+	device.stateLock.Unlock()
+	if !due {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, app.DeviceTimeout)
+	defer cancel()
+
+	metadata, err := app.fetchMetadata(ctx, device.activeEndpoint())
+	if err != nil && app.awaitsMetadataLabels(device) {
+		// The readings aren't held back for as long as the config endpoint
+		// fails, which it may while the air data endpoint works
+		app.Logger.Warnw("Failed to read metadata of Awair device; its sensor series are exported with empty metadata labels, which they keep until the exporter restarts", "device", redactAddress(device.label), "device_name", device.Name, "metadata_labels", app.MetadataLabels, "error", err.Error())
+		app.pinMetadataLabels(device, &DeviceMetadata{})
+		return
+	}
+	if err != nil {
+		app.Logger.Warnf("Failed to read metadata of Awair device (%+v): %+v", device.Name, err)
+		return
+	}
+	app.setMetadata(device, metadata)
+}
+
+// setMetadata records a device's identity and updates its info series.
+func (app *App) setMetadata(device *Device, metadata *DeviceMetadata) {
+	app.devicesLock.RLock()
+	defer app.devicesLock.RUnlock()
+
+	if device.removed {
+		return
+	}
+
+	device.stateLock.Lock()
+	previous := device.metadata
+	device.metadata = metadata
+	device.stateLock.Unlock()
+
+	if previous != nil && *previous != *metadata {
+		app.Logger.Infof("Metadata of Awair device (%+v) changed from (%+v) to (%+v)", device.Name, *previous, *metadata)
+		app.deleteDeviceInfo(device.label, previous)
+	}
+	app.deviceInfoGauge.WithLabelValues(device.label, metadata.UUID, metadata.Type, metadata.Firmware).Set(1)
+	app.pinMetadataLabels(device, metadata)
+}
+
+func (app *App) fetchMetadata(ctx context.Context, awairAddress string) (*DeviceMetadata, error) {
+	client, err := awair.NewClient(awairAddress, app.deviceHTTPClient(awairAddress))
+	if err != nil {
+		return nil, err
+	}
+	app.prepareClient(awairAddress, client)
+
+	config, err := client.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeviceMetadata{
+		UUID:     config.DeviceUUID,
+		Type:     deviceType(config.DeviceUUID),
+		Firmware: config.FwVersion,
+		MAC:      config.WifiMAC,
+	}, nil
+}
+
+func (app *App) deleteDeviceInfo(label string, metadata *DeviceMetadata) {
+	app.deviceInfoGauge.DeleteLabelValues(label, metadata.UUID, metadata.Type, metadata.Firmware)
+}
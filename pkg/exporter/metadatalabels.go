@@ -0,0 +1,134 @@
+package exporter
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// metadataLabelNames maps the fields metadata_labels can copy onto the
+// sensor series to the labels they're copied as, named as in
+// awair_device_info.
+var metadataLabelNames = map[string]string{
+	"uuid":     "device_uuid",
+	"name":     "device_name",
+	"type":     "device_type",
+	"firmware": "firmware_version",
+}
+
+// validateMetadataLabels checks metadata_labels, and that its labels don't
+// clash with those of relabel_file or a polling group.
+func (app *App) validateMetadataLabels() []error {
+	errs := []error{}
+	seen := map[string]bool{}
+	for _, field := range app.MetadataLabels {
+		label, ok := metadataLabelNames[field]
+		if !ok {
+			errs = append(errs, fmt.Errorf("metadata_labels (%q): must be among uuid, name, type, firmware", field))
+			continue
+		}
+		if seen[field] {
+			errs = append(errs, fmt.Errorf("metadata_labels (%q): listed more than once", field))
+			continue
+		}
+		seen[field] = true
+
+		for _, name := range app.relabelNames {
+			if name == label {
+				errs = append(errs, fmt.Errorf("metadata_labels (%q): label %q is also produced by relabel_file", field, label))
+			}
+		}
+		for _, group := range app.groupEntries {
+			if _, ok := group.Labels[label]; ok {
+				errs = append(errs, fmt.Errorf("metadata_labels (%q): label %q is also a constant label of group %q", field, label, group.Name))
+			}
+		}
+	}
+	return errs
+}
+
+// metadataLabelKeys returns the labels metadata_labels adds to the sensor
+// series, in the order given.
+func (app *App) metadataLabelKeys() []string {
+	labels := make([]string, 0, len(app.MetadataLabels))
+	for _, field := range app.MetadataLabels {
+		labels = append(labels, metadataLabelNames[field])
+	}
+	return labels
+}
+
+// metadataLabelValues returns the values of the metadata labels of a device
+// with the given identity.
+func (app *App) metadataLabelValues(device *Device, metadata *DeviceMetadata) []string {
+	values := make([]string, 0, len(app.MetadataLabels))
+	for _, field := range app.MetadataLabels {
+		switch field {
+		case "uuid":
+			values = append(values, metadata.UUID)
+		case "name":
+			values = append(values, device.Name)
+		case "type":
+			values = append(values, metadata.Type)
+		case "firmware":
+			values = append(values, metadata.Firmware)
+		}
+	}
+	return values
+}
+
+// metadataLabelsFromDevice reports whether metadata_labels takes any label
+// from the metadata a device reports, rather than only its name, which is
+// known from the start.
+func (app *App) metadataLabelsFromDevice() bool {
+	for _, field := range app.MetadataLabels {
+		if field != "name" {
+			return true
+		}
+	}
+	return false
+}
+
+// pinMetadataLabels fixes the metadata labels of a device from the first
+// identity it reports. The series of a device must keep their labels, so a
+// later change, such as a firmware upgrade, is only logged, once, and picked
+// up on the next restart.
+func (app *App) pinMetadataLabels(device *Device, metadata *DeviceMetadata) {
+	if len(app.MetadataLabels) == 0 {
+		return
+	}
+	values := app.metadataLabelValues(device, metadata)
+
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	if device.metadataLabels == nil {
+		device.metadataLabels = values
+		return
+	}
+	if !reflect.DeepEqual(device.metadataLabels, values) && !reflect.DeepEqual(device.metadataReported, values) {
+		device.metadataReported = values
+		app.Logger.Warnw("Metadata of Awair device changed; its sensor series keep their metadata labels until the exporter restarts", "device", redactAddress(device.label), "device_name", device.Name, "labels", device.metadataLabels, "reported", values)
+	}
+}
+
+// awaitsMetadataLabels reports whether the device's sensor series are held
+// back until it has reported the identity their metadata labels are taken
+// from, or failed to.
+func (app *App) awaitsMetadataLabels(device *Device) bool {
+	if len(app.MetadataLabels) == 0 {
+		return false
+	}
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	return device.metadataLabels == nil
+}
+
+// sensorLabels returns the label values of one of the device's sensor
+// series: its seriesLabels followed by its group and metadata labels.
+func (app *App) sensorLabels(device *Device, values ...string) []string {
+	labels := append(device.seriesLabels(values...), device.Group)
+	if len(app.MetadataLabels) == 0 {
+		return labels
+	}
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	return append(labels, device.metadataLabels...)
+}
@@ -0,0 +1,47 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+)
+
+// A device whose config endpoint fails still has its readings exported,
+// with empty metadata labels other than its name.
+func TestMetadataLabelsWithoutMetadata(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Score: 92}, nil)
+	app := newTestApp(t, client, func(app *App) {
+		app.MetadataLabels = []string{"uuid", "name"}
+	}, testAddress)
+
+	pollOnce(app)
+
+	labels := map[string]string{"device_address": testAddress, "device_uuid": "", "device_name": "living-room"}
+	if got, ok := metricValue(t, app, "awair_air_quality_score", labels); !ok || got != 92 {
+		t.Errorf("score = %v (exported %v), want 92 with empty metadata labels", got, ok)
+	}
+
+	// The metadata isn't read again every poll
+	device, _ := app.LookupDevice(testAddress)
+	device.stateLock.Lock()
+	attempt := device.metadataAttempt
+	device.stateLock.Unlock()
+	pollOnce(app)
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	if !device.metadataAttempt.Equal(attempt) {
+		t.Errorf("metadata read again on the next poll")
+	}
+}
+
+// With the name the only metadata label, nothing needs to be read first.
+func TestMetadataLabelsNameOnly(t *testing.T) {
+	app := newTestApp(t, newFakeDeviceClient(), func(app *App) {
+		app.MetadataLabels = []string{"name"}
+	}, testAddress)
+
+	device, _ := app.LookupDevice(testAddress)
+	if app.awaitsMetadataLabels(device) {
+		t.Errorf("device awaits its metadata with only the name label")
+	}
+}
@@ -0,0 +1,94 @@
+package exporter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Ways the sensor readings are exported, chosen with metric_style: a gauge
+// per sensor, a single awair_sensor_value gauge with a sensor label, or
+// both.
+const (
+	MetricStyleSplit    = "split"
+	MetricStyleCombined = "combined"
+	MetricStyleBoth     = "both"
+)
+
+// sensorUnits gives the unit label of each sensor in awair_sensor_value.
+var sensorUnits = map[string]string{
+	"temp":  "celsius",
+	"humid": "percent",
+	"co2":   "ppm",
+	"voc":   "ppb",
+	"pm25":  "ug_m3",
+	"score": "score",
+}
+
+func (app *App) validateMetricStyle() error {
+	switch app.MetricStyle {
+	case MetricStyleSplit, MetricStyleCombined, MetricStyleBoth:
+		return nil
+	}
+	return fmt.Errorf("metric_style (%q): must be one of split, combined, both", app.MetricStyle)
+}
+
+// exportsSplit and exportsCombined report whether the sensor readings are
+// exported as a gauge per sensor and as awair_sensor_value.
+func (app *App) exportsSplit() bool {
+	return app.MetricStyle != MetricStyleCombined
+}
+
+func (app *App) exportsCombined() bool {
+	return app.MetricStyle == MetricStyleCombined || app.MetricStyle == MetricStyleBoth
+}
+
+// setSensorGauges sets the series of the sensor gauges with the given label
+// values, under both their names with legacy_metrics.
+func (app *App) setSensorGauges(labels []string, stats AwairStats) {
+	for _, sensor := range sensorReadings {
+		for _, gauge := range app.sensorGauges[sensor.Sensor] {
+			gauge.WithLabelValues(labels...).Set(sensor.Value(stats))
+		}
+	}
+}
+
+// deleteSensorGauges deletes the series of the sensor gauges with the given
+// label values.
+func (app *App) deleteSensorGauges(labels []string) {
+	for _, gauges := range app.sensorGauges {
+		for _, gauge := range gauges {
+			gauge.DeleteLabelValues(labels...)
+		}
+	}
+}
+
+// setSensorValues sets the device's series of awair_sensor_value.
+func (app *App) setSensorValues(device *Device, stats AwairStats) {
+	source := device.dataSource()
+	for _, sensor := range sensorReadings {
+		app.sensorValueGauge.WithLabelValues(app.sensorLabels(device, source, sensor.Sensor, sensorUnits[sensor.Sensor])...).Set(sensor.Value(stats))
+	}
+}
+
+// deleteSensorValues deletes the device's series of awair_sensor_value.
+func (app *App) deleteSensorValues(device *Device) {
+	source := device.dataSource()
+	for _, sensor := range sensorReadings {
+		app.sensorValueGauge.DeleteLabelValues(app.sensorLabels(device, source, sensor.Sensor, sensorUnits[sensor.Sensor])...)
+	}
+}
+
+// sensorSelector returns the PromQL selector of a sensor's series, with the
+// given label matchers, in the metric_style exported: its own gauge, or
+// awair_sensor_value unless that gauge is exported too.
+func (app *App) sensorSelector(sensor sensorReading, matchers ...string) string {
+	metric := sensor.Metric
+	if !app.exportsSplit() {
+		metric = "awair_sensor_value"
+		matchers = append([]string{fmt.Sprintf("sensor=%q", sensor.Sensor)}, matchers...)
+	}
+	if len(matchers) == 0 {
+		return metric
+	}
+	return metric + "{" + strings.Join(matchers, ",") + "}"
+}
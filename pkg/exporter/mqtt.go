@@ -0,0 +1,111 @@
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const mqttPasswordEnv = "AWAIR_EXPORTER_MQTT_PASSWORD"
+
+// mqttPublishTimeout bounds how long a publish may wait for the broker to
+// acknowledge it before it is counted as failed.
+const mqttPublishTimeout = 10 * time.Second
+
+func (app *App) loadMQTTPassword() error {
+	password := os.Getenv(mqttPasswordEnv)
+	if app.MQTTPasswordFile != "" {
+		contents, err := ioutil.ReadFile(app.MQTTPasswordFile)
+		if err != nil {
+			return fmt.Errorf("mqtt_password_file (%q): %w", app.MQTTPasswordFile, err)
+		}
+		password = strings.TrimSpace(string(contents))
+	}
+
+	app.mqttPassword = password
+	return nil
+}
+
+// connectMQTT starts a client that connects to the broker in the background,
+// retrying and reconnecting with backoff for as long as the exporter runs.
+func (app *App) connectMQTT() {
+	factory := promauto.With(app.Registerer)
+	app.mqttPublishes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "awair",
+		Subsystem: "mqtt",
+		Name:      "publishes_total",
+		Help:      "MQTT messages published, by result",
+	}, []string{"result"})
+	app.mqttConnected = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: "awair",
+		Subsystem: "mqtt",
+		Name:      "connected",
+		Help:      "Set to 1 while connected to the MQTT broker",
+	})
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(app.MQTTBroker)
+	opts.SetClientID(app.MQTTClientID)
+	opts.SetUsername(app.MQTTUsername)
+	opts.SetPassword(app.mqttPassword)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(2 * time.Minute)
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		app.Logger.Infof("Connected to MQTT broker (%+v)", app.MQTTBroker)
+		app.mqttConnected.Set(1)
+		go app.onMQTTConnect()
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		app.Logger.Warnf("Lost connection to MQTT broker (%+v), reconnecting: %+v", app.MQTTBroker, err)
+		app.mqttConnected.Set(0)
+	})
+
+	app.mqttClient = mqtt.NewClient(opts)
+	app.mqttClient.Connect()
+}
+
+// mqttTopic fills in the topic template for one sensor of a device.
+func (app *App) mqttTopic(device *Device, sensor string) string {
+	return strings.NewReplacer(
+		"{device_name}", device.Name,
+		"{sensor}", sensor,
+	).Replace(app.MQTTTopic)
+}
+
+// publishMQTT publishes each sensor of a reading without waiting for the
+// broker; acknowledgements are counted as they arrive.
+func (app *App) publishMQTT(device *Device, stats AwairStats) {
+	if app.mqttClient == nil {
+		return
+	}
+
+	for _, reading := range sensorReadings {
+		payload := strconv.FormatFloat(reading.Value(stats), 'f', -1, 64)
+		topic := app.mqttTopic(device, reading.Sensor)
+		token := app.mqttClient.Publish(topic, app.MQTTQoS, app.MQTTRetain, payload)
+		go app.awaitMQTTPublish(topic, token)
+	}
+}
+
+func (app *App) awaitMQTTPublish(topic string, token mqtt.Token) {
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		app.mqttPublishes.WithLabelValues("failure").Inc()
+		app.Logger.Warnf("Timed out publishing to MQTT topic (%+v)", topic)
+		return
+	}
+	if err := token.Error(); err != nil {
+		app.mqttPublishes.WithLabelValues("failure").Inc()
+		app.Logger.Warnf("Failed to publish to MQTT topic (%+v): %+v", topic, err)
+		return
+	}
+	app.mqttPublishes.WithLabelValues("success").Inc()
+}
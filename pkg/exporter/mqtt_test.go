@@ -0,0 +1,71 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// blockingMQTTClient is an MQTT client whose publishes block until
+// released, as they do while the client's queue is full.
+type blockingMQTTClient struct {
+	mqtt.Client
+	published chan struct{}
+	release   chan struct{}
+}
+
+func (c *blockingMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	select {
+	case c.published <- struct{}{}:
+	default:
+	}
+	<-c.release
+	return doneToken{}
+}
+
+type doneToken struct {
+	mqtt.Token
+}
+
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+
+// A publish stuck on the broker doesn't hold up removing or pausing
+// devices.
+func TestBlockedMQTTPublishDoesNotHoldDevicesLock(t *testing.T) {
+	const other = "http://bedroom/air-data/latest"
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Score: 92}, nil)
+	app := newTestApp(t, client, func(app *App) {
+		app.MQTTAggregateTopic = "awair/house/{sensor}/{agg}"
+	}, testAddress, other)
+	mqttClient := &blockingMQTTClient{published: make(chan struct{}, 1), release: make(chan struct{})}
+	app.mqttClient = mqttClient
+	app.mqttPublishes = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "publishes_total"}, []string{"result"})
+
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		device, _ := app.LookupDevice(testAddress)
+		app.updateDevice(device, AwairStats{Timestamp: time.Now(), Score: 92})
+	}()
+	<-mqttClient.published
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		device, _ := app.LookupDevice(testAddress)
+		app.SetDevicePaused(device, true)
+		app.RemoveDevice(other, deviceSourceStatic)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		close(mqttClient.release)
+		t.Fatal("pausing and removing devices waited on a blocked MQTT publish")
+	}
+	close(mqttClient.release)
+	<-polled
+}
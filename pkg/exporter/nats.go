@@ -0,0 +1,137 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// natsOutput publishes readings to NATS, either one message per sensor when
+// the subject template contains {sensor}, or one JSON message per device.
+// Publishes are buffered by the client, and held across reconnects, so they
+// never block polling.
+type natsOutput struct {
+	app  *App
+	conn *nats.Conn
+
+	publishes *prometheus.CounterVec
+	connected prometheus.Gauge
+}
+
+func (app *App) newNATSOutput() (*natsOutput, error) {
+	factory := promauto.With(app.Registerer)
+	out := &natsOutput{
+		app: app,
+		publishes: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "nats",
+			Name:      "publishes_total",
+			Help:      "NATS messages published, by result",
+		}, []string{"result"}),
+		connected: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: "awair",
+			Subsystem: "nats",
+			Name:      "connected",
+			Help:      "Set to 1 while connected to a NATS server",
+		}),
+	}
+
+	opts := []nats.Option{
+		nats.Name("awair-local-prom-exporter"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2 * time.Second),
+		nats.ConnectHandler(func(conn *nats.Conn) {
+			app.Logger.Infof("Connected to NATS server (%+v)", conn.ConnectedUrlRedacted())
+			out.connected.Set(1)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			app.Logger.Infof("Reconnected to NATS server (%+v)", conn.ConnectedUrlRedacted())
+			out.connected.Set(1)
+		}),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				app.Logger.Warnf("Lost connection to NATS, reconnecting: %+v", err)
+			}
+			out.connected.Set(0)
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			out.publishes.WithLabelValues("failure").Inc()
+			app.Logger.Warnf("NATS error: %+v", err)
+		}),
+	}
+	if app.NATSCredentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(app.NATSCredentialsFile))
+	}
+	if app.NATSNKeyFile != "" {
+		opt, err := nats.NkeyOptionFromSeed(app.NATSNKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+
+	conn, err := nats.Connect(app.NATSURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	out.conn = conn
+	if conn.IsConnected() {
+		out.connected.Set(1)
+	}
+	return out, nil
+}
+
+// natsSubject fills in the subject template. Device names become a single
+// token so that dots in an address don't add levels to the subject.
+func (app *App) natsSubject(device *Device, sensor string) string {
+	return strings.NewReplacer(
+		"{device}", metricPathSegment(device.Name),
+		"{sensor}", sensor,
+	).Replace(app.NATSSubject)
+}
+
+func (out *natsOutput) Record(device *Device, stats AwairStats) {
+	if !strings.Contains(out.app.NATSSubject, "{sensor}") {
+		payload, err := json.Marshal(jsonReading{Device: device.Name, Labels: device.Labels, AwairStats: stats})
+		if err != nil {
+			out.app.Logger.Errorf("Failed to encode reading of Awair device (%+v) for NATS: %+v", device.Name, err)
+			return
+		}
+		out.publish(out.app.natsSubject(device, ""), payload)
+		return
+	}
+
+	for _, reading := range sensorReadings {
+		payload := strconv.FormatFloat(reading.Value(stats), 'f', -1, 64)
+		out.publish(out.app.natsSubject(device, reading.Sensor), []byte(payload))
+	}
+}
+
+func (out *natsOutput) publish(subject string, payload []byte) {
+	if err := out.conn.Publish(subject, payload); err != nil {
+		out.publishes.WithLabelValues("failure").Inc()
+		out.app.Logger.Warnf("Failed to publish to NATS subject (%+v): %+v", subject, err)
+		return
+	}
+	out.publishes.WithLabelValues("success").Inc()
+}
+
+func (out *natsOutput) Flush() {}
+
+// Close waits for buffered messages to reach the server, if it's connected,
+// before disconnecting.
+func (out *natsOutput) Close(ctx context.Context) {
+	if out.conn.IsConnected() {
+		if err := out.conn.FlushWithContext(ctx); err != nil {
+			out.app.Logger.Warnf("Gave up on buffered NATS messages at shutdown: %+v", err)
+		}
+	}
+	out.conn.Close()
+}
@@ -0,0 +1,72 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// RunOnce polls every device a single time and writes the resulting Awair
+// metrics in the text exposition format to outputPath, or stdout if empty.
+// Metrics are written even if some devices failed.
+func (app *App) RunOnce(ctx context.Context, outputPath string) error {
+	if err := app.setup(true); err != nil {
+		return err
+	}
+
+	if app.DiscoverMDNS {
+		app.browseMDNS()
+	}
+
+	devices := app.Devices()
+	failed := []string{}
+	for _, device := range devices {
+		if err := app.getAwairData(ctx, device); err != nil {
+			failed = append(failed, device.Address)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.ShutdownGracePeriod)
+	defer cancel()
+	app.closeOutputs(ctx)
+
+	out := io.Writer(os.Stdout)
+	if outputPath != "" {
+		f, err := os.Create(outputPath)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if err := writeAwairMetrics(out, app.Gatherer); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d devices failed: %s", len(failed), len(devices), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func writeAwairMetrics(w io.Writer, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "awair_") {
+			continue
+		}
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Option changes the configuration of an exporter, returning an error if
+// the change is invalid.
+type Option func(app *App) error
+
+// Apply applies options to an exporter that isn't running yet, for settings
+// that are only known after it was created, such as from flags. It stops at
+// the first invalid option.
+func (app *App) Apply(opts ...Option) error {
+	for _, opt := range opts {
+		if err := opt(app); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithLogger logs to logger. level is the level logger was built with, which
+// the /-/log-level endpoint changes at runtime.
+func WithLogger(logger *zap.SugaredLogger, level zap.AtomicLevel) Option {
+	return func(app *App) error {
+		if logger == nil {
+			return fmt.Errorf("logger must not be nil")
+		}
+		app.Logger = logger
+		app.logLevel = level
+		app.LogLevel = level.Level()
+		return nil
+	}
+}
+
+// WithAddresses polls the devices at the given air-data URLs. At least one
+// is required, and each must be an http:// or https:// URL.
+func WithAddresses(addresses ...string) Option {
+	return func(app *App) error {
+		if len(addresses) == 0 {
+			return fmt.Errorf("at least one device address is required")
+		}
+		for _, address := range addresses {
+			if err := validateDeviceAddress(address); err != nil {
+				return fmt.Errorf("device address (%q): %w", address, err)
+			}
+		}
+		app.AwairAddresses = addresses
+		return nil
+	}
+}
+
+// WithPollInterval sets the time between poll cycles.
+func WithPollInterval(interval time.Duration) Option {
+	return func(app *App) error {
+		if interval <= 0 {
+			return fmt.Errorf("poll interval must be positive")
+		}
+		app.TimeBetweenChecks = interval
+		return nil
+	}
+}
+
+// WithHTTPClient sends device requests with client instead of one built
+// from DeviceTimeout and the source interface or address.
+func WithHTTPClient(client *http.Client) Option {
+	return func(app *App) error {
+		if client == nil {
+			return fmt.Errorf("HTTP client must not be nil")
+		}
+		app.httpClient = client
+		return nil
+	}
+}
+
+// WithDeviceClient polls local devices through client instead of their
+// local API.
+func WithDeviceClient(client DeviceClient) Option {
+	return func(app *App) error {
+		if client == nil {
+			return fmt.Errorf("device client must not be nil")
+		}
+		app.deviceClient = client
+		return nil
+	}
+}
+
+// WithRegisterer registers the exporter's metrics with registerer and
+// serves them from gatherer instead of a registry of its own. gatherer may
+// be nil if registerer is also a Gatherer, such as a *prometheus.Registry.
+func WithRegisterer(registerer prometheus.Registerer, gatherer prometheus.Gatherer) Option {
+	return func(app *App) error {
+		if registerer == nil {
+			return fmt.Errorf("registerer must not be nil")
+		}
+		if gatherer == nil {
+			var ok bool
+			if gatherer, ok = registerer.(prometheus.Gatherer); !ok {
+				return fmt.Errorf("a gatherer is required for a registerer that isn't also one")
+			}
+		}
+		app.Registerer = registerer
+		app.Gatherer = gatherer
+		return nil
+	}
+}
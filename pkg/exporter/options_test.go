@@ -0,0 +1,53 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestNewAppRejectsInvalidOptions(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"no addresses":      WithAddresses(),
+		"empty address":     WithAddresses(testAddress, ""),
+		"address scheme":    WithAddresses("ftp://living-room/air-data/latest"),
+		"zero interval":     WithPollInterval(0),
+		"nil HTTP client":   WithHTTPClient(nil),
+		"nil device client": WithDeviceClient(nil),
+		"nil logger":        WithLogger(nil, zap.NewAtomicLevel()),
+	} {
+		if app, err := NewApp(opt); err == nil || app != nil {
+			t.Errorf("NewApp with %s = %v, %v, want an error and no exporter", name, app, err)
+		}
+	}
+
+	app, err := NewApp(WithAddresses(testAddress), WithPollInterval(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Apply(WithAddresses()); err == nil {
+		t.Errorf("Apply(WithAddresses()) succeeded, want an error")
+	}
+	if len(app.AwairAddresses) != 1 {
+		t.Errorf("addresses after a rejected Apply = %v, want them unchanged", app.AwairAddresses)
+	}
+}
+
+func TestConfigureRejectsNoDevices(t *testing.T) {
+	t.Setenv(adminTokenEnv, "")
+	app, err := NewApp(WithRegisterer(prometheus.NewRegistry(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := app.Configure()
+	found := false
+	for _, err := range errs {
+		found = found || strings.Contains(err.Error(), "no devices configured")
+	}
+	if !found {
+		t.Errorf("Configure without devices = %v, want a no devices error", errs)
+	}
+}
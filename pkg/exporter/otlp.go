@@ -0,0 +1,243 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// otlpUnits gives each sensor's unit in UCUM, as OTLP expects.
+var otlpUnits = map[string]string{
+	"temp":  "Cel",
+	"humid": "%",
+	"co2":   "[ppm]",
+	"voc":   "[ppb]",
+	"pm25":  "ug/m3",
+	"score": "1",
+}
+
+// The OTLP/HTTP JSON encoding of ExportMetricsServiceRequest, trimmed to the
+// gauges the exporter sends.
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpMetric struct {
+	Name  string    `json:"name"`
+	Unit  string    `json:"unit"`
+	Gauge otlpGauge `json:"gauge"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	TimeUnixNano string  `json:"timeUnixNano"`
+	AsDouble     float64 `json:"asDouble"`
+}
+
+type otlpAttribute struct {
+	Key   string             `json:"key"`
+	Value otlpAttributeValue `json:"value"`
+}
+
+type otlpAttributeValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpString(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAttributeValue{StringValue: value}}
+}
+
+// otlpOutput exports the latest reading of every device as OTel gauges over
+// OTLP/HTTP on its own interval. It reads the readings the poll loop already
+// keeps rather than polling devices itself.
+type otlpOutput struct {
+	app *App
+
+	closed chan struct{}
+	done   chan struct{}
+
+	exportErrors prometheus.Counter
+}
+
+func (app *App) newOTLPOutput() *otlpOutput {
+	out := &otlpOutput{
+		app:    app,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+		exportErrors: promauto.With(app.Registerer).NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "otlp",
+			Name:      "export_errors_total",
+			Help:      "Failed OTLP metric exports",
+		}),
+	}
+
+	go out.run()
+	return out
+}
+
+// Record and Flush are no-ops: exports run on otlp_interval rather than per
+// poll cycle.
+func (out *otlpOutput) Record(device *Device, stats AwairStats) {}
+
+func (out *otlpOutput) Flush() {}
+
+func (out *otlpOutput) Close(ctx context.Context) {
+	close(out.closed)
+
+	select {
+	case <-out.done:
+	case <-ctx.Done():
+	}
+}
+
+func (out *otlpOutput) run() {
+	defer close(out.done)
+
+	ticker := time.NewTicker(out.app.OTLPInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-out.closed:
+			out.export()
+			return
+		}
+		out.export()
+	}
+}
+
+func (out *otlpOutput) export() {
+	request := out.app.otlpRequest()
+	if len(request.ResourceMetrics) == 0 {
+		return
+	}
+
+	if err := out.post(request); err != nil {
+		out.exportErrors.Inc()
+		out.app.Logger.Errorf("Failed to export metrics over OTLP to (%+v): %+v", out.app.OTLPEndpoint, err)
+	}
+}
+
+func (out *otlpOutput) post(request otlpRequest) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(out.app.OTLPEndpoint, "/") + "/v1/metrics"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range out.app.otlpHeaders {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := out.app.pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// otlpRequest builds one resource per device that's up, carrying the
+// device's identity and labels, with a gauge per sensor.
+func (app *App) otlpRequest() otlpRequest {
+	request := otlpRequest{ResourceMetrics: []otlpResourceMetrics{}}
+
+	for _, device := range app.Devices() {
+		status := device.Status()
+		reading := device.LastReading()
+		if !status.Up || status.Paused || reading == nil {
+			continue
+		}
+
+		attributes := []otlpAttribute{
+			otlpString("service.name", "awair-local-prom-exporter"),
+			otlpString("device.name", status.Name),
+		}
+		if status.Metadata != nil {
+			attributes = append(attributes,
+				otlpString("device.id", status.Metadata.UUID),
+				otlpString("device.model.identifier", status.Metadata.Type),
+			)
+		}
+		keys := make([]string, 0, len(status.Labels))
+		for key := range status.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			attributes = append(attributes, otlpString(key, status.Labels[key]))
+		}
+
+		timestamp := reading.Timestamp
+		if timestamp.IsZero() {
+			timestamp = status.LastSuccess
+		}
+
+		metrics := []otlpMetric{}
+		for _, sensor := range sensorReadings {
+			metrics = append(metrics, otlpMetric{
+				Name: "awair." + sensor.Sensor,
+				Unit: otlpUnits[sensor.Sensor],
+				Gauge: otlpGauge{DataPoints: []otlpDataPoint{{
+					TimeUnixNano: strconv.FormatInt(timestamp.UnixNano(), 10),
+					AsDouble:     sensor.Value(*reading),
+				}}},
+			})
+		}
+
+		request.ResourceMetrics = append(request.ResourceMetrics, otlpResourceMetrics{
+			Resource: otlpResource{Attributes: attributes},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: "github.com/ericvolp12/awair-local-prom-exporter", Version: exporterVersion()},
+				Metrics: metrics,
+			}},
+		})
+	}
+
+	return request
+}
@@ -0,0 +1,128 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// output is a destination that readings are pushed to, batched per poll
+// cycle so that each cycle costs one request per destination.
+type output interface {
+	// Record adds a reading to the current batch.
+	Record(device *Device, stats AwairStats)
+	// Flush hands the current batch off for sending without blocking the
+	// poll loop.
+	Flush()
+	// Close sends whatever is still queued, giving up when ctx is done.
+	Close(ctx context.Context)
+}
+
+func (app *App) recordOutputs(device *Device, stats AwairStats) {
+	app.outputsLock.RLock()
+	defer app.outputsLock.RUnlock()
+	for _, out := range app.outputs {
+		out.Record(device, stats)
+	}
+}
+
+func (app *App) flushOutputs() {
+	app.outputsLock.RLock()
+	defer app.outputsLock.RUnlock()
+	for _, out := range app.outputs {
+		out.Flush()
+	}
+}
+
+// closeOutputs detaches the outputs before closing them, so that a poll
+// still running during shutdown can't record to a closed output.
+func (app *App) closeOutputs(ctx context.Context) {
+	app.outputsLock.Lock()
+	outputs := app.outputs
+	app.outputs = nil
+	app.outputsLock.Unlock()
+
+	for _, out := range outputs {
+		out.Close(ctx)
+	}
+}
+
+// Pushes that fail transiently are retried with exponential backoff, starting
+// at outputRetryBackoff, up to outputMaxAttempts times in all.
+const (
+	outputMaxAttempts  = 4
+	outputRetryBackoff = time.Second
+)
+
+// retryableStatus reports whether a push rejected with status may succeed if
+// retried later.
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// retryAfter returns the delay asked for by a Retry-After header in seconds,
+// or fallback if there is none.
+func retryAfter(resp *http.Response, fallback time.Duration) time.Duration {
+	if resp == nil {
+		return fallback
+	}
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// errorLogInterval is the shortest time between repeated error logs from an
+// output whose destination is unreachable.
+const errorLogInterval = time.Minute
+
+// rateLimitedLog logs at most once per errorLogInterval, reporting how many
+// messages were suppressed in between.
+type rateLimitedLog struct {
+	lock       sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func (limit *rateLimitedLog) Errorf(app *App, format string, args ...interface{}) {
+	limit.lock.Lock()
+	defer limit.lock.Unlock()
+
+	if time.Since(limit.last) < errorLogInterval {
+		limit.suppressed++
+		return
+	}
+	if limit.suppressed > 0 {
+		format += fmt.Sprintf(" (%d similar errors suppressed)", limit.suppressed)
+	}
+	app.Logger.Errorf(format, args...)
+	limit.last = time.Now()
+	limit.suppressed = 0
+}
+
+// parseHeaders parses a comma-separated list of key=value headers, as in
+// OTEL_EXPORTER_OTLP_HEADERS.
+func parseHeaders(list string) (http.Header, error) {
+	headers := http.Header{}
+	for _, pair := range strings.Split(list, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("(%q) must be key=value", pair)
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("(%q): %w", pair, err)
+		}
+		headers.Set(strings.TrimSpace(key), decoded)
+	}
+	return headers, nil
+}
@@ -0,0 +1,34 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+)
+
+// recoverPanic logs a panic recovered while polling, with its stack, and
+// counts it in awair_exporter_panics_total. With crash_on_panic it panics
+// again instead, taking the process down for its supervisor to restart.
+func (app *App) recoverPanic(recovered interface{}, fields ...interface{}) error {
+	err := fmt.Errorf("panic: %v", recovered)
+	if app.panics != nil {
+		app.panics.Inc()
+	}
+	app.Logger.Errorw("Recovered from a panic while polling", append(fields, "error", err.Error(), "stack", string(debug.Stack()))...)
+	if app.CrashOnPanic {
+		panic(recovered)
+	}
+	return err
+}
+
+// pollCycle runs a poll cycle, recovering from a panic in it so that the
+// poll loop carries on with the next cycle rather than dying while the
+// server keeps serving stale readings.
+func (app *App) pollCycle(ctx context.Context) {
+	defer func() {
+		if r := recover(); r != nil {
+			app.recoverPanic(r)
+		}
+	}()
+	app.pollDevices(ctx)
+}
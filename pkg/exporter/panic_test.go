@@ -0,0 +1,57 @@
+package exporter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestPanickingClientKeepsLoopAlive polls a device whose client panics
+// next to one that works, and checks that the poll loop carries on and the
+// panics are counted.
+func TestPanickingClientKeepsLoopAlive(t *testing.T) {
+	const (
+		panicking = "http://panicking/air-data/latest"
+		working   = "http://working/air-data/latest"
+	)
+	client := newFakeDeviceClient()
+	client.fetch = func(ctx context.Context, address string) (AwairStats, error) {
+		if address == panicking {
+			var readings map[string]AwairStats
+			readings[address] = AwairStats{}
+		}
+		return AwairStats{Timestamp: time.Now(), Score: 92}, nil
+	}
+	app := newTestApp(t, client, func(app *App) {
+		app.TimeBetweenChecks = 10 * time.Millisecond
+		app.AllowFastPolling = true
+	}, panicking, working)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app.recordMetrics(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.fetchCount(working) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("poll loop stopped after %d polls of the working device", client.fetchCount(working))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	panics, _ := metricValue(t, app, "awair_exporter_panics_total", nil)
+	if panics < 2 {
+		t.Errorf("awair_exporter_panics_total = %v, want a panic counted every cycle", panics)
+	}
+	labels := map[string]string{"device_address": panicking, "reason": pollReasonPanic}
+	if got, _ := metricValue(t, app, "awair_device_poll_errors_total", labels); got < 2 {
+		t.Errorf("awair_device_poll_errors_total{reason=%q} = %v, want a panic counted every cycle", pollReasonPanic, got)
+	}
+	if got, _ := metricValue(t, app, "awair_device_up", map[string]string{"device_address": panicking}); got != 0 {
+		t.Errorf("awair_device_up of the panicking device = %v, want 0", got)
+	}
+	if got, _ := metricValue(t, app, "awair_device_up", map[string]string{"device_address": working}); got != 1 {
+		t.Errorf("awair_device_up of the working device = %v, want 1", got)
+	}
+}
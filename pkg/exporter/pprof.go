@@ -0,0 +1,37 @@
+package exporter
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+func registerPprof(mux *http.ServeMux, wrap func(http.Handler) http.Handler) {
+	mux.Handle("/debug/pprof/", wrap(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", wrap(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", wrap(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", wrap(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", wrap(http.HandlerFunc(pprof.Trace)))
+}
+
+// servePprof serves the profiling endpoints on their own listener so they
+// never share the scrape port.
+func (app *App) servePprof() {
+	mux := http.NewServeMux()
+	registerPprof(mux, func(h http.Handler) http.Handler { return h })
+
+	go func() {
+		app.Logger.Infof("Serving pprof on (%+v)", app.PprofListen)
+		server := app.newHTTPServer(mux)
+		server.Addr = app.PprofListen
+		err := server.ListenAndServe()
+		if err != nil {
+			app.Logger.Errorf("pprof server failed: %+v", err)
+		}
+	}()
+}
+
+// pprofOnMainServer reports whether pprof is mounted on the exporter's own
+// server rather than on pprof_listen.
+func (app *App) pprofOnMainServer() bool {
+	return app.EnablePprof && app.PprofListen == ""
+}
@@ -0,0 +1,118 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// validateProxy checks device_proxy_url and no_proxy.
+func (app *App) validateProxy() []error {
+	errs := []error{}
+	if app.DeviceProxyURL != "" {
+		u, err := url.Parse(app.DeviceProxyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("device_proxy_url (%q): must be an http://, https:// or socks5:// URL", redactAddress(app.DeviceProxyURL)))
+		}
+	}
+	for i, host := range app.NoProxy {
+		if strings.TrimSpace(host) == "" {
+			errs = append(errs, fmt.Errorf("no_proxy[%d]: must not be empty", i))
+		}
+	}
+	return errs
+}
+
+// deviceProxy returns the proxy selection for device requests. Without
+// device_proxy_url the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables apply, as for any Go program; no_proxy replaces NO_PROXY either
+// way.
+func (app *App) deviceProxy() func(*http.Request) (*url.URL, error) {
+	if app.DeviceProxyURL == "" && len(app.NoProxy) == 0 {
+		return http.ProxyFromEnvironment
+	}
+
+	config := httpproxy.FromEnvironment()
+	if app.DeviceProxyURL != "" {
+		config.HTTPProxy = app.DeviceProxyURL
+		config.HTTPSProxy = app.DeviceProxyURL
+	}
+	if len(app.NoProxy) > 0 {
+		config.NoProxy = strings.Join(app.NoProxy, ",")
+	}
+
+	proxyFunc := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+}
+
+// isProxyError reports whether a request failed at the proxy it was sent
+// through, rather than at the device behind it: the proxy couldn't be
+// reached, or it refused the tunnel to the device, as a SOCKS5 proxy or an
+// HTTP proxy answering CONNECT with anything but 200 does.
+func isProxyError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "proxyconnect" || strings.HasPrefix(opErr.Op, "socks "))
+}
+
+// proxyConnectKey holds the proxyConnect of a request in its context.
+type proxyConnectKey struct{}
+
+// proxyConnect tracks a request's CONNECT through an HTTP proxy: whether it
+// was sent, and whether the TLS handshake with the device started over the
+// tunnel, which the transport only does once the proxy answered 200.
+type proxyConnect struct {
+	sent     int32
+	tunneled int32
+}
+
+// markProxyConnect is the transport's GetProxyConnectHeader, called right
+// before it sends a CONNECT to the proxy.
+func markProxyConnect(ctx context.Context, _ *url.URL, _ string) (http.Header, error) {
+	if connect, ok := ctx.Value(proxyConnectKey{}).(*proxyConnect); ok {
+		atomic.StoreInt32(&connect.sent, 1)
+	}
+	return nil, nil
+}
+
+// proxyConnectTransport tells a CONNECT the proxy refused apart from a
+// failure of the device, which the transport doesn't: it returns the status
+// text of the proxy's answer as a bare error. Such errors are wrapped as the
+// transport wraps failures to reach the proxy, so that isProxyError matches
+// them.
+type proxyConnectTransport struct {
+	next *http.Transport
+}
+
+func (t *proxyConnectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	connect := &proxyConnect{}
+	ctx := context.WithValue(req.Context(), proxyConnectKey{}, connect)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			if atomic.LoadInt32(&connect.sent) == 1 {
+				atomic.StoreInt32(&connect.tunneled, 1)
+			}
+		},
+	})
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil && atomic.LoadInt32(&connect.sent) == 1 && atomic.LoadInt32(&connect.tunneled) == 0 && !isProxyError(err) {
+		err = &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+	return resp, err
+}
+
+// CloseIdleConnections forwards to the wrapped transport, which
+// http.Client.CloseIdleConnections can't reach otherwise.
+func (t *proxyConnectTransport) CloseIdleConnections() {
+	t.next.CloseIdleConnections()
+}
@@ -0,0 +1,129 @@
+package exporter
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// proxyPollReason polls address through the proxy at proxyURL and returns
+// the reason the poll failed for.
+func proxyPollReason(t *testing.T, proxyURL, address string) string {
+	t.Helper()
+	app := newTestApp(t, nil, func(app *App) {
+		app.httpClient = nil
+		app.DeviceProxyURL = proxyURL
+	}, address)
+
+	pollOnce(app)
+	for _, reason := range pollReasons {
+		labels := map[string]string{"device_address": address, "reason": reason}
+		if got, _ := metricValue(t, app, "awair_device_poll_errors_total", labels); got > 0 {
+			return reason
+		}
+	}
+	t.Fatalf("poll of %s through %s didn't fail", address, proxyURL)
+	return ""
+}
+
+func TestProxyErrors(t *testing.T) {
+	// A proxy requiring credentials refuses both plain requests and
+	// tunnels. Loopback addresses are never proxied, so the devices are
+	// named.
+	authProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+	}))
+	defer authProxy.Close()
+	forbiddingProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}))
+	defer forbiddingProxy.Close()
+
+	for _, test := range []struct {
+		name    string
+		proxy   string
+		address string
+	}{
+		{"407 to a plain request", authProxy.URL, "http://living-room.test/air-data/latest"},
+		{"407 to CONNECT", authProxy.URL, "https://living-room.test/air-data/latest"},
+		{"403 to CONNECT", forbiddingProxy.URL, "https://living-room.test/air-data/latest"},
+		{"SOCKS5 rejecting the connection", newRejectingSOCKS5Proxy(t), "http://living-room.test/air-data/latest"},
+	} {
+		if got := proxyPollReason(t, test.proxy, test.address); got != pollReasonProxy {
+			t.Errorf("%s: poll failed for %q, want %q", test.name, got, pollReasonProxy)
+		}
+	}
+}
+
+// A device failing the TLS handshake over a tunnel the proxy opened is the
+// device's failure, not the proxy's.
+func TestTunneledDeviceErrorIsNotProxyError(t *testing.T) {
+	device := httptest.NewTLSServer(http.NotFoundHandler())
+	defer device.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", device.Listener.Addr().String())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}))
+	defer proxy.Close()
+
+	if got := proxyPollReason(t, proxy.URL, "https://living-room.test/air-data/latest"); got != pollReasonTLS {
+		t.Errorf("poll failed for %q, want %q", got, pollReasonTLS)
+	}
+}
+
+// newRejectingSOCKS5Proxy serves a SOCKS5 proxy that accepts clients
+// without authentication and refuses every connection they ask for.
+func newRejectingSOCKS5Proxy(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				header := make([]byte, 2)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				// Version, command, reserved, address type and the length of
+				// the host name, which is enough to answer
+				if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0})
+			}()
+		}
+	}()
+	return "socks5://" + listener.Addr().String()
+}
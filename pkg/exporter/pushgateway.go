@@ -0,0 +1,124 @@
+package exporter
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pushgatewayOutput pushes a snapshot of the awair_* metrics to a
+// Pushgateway after every cycle, replacing the previous snapshot of its
+// group.
+type pushgatewayOutput struct {
+	app    *App
+	pusher *push.Pusher
+
+	// deleteOnClose removes the group on shutdown so that a stopped
+	// exporter doesn't leave stale readings behind. It's off for --once,
+	// whose whole point is to leave its snapshot in place.
+	deleteOnClose bool
+
+	wake   chan struct{}
+	closed chan struct{}
+	done   chan struct{}
+
+	pushErrors prometheus.Counter
+}
+
+func (app *App) newPushgatewayOutput(deleteOnClose bool) *pushgatewayOutput {
+	instance := app.PushgatewayInstance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+
+	awairMetrics := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := app.Gatherer.Gather()
+		filtered := []*dto.MetricFamily{}
+		for _, family := range families {
+			if strings.HasPrefix(family.GetName(), "awair_") {
+				filtered = append(filtered, family)
+			}
+		}
+		return filtered, err
+	})
+
+	out := &pushgatewayOutput{
+		app: app,
+		pusher: push.New(app.PushgatewayURL, app.PushgatewayJob).
+			Gatherer(awairMetrics).
+			Grouping("instance", instance).
+			Client(app.pushClient),
+		deleteOnClose: deleteOnClose,
+		wake:          make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+		done:          make(chan struct{}),
+		pushErrors: promauto.With(app.Registerer).NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "pushgateway",
+			Name:      "push_errors_total",
+			Help:      "Failed pushes to the Pushgateway",
+		}),
+	}
+
+	go out.run()
+	return out
+}
+
+// Record is a no-op: the snapshot is gathered from the registry on push.
+func (out *pushgatewayOutput) Record(device *Device, stats AwairStats) {}
+
+func (out *pushgatewayOutput) Flush() {
+	select {
+	case out.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (out *pushgatewayOutput) Close(ctx context.Context) {
+	out.Flush()
+	close(out.closed)
+
+	select {
+	case <-out.done:
+	case <-ctx.Done():
+		out.app.Logger.Warnf("Gave up on pushing to the Pushgateway at shutdown")
+		return
+	}
+
+	if out.deleteOnClose {
+		if err := out.pusher.Delete(); err != nil {
+			out.app.Logger.Errorf("Failed to delete the Pushgateway group at shutdown: %+v", err)
+		}
+	}
+}
+
+// run pushes the latest snapshot whenever a cycle completes. Pushes are
+// coalesced, since each one replaces the last.
+func (out *pushgatewayOutput) run() {
+	defer close(out.done)
+	for {
+		select {
+		case <-out.wake:
+			out.push()
+		case <-out.closed:
+			select {
+			case <-out.wake:
+				out.push()
+			default:
+			}
+			return
+		}
+	}
+}
+
+func (out *pushgatewayOutput) push() {
+	if err := out.pusher.Push(); err != nil {
+		out.pushErrors.Inc()
+		out.app.Logger.Errorf("Failed to push to the Pushgateway at (%+v): %+v", out.app.PushgatewayURL, err)
+	}
+}
@@ -0,0 +1,125 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+const readingsLogQueueSize = 16
+
+// jsonReading is a reading as written by the outputs that emit JSON.
+type jsonReading struct {
+	Device string            `json:"device"`
+	Labels map[string]string `json:"labels,omitempty"`
+	AwairStats
+}
+
+// readingsLogOutput appends every reading to a newline-delimited JSON file.
+// SIGUSR1 reopens the file so that logrotate can move it aside.
+type readingsLogOutput struct {
+	app *App
+
+	lock sync.Mutex
+	buf  bytes.Buffer
+
+	queue  chan []byte
+	reopen chan os.Signal
+	done   chan struct{}
+	file   *os.File
+}
+
+func (app *App) newReadingsLogOutput() *readingsLogOutput {
+	out := &readingsLogOutput{
+		app:    app,
+		queue:  make(chan []byte, readingsLogQueueSize),
+		reopen: make(chan os.Signal, 1),
+		done:   make(chan struct{}),
+	}
+	notifyReopen(out.reopen)
+	go out.run()
+	return out
+}
+
+func (out *readingsLogOutput) Record(device *Device, stats AwairStats) {
+	line, err := json.Marshal(jsonReading{Device: device.Name, Labels: device.Labels, AwairStats: stats})
+	if err != nil {
+		out.app.Logger.Errorf("Failed to encode reading of Awair device (%+v) for the readings log: %+v", device.Name, err)
+		return
+	}
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	out.buf.Write(line)
+	out.buf.WriteByte('\n')
+}
+
+func (out *readingsLogOutput) Flush() {
+	out.lock.Lock()
+	lines := append([]byte(nil), out.buf.Bytes()...)
+	out.buf.Reset()
+	out.lock.Unlock()
+
+	if len(lines) == 0 {
+		return
+	}
+
+	select {
+	case out.queue <- lines:
+	default:
+		out.app.Logger.Warnf("Dropped readings log lines, the write queue is full")
+	}
+}
+
+func (out *readingsLogOutput) Close(ctx context.Context) {
+	out.Flush()
+	close(out.queue)
+
+	select {
+	case <-out.done:
+	case <-ctx.Done():
+	}
+}
+
+func (out *readingsLogOutput) run() {
+	defer close(out.done)
+	defer signal.Stop(out.reopen)
+
+	for {
+		select {
+		case <-out.reopen:
+			if out.file != nil {
+				out.app.Logger.Infof("Reopening readings log (%+v)", out.app.ReadingsLog)
+				out.file.Close()
+				out.file = nil
+			}
+		case lines, ok := <-out.queue:
+			if !ok {
+				if out.file != nil {
+					out.file.Close()
+				}
+				return
+			}
+			if err := out.write(lines); err != nil {
+				out.app.Logger.Errorf("Failed to write to readings log (%+v): %+v", out.app.ReadingsLog, err)
+			}
+		}
+	}
+}
+
+// write appends a cycle's lines in a single write, so lines from a crash
+// mid-cycle are either all there or all missing.
+func (out *readingsLogOutput) write(lines []byte) error {
+	if out.file == nil {
+		file, err := os.OpenFile(out.app.ReadingsLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		out.file = file
+	}
+	_, err := out.file.Write(lines)
+	return err
+}
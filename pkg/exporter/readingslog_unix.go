@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package exporter
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReopen relays SIGUSR1 to reopen.
+func notifyReopen(reopen chan<- os.Signal) {
+	signal.Notify(reopen, syscall.SIGUSR1)
+}
@@ -0,0 +1,7 @@
+package exporter
+
+import "os"
+
+// notifyReopen does nothing, Windows has no SIGUSR1 and its files can't be
+// moved aside while they're open anyway.
+func notifyReopen(reopen chan<- os.Signal) {}
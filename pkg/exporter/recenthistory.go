@@ -0,0 +1,137 @@
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// historyRingMaxSamples bounds the readings kept in memory per device,
+// whatever recent_history and poll_frequency are, to about 700 KiB.
+const historyRingMaxSamples = 10000
+
+// historySample is a reading kept in memory for /api/v1/history/recent,
+// about 72 bytes each.
+type historySample struct {
+	Time  time.Time `json:"time"`
+	Temp  float64   `json:"temp"`
+	Humid float64   `json:"humid"`
+	Co2   int       `json:"co2"`
+	Voc   int       `json:"voc"`
+	Pm25  int       `json:"pm25"`
+	Score int       `json:"score"`
+}
+
+// historyRing keeps a device's most recent readings, overwriting the oldest
+// once it's full.
+type historyRing struct {
+	lock    sync.Mutex
+	samples []historySample
+	next    int
+	full    bool
+}
+
+// newHistoryRing returns a ring holding recent_history of readings at
+// poll_frequency, or nil if recent_history is 0.
+func (app *App) newHistoryRing() *historyRing {
+	if app.RecentHistory <= 0 || app.TimeBetweenChecks <= 0 {
+		return nil
+	}
+	size := int(app.RecentHistory/app.TimeBetweenChecks) + 1
+	if size > historyRingMaxSamples {
+		size = historyRingMaxSamples
+	}
+	return &historyRing{samples: make([]historySample, size)}
+}
+
+func (ring *historyRing) add(stats AwairStats) {
+	timestamp := stats.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	ring.samples[ring.next] = historySample{
+		Time:  timestamp.UTC(),
+		Temp:  stats.Temp,
+		Humid: stats.Humid,
+		Co2:   stats.Co2,
+		Voc:   stats.Voc,
+		Pm25:  stats.Pm25,
+		Score: stats.Score,
+	}
+	ring.next = (ring.next + 1) % len(ring.samples)
+	if ring.next == 0 {
+		ring.full = true
+	}
+}
+
+// since returns the readings taken at or after start, oldest first.
+func (ring *historyRing) since(start time.Time) []historySample {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	ordered := ring.samples[:ring.next]
+	if ring.full {
+		ordered = append(append([]historySample{}, ring.samples[ring.next:]...), ordered...)
+	}
+
+	samples := []historySample{}
+	for _, sample := range ordered {
+		if !sample.Time.Before(start) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+type recentHistoryResponse struct {
+	Device  string          `json:"device"`
+	Since   time.Time       `json:"since"`
+	Samples []historySample `json:"samples"`
+}
+
+// recentHistoryHandler serves GET /api/v1/history/recent?device=&duration=
+// from the readings kept in memory, up to recent_history back.
+func (app *App) recentHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("device")
+	if name == "" {
+		http.Error(w, "device is required", http.StatusBadRequest)
+		return
+	}
+	device, ok := app.lookupHistoryDevice(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown device (%q)", name), http.StatusNotFound)
+		return
+	}
+
+	duration, err := historyDuration(query.Get("duration"), app.RecentHistory)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("duration: %v", err), http.StatusBadRequest)
+		return
+	}
+	if duration > app.RecentHistory {
+		duration = app.RecentHistory
+	}
+
+	start := time.Now().Add(-duration).UTC().Truncate(time.Second)
+	response := recentHistoryResponse{
+		Device:  device.Name,
+		Since:   start,
+		Samples: []historySample{},
+	}
+	if device.history != nil {
+		response.Samples = device.history.since(start)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
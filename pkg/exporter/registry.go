@@ -0,0 +1,386 @@
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	deviceSourceStatic = "static"
+	deviceSourceMDNS   = "mdns"
+	deviceSourceFile   = "file"
+	deviceSourceAPI    = "api"
+	deviceSourceCloud  = "cloud"
+	deviceSourceGroup  = "group"
+)
+
+type Device struct {
+	Name    string
+	Address string
+	Source  string
+	Labels  map[string]string
+
+	// Group is the device group the device is aggregated in and that its
+	// sensor series carry as their group label, if any.
+	Group string
+
+	// label identifies the device in its series as their device_address
+	// label, as chosen by device_label_source.
+	label string
+
+	// Labels include those relabel_file gives the device, whose values
+	// are added to its sensor and up series as relabeled. ownLabels are
+	// the ones it was configured with, which are written back to
+	// devices_file.
+	ownLabels map[string]string
+	relabeled []string
+
+	// Fallbacks are URLs the device is polled through, in order, when its
+	// address fails. Its series stay under its address either way.
+	Fallbacks []string
+
+	// Headers are sent with every request to the device, overriding the
+	// device_header flags.
+	Headers http.Header
+
+	// basicAuth, if set, is sent with every request to the device.
+	basicAuth *deviceBasicAuth
+
+	// tlsSkipVerify and clientCert override device_tls_skip_verify and
+	// device_client_cert for the device, in which case it's polled with an
+	// httpClient of its own.
+	tlsSkipVerify *bool
+	clientCert    *certReloader
+	httpClient    *http.Client
+
+	// removed is set under devicesLock when the device leaves the registry
+	// so that an in-flight poll doesn't recreate its series afterwards.
+	removed bool
+
+	stateLock   sync.Mutex
+	up          bool
+	lastPoll    time.Time
+	lastSuccess time.Time
+	lastError   string
+	failures    int
+	successes   int
+	health      string
+	polls       int
+	pollErrors  int
+	paused      bool
+	inflight    *pollCall
+	endpoint    string
+
+	// throttledUntil is when the device may be polled again after it
+	// asked to be polled less often, and throttles how many polls in a
+	// row it did.
+	throttledUntil time.Time
+	throttles      int
+
+	// failingSince, failingErrors and errorLoggedAt track a run of failed
+	// polls so that it's logged as periodic summaries rather than every poll.
+	failingSince  time.Time
+	failingErrors int
+	errorLoggedAt time.Time
+
+	// haGeneration is the MQTT connection the device was last announced to
+	// Home Assistant on.
+	haGeneration int32
+
+	lastResponse *capturedResponse
+	lastReading  *AwairStats
+
+	// history keeps the readings of the last recent_history for
+	// /api/v1/history/recent, if enabled.
+	history *historyRing
+
+	metadata        *DeviceMetadata
+	metadataAttempt time.Time
+
+	// metadataLabels are the values of the metadata_labels of the device's
+	// sensor series, fixed from the first metadata it reports, and
+	// metadataReported those of the last differing metadata logged.
+	metadataLabels   []string
+	metadataReported []string
+}
+
+// maxErrorLength bounds the error strings kept per device.
+const maxErrorLength = 256
+
+func boundedError(err error) string {
+	message := err.Error()
+	if len(message) > maxErrorLength {
+		message = message[:maxErrorLength] + "..."
+	}
+	return message
+}
+
+// DeviceStatus is a point-in-time copy of a device's polling state.
+// ThrottledUntil is when a device that asked to be polled less often may be
+// polled again.
+type DeviceStatus struct {
+	Name           string
+	Address        string
+	Label          string
+	Source         string
+	Labels         map[string]string
+	Up             bool
+	LastPoll       time.Time
+	LastSuccess    time.Time
+	LastError      string
+	Failures       int
+	Paused         bool
+	Metadata       *DeviceMetadata
+	ThrottledUntil time.Time
+}
+
+func (device *Device) recordPoll(err error) {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+
+	device.lastPoll = time.Now()
+	device.up = err == nil
+	device.polls++
+	if err != nil {
+		device.lastError = boundedError(err)
+		device.failures++
+		device.pollErrors++
+	} else {
+		device.lastSuccess = device.lastPoll
+		device.lastError = ""
+		device.failures = 0
+	}
+}
+
+func (device *Device) Status() DeviceStatus {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+
+	return DeviceStatus{
+		Name:           device.Name,
+		Address:        redactAddress(device.Address),
+		Label:          redactAddress(device.label),
+		Source:         device.Source,
+		Labels:         device.Labels,
+		Up:             device.up,
+		LastPoll:       device.lastPoll,
+		LastSuccess:    device.lastSuccess,
+		LastError:      device.lastError,
+		Failures:       device.failures,
+		Paused:         device.paused,
+		Metadata:       device.metadata,
+		ThrottledUntil: device.throttledUntil,
+	}
+}
+
+// redactAddress masks any password embedded in a device URL so it can be
+// shown outside of the poll path.
+func redactAddress(address string) string {
+	u, err := url.Parse(address)
+	if err != nil || u.User == nil {
+		return address
+	}
+	return u.Redacted()
+}
+
+// deviceNameFromAddress names a device after the host (and port, if any)
+// of its URL.
+func deviceNameFromAddress(address string) string {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return address
+	}
+	return u.Host
+}
+
+// AddDevice registers a device to be polled from the next poll cycle on.
+// It returns false if a device with the same address is already registered.
+func (app *App) AddDevice(name string, address string, source string, labels map[string]string) bool {
+	_, err := app.addDevice(name, source, deviceEntry{URL: address, Labels: labels})
+	return err == nil
+}
+
+// addDevice registers a device from an entry of the devices file or API,
+// including its fallback URLs and headers, and returns it. A device added
+// through the API is managed by its name, which must not be taken either.
+func (app *App) addDevice(name string, source string, entry deviceEntry) (*Device, error) {
+	address := entry.URL
+	app.devicesLock.Lock()
+	defer app.devicesLock.Unlock()
+
+	if _, ok := app.devices[address]; ok {
+		return nil, fmt.Errorf("device at (%s) already exists", redactAddress(address))
+	}
+	label := app.deviceLabel(name, address, source)
+	labels, err := app.relabel(name, address, entry.Labels)
+	if err != nil {
+		app.Logger.Errorf("Not adding Awair device (%+v) at (%+v): %+v", name, redactAddress(address), err)
+		return nil, err
+	}
+	for _, other := range app.devices {
+		if source == deviceSourceAPI && other.Name == name {
+			return nil, fmt.Errorf("device (%q) already exists", name)
+		}
+		if other.label == label {
+			app.Logger.Errorf("Not adding Awair device (%+v) at (%+v): device (%+v) already has the device_address label (%+v)", name, redactAddress(address), other.Name, redactAddress(label))
+			return nil, fmt.Errorf("device (%q) already has the device_address label (%s)", other.Name, redactAddress(label))
+		}
+	}
+
+	clientCert := app.loadDeviceClientCert(name, label, entry)
+	device := &Device{
+		Name:          name,
+		Address:       address,
+		Source:        source,
+		Labels:        labels,
+		Group:         entry.Group,
+		label:         label,
+		ownLabels:     entry.Labels,
+		relabeled:     app.relabelValues(labels),
+		Fallbacks:     entry.FallbackURLs,
+		Headers:       newDeviceHeader(entry.Headers),
+		basicAuth:     entry.BasicAuth,
+		tlsSkipVerify: entry.TLSSkipVerify,
+		clientCert:    clientCert,
+		httpClient:    app.newDeviceHTTPClient(entry, clientCert),
+		history:       app.newHistoryRing(),
+	}
+	app.devices[address] = device
+	if source == deviceSourceCloud || !app.metadataLabelsFromDevice() {
+		// Cloud devices don't report metadata, so only their name is known,
+		// which is also all that's needed if it's the only metadata label
+		app.pinMetadataLabels(device, &DeviceMetadata{})
+	}
+	if entry.TLSSkipVerify != nil && *entry.TLSSkipVerify {
+		app.Logger.Warnw("TLS certificate verification is disabled for Awair device; anyone on the network path can impersonate it", "device", redactAddress(label), "device_name", name)
+	}
+	app.pausedGauge.WithLabelValues(label).Set(0)
+	app.Logger.Infof("Added Awair device (%+v) at (%+v) from source (%+v)", name, redactAddress(address), source)
+	return device, nil
+}
+
+// RemoveDevice stops polling a device and deletes its series. Only a device
+// registered by the given source is removed, so discovery can't retire a
+// statically configured device that it happens to also see.
+func (app *App) RemoveDevice(address string, source string) bool {
+	app.devicesLock.Lock()
+	device, ok := app.devices[address]
+	if !ok || device.Source != source {
+		app.devicesLock.Unlock()
+		return false
+	}
+
+	delete(app.devices, address)
+	device.removed = true
+	app.deleteDeviceSeries(device)
+	app.pausedGauge.DeleteLabelValues(device.label)
+	app.upGauge.DeleteLabelValues(device.seriesLabels(device.Name)...)
+	app.deleteHealthSeries(device.label)
+	for _, reason := range pollReasons {
+		app.pollErrorsCounter.DeleteLabelValues(device.label, reason)
+	}
+	if endpoint := device.activeEndpoint(); len(device.Fallbacks) > 0 {
+		app.endpointInfoGauge.DeleteLabelValues(device.label, redactAddress(endpoint))
+	}
+	if metadata := device.Status().Metadata; metadata != nil {
+		app.deleteDeviceInfo(device.label, metadata)
+	}
+	snapshot := app.updateAggregates(app.deviceList())
+	app.devicesLock.Unlock()
+
+	app.publishAggregatesMQTT(snapshot)
+	app.Logger.Infof("Removed Awair device (%+v) at (%+v) from source (%+v)", device.Name, redactAddress(address), source)
+	return true
+}
+
+// Devices returns a snapshot of the registered devices ordered by address.
+func (app *App) Devices() []*Device {
+	app.devicesLock.RLock()
+	defer app.devicesLock.RUnlock()
+	return app.deviceList()
+}
+
+// deviceList is Devices for callers already holding devicesLock.
+func (app *App) deviceList() []*Device {
+	devices := make([]*Device, 0, len(app.devices))
+	for _, device := range app.devices {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Address < devices[j].Address
+	})
+	return devices
+}
+
+// LookupDevice finds a registered device by name or address.
+func (app *App) LookupDevice(key string) (*Device, bool) {
+	app.devicesLock.RLock()
+	defer app.devicesLock.RUnlock()
+
+	if device, ok := app.devices[key]; ok {
+		return device, true
+	}
+	for _, device := range app.devices {
+		if device.Name == key {
+			return device, true
+		}
+	}
+	return nil, false
+}
+
+// seriesLabels returns the label values of one of the device's series:
+// its device_address label, the given values, and its relabeled labels.
+func (device *Device) seriesLabels(values ...string) []string {
+	labels := append([]string{device.label}, values...)
+	return append(labels, device.relabeled...)
+}
+
+// dataSource is the value of the source label on a device's sensor series:
+// whether its readings come from the local API or the Awair cloud.
+func (device *Device) dataSource() string {
+	if device.Source == deviceSourceCloud {
+		return "cloud"
+	}
+	return "local"
+}
+
+func (device *Device) isPaused() bool {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	return device.paused
+}
+
+// SetDevicePaused stops or resumes polling of a device. Pausing deletes the
+// device's sensor series rather than leaving them frozen at stale values,
+// and drops it from the aggregates.
+// It returns false if the device was already in the requested state.
+func (app *App) SetDevicePaused(device *Device, paused bool) bool {
+	app.devicesLock.Lock()
+	device.stateLock.Lock()
+	changed := device.paused != paused
+	device.paused = paused
+	device.stateLock.Unlock()
+
+	if !changed || device.removed {
+		app.devicesLock.Unlock()
+		return false
+	}
+
+	if paused {
+		app.deleteDeviceSeries(device)
+		app.pausedGauge.WithLabelValues(device.label).Set(1)
+		snapshot := app.updateAggregates(app.deviceList())
+		app.devicesLock.Unlock()
+		app.publishAggregatesMQTT(snapshot)
+		app.Logger.Infof("Paused polling of Awair device (%+v)", device.Name)
+	} else {
+		app.pausedGauge.WithLabelValues(device.label).Set(0)
+		app.devicesLock.Unlock()
+		app.Logger.Infof("Resumed polling of Awair device (%+v)", device.Name)
+	}
+	return true
+}
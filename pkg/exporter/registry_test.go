@@ -0,0 +1,107 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestAddRemoveDuringPolls adds and removes devices while poll cycles run;
+// it's meant to be run with -race.
+func TestAddRemoveDuringPolls(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.fetch = func(ctx context.Context, address string) (AwairStats, error) {
+		select {
+		case <-time.After(time.Millisecond):
+		case <-ctx.Done():
+			return AwairStats{}, ctx.Err()
+		}
+		return AwairStats{Timestamp: time.Now(), Temp: 21, Score: 90}, nil
+	}
+	app := newTestApp(t, client, nil, "http://static/air-data/latest")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			app.pollDevices(ctx)
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			if _, err := app.Gatherer.Gather(); err != nil {
+				t.Errorf("Gather: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		address := fmt.Sprintf("http://device-%d/air-data/latest", i)
+		if !app.AddDevice(fmt.Sprintf("device-%d", i), address, deviceSourceAPI, nil) {
+			t.Fatalf("AddDevice(%s) = false", address)
+		}
+		if i%2 == 0 {
+			// Let a poll of it start before it's removed
+			time.Sleep(2 * time.Millisecond)
+		}
+		if !app.RemoveDevice(address, deviceSourceAPI) {
+			t.Fatalf("RemoveDevice(%s) = false", address)
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	// A poll in flight when its device was removed must not have recreated
+	// its series
+	for i := 0; i < 50; i++ {
+		label := fmt.Sprintf("http://device-%d/air-data/latest", i)
+		if _, ok := metricValue(t, app, "awair_device_up", map[string]string{"device_address": label}); ok {
+			t.Errorf("awair_device_up of removed device (%s) still exported", label)
+		}
+		if _, ok := metricValue(t, app, "awair_air_quality_score", map[string]string{"device_address": label}); ok {
+			t.Errorf("awair_air_quality_score of removed device (%s) still exported", label)
+		}
+	}
+	if _, ok := app.LookupDevice("http://static/air-data/latest"); !ok {
+		t.Errorf("static device was removed")
+	}
+	if client.fetchCount("http://static/air-data/latest") == 0 {
+		t.Errorf("static device was never polled")
+	}
+}
+
+func TestRemoveDeviceOnlyBySource(t *testing.T) {
+	app := newTestApp(t, newFakeDeviceClient(), nil, "http://static/air-data/latest")
+
+	if app.RemoveDevice("http://static/air-data/latest", deviceSourceMDNS) {
+		t.Errorf("RemoveDevice of a static device by mdns = true")
+	}
+	if app.AddDevice("static", "http://static/air-data/latest", deviceSourceAPI, nil) {
+		t.Errorf("AddDevice of a registered address = true")
+	}
+	if !app.RemoveDevice("http://static/air-data/latest", deviceSourceStatic) {
+		t.Errorf("RemoveDevice by its own source = false")
+	}
+}
+
+func TestAddDeviceFromAPINeedsFreeName(t *testing.T) {
+	app := newTestApp(t, newFakeDeviceClient(), nil, "http://static/air-data/latest")
+
+	device, err := app.addDevice("office", deviceSourceAPI, deviceEntry{URL: "http://office/air-data/latest"})
+	if err != nil || device == nil || device.Name != "office" {
+		t.Fatalf("addDevice = %v, %v, want the added device", device, err)
+	}
+	if _, err := app.addDevice("office", deviceSourceAPI, deviceEntry{URL: "http://office-2/air-data/latest"}); err == nil {
+		t.Errorf("addDevice with a name that's taken succeeded")
+	}
+	if _, err := app.addDevice("static", deviceSourceAPI, deviceEntry{URL: "http://static/air-data/latest"}); err == nil {
+		t.Errorf("addDevice with an address that's taken succeeded")
+	}
+}
@@ -0,0 +1,193 @@
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Values of the source of a relabel rule: the text its regex is matched
+// against.
+const (
+	relabelSourceAddress = "address"
+	relabelSourceName    = "name"
+)
+
+// relabelRule is an entry of relabel_file: a regex over a device's address
+// or name whose capture groups fill in the templates of its labels, as in
+// Prometheus' relabel_configs.
+type relabelRule struct {
+	Source string            `yaml:"source"`
+	Regex  string            `yaml:"regex"`
+	Labels map[string]string `yaml:"labels"`
+
+	regex *regexp.Regexp
+}
+
+type relabelFile struct {
+	Rules []relabelRule `yaml:"rules"`
+}
+
+// loadRelabelFile reads and checks the rules kept in relabel_file, and
+// notes the labels they produce, which every device must end up with.
+func (app *App) loadRelabelFile() error {
+	if app.RelabelFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(app.RelabelFile)
+	if err != nil {
+		return fmt.Errorf("relabel_file (%q): %w", app.RelabelFile, err)
+	}
+
+	file := relabelFile{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("relabel_file (%q): %w", app.RelabelFile, err)
+	}
+	if len(file.Rules) == 0 {
+		return fmt.Errorf("relabel_file (%q): no rules defined", app.RelabelFile)
+	}
+
+	names := map[string]bool{}
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("relabel_file (%q): rule %d: %w", app.RelabelFile, i, err)
+		}
+		for name := range rule.Labels {
+			names[name] = true
+		}
+	}
+
+	app.relabelRules = file.Rules
+	app.relabelNames = make([]string, 0, len(names))
+	for name := range names {
+		app.relabelNames = append(app.relabelNames, name)
+	}
+	sort.Strings(app.relabelNames)
+	return nil
+}
+
+// compile checks a rule and compiles its regex, anchored at both ends.
+func (rule *relabelRule) compile() error {
+	switch rule.Source {
+	case relabelSourceAddress, relabelSourceName:
+	default:
+		return fmt.Errorf("source (%q): must be one of address, name", rule.Source)
+	}
+	if len(rule.Labels) == 0 {
+		return fmt.Errorf("labels: at least one label is required")
+	}
+	for name := range rule.Labels {
+		if reservedGroupLabels[name] || !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("labels: %q is not a usable label name", name)
+		}
+	}
+
+	regex, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("regex (%q): %w", rule.Regex, err)
+	}
+	rule.regex = regex
+	return nil
+}
+
+// relabel applies the relabel rules to a device, in order, and merges the
+// labels they produce under the device's own labels, which win. Rules that
+// don't match leave their labels unset, and a label set to "" is dropped.
+// It fails if the device ends up without one of the labels the rules
+// produce, since the series of all devices must share the same labels.
+func (app *App) relabel(name, address string, labels map[string]string) (map[string]string, error) {
+	if len(app.relabelRules) == 0 {
+		return labels, nil
+	}
+
+	merged := map[string]string{}
+	for _, rule := range app.relabelRules {
+		text := redactAddress(address)
+		if rule.Source == relabelSourceName {
+			text = name
+		}
+		match := rule.regex.FindStringSubmatchIndex(text)
+		if match == nil {
+			continue
+		}
+		for label, template := range rule.Labels {
+			merged[label] = string(rule.regex.ExpandString(nil, template, text, match))
+		}
+	}
+	for label, value := range labels {
+		merged[label] = value
+	}
+
+	for label, value := range merged {
+		if value == "" {
+			delete(merged, label)
+		}
+	}
+	missing := []string{}
+	for _, label := range app.relabelNames {
+		if _, ok := merged[label]; !ok {
+			missing = append(missing, label)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no rule in relabel_file gives it the label(s) %s", strings.Join(missing, ", "))
+	}
+	return merged, nil
+}
+
+// relabelValues returns the values of the labels the relabel rules produce,
+// in the order of the label names of the series they're added to.
+func (app *App) relabelValues(labels map[string]string) []string {
+	values := make([]string, len(app.relabelNames))
+	for i, name := range app.relabelNames {
+		values[i] = labels[name]
+	}
+	return values
+}
+
+// validateRelabeling checks that the relabel rules give the devices known
+// at startup all of their labels.
+func (app *App) validateRelabeling() []error {
+	if len(app.relabelRules) == 0 {
+		return nil
+	}
+
+	errs := []error{}
+	check := func(name, address string, labels map[string]string) {
+		if name == "" {
+			name = deviceNameFromAddress(address)
+		}
+		if _, err := app.relabel(name, address, labels); err != nil {
+			errs = append(errs, fmt.Errorf("relabel_file (%q): device (%s): %w", app.RelabelFile, redactAddress(address), err))
+		}
+	}
+	for _, address := range app.AwairAddresses {
+		check(deviceNameFromAddress(address), address, nil)
+	}
+	for _, entry := range app.fileDevices {
+		check(entry.Name, entry.URL, entry.Labels)
+	}
+	for _, entry := range app.cloudDevices {
+		check(entry.Name, entry.address(app.CloudAPIURL), nil)
+	}
+	for _, group := range app.groupEntries {
+		for _, entry := range group.Devices {
+			check(entry.Name, entry.URL, entry.Labels)
+		}
+		for name := range group.Labels {
+			for _, label := range app.relabelNames {
+				if name == label {
+					errs = append(errs, fmt.Errorf("relabel_file (%q): label %q is also a constant label of group %q", app.RelabelFile, name, group.Name))
+				}
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,348 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	remoteWriteTokenEnv    = "AWAIR_EXPORTER_REMOTE_WRITE_TOKEN"
+	remoteWritePasswordEnv = "AWAIR_EXPORTER_REMOTE_WRITE_PASSWORD"
+)
+
+func (app *App) loadRemoteWriteCredentials() error {
+	var err error
+	app.remoteWriteToken, err = readSecret("remote_write_bearer_token_file", app.RemoteWriteBearerTokenFile, remoteWriteTokenEnv)
+	if err != nil {
+		return err
+	}
+	app.remoteWritePassword, err = readSecret("remote_write_password_file", app.RemoteWritePasswordFile, remoteWritePasswordEnv)
+	return err
+}
+
+type remoteWriteLabel struct {
+	Name  string
+	Value string
+}
+
+type remoteWriteSeries struct {
+	Labels    []remoteWriteLabel
+	Value     float64
+	Timestamp int64
+}
+
+// remoteWriteBatch is one cycle's samples waiting to be pushed.
+type remoteWriteBatch struct {
+	Created time.Time
+	Series  []remoteWriteSeries
+}
+
+// remoteWriteOutput pushes the awair_* series to a Prometheus remote write
+// endpoint after every cycle. Batches that can't be delivered are kept and
+// retried in order until they are older than remote_write_max_age.
+type remoteWriteOutput struct {
+	app *App
+
+	lock    sync.Mutex
+	pending []remoteWriteBatch
+	wake    chan struct{}
+	closed  chan struct{}
+	done    chan struct{}
+
+	samplesPushed  prometheus.Counter
+	samplesDropped *prometheus.CounterVec
+	samplesPending prometheus.Gauge
+	pushErrors     prometheus.Counter
+}
+
+func (app *App) newRemoteWriteOutput() *remoteWriteOutput {
+	factory := promauto.With(app.Registerer)
+	out := &remoteWriteOutput{
+		app:    app,
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+		samplesPushed: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "remote_write",
+			Name:      "samples_pushed_total",
+			Help:      "Samples accepted by the remote write endpoint",
+		}),
+		samplesDropped: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "remote_write",
+			Name:      "samples_dropped_total",
+			Help:      "Samples given up on, by reason (expired or rejected)",
+		}, []string{"reason"}),
+		samplesPending: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: "awair",
+			Subsystem: "remote_write",
+			Name:      "samples_pending",
+			Help:      "Samples buffered waiting to be pushed",
+		}),
+		pushErrors: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "remote_write",
+			Name:      "push_errors_total",
+			Help:      "Failed remote write requests, including ones later retried",
+		}),
+	}
+
+	go out.run()
+	return out
+}
+
+// Record is a no-op: each cycle's samples are gathered from the registry on
+// Flush so that they match what /metrics serves.
+func (out *remoteWriteOutput) Record(device *Device, stats AwairStats) {}
+
+func (out *remoteWriteOutput) Flush() {
+	series, err := out.gather()
+	if err != nil {
+		out.app.Logger.Errorf("Failed to gather metrics for remote write: %+v", err)
+		return
+	}
+	if len(series) == 0 {
+		return
+	}
+
+	out.lock.Lock()
+	out.pending = append(out.pending, remoteWriteBatch{Created: time.Now(), Series: series})
+	out.updatePending()
+	out.lock.Unlock()
+
+	select {
+	case out.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (out *remoteWriteOutput) Close(ctx context.Context) {
+	out.Flush()
+	close(out.closed)
+
+	select {
+	case <-out.done:
+	case <-ctx.Done():
+		out.app.Logger.Warnf("Gave up on pending remote write samples at shutdown")
+	}
+}
+
+// updatePending must be called with the lock held.
+func (out *remoteWriteOutput) updatePending() {
+	samples := 0
+	for _, batch := range out.pending {
+		samples += len(batch.Series)
+	}
+	out.samplesPending.Set(float64(samples))
+}
+
+// run pushes pending batches oldest first, backing off while the endpoint
+// fails. Once closed, it makes a single last attempt at what's left.
+func (out *remoteWriteOutput) run() {
+	defer close(out.done)
+
+	backoff := outputRetryBackoff
+	for {
+		closing := false
+		select {
+		case <-out.wake:
+		case <-out.closed:
+			closing = true
+		}
+
+		for {
+			delay, ok := out.pushNext()
+			if ok {
+				backoff = outputRetryBackoff
+				continue
+			}
+			if delay < 0 || closing {
+				break
+			}
+
+			if delay == 0 {
+				delay = backoff
+				if backoff < out.app.TimeBetweenChecks {
+					backoff *= 2
+				}
+			}
+			select {
+			case <-time.After(delay):
+			case <-out.closed:
+				closing = true
+			}
+		}
+
+		if closing {
+			return
+		}
+	}
+}
+
+// pushNext pushes the oldest pending batch. It returns ok if it was pushed
+// or dropped, and otherwise the delay asked for by the endpoint (0 if none),
+// or a negative delay if nothing is pending.
+func (out *remoteWriteOutput) pushNext() (time.Duration, bool) {
+	out.lock.Lock()
+	for len(out.pending) > 0 && time.Since(out.pending[0].Created) > out.app.RemoteWriteMaxAge {
+		out.samplesDropped.WithLabelValues("expired").Add(float64(len(out.pending[0].Series)))
+		out.pending = out.pending[1:]
+	}
+	out.updatePending()
+	if len(out.pending) == 0 {
+		out.lock.Unlock()
+		return -1, false
+	}
+	batch := out.pending[0]
+	out.lock.Unlock()
+
+	resp, err := out.post(batch.Series)
+	if err != nil {
+		out.pushErrors.Inc()
+		out.app.Logger.Warnf("Failed to push (%+v) samples to remote write endpoint: %+v", len(batch.Series), err)
+		if resp == nil || retryableStatus(resp.StatusCode) {
+			return retryAfter(resp, 0), false
+		}
+		// The endpoint will never accept these samples, so don't block the
+		// ones behind them
+		out.samplesDropped.WithLabelValues("rejected").Add(float64(len(batch.Series)))
+	} else {
+		out.samplesPushed.Add(float64(len(batch.Series)))
+	}
+
+	out.lock.Lock()
+	out.pending = out.pending[1:]
+	out.updatePending()
+	out.lock.Unlock()
+	return 0, true
+}
+
+func (out *remoteWriteOutput) post(series []remoteWriteSeries) (*http.Response, error) {
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+
+	req, err := http.NewRequest(http.MethodPost, out.app.RemoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "awair-local-prom-exporter/"+exporterVersion())
+	if out.app.remoteWriteToken != "" {
+		req.Header.Set("Authorization", "Bearer "+out.app.remoteWriteToken)
+	} else if out.app.RemoteWriteUsername != "" {
+		req.SetBasicAuth(out.app.RemoteWriteUsername, out.app.remoteWritePassword)
+	}
+
+	resp, err := out.app.pushClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return resp, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return resp, nil
+}
+
+// gather snapshots the awair_* gauges and counters as remote write series,
+// adding the job and instance labels a scrape would have attached.
+func (out *remoteWriteOutput) gather() ([]remoteWriteSeries, error) {
+	families, err := out.app.Gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	instance, _ := os.Hostname()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	series := []remoteWriteSeries{}
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "awair_") {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			value := math.NaN()
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				value = metric.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				value = metric.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = metric.GetUntyped().GetValue()
+			default:
+				continue
+			}
+
+			labels := []remoteWriteLabel{
+				{Name: "__name__", Value: family.GetName()},
+				{Name: "job", Value: out.app.RemoteWriteJob},
+				{Name: "instance", Value: instance},
+			}
+			for _, pair := range metric.GetLabel() {
+				labels = append(labels, remoteWriteLabel{Name: pair.GetName(), Value: pair.GetValue()})
+			}
+			sort.Slice(labels, func(i, j int) bool {
+				return labels[i].Name < labels[j].Name
+			})
+
+			series = append(series, remoteWriteSeries{Labels: labels, Value: value, Timestamp: now})
+		}
+	}
+	return series, nil
+}
+
+// encodeWriteRequest encodes series as a prometheus.WriteRequest protobuf:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []remoteWriteSeries) []byte {
+	var request []byte
+	for _, s := range series {
+		var timeseries []byte
+		for _, label := range s.Labels {
+			var encoded []byte
+			encoded = protowire.AppendTag(encoded, 1, protowire.BytesType)
+			encoded = protowire.AppendString(encoded, label.Name)
+			encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+			encoded = protowire.AppendString(encoded, label.Value)
+
+			timeseries = protowire.AppendTag(timeseries, 1, protowire.BytesType)
+			timeseries = protowire.AppendBytes(timeseries, encoded)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.Value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.Timestamp))
+
+		timeseries = protowire.AppendTag(timeseries, 2, protowire.BytesType)
+		timeseries = protowire.AppendBytes(timeseries, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, timeseries)
+	}
+	return request
+}
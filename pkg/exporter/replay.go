@@ -0,0 +1,337 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair"
+)
+
+// recordingTimeFormat names recorded responses so that they sort in the
+// order they were received.
+const recordingTimeFormat = "20060102T150405.000000000Z"
+
+// recordingAddressFile holds the scheme and host of the device whose
+// responses are recorded in a directory.
+const recordingAddressFile = "address"
+
+// recordingEndpoint names the endpoint a device response came from in the
+// names of recorded responses.
+func recordingEndpoint(path string) string {
+	switch path {
+	case awair.AirDataPath:
+		return "air-data"
+	case awair.ConfigPath:
+		return "config"
+	}
+	return strings.NewReplacer("/", "-", "_", "-").Replace(strings.Trim(path, "/"))
+}
+
+// recordingDir names the directory the responses of the device at host are
+// recorded in.
+func recordingDir(host string) string {
+	return strings.NewReplacer(":", "_", "[", "", "]", "").Replace(host)
+}
+
+// recordingTransport saves every device response to record_dir, as
+// <host>/<time>_<endpoint>_<status>.json holding the body exactly as
+// received, before handing it on to be decoded.
+type recordingTransport struct {
+	app  *App
+	next http.RoundTripper
+
+	lock      sync.Mutex
+	addresses map[string]bool
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		// Leave the failed read to the client, which fails the poll
+		resp.Body = ioutil.NopCloser(&failingReader{err: err})
+		return resp, nil
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err := t.save(req.URL, resp.StatusCode, body, time.Now()); err != nil {
+		t.app.Logger.Warnf("Failed to record response of (%+v) to record_dir (%+v): %+v", redactAddress(req.URL.String()), t.app.RecordDir, err)
+	}
+	return resp, nil
+}
+
+// CloseIdleConnections forwards to the wrapped transport, which
+// http.Client.CloseIdleConnections can't reach otherwise, so that reloaded
+// device certificates and DNS changes still drop the old connections.
+func (t *recordingTransport) CloseIdleConnections() {
+	if closer, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+func (t *recordingTransport) save(address *url.URL, statusCode int, body []byte, now time.Time) error {
+	dir := filepath.Join(t.app.RecordDir, recordingDir(address.Host))
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.addresses[dir] {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		origin := address.Scheme + "://" + address.Host + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, recordingAddressFile), []byte(origin), 0644); err != nil {
+			return err
+		}
+		t.addresses[dir] = true
+	}
+
+	name := fmt.Sprintf("%s_%s_%d.json", now.UTC().Format(recordingTimeFormat), recordingEndpoint(address.Path), statusCode)
+	return ioutil.WriteFile(filepath.Join(dir, name), body, 0644)
+}
+
+// failingReader fails every read with err.
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// replayedResponse is a device response recorded to record_dir.
+type replayedResponse struct {
+	at         time.Duration
+	statusCode int
+	body       []byte
+}
+
+// replaySequence is the responses recorded from one endpoint of a device,
+// in order, and the next to serve when replaying step by step.
+type replaySequence struct {
+	responses []replayedResponse
+	next      int
+}
+
+// replayTransport answers device requests from the responses recorded in
+// replay_dir instead of contacting the devices, so that replayed responses
+// are decoded and exported exactly as live ones. At replay_speed, each
+// endpoint's responses are served as they were received, sped up, and
+// start over once they run out; at 0, each request is answered with the
+// next response.
+type replayTransport struct {
+	speed float64
+	start time.Time
+
+	lock      sync.Mutex
+	origins   []string
+	sequences map[string]*replaySequence
+}
+
+// createRecordDir creates record_dir, so that a directory that can't be
+// written to is found at startup.
+func (app *App) createRecordDir() error {
+	if app.RecordDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(app.RecordDir, 0755); err != nil {
+		return fmt.Errorf("record_dir (%q): %w", app.RecordDir, err)
+	}
+	return nil
+}
+
+// deviceTransport wraps the transport of device requests to record them to
+// record_dir, or replaces it to answer them from replay_dir.
+func (app *App) deviceTransport(transport http.RoundTripper) http.RoundTripper {
+	switch {
+	case app.replay != nil:
+		return app.replay
+	case app.RecordDir != "":
+		return &recordingTransport{app: app, next: transport, addresses: map[string]bool{}}
+	}
+	return transport
+}
+
+// loadReplayDir reads the responses recorded in replay_dir.
+func (app *App) loadReplayDir() error {
+	if app.ReplayDir == "" {
+		return nil
+	}
+	if app.RecordDir != "" {
+		return fmt.Errorf("replay_dir (%q): mutually exclusive with record_dir", app.ReplayDir)
+	}
+	if app.ReplaySpeed < 0 {
+		return fmt.Errorf("replay_speed (%v): must not be negative", app.ReplaySpeed)
+	}
+
+	replay, err := loadReplay(app.ReplayDir, app.ReplaySpeed)
+	if err != nil {
+		return fmt.Errorf("replay_dir (%q): %w", app.ReplayDir, err)
+	}
+	app.replay = replay
+	return nil
+}
+
+// ReplayAddresses returns the air-data URLs of the devices recorded in dir,
+// to poll while replaying it.
+func ReplayAddresses(dir string) ([]string, error) {
+	replay, err := loadReplay(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	addresses := []string{}
+	for _, origin := range replay.origins {
+		addresses = append(addresses, origin+awair.AirDataPath)
+	}
+	return addresses, nil
+}
+
+func loadReplay(dir string, speed float64) (*replayTransport, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	replay := &replayTransport{speed: speed, start: time.Now(), sequences: map[string]*replaySequence{}}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		deviceDir := filepath.Join(dir, entry.Name())
+		origin, err := ioutil.ReadFile(filepath.Join(deviceDir, recordingAddressFile))
+		if err != nil {
+			return nil, err
+		}
+		address, err := url.Parse(strings.TrimSpace(string(origin)))
+		if err != nil || address.Host == "" {
+			return nil, fmt.Errorf("%s: not a device address (%q)", filepath.Join(deviceDir, recordingAddressFile), strings.TrimSpace(string(origin)))
+		}
+		if err := replay.loadDevice(deviceDir, address.Host); err != nil {
+			return nil, err
+		}
+		replay.origins = append(replay.origins, address.Scheme+"://"+address.Host)
+	}
+	if len(replay.origins) == 0 {
+		return nil, fmt.Errorf("no recorded devices")
+	}
+	return replay, nil
+}
+
+// loadDevice reads the responses recorded from the device at host, each
+// endpoint's timed from the first.
+func (replay *replayTransport) loadDevice(dir, host string) error {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	starts := map[string]time.Time{}
+	for _, name := range names {
+		base := strings.TrimSuffix(filepath.Base(name), ".json")
+		first, last := strings.Index(base, "_"), strings.LastIndex(base, "_")
+		if first < 0 || first == last {
+			return fmt.Errorf("%s: not named <time>_<endpoint>_<status>.json", name)
+		}
+		receivedAt, err := time.Parse(recordingTimeFormat, base[:first])
+		if err != nil {
+			return fmt.Errorf("%s: time (%q): %w", name, base[:first], err)
+		}
+		statusCode, err := strconv.Atoi(base[last+1:])
+		if err != nil {
+			return fmt.Errorf("%s: status (%q): %w", name, base[last+1:], err)
+		}
+		body, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		endpoint := base[first+1 : last]
+		if _, ok := starts[endpoint]; !ok {
+			starts[endpoint] = receivedAt
+		}
+		key := host + "\x00" + endpoint
+		sequence, ok := replay.sequences[key]
+		if !ok {
+			sequence = &replaySequence{}
+			replay.sequences[key] = sequence
+		}
+		sequence.responses = append(sequence.responses, replayedResponse{
+			at:         receivedAt.Sub(starts[endpoint]),
+			statusCode: statusCode,
+			body:       body,
+		})
+	}
+	return nil
+}
+
+func (replay *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	replay.lock.Lock()
+	defer replay.lock.Unlock()
+
+	sequence, ok := replay.sequences[req.URL.Host+"\x00"+recordingEndpoint(req.URL.Path)]
+	if !ok {
+		for key := range replay.sequences {
+			if strings.HasPrefix(key, req.URL.Host+"\x00") {
+				return replayResponse(req, http.StatusNotFound, []byte("no recorded responses\n")), nil
+			}
+		}
+		return nil, fmt.Errorf("no recorded responses of (%s) in replay_dir", req.URL.Host)
+	}
+
+	var response replayedResponse
+	if replay.speed == 0 {
+		response = sequence.responses[sequence.next]
+		sequence.next = (sequence.next + 1) % len(sequence.responses)
+	} else {
+		response = sequence.at(time.Duration(float64(time.Since(replay.start)) * replay.speed))
+	}
+	return replayResponse(req, response.statusCode, response.body), nil
+}
+
+// at returns the response last received at elapsed into the recording,
+// starting over at the end, after the mean time between responses.
+func (sequence *replaySequence) at(elapsed time.Duration) replayedResponse {
+	responses := sequence.responses
+	span := responses[len(responses)-1].at
+	if len(responses) == 1 || span <= 0 {
+		return responses[len(responses)-1]
+	}
+	period := span + span/time.Duration(len(responses)-1)
+	elapsed %= period
+
+	i := sort.Search(len(responses), func(i int) bool { return responses[i].at > elapsed })
+	return responses[i-1]
+}
+
+func replayResponse(req *http.Request, statusCode int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
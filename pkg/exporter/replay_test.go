@@ -0,0 +1,25 @@
+package exporter
+
+import (
+	"net/http"
+	"testing"
+)
+
+// idleClosingTransport counts the calls to CloseIdleConnections.
+type idleClosingTransport struct {
+	offlineTransport
+	closed int
+}
+
+func (t *idleClosingTransport) CloseIdleConnections() {
+	t.closed++
+}
+
+func TestRecordingTransportClosesIdleConnections(t *testing.T) {
+	next := &idleClosingTransport{}
+	client := &http.Client{Transport: &recordingTransport{next: next}}
+	client.CloseIdleConnections()
+	if next.closed != 1 {
+		t.Errorf("CloseIdleConnections reached the wrapped transport %d times, want 1", next.closed)
+	}
+}
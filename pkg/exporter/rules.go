@@ -0,0 +1,147 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// deviceDownFor is the shortest time a device must fail before the
+// generated AwairDeviceDown alert fires.
+const deviceDownFor = 5 * time.Minute
+
+// alertName names the alert for a threshold: the threshold's own name when
+// it was given one, otherwise the sensor and direction, e.g. "CO2High".
+func (t threshold) alertName() string {
+	sensor, _ := lookupSensor(t.Sensor)
+	name := sensor.Name + "High"
+	if t.Below != nil {
+		name = sensor.Name + "Low"
+	}
+
+	if t.named {
+		var custom strings.Builder
+		for _, word := range strings.FieldsFunc(t.Name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+			custom.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+		if custom.Len() > 0 {
+			name = custom.String()
+		}
+	}
+	return "Awair" + name
+}
+
+// WriteAlertRules writes a Prometheus rules file with an alert per threshold
+// in thresholds_file and one for devices that fail to poll.
+func (app *App) WriteAlertRules(w io.Writer) {
+	downFor := 3 * app.TimeBetweenChecks
+	if downFor < deviceDownFor {
+		downFor = deviceDownFor
+	}
+
+	fmt.Fprintf(w, "groups:\n")
+	fmt.Fprintf(w, "  - name: awair\n")
+	fmt.Fprintf(w, "    rules:\n")
+
+	for _, t := range app.alertThresholds() {
+		sensor, _ := lookupSensor(t.Sensor)
+		_, limit := t.describe()
+		direction := "above"
+		if t.Below != nil {
+			direction = "below"
+		}
+		limitText := strconv.FormatFloat(limit, 'f', -1, 64)
+		if app.thresholdOverridden(t.Name) {
+			limitText += " (or the device's own limit)"
+		}
+
+		// The exporter evaluates the threshold, including its for, so that
+		// alerts agree with webhook_url and /api/v1/readings
+		fmt.Fprintf(w, "      - alert: %s\n", t.alertName())
+		fmt.Fprintf(w, "        expr: %s\n", strconv.Quote(fmt.Sprintf("awair_threshold_breached{threshold=%q} == 1", t.Name)))
+		fmt.Fprintf(w, "        labels:\n")
+		fmt.Fprintf(w, "          severity: %s\n", strconv.Quote(t.Severity))
+		fmt.Fprintf(w, "        annotations:\n")
+		fmt.Fprintf(w, "          summary: %s\n", strconv.Quote(fmt.Sprintf("%s %s %s on {{ $labels.device_name }}", sensor.Name, direction, limitText)))
+		description := fmt.Sprintf("%s on {{ $labels.device_name }} is %s %s", sensor.Name, direction, limitText)
+		if t.named {
+			description = fmt.Sprintf("%s on {{ $labels.device_name }} is %s the %s threshold of %s", sensor.Name, direction, t.Name, limitText)
+		}
+		if t.forDuration > 0 {
+			description += fmt.Sprintf(", and has been for %s", prometheusDuration(t.forDuration))
+		}
+		fmt.Fprintf(w, "          description: %s\n", strconv.Quote(description+"."))
+	}
+
+	fmt.Fprintf(w, "      - alert: AwairDeviceDown\n")
+	fmt.Fprintf(w, "        expr: awair_device_up == 0\n")
+	fmt.Fprintf(w, "        for: %s\n", prometheusDuration(downFor))
+	fmt.Fprintf(w, "        labels:\n")
+	fmt.Fprintf(w, "          severity: warning\n")
+	fmt.Fprintf(w, "        annotations:\n")
+	fmt.Fprintf(w, "          summary: %s\n", strconv.Quote("Awair device {{ $labels.device_name }} is down"))
+	fmt.Fprintf(w, "          description: %s\n", strconv.Quote(fmt.Sprintf("Polls of {{ $labels.device_name }} ({{ $labels.device_address }}) have failed for more than %s.", prometheusDuration(downFor))))
+}
+
+// prometheusDuration formats a duration the way Prometheus parses them,
+// e.g. "1h30m" rather than Go's "1h30m0s".
+func prometheusDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d == 0 {
+		return "0s"
+	}
+	var out strings.Builder
+	for _, unit := range []struct {
+		suffix string
+		size   time.Duration
+	}{{"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}} {
+		if n := d / unit.size; n > 0 {
+			fmt.Fprintf(&out, "%d%s", n, unit.suffix)
+			d -= n * unit.size
+		}
+	}
+	return out.String()
+}
+
+// alertThresholds returns a threshold per alert: each threshold that lists
+// no devices, and the first of those that only list devices under a name
+// of their own.
+func (app *App) alertThresholds() []threshold {
+	general := map[string]bool{}
+	for _, t := range app.thresholds {
+		if len(t.Devices) == 0 {
+			general[t.Name] = true
+		}
+	}
+
+	seen := map[string]bool{}
+	thresholds := []threshold{}
+	for _, t := range app.thresholds {
+		if seen[t.Name] || (len(t.Devices) > 0 && general[t.Name]) {
+			continue
+		}
+		seen[t.Name] = true
+		thresholds = append(thresholds, t)
+	}
+	return thresholds
+}
+
+// thresholdOverridden reports whether some devices have a threshold of
+// their own under the name.
+func (app *App) thresholdOverridden(name string) bool {
+	for _, t := range app.thresholds {
+		if t.Name == name && len(t.Devices) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) alertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	app.WriteAlertRules(w)
+}
@@ -0,0 +1,68 @@
+package exporter
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdNotify sends a state such as READY=1 to the systemd notify socket, see
+// sd_notify(3). It's a no-op unless systemd passed a socket, as it does for
+// Type=notify services.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the WatchdogSec systemd expects WATCHDOG=1
+// within, or 0 if the watchdog isn't enabled for this process, see
+// sd_watchdog_enabled(3).
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifySystemd sends state to systemd, logging rather than failing if it
+// can't be delivered.
+func (app *App) notifySystemd(state string) {
+	if err := sdNotify(state); err != nil {
+		app.Logger.Warnf("Failed to notify systemd (%s): %+v", state, err)
+	}
+}
+
+// startWatchdog makes the poll loop send WATCHDOG=1 after every cycle when
+// systemd's watchdog is enabled, so that systemd restarts a wedged loop.
+func (app *App) startWatchdog() {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	if interval <= app.TimeBetweenChecks+app.DeviceTimeout {
+		app.Logger.Warnw("WatchdogSec is shorter than a poll cycle may take; systemd may restart a healthy exporter", "watchdog", interval.String(), "poll_frequency", app.TimeBetweenChecks.String(), "device_timeout", app.DeviceTimeout.String())
+	}
+	app.sdWatchdog = true
+	app.Logger.Infow("Notifying the systemd watchdog every poll cycle", "watchdog", interval.String())
+}
@@ -0,0 +1,198 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// sanityRanges are the values each sensor can plausibly report, as
+// specified for Awair devices. A reading outside them points at a broken
+// sensor or a payload decoded wrongly.
+var sanityRanges = map[string][2]float64{
+	"temp":  {-40, 85},
+	"humid": {0, 100},
+	"co2":   {0, 10000},
+	"voc":   {0, 60000},
+	"pm25":  {0, 1000},
+	"score": {0, 100},
+}
+
+// selfTestResult is how one device fared in the self-test.
+type selfTestResult struct {
+	device     *Device
+	reachable  bool
+	statusCode int
+	decoded    bool
+	problems   []string
+	skew       *time.Duration
+	skewed     bool
+	err        error
+}
+
+func (result selfTestResult) passed() bool {
+	return result.err == nil && len(result.problems) == 0 && !result.skewed
+}
+
+// SelfTest polls every device once, its polling groups' included, through
+// the same client as the exporter itself, writes a table of whether each
+// was reachable, answered 200, decoded, reported a sane reading and agrees
+// with this host's clock within SelfTestMaxClockSkew, and returns an error
+// if any device failed. Nothing is exported or pushed to the outputs.
+func (app *App) SelfTest(ctx context.Context, w io.Writer) error {
+	if err := app.setup(true); err != nil {
+		return err
+	}
+	if err := app.setupGroups(); err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), app.ShutdownGracePeriod)
+		defer cancel()
+		app.closeOutputs(ctx)
+	}()
+
+	apps := []*App{app}
+	for _, group := range app.groups {
+		apps = append(apps, group.app)
+	}
+
+	results := []*selfTestResult{}
+	var wg sync.WaitGroup
+	for _, a := range apps {
+		for _, device := range a.Devices() {
+			result := &selfTestResult{device: device}
+			results = append(results, result)
+			wg.Add(1)
+			go func(a *App) {
+				defer wg.Done()
+				a.selfTestDevice(ctx, result)
+			}(a)
+		}
+	}
+	wg.Wait()
+
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tREACHABLE\tSTATUS\tDECODE\tSANITY\tCLOCK SKEW\tRESULT")
+	for _, result := range results {
+		if !result.passed() {
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			result.device.Name,
+			selfTestCheck(true, result.reachable),
+			selfTestStatus(result),
+			selfTestCheck(result.reachable && result.statusCode == 200, result.decoded),
+			selfTestCheck(result.decoded, len(result.problems) == 0),
+			selfTestSkew(result),
+			selfTestVerdict(result),
+		)
+	}
+	tw.Flush()
+
+	if len(results) == 0 {
+		return fmt.Errorf("no devices configured")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d devices failed the self-test", failed, len(results))
+	}
+	return nil
+}
+
+// selfTestDevice polls a device once and checks its reading.
+func (app *App) selfTestDevice(ctx context.Context, result *selfTestResult) {
+	device := result.device
+
+	var stats AwairStats
+	var err error
+	if device.Source == deviceSourceCloud {
+		fetchCtx, cancel := context.WithTimeout(ctx, app.DeviceTimeout)
+		stats, err = app.fetchCloudData(fetchCtx, device)
+		cancel()
+	} else {
+		stats, err = app.fetchLocalData(ctx, device)
+	}
+	now := time.Now()
+
+	result.err = err
+	if err != nil {
+		var devErr *deviceError
+		if errors.As(err, &devErr) && devErr.StatusCode != 0 {
+			result.reachable = true
+			result.statusCode = devErr.StatusCode
+		}
+		return
+	}
+	result.reachable = true
+	result.statusCode = 200
+	result.decoded = true
+
+	for _, sensor := range sensorReadings {
+		value := sensor.Value(stats)
+		limits := sanityRanges[sensor.Sensor]
+		if value < limits[0] || value > limits[1] {
+			result.problems = append(result.problems, fmt.Sprintf("%s (%v) outside %v to %v", sensor.Sensor, value, limits[0], limits[1]))
+		}
+	}
+	if stats.Timestamp.IsZero() {
+		result.problems = append(result.problems, "reading has no timestamp")
+		return
+	}
+
+	// Cloud readings are as old as the API's last sync, so only a local
+	// device's timestamp says anything about its clock
+	if device.Source == deviceSourceCloud {
+		return
+	}
+	skew := stats.Timestamp.Sub(now)
+	result.skew = &skew
+	result.skewed = skew > app.SelfTestMaxClockSkew || -skew > app.SelfTestMaxClockSkew
+}
+
+// selfTestCheck shows a check as ok or FAIL, or - if it wasn't reached.
+func selfTestCheck(reached, ok bool) string {
+	switch {
+	case !reached:
+		return "-"
+	case ok:
+		return "ok"
+	}
+	return "FAIL"
+}
+
+func selfTestStatus(result *selfTestResult) string {
+	if !result.reachable {
+		return "-"
+	}
+	return strconv.Itoa(result.statusCode)
+}
+
+func selfTestSkew(result *selfTestResult) string {
+	if result.skew == nil {
+		return "-"
+	}
+	skew := result.skew.Round(100 * time.Millisecond)
+	if skew <= 0 {
+		return skew.String()
+	}
+	return "+" + skew.String()
+}
+
+func selfTestVerdict(result *selfTestResult) string {
+	switch {
+	case result.err != nil:
+		return "FAIL: " + result.err.Error()
+	case len(result.problems) > 0:
+		return "FAIL: " + strings.Join(result.problems, ", ")
+	case result.skewed:
+		return "FAIL: clock skew over selftest_max_clock_skew"
+	}
+	return "PASS"
+}
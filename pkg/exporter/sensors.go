@@ -0,0 +1,62 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// sensorReading reads one sensor out of a device's stats.
+type sensorReading struct {
+	Sensor string
+	Name   string // human-readable, as used in generated alert names
+	Metric string // the Prometheus gauge the sensor is exported as
+	Legacy string // the gauge's former name, also exported with legacy_metrics
+	Help   string
+	Value  func(AwairStats) float64
+}
+
+// sensorReadings lists the sensors published by the push outputs, named as
+// in the device's air-data JSON.
+var sensorReadings = []sensorReading{
+	{Sensor: "temp", Name: "Temperature", Metric: "awair_air_quality_temperature_celsius", Legacy: "awair_climate_temp_c", Help: "The current temperature in degrees Celsius", Value: func(s AwairStats) float64 { return s.Temp }},
+	{Sensor: "humid", Name: "Humidity", Metric: "awair_air_quality_relative_humidity_percent", Legacy: "awair_climate_relative_humidity", Help: "The current relative humidity in percent", Value: func(s AwairStats) float64 { return s.Humid }},
+	{Sensor: "co2", Name: "CO2", Metric: "awair_air_quality_co2_ppm", Legacy: "awair_climate_co2_ppm", Help: "The current CO2 concentration in parts per million", Value: func(s AwairStats) float64 { return float64(s.Co2) }},
+	{Sensor: "voc", Name: "VOC", Metric: "awair_air_quality_voc_ppb", Legacy: "awair_climate_voc_ppb", Help: "The current Volatile Organic Compound concentration in parts per billion", Value: func(s AwairStats) float64 { return float64(s.Voc) }},
+	{Sensor: "pm25", Name: "PM25", Metric: "awair_air_quality_pm25_micrograms_per_cubic_meter", Legacy: "awair_climate_pm25_ug_m3", Help: "The current concentration of 2.5 micron particles in micrograms per cubic meter", Value: func(s AwairStats) float64 { return float64(s.Pm25) }},
+	{Sensor: "score", Name: "Score", Metric: "awair_air_quality_score", Legacy: "awair_climate_score", Help: "The current Awair Score", Value: func(s AwairStats) float64 { return float64(s.Score) }},
+}
+
+func lookupSensor(sensor string) (sensorReading, bool) {
+	for _, reading := range sensorReadings {
+		if reading.Sensor == sensor {
+			return reading, true
+		}
+	}
+	return sensorReading{}, false
+}
+
+// sensorMetricNames returns the names a sensor's gauge is exported under in
+// a namespace: its own, and its legacy one with legacy_metrics.
+func (app *App) sensorMetricNames(sensor sensorReading, namespace string) []string {
+	names := []string{sensor.Metric}
+	if app.LegacyMetrics {
+		names = append(names, sensor.Legacy)
+	}
+	for i, name := range names {
+		names[i] = namespace + strings.TrimPrefix(name, defaultNamespace)
+	}
+	return names
+}
+
+// WriteMetricMap writes the legacy name of each sensor gauge next to the
+// name that replaces it, to update dashboards and alerts by.
+func WriteMetricMap(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LEGACY\tCURRENT")
+	for _, sensor := range sensorReadings {
+		fmt.Fprintf(tw, "%s\t%s\n", sensor.Legacy, sensor.Metric)
+	}
+	tw.Flush()
+}
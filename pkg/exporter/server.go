@@ -0,0 +1,138 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// newHTTPServer builds a server with explicit timeouts so slow or wedged
+// clients can't hold connections open indefinitely.
+func (app *App) newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: app.ServerReadHeaderTimeout,
+		ReadTimeout:       app.ServerReadTimeout,
+		WriteTimeout:      app.ServerWriteTimeout,
+		IdleTimeout:       app.ServerIdleTimeout,
+		MaxHeaderBytes:    app.ServerMaxHeaderBytes,
+		ConnContext:       tagUnixConn,
+	}
+}
+
+// unixConnKey marks the context of requests received over a unix socket.
+type unixConnKey struct{}
+
+// tagUnixConn marks connections accepted on a unix socket, whether it was
+// opened for listen_socket or passed by systemd socket activation.
+func tagUnixConn(ctx context.Context, conn net.Conn) context.Context {
+	if conn.LocalAddr().Network() == "unix" {
+		return context.WithValue(ctx, unixConnKey{}, true)
+	}
+	return ctx
+}
+
+// isUnixConn reports whether a request was received over a unix socket.
+func isUnixConn(r *http.Request) bool {
+	unix, _ := r.Context().Value(unixConnKey{}).(bool)
+	return unix
+}
+
+// listen opens the listener the HTTP server is served from: the socket passed
+// by systemd socket activation if there is one, the unix socket when
+// listen_socket is set, otherwise the TCP listen address and port.
+func (app *App) listen() (net.Listener, error) {
+	listener, err := systemdListener()
+	if err != nil {
+		return nil, fmt.Errorf("failed to use systemd socket: %w", err)
+	}
+	if listener != nil {
+		app.Logger.Infof("Using listener (%+v) passed by systemd socket activation", listener.Addr())
+		return listener, nil
+	}
+
+	if app.ListenSocket != "" {
+		return app.listenUnix()
+	}
+	return net.Listen("tcp", fmt.Sprintf("%s:%d", app.ListenAddress, app.ListenPort))
+}
+
+func (app *App) listenUnix() (net.Listener, error) {
+	if err := removeStaleSocket(app.ListenSocket); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", app.ListenSocket)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket file is unlinked when the listener is closed
+	if err := os.Chmod(app.ListenSocket, app.ListenSocketMode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set permissions on socket: %w", err)
+	}
+
+	return listener, nil
+}
+
+// removeStaleSocket deletes a socket file left behind by an unclean exit,
+// refusing to touch it if another process is still accepting on it or if
+// the path isn't a socket at all.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("failed to check for stale socket %s: %w", path, err)
+	}
+
+	return os.Remove(path)
+}
+
+// The first file descriptor passed by systemd, see sd_listen_fds(3)
+const systemdListenFDsStart = 3
+
+// systemdListener returns the listening socket inherited from systemd socket
+// activation, or nil if the process wasn't socket activated.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	if fds > 1 {
+		return nil, fmt.Errorf("expected a single socket, got %d", fds)
+	}
+
+	// Don't pass the sockets on to any child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdListenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+
+	return net.FileListener(f)
+}
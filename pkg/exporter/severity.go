@@ -0,0 +1,36 @@
+package exporter
+
+// severityBand classifies a sensor reading, loosely following the bands
+// Awair uses for its own per-sensor index: values within Good are good,
+// values within Fair are fair, anything else is poor. Bounds are inclusive.
+type severityBand struct {
+	Good [2]float64 `json:"good"`
+	Fair [2]float64 `json:"fair"`
+}
+
+// severityBands is keyed by the sensor's name in the readings JSON.
+var severityBands = map[string]severityBand{
+	"temp":  {Good: [2]float64{18, 25}, Fair: [2]float64{16, 28}},
+	"humid": {Good: [2]float64{40, 50}, Fair: [2]float64{30, 60}},
+	"co2":   {Good: [2]float64{0, 600}, Fair: [2]float64{0, 1500}},
+	"voc":   {Good: [2]float64{0, 333}, Fair: [2]float64{0, 3333}},
+	"pm25":  {Good: [2]float64{0, 15}, Fair: [2]float64{0, 35}},
+	"score": {Good: [2]float64{80, 100}, Fair: [2]float64{60, 100}},
+}
+
+const (
+	severityGood = "good"
+	severityFair = "fair"
+	severityPoor = "poor"
+)
+
+func (band severityBand) classify(value float64) string {
+	switch {
+	case value >= band.Good[0] && value <= band.Good[1]:
+		return severityGood
+	case value >= band.Fair[0] && value <= band.Fair[1]:
+		return severityFair
+	default:
+		return severityPoor
+	}
+}
@@ -0,0 +1,151 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// simulationSampleInterval is how often a simulation samples the
+// goroutine count and memory use.
+const simulationSampleInterval = time.Second
+
+// maxSimulationCycles bounds the cycle times a simulation keeps for its
+// report.
+const maxSimulationCycles = 100000
+
+// simulation tracks how the exporter keeps up while polling fake devices.
+type simulation struct {
+	cycleHistogram prometheus.Histogram
+
+	lock          sync.Mutex
+	start         time.Time
+	cycles        []time.Duration
+	maxGoroutines int
+	maxHeap       uint64
+	maxSys        uint64
+}
+
+// Simulate runs the exporter as Run does, for capacity testing against the
+// fake devices it was configured with, and writes a report of its poll
+// cycle times, goroutines and memory to w once duration has passed, or ctx
+// is cancelled if duration is 0. Cycle times are also exported as
+// awair_simulation_cycle_duration_seconds while it runs.
+func (app *App) Simulate(ctx context.Context, w io.Writer, duration time.Duration) error {
+	app.simulation = &simulation{start: time.Now()}
+
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(simulationSampleInterval)
+		defer ticker.Stop()
+		for {
+			app.simulation.sample()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	err := app.Run(ctx)
+	<-sampled
+	app.writeSimulationReport(w)
+	return err
+}
+
+// initializeSimulation registers awair_simulation_cycle_duration_seconds
+// while simulating.
+func (app *App) initializeSimulation(factory promauto.Factory, namespace string) {
+	if app.simulation == nil {
+		return
+	}
+	app.simulation.cycleHistogram = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "simulation",
+		Name:      "cycle_duration_seconds",
+		Help:      "Time taken by each poll cycle over the simulated Awair devices",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+	})
+}
+
+// observeCycle records the time a poll cycle took while simulating.
+func (app *App) observeCycle(elapsed time.Duration) {
+	sim := app.simulation
+	if sim == nil {
+		return
+	}
+	sim.cycleHistogram.Observe(elapsed.Seconds())
+
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	if len(sim.cycles) < maxSimulationCycles {
+		sim.cycles = append(sim.cycles, elapsed)
+	}
+}
+
+// sample records the goroutine count and memory use if they're the highest
+// yet.
+func (sim *simulation) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	goroutines := runtime.NumGoroutine()
+
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	if goroutines > sim.maxGoroutines {
+		sim.maxGoroutines = goroutines
+	}
+	if stats.HeapAlloc > sim.maxHeap {
+		sim.maxHeap = stats.HeapAlloc
+	}
+	if stats.Sys > sim.maxSys {
+		sim.maxSys = stats.Sys
+	}
+}
+
+func (app *App) writeSimulationReport(w io.Writer) {
+	sim := app.simulation
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	devices := app.Devices()
+	polls, failed := 0, 0
+	for _, device := range devices {
+		device.stateLock.Lock()
+		polls += device.polls
+		failed += device.pollErrors
+		device.stateLock.Unlock()
+	}
+
+	fmt.Fprintf(w, "Simulated %d devices for %v, polling every %v\n", len(devices), time.Since(sim.start).Round(time.Second), app.TimeBetweenChecks)
+	fmt.Fprintf(w, "polls:       %d, %d failed\n", polls, failed)
+	if len(sim.cycles) == 0 {
+		fmt.Fprintln(w, "cycle time:  no poll cycle completed")
+	} else {
+		cycles := append([]time.Duration(nil), sim.cycles...)
+		sort.Slice(cycles, func(i, j int) bool { return cycles[i] < cycles[j] })
+		percentile := func(p float64) time.Duration {
+			return cycles[int(p*float64(len(cycles)-1))].Round(time.Millisecond)
+		}
+		overran := len(cycles) - sort.Search(len(cycles), func(i int) bool { return cycles[i] > app.TimeBetweenChecks })
+		fmt.Fprintf(w, "cycle time:  min %v, p50 %v, p95 %v, max %v over %d cycles\n", percentile(0), percentile(0.5), percentile(0.95), percentile(1), len(cycles))
+		fmt.Fprintf(w, "overran:     %d of %d cycles took longer than poll_frequency\n", overran, len(cycles))
+	}
+	fmt.Fprintf(w, "goroutines:  max %d\n", sim.maxGoroutines)
+	fmt.Fprintf(w, "memory:      max %.1f MiB heap, %.1f MiB from the OS\n", float64(sim.maxHeap)/(1<<20), float64(sim.maxSys)/(1<<20))
+}
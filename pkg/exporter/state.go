@@ -0,0 +1,222 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// stateVersion is the version of the state_file format written.
+const stateVersion = 1
+
+// stateFile is the contents of state_file: the last reading of every
+// device, by address.
+type stateFile struct {
+	Version int                    `json:"version"`
+	SavedAt time.Time              `json:"saved_at"`
+	Devices map[string]deviceState `json:"devices"`
+}
+
+// deviceState is the last reading of a device, and its name to make the
+// file readable.
+type deviceState struct {
+	Name    string     `json:"name"`
+	Reading AwairStats `json:"reading"`
+}
+
+// markStateChanged notes that a reading changed since state_file was last
+// written.
+func (app *App) markStateChanged() {
+	atomic.StoreInt32(&app.stateChanged, 1)
+}
+
+// saveState writes the last reading of every device, its polling groups'
+// included, to state_file if any changed since it was last written. The
+// file is replaced atomically so that a crash never leaves it half written.
+func (app *App) saveState() {
+	if app.StateFile == "" {
+		return
+	}
+	changed := atomic.SwapInt32(&app.stateChanged, 0) == 1
+	for _, group := range app.groups {
+		if atomic.SwapInt32(&group.app.stateChanged, 0) == 1 {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	state := stateFile{Version: stateVersion, SavedAt: time.Now().UTC(), Devices: map[string]deviceState{}}
+	for _, a := range app.stateApps() {
+		for _, device := range a.Devices() {
+			if reading := device.LastReading(); reading != nil {
+				state.Devices[device.Address] = deviceState{Name: device.Name, Reading: *reading}
+			}
+		}
+	}
+
+	if err := writeFileAtomic(app.StateFile, state); err != nil {
+		app.Logger.Errorf("Failed to write state_file (%+v): %+v", app.StateFile, err)
+		app.markStateChanged()
+	}
+}
+
+// stateApps are the exporter and those of its polling groups.
+func (app *App) stateApps() []*App {
+	apps := []*App{app}
+	for _, group := range app.groups {
+		apps = append(apps, group.app)
+	}
+	return apps
+}
+
+func writeFileAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	// The data must be on disk before the rename is, or a power cut can
+	// leave an empty file in place of the old one
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// loadStateFile reads state_file, if it exists, for restoreState.
+func (app *App) loadStateFile() error {
+	if app.StateFile == "" {
+		return nil
+	}
+	if app.StateMaxAge <= 0 {
+		return fmt.Errorf("state_max_age (%v): must be positive", app.StateMaxAge)
+	}
+
+	data, err := ioutil.ReadFile(app.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("state_file (%q): %w", app.StateFile, err)
+	}
+
+	state := &stateFile{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return fmt.Errorf("state_file (%q): %w", app.StateFile, err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("state_file (%q): version %d isn't supported, only %d", app.StateFile, state.Version, stateVersion)
+	}
+	app.state = state
+	return nil
+}
+
+// restoreState exports the readings of state_file until the devices are
+// polled, so that a restart doesn't leave gaps, and a device that's
+// offline at startup isn't missing altogether. A reading older than
+// state_max_age, by the device's timestamp, is dropped as too stale to
+// trust, and a restored reading is dropped again once it gets older than
+// that without a poll replacing it. Restored readings set the sensor gauges
+// and the JSON API's last reading only: the device's health stays unknown until it's polled, so it
+// isn't aggregated, and nothing is pushed to the outputs or checked against
+// the thresholds again.
+func (app *App) restoreState() {
+	if app.state == nil {
+		return
+	}
+
+	restored, stale := 0, 0
+	for _, a := range app.stateApps() {
+		for _, device := range a.Devices() {
+			saved, ok := app.state.Devices[device.Address]
+			if !ok {
+				continue
+			}
+			taken := saved.Reading.Timestamp
+			if taken.IsZero() {
+				taken = app.state.SavedAt
+			}
+			age := time.Since(taken)
+			if age > app.StateMaxAge {
+				app.Logger.Infow("Dropped stale reading from state_file", "device", redactAddress(device.label), "device_name", device.Name, "age", age.Round(time.Second).String())
+				stale++
+				continue
+			}
+			if a.restoreReading(device, saved.Reading, app.StateMaxAge-age) {
+				restored++
+			}
+		}
+	}
+	app.state = nil
+	app.Logger.Infow("Restored readings from state_file", "path", app.StateFile, "restored", restored, "stale", stale)
+}
+
+// restoreReading sets a device's gauges and last reading from a reading
+// restored from state_file, unless it has been polled already, and drops
+// them again after expires.
+func (app *App) restoreReading(device *Device, stats AwairStats, expires time.Duration) bool {
+	app.devicesLock.RLock()
+	defer app.devicesLock.RUnlock()
+
+	if device.removed || device.isPaused() || device.LastReading() != nil {
+		return false
+	}
+	if !app.awaitsMetadataLabels(device) {
+		app.setSensorGauges(app.sensorLabels(device, device.dataSource()), stats)
+		app.setSensorValues(device, stats)
+	}
+	device.recordReading(stats)
+
+	restored := device.LastReading()
+	time.AfterFunc(expires, func() {
+		app.expireRestoredReading(device, restored)
+	})
+	return true
+}
+
+// expireRestoredReading drops a reading restored from state_file that has
+// gotten older than state_max_age, unless a poll has replaced it since.
+func (app *App) expireRestoredReading(device *Device, restored *AwairStats) {
+	app.devicesLock.RLock()
+	defer app.devicesLock.RUnlock()
+
+	if device.removed {
+		return
+	}
+	device.stateLock.Lock()
+	replaced := device.lastReading != restored
+	if !replaced {
+		device.lastReading = nil
+	}
+	device.stateLock.Unlock()
+	if replaced {
+		return
+	}
+
+	if !app.awaitsMetadataLabels(device) {
+		app.deleteSensorGauges(app.sensorLabels(device, device.dataSource()))
+		app.deleteSensorValues(device)
+	}
+	app.Logger.Infow("Dropped reading restored from state_file, it's older than state_max_age", "device", redactAddress(device.label), "device_name", device.Name)
+}
@@ -0,0 +1,56 @@
+package exporter
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A restored reading is exported until it gets older than state_max_age,
+// unless a poll replaces it first.
+func TestRestoredReadingExpires(t *testing.T) {
+	const polled = "http://bedroom/air-data/latest"
+	path := filepath.Join(t.TempDir(), "state.json")
+	taken := time.Now().Add(-time.Hour + 200*time.Millisecond)
+	err := writeFileAtomic(path, stateFile{
+		Version: stateVersion,
+		SavedAt: taken,
+		Devices: map[string]deviceState{
+			testAddress: {Name: "living-room", Reading: AwairStats{Timestamp: taken, Score: 80}},
+			polled:      {Name: "bedroom", Reading: AwairStats{Timestamp: taken, Score: 70}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newFakeDeviceClient()
+	client.set(testAddress, AwairStats{}, errors.New("offline"))
+	app := newTestApp(t, client, func(app *App) {
+		app.StateFile = path
+		app.StateMaxAge = time.Hour
+	}, testAddress, polled)
+	app.restoreState()
+
+	score := func(address string) (float64, bool) {
+		return metricValue(t, app, "awair_air_quality_score", map[string]string{"device_address": address})
+	}
+	if got, ok := score(testAddress); !ok || got != 80 {
+		t.Fatalf("restored score = %v (exported %v), want 80", got, ok)
+	}
+
+	client.set(polled, AwairStats{Timestamp: time.Now(), Score: 92}, nil)
+	pollOnce(app)
+	time.Sleep(400 * time.Millisecond)
+
+	if _, ok := score(testAddress); ok {
+		t.Errorf("score of the offline device is still exported past state_max_age")
+	}
+	if device, _ := app.LookupDevice(testAddress); device.LastReading() != nil {
+		t.Errorf("last reading of the offline device = %+v, want none past state_max_age", device.LastReading())
+	}
+	if got, _ := score(polled); got != 92 {
+		t.Errorf("score of the polled device = %v, want 92", got)
+	}
+}
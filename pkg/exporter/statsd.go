@@ -0,0 +1,228 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// statsdMaxPacketBytes keeps UDP datagrams under a typical MTU.
+	statsdMaxPacketBytes = 1432
+	statsdQueueSize      = 16
+	statsdDialTimeout    = 5 * time.Second
+	maxDialBackoff       = 5 * time.Minute
+)
+
+// parseStatsdAddress splits an address such as udp://host:8125 or
+// tcp://host:8125 into a network and address. A bare host:port means UDP.
+func parseStatsdAddress(address string) (string, string, error) {
+	if !strings.Contains(address, "://") {
+		address = "udp://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("missing host")
+		}
+		return u.Scheme, u.Host, nil
+	default:
+		return "", "", fmt.Errorf("scheme must be udp or tcp")
+	}
+}
+
+var invalidMetricPathChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// metricPathSegment turns a device name into a single dot-free path
+// segment, e.g. "192.168.1.50:80" becomes "192_168_1_50_80".
+func metricPathSegment(name string) string {
+	return strings.Trim(invalidMetricPathChars.ReplaceAllString(name, "_"), "_")
+}
+
+// statsdOutput sends readings as lines of text over UDP, TCP or a unix
+// socket, formatted for StatsD, DogStatsD or Graphite. Lines are queued per
+// cycle and written by a background goroutine so that an unreachable server
+// can't hold up polling.
+type statsdOutput struct {
+	app     *App
+	network string
+	address string
+	format  func(device *Device, sensor string, value float64, timestamp time.Time) string
+
+	lock  sync.Mutex
+	lines []string
+
+	queue chan []string
+	done  chan struct{}
+	conn  net.Conn
+
+	// After a failed dial, the next one waits out dialBackoff, which
+	// doubles up to maxDialBackoff while the server stays unreachable.
+	nextDial    time.Time
+	dialBackoff time.Duration
+
+	errorLog     rateLimitedLog
+	linesSent    prometheus.Counter
+	linesDropped prometheus.Counter
+	sendErrors   prometheus.Counter
+}
+
+func (app *App) newStatsdOutput() *statsdOutput {
+	network, address, _ := parseStatsdAddress(app.StatsdAddress)
+	prefix := app.StatsdPrefix
+
+	out := app.newStatsdSink("statsd", network, address)
+	out.format = func(device *Device, sensor string, value float64, _ time.Time) string {
+		return fmt.Sprintf("%s.%s.%s:%s|g", prefix, metricPathSegment(device.Name), sensor, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+
+	go out.run()
+	return out
+}
+
+func (app *App) newStatsdSink(subsystem string, network string, address string) *statsdOutput {
+	factory := promauto.With(app.Registerer)
+	return &statsdOutput{
+		app:     app,
+		network: network,
+		address: address,
+		queue:   make(chan []string, statsdQueueSize),
+		done:    make(chan struct{}),
+		linesSent: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: subsystem,
+			Name:      "lines_sent_total",
+			Help:      "Metric lines sent",
+		}),
+		linesDropped: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: subsystem,
+			Name:      "lines_dropped_total",
+			Help:      "Metric lines dropped because they couldn't be sent or the queue was full",
+		}),
+		sendErrors: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: subsystem,
+			Name:      "send_errors_total",
+			Help:      "Failed writes to the server",
+		}),
+	}
+}
+
+func (out *statsdOutput) Record(device *Device, stats AwairStats) {
+	lines := make([]string, 0, len(sensorReadings))
+	for _, reading := range sensorReadings {
+		lines = append(lines, out.format(device, reading.Sensor, reading.Value(stats), stats.Timestamp))
+	}
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	out.lines = append(out.lines, lines...)
+}
+
+func (out *statsdOutput) Flush() {
+	out.lock.Lock()
+	lines := out.lines
+	out.lines = nil
+	out.lock.Unlock()
+
+	if len(lines) == 0 {
+		return
+	}
+
+	select {
+	case out.queue <- lines:
+	default:
+		out.linesDropped.Add(float64(len(lines)))
+	}
+}
+
+func (out *statsdOutput) Close(ctx context.Context) {
+	out.Flush()
+	close(out.queue)
+
+	select {
+	case <-out.done:
+	case <-ctx.Done():
+	}
+}
+
+func (out *statsdOutput) run() {
+	defer close(out.done)
+	for lines := range out.queue {
+		if err := out.send(lines); err != nil {
+			out.sendErrors.Inc()
+			out.linesDropped.Add(float64(len(lines)))
+			out.errorLog.Errorf(out.app, "Failed to send metrics to (%+v): %+v", out.address, err)
+			continue
+		}
+		out.linesSent.Add(float64(len(lines)))
+	}
+	if out.conn != nil {
+		out.conn.Close()
+	}
+}
+
+// send writes lines over the connection, packing as many as fit into each
+// datagram. A connection that fails is dropped and redialed next time.
+func (out *statsdOutput) send(lines []string) error {
+	if out.conn == nil {
+		if time.Now().Before(out.nextDial) {
+			return fmt.Errorf("waiting %v to reconnect", time.Until(out.nextDial).Round(time.Second))
+		}
+		conn, err := net.DialTimeout(out.network, out.address, statsdDialTimeout)
+		if err != nil {
+			if out.dialBackoff == 0 {
+				out.dialBackoff = outputRetryBackoff
+			} else if out.dialBackoff < maxDialBackoff {
+				out.dialBackoff *= 2
+			}
+			out.nextDial = time.Now().Add(out.dialBackoff)
+			return err
+		}
+		out.conn = conn
+		out.dialBackoff = 0
+	}
+
+	packets := []string{}
+	if out.network == "tcp" {
+		// Streams need no packing, but every line must be terminated
+		packets = append(packets, strings.Join(lines, "\n")+"\n")
+	} else {
+		packet := ""
+		for _, line := range lines {
+			if packet != "" && len(packet)+1+len(line) > statsdMaxPacketBytes {
+				packets = append(packets, packet)
+				packet = ""
+			}
+			if packet != "" {
+				packet += "\n"
+			}
+			packet += line
+		}
+		packets = append(packets, packet)
+	}
+
+	for _, packet := range packets {
+		out.conn.SetWriteDeadline(time.Now().Add(statsdDialTimeout))
+		if _, err := out.conn.Write([]byte(packet)); err != nil {
+			out.conn.Close()
+			out.conn = nil
+			return err
+		}
+	}
+	return nil
+}
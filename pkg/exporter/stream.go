@@ -0,0 +1,124 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// streamHeartbeatInterval keeps proxies from closing idle streams
+	streamHeartbeatInterval = 15 * time.Second
+	// streamBufferSize is how many events a slow subscriber may fall behind
+	// by before events are dropped for it
+	streamBufferSize = 32
+)
+
+type streamEvent struct {
+	Name    string     `json:"name"`
+	Address string     `json:"address"`
+	Reading AwairStats `json:"reading"`
+}
+
+// subscribe registers a stream subscriber, returning false if the
+// subscriber limit has been reached.
+func (app *App) subscribe() (chan streamEvent, bool) {
+	app.streamLock.Lock()
+	defer app.streamLock.Unlock()
+
+	if len(app.streamSubscribers) >= app.StreamMaxSubscribers {
+		return nil, false
+	}
+	events := make(chan streamEvent, streamBufferSize)
+	app.streamSubscribers[events] = struct{}{}
+	return events, true
+}
+
+func (app *App) unsubscribe(events chan streamEvent) {
+	app.streamLock.Lock()
+	defer app.streamLock.Unlock()
+	delete(app.streamSubscribers, events)
+}
+
+// publishReading fans a fresh reading out to every subscriber without ever
+// blocking the poll loop.
+func (app *App) publishReading(device *Device, stats AwairStats) {
+	event := streamEvent{
+		Name:    device.Name,
+		Address: redactAddress(device.Address),
+		Reading: stats,
+	}
+
+	app.streamLock.Lock()
+	defer app.streamLock.Unlock()
+
+	for events := range app.streamSubscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// streamHandler emits a server-sent event for every completed device poll.
+// Streams end just before the server's write timeout; EventSource clients
+// reconnect automatically.
+func (app *App) streamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, ok := app.subscribe()
+	if !ok {
+		http.Error(w, "too many stream subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer app.unsubscribe(events)
+
+	var deadline <-chan time.Time
+	if app.ServerWriteTimeout > 0 {
+		lifetime := app.ServerWriteTimeout - time.Second
+		if lifetime <= 0 {
+			lifetime = app.ServerWriteTimeout / 2
+		}
+		timer := time.NewTimer(lifetime)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: 1000\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-deadline:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				app.Logger.Errorf("Failed to marshal stream event: %+v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: reading\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// textfileOutput writes the awair_* metrics for node_exporter's textfile
+// collector after every cycle.
+type textfileOutput struct {
+	app *App
+
+	writeTimestamp prometheus.Gauge
+}
+
+func (app *App) newTextfileOutput() *textfileOutput {
+	return &textfileOutput{
+		app: app,
+		writeTimestamp: promauto.With(app.Registerer).NewGauge(prometheus.GaugeOpts{
+			Namespace: "awair",
+			Subsystem: "textfile",
+			Name:      "write_timestamp_seconds",
+			Help:      "Unix time the textfile was last written, to detect a stale file",
+		}),
+	}
+}
+
+// Record is a no-op: the file is written from the registry on Flush.
+func (out *textfileOutput) Record(device *Device, stats AwairStats) {}
+
+func (out *textfileOutput) Flush() {
+	if err := out.write(); err != nil {
+		out.app.Logger.Errorf("Failed to write metrics to textfile (%+v): %+v", out.app.TextfileOutput, err)
+	}
+}
+
+func (out *textfileOutput) Close(ctx context.Context) {
+	out.Flush()
+}
+
+// write replaces the file atomically so node_exporter never reads a partial
+// file. The temporary file doesn't end in .prom, so it's never collected.
+func (out *textfileOutput) write() error {
+	out.writeTimestamp.Set(float64(time.Now().Unix()))
+
+	var buf bytes.Buffer
+	if err := writeAwairMetrics(&buf, out.app.Gatherer); err != nil {
+		return err
+	}
+
+	path := out.app.TextfileOutput
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	// node_exporter usually runs as a different user
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
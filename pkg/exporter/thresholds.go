@@ -0,0 +1,203 @@
+package exporter
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultThresholdSeverity is the severity of a threshold that doesn't set
+// one.
+const defaultThresholdSeverity = "warning"
+
+// thresholdState tracks one threshold on one device.
+type thresholdState struct {
+	since  time.Time
+	value  float64
+	firing bool
+}
+
+// thresholdBreach is a threshold firing for a device, as shown in
+// /api/v1/readings.
+type thresholdBreach struct {
+	Threshold string    `json:"threshold"`
+	Sensor    string    `json:"sensor"`
+	Severity  string    `json:"severity"`
+	Value     float64   `json:"value"`
+	Operator  string    `json:"operator"`
+	Limit     float64   `json:"limit"`
+	Since     time.Time `json:"since"`
+}
+
+// checkThresholdOverrides checks that a threshold listing devices, which
+// replaces the one of the same name for them, replaces one on the same
+// sensor and was named to do so.
+func checkThresholdOverrides(thresholds []threshold) error {
+	general := map[string]threshold{}
+	for _, t := range thresholds {
+		if len(t.Devices) == 0 {
+			if _, ok := general[t.Name]; ok {
+				return fmt.Errorf("threshold (%q): name used by another threshold without devices", t.Name)
+			}
+			general[t.Name] = t
+		}
+	}
+	for _, t := range thresholds {
+		if other, ok := general[t.Name]; ok && len(t.Devices) > 0 && other.Sensor != t.Sensor {
+			return fmt.Errorf("threshold (%q): overrides a threshold on sensor (%q) with one on (%q)", t.Name, other.Sensor, t.Sensor)
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether a threshold listing devices lists the device,
+// by name or URL.
+func (t threshold) appliesTo(device *Device) bool {
+	for _, key := range t.Devices {
+		if key == device.Name || key == device.Address {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceThresholds returns the thresholds evaluated for a device: those
+// listing it, and those listing no devices that it has no override of.
+func (app *App) deviceThresholds(device *Device) []threshold {
+	overridden := map[string]bool{}
+	for _, t := range app.thresholds {
+		if t.appliesTo(device) {
+			overridden[t.Name] = true
+		}
+	}
+
+	thresholds := []threshold{}
+	for _, t := range app.thresholds {
+		if t.appliesTo(device) || (len(t.Devices) == 0 && !overridden[t.Name]) {
+			thresholds = append(thresholds, t)
+		}
+	}
+	return thresholds
+}
+
+// evaluateThresholds checks a reading against the device's thresholds, once
+// for awair_threshold_breached, /api/v1/readings and webhook_url alike. A
+// threshold fires once it has been breached for its For, and resolves once
+// a reading clears it. A breach that ends before its For is forgotten.
+func (app *App) evaluateThresholds(device *Device, stats AwairStats) {
+	if len(app.thresholds) == 0 {
+		return
+	}
+	now := time.Now()
+
+	app.thresholdsLock.Lock()
+	defer app.thresholdsLock.Unlock()
+
+	for _, t := range app.deviceThresholds(device) {
+		sensor, _ := lookupSensor(t.Sensor)
+		value := sensor.Value(stats)
+		key := device.Address + "\x00" + t.Name
+		state, ok := app.thresholdStates[key]
+
+		switch {
+		case ok && state.firing && t.cleared(value):
+			app.Logger.Infow("Threshold resolved", "threshold", t.Name, "severity", t.Severity, "device", redactAddress(device.label), "device_name", device.Name, "value", value)
+			if app.webhook != nil {
+				app.webhook.notify("resolved", device, t, value, state.since, now)
+			}
+			delete(app.thresholdStates, key)
+		case ok && state.firing:
+			// Between the limit and clear, the threshold keeps firing
+			state.value = value
+		case t.breached(value):
+			if !ok {
+				state = &thresholdState{since: now}
+				app.thresholdStates[key] = state
+			}
+			state.value = value
+			if now.Sub(state.since) >= t.forDuration {
+				state.firing = true
+				app.Logger.Infow("Threshold firing", "threshold", t.Name, "severity", t.Severity, "device", redactAddress(device.label), "device_name", device.Name, "value", value)
+				if app.webhook != nil {
+					app.webhook.notify("firing", device, t, value, state.since, now)
+				}
+			}
+		default:
+			delete(app.thresholdStates, key)
+		}
+
+		breached := 0.0
+		if state, ok := app.thresholdStates[key]; ok && state.firing {
+			breached = 1
+		}
+		app.thresholdGauge.WithLabelValues(device.seriesLabels(device.Name, t.Name, t.Sensor, t.Severity)...).Set(breached)
+	}
+}
+
+// thresholdBreaches lists the thresholds firing for a device.
+func (app *App) thresholdBreaches(device *Device) []thresholdBreach {
+	if len(app.thresholds) == 0 {
+		return nil
+	}
+
+	app.thresholdsLock.Lock()
+	defer app.thresholdsLock.Unlock()
+
+	breaches := []thresholdBreach{}
+	for _, t := range app.deviceThresholds(device) {
+		state, ok := app.thresholdStates[device.Address+"\x00"+t.Name]
+		if !ok || !state.firing {
+			continue
+		}
+		operator, limit := t.describe()
+		breaches = append(breaches, thresholdBreach{
+			Threshold: t.Name,
+			Sensor:    t.Sensor,
+			Severity:  t.Severity,
+			Value:     state.value,
+			Operator:  operator,
+			Limit:     limit,
+			Since:     state.since,
+		})
+	}
+	return breaches
+}
+
+// holdThresholds forgets the breaches of a device that went down that
+// hadn't fired yet, since they can't be known to have lasted their For. The
+// thresholds that were firing are left as they were, in
+// awair_threshold_breached and to webhook_url alike, neither resolved nor
+// fired again once the device is back: its next reading either keeps them
+// firing or resolves them.
+func (app *App) holdThresholds(device *Device) {
+	if len(app.thresholds) == 0 {
+		return
+	}
+
+	app.thresholdsLock.Lock()
+	defer app.thresholdsLock.Unlock()
+
+	for _, t := range app.deviceThresholds(device) {
+		key := device.Address + "\x00" + t.Name
+		if state, ok := app.thresholdStates[key]; ok && !state.firing {
+			delete(app.thresholdStates, key)
+		}
+	}
+}
+
+// deleteThresholdSeries forgets the device's threshold states and deletes
+// its series of awair_threshold_breached, without notifying webhook_url of
+// the thresholds that were firing. It's called when the device is paused or
+// removed.
+func (app *App) deleteThresholdSeries(device *Device) {
+	if len(app.thresholds) == 0 {
+		return
+	}
+
+	app.thresholdsLock.Lock()
+	defer app.thresholdsLock.Unlock()
+
+	for _, t := range app.deviceThresholds(device) {
+		delete(app.thresholdStates, device.Address+"\x00"+t.Name)
+		app.thresholdGauge.DeleteLabelValues(device.seriesLabels(device.Name, t.Name, t.Sensor, t.Severity)...)
+	}
+}
@@ -0,0 +1,170 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver collects the notifications posted to it.
+type webhookReceiver struct {
+	*httptest.Server
+	lock     sync.Mutex
+	payloads []webhookPayload
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	t.Helper()
+	receiver := &webhookReceiver{}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := webhookPayload{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("webhook payload: %v", err)
+		}
+		receiver.lock.Lock()
+		receiver.payloads = append(receiver.payloads, payload)
+		receiver.lock.Unlock()
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (receiver *webhookReceiver) statuses() []string {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	statuses := []string{}
+	for _, payload := range receiver.payloads {
+		statuses = append(statuses, payload.Status)
+	}
+	return statuses
+}
+
+func writeThresholds(t *testing.T, thresholds string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "thresholds.json")
+	if err := ioutil.WriteFile(path, []byte(thresholds), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A firing threshold is neither resolved when its device goes down nor
+// fired again when it's back.
+func TestThresholdFiringAcrossOutage(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	client := newFakeDeviceClient()
+	app := newTestApp(t, client, func(app *App) {
+		app.ThresholdsFile = writeThresholds(t, `[{"name": "stuffy", "sensor": "co2", "above": 1200}]`)
+		app.WebhookURL = receiver.URL
+	}, testAddress)
+	breached := func() float64 {
+		value, _ := metricValue(t, app, "awair_threshold_breached", map[string]string{"device_address": testAddress, "device_name": "living-room", "threshold": "stuffy", "sensor": "co2", "severity": "warning"})
+		return value
+	}
+
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Co2: 1500}, nil)
+	pollOnce(app)
+	if got := breached(); got != 1 {
+		t.Fatalf("awair_threshold_breached = %v, want 1", got)
+	}
+
+	client.set(testAddress, AwairStats{}, errors.New("connection refused"))
+	for i := 0; i < app.DeviceDownAfter; i++ {
+		pollOnce(app)
+	}
+	device, _ := app.LookupDevice(testAddress)
+	if device.Health() != healthDown {
+		t.Fatalf("health = %s, want %s", device.Health(), healthDown)
+	}
+	if got := breached(); got != 1 {
+		t.Errorf("awair_threshold_breached while down = %v, want it still firing", got)
+	}
+
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Co2: 1500}, nil)
+	pollOnce(app)
+	if got := breached(); got != 1 {
+		t.Errorf("awair_threshold_breached after recovering = %v, want 1", got)
+	}
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Co2: 800}, nil)
+	pollOnce(app)
+	if got := breached(); got != 0 {
+		t.Errorf("awair_threshold_breached once cleared = %v, want 0", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	app.closeOutputs(ctx)
+	statuses := receiver.statuses()
+	if len(statuses) != 2 || statuses[0] != "firing" || statuses[1] != "resolved" {
+		t.Errorf("webhook notifications = %v, want [firing resolved]", statuses)
+	}
+}
+
+// A breach still waiting out its for when the device goes down starts
+// over once it's back.
+func TestThresholdPendingForgottenWhenDown(t *testing.T) {
+	client := newFakeDeviceClient()
+	app := newTestApp(t, client, func(app *App) {
+		app.ThresholdsFile = writeThresholds(t, `[{"name": "stuffy", "sensor": "co2", "above": 1200, "for": "1h"}]`)
+	}, testAddress)
+
+	client.set(testAddress, AwairStats{Timestamp: time.Now(), Co2: 1500}, nil)
+	pollOnce(app)
+	client.set(testAddress, AwairStats{}, errors.New("connection refused"))
+	for i := 0; i < app.DeviceDownAfter; i++ {
+		pollOnce(app)
+	}
+
+	app.thresholdsLock.Lock()
+	defer app.thresholdsLock.Unlock()
+	if state, ok := app.thresholdStates[testAddress+"\x00stuffy"]; ok {
+		t.Errorf("pending breach kept while down: %+v", state)
+	}
+}
+
+// The devices of a polling group notify the top-level webhook_url.
+func TestGroupThresholdsNotifyWebhook(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	client := newFakeDeviceClient()
+	groupsFile := filepath.Join(t.TempDir(), "groups.yaml")
+	groups := "groups:\n  - name: upstairs\n    labels: {floor: up}\n    devices:\n      - url: http://bedroom/air-data/latest\n        name: bedroom\n"
+	if err := ioutil.WriteFile(groupsFile, []byte(groups), 0600); err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, client, func(app *App) {
+		app.ThresholdsFile = writeThresholds(t, `[{"name": "stuffy", "sensor": "co2", "above": 1200}]`)
+		app.WebhookURL = receiver.URL
+		app.GroupsFile = groupsFile
+	}, testAddress)
+	if len(app.groups) != 1 {
+		t.Fatalf("groups = %d, want 1", len(app.groups))
+	}
+
+	client.set("http://bedroom/air-data/latest", AwairStats{Timestamp: time.Now(), Co2: 1500}, nil)
+	pollOnce(app.groups[0].app)
+	labels := map[string]string{"device_name": "bedroom", "threshold": "stuffy", "floor": "up"}
+	if got, _ := metricValue(t, app, "awair_threshold_breached", labels); got != 1 {
+		t.Errorf("awair_threshold_breached of the group's device = %v, want 1", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	app.closeOutputs(ctx)
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	if len(receiver.payloads) != 1 || receiver.payloads[0].Status != "firing" || receiver.payloads[0].Device != "bedroom" {
+		t.Errorf("webhook notifications = %+v, want bedroom firing", receiver.payloads)
+	}
+
+	// Once the webhook is closed, a late poll of the group drops its
+	// notifications rather than panicking
+	client.set("http://bedroom/air-data/latest", AwairStats{Timestamp: time.Now(), Co2: 800}, nil)
+	pollOnce(app.groups[0].app)
+}
@@ -0,0 +1,85 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ericvolp12/awair-local-prom-exporter/pkg/awair"
+)
+
+// isThrottled reports whether a device, or a proxy in front of it, asked to
+// be polled less often: 429 Too Many Requests, or 503 Service Unavailable
+// with a Retry-After.
+func isThrottled(statusErr *awair.StatusError) bool {
+	return statusErr.StatusCode == http.StatusTooManyRequests ||
+		(statusErr.StatusCode == http.StatusServiceUnavailable && statusErr.RetryAfter > 0)
+}
+
+// throttleMaxDoublings bounds the exponent of the back-off from throttling
+// without a Retry-After, which device_max_retry_after caps long before.
+const throttleMaxDoublings = 16
+
+// throttleDelay returns the delay a throttled poll asked for, at most
+// device_max_retry_after, or 0 if err isn't throttling. Without a
+// Retry-After it backs off exponentially instead, from the poll interval,
+// doubling with every throttled poll of the device in a row.
+func (app *App) throttleDelay(device *Device, err error) time.Duration {
+	var statusErr *awair.StatusError
+	if !errors.As(err, &statusErr) || !isThrottled(statusErr) {
+		return 0
+	}
+	delay := statusErr.RetryAfter
+	if delay <= 0 {
+		device.stateLock.Lock()
+		doublings := device.throttles
+		device.stateLock.Unlock()
+		if doublings > throttleMaxDoublings {
+			doublings = throttleMaxDoublings
+		}
+		delay = app.TimeBetweenChecks << doublings
+	}
+	if delay > app.DeviceMaxRetryAfter {
+		return app.DeviceMaxRetryAfter
+	}
+	return delay
+}
+
+// throttle holds off polling a device for wait, stretching its next poll
+// past the cycles in between, and notes the delay in err.
+func (app *App) throttle(device *Device, wait time.Duration, err error) error {
+	device.stateLock.Lock()
+	device.throttledUntil = time.Now().Add(wait)
+	device.throttles++
+	device.stateLock.Unlock()
+	return fmt.Errorf("%w, polling again in %v", err, wait)
+}
+
+// clearThrottle starts the back-off over once a poll wasn't throttled.
+func (device *Device) clearThrottle() {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	device.throttles = 0
+}
+
+// throttledError is the error of a poll that wasn't sent because the
+// device is being left alone after it asked to be polled less often, or nil
+// if it isn't.
+func (device *Device) throttledError() error {
+	device.stateLock.Lock()
+	until := device.throttledUntil
+	device.stateLock.Unlock()
+	if !time.Now().Before(until) {
+		return nil
+	}
+	return &deviceError{Reason: pollReasonThrottled, Err: fmt.Errorf("device asked to be polled less often, polling again at %s", until.Format(time.RFC3339))}
+}
+
+// isThrottled reports whether the device is being left alone after it
+// asked to be polled less often.
+func (device *Device) isThrottled() bool {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	return time.Now().Before(device.throttledUntil)
+}
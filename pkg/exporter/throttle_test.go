@@ -0,0 +1,115 @@
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newThrottlingDevice serves a device that answers the first throttled
+// requests with 429 Too Many Requests, with retryAfter as their
+// Retry-After if it's set, and readings after that. It returns the number
+// of readings asked for so far.
+func newThrottlingDevice(t *testing.T, throttled int32, retryAfter string) (*httptest.Server, *int32) {
+	t.Helper()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/air-data/latest" {
+			http.NotFound(w, r)
+			return
+		}
+		if atomic.AddInt32(&requests, 1) <= throttled {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"timestamp": "2022-06-01T12:00:00Z", "score": 92, "temp": 21.5}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestThrottledThenSucceeds(t *testing.T) {
+	server, requests := newThrottlingDevice(t, 1, "1")
+	address := server.URL + "/air-data/latest"
+	app := newTestApp(t, nil, func(app *App) {
+		app.httpClient = server.Client()
+	}, address)
+	device, _ := app.LookupDevice(address)
+
+	pollOnce(app)
+	labels := map[string]string{"device_address": address, "reason": pollReasonThrottled}
+	if got, _ := metricValue(t, app, "awair_device_poll_errors_total", labels); got != 1 {
+		t.Errorf("awair_device_poll_errors_total{reason=%q} = %v, want 1", pollReasonThrottled, got)
+	}
+	if !device.isThrottled() {
+		t.Fatalf("device isn't throttled after a 429")
+	}
+
+	// Neither the next cycle nor an ad-hoc poll reaches the device before
+	// Retry-After has passed
+	pollOnce(app)
+	call := app.pollDevice(app.runCtx, device)
+	<-call.done
+	if pollReason(call.err) != pollReasonThrottled {
+		t.Errorf("ad-hoc poll error = %v, want it throttled", call.err)
+	}
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Errorf("device got %d requests while throttled, want 1", got)
+	}
+
+	time.Sleep(time.Until(device.Status().ThrottledUntil) + 10*time.Millisecond)
+	pollOnce(app)
+	if got := atomic.LoadInt32(requests); got != 2 {
+		t.Errorf("device got %d requests, want 2 once Retry-After passed", got)
+	}
+	if got, _ := metricValue(t, app, "awair_device_up", map[string]string{"device_address": address}); got != 1 {
+		t.Errorf("awair_device_up = %v, want 1", got)
+	}
+	if got, _ := metricValue(t, app, "awair_air_quality_score", map[string]string{"device_address": address}); got != 92 {
+		t.Errorf("score = %v, want 92", got)
+	}
+}
+
+func TestThrottledWithoutRetryAfterBacksOff(t *testing.T) {
+	server, _ := newThrottlingDevice(t, 5, "")
+	address := server.URL + "/air-data/latest"
+	app := newTestApp(t, nil, func(app *App) {
+		app.httpClient = server.Client()
+		app.TimeBetweenChecks = time.Minute
+		app.DeviceMaxRetryAfter = 5 * time.Minute
+	}, address)
+	device, _ := app.LookupDevice(address)
+
+	// Each throttled poll in a row doubles the delay, up to
+	// device_max_retry_after, and a poll that isn't throttled starts over
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute, 0} {
+		device.stateLock.Lock()
+		device.throttledUntil = time.Time{}
+		device.stateLock.Unlock()
+
+		pollOnce(app)
+		delay := time.Until(device.Status().ThrottledUntil)
+		if want == 0 {
+			if delay > 0 {
+				t.Errorf("delay after a reading = %v, want none", delay)
+			}
+			continue
+		}
+		if delay <= want-5*time.Second || delay > want {
+			t.Errorf("delay = %v, want %v", delay, want)
+		}
+	}
+	device.stateLock.Lock()
+	throttles := device.throttles
+	device.stateLock.Unlock()
+	if throttles != 0 {
+		t.Errorf("throttled polls in a row after a reading = %d, want 0", throttles)
+	}
+}
@@ -0,0 +1,150 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var watchColors = map[string]string{
+	severityGood: "\033[32m",
+	severityFair: "\033[33m",
+	severityPoor: "\033[31m",
+}
+
+const (
+	watchColorReset = "\033[0m"
+	watchClear      = "\033[H\033[2J"
+)
+
+type watchColumn struct {
+	Header string
+	Sensor string
+	Width  int
+	Value  func(AwairStats) float64
+}
+
+var watchColumns = []watchColumn{
+	{Header: "TEMP", Sensor: "temp", Width: 7, Value: func(s AwairStats) float64 { return s.Temp }},
+	{Header: "HUMID", Sensor: "humid", Width: 7, Value: func(s AwairStats) float64 { return s.Humid }},
+	{Header: "CO2", Sensor: "co2", Width: 6, Value: func(s AwairStats) float64 { return float64(s.Co2) }},
+	{Header: "VOC", Sensor: "voc", Width: 6, Value: func(s AwairStats) float64 { return float64(s.Voc) }},
+	{Header: "PM25", Sensor: "pm25", Width: 6, Value: func(s AwairStats) float64 { return float64(s.Pm25) }},
+	{Header: "SCORE", Sensor: "score", Width: 6, Value: func(s AwairStats) float64 { return float64(s.Score) }},
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Watch polls devices and renders their readings to stdout after every
+// cycle until ctx is cancelled. On a terminal the table is redrawn in place with
+// colors; otherwise one plain line is written per device per cycle.
+func (app *App) Watch(ctx context.Context) error {
+	out := os.Stdout
+	tty := isTerminal(out)
+	if tty {
+		// Errors are shown in the table, so logs would only scribble over it
+		app.Logger = zap.NewNop().Sugar()
+	}
+
+	if err := app.setup(false); err != nil {
+		return err
+	}
+
+	if app.DiscoverMDNS {
+		app.discoverDevices(ctx)
+	}
+
+	for {
+		app.pollDevices(ctx)
+		if tty {
+			app.renderWatchTable(out)
+		} else {
+			app.renderWatchLines(out)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(app.TimeBetweenChecks):
+		}
+	}
+}
+
+func (app *App) renderWatchTable(w io.Writer) {
+	devices := app.Devices()
+
+	nameWidth := len("DEVICE")
+	for _, device := range devices {
+		if len(device.Name) > nameWidth {
+			nameWidth = len(device.Name)
+		}
+	}
+
+	fmt.Fprint(w, watchClear)
+	fmt.Fprintf(w, "Awair devices, updated %s, polling every %v (Ctrl-C to exit)\n\n", time.Now().Format("15:04:05"), app.TimeBetweenChecks)
+
+	fmt.Fprintf(w, "%-*s  %-6s", nameWidth, "DEVICE", "STATUS")
+	for _, column := range watchColumns {
+		fmt.Fprintf(w, "  %*s", column.Width, column.Header)
+	}
+	fmt.Fprintln(w)
+
+	for _, device := range devices {
+		status := device.Status()
+		reading := device.LastReading()
+
+		state := fmt.Sprintf("%-6s", "up")
+		if !status.Up {
+			state = watchColors[severityPoor] + fmt.Sprintf("%-6s", "down") + watchColorReset
+		}
+		fmt.Fprintf(w, "%-*s  %s", nameWidth, status.Name, state)
+
+		for _, column := range watchColumns {
+			if reading == nil {
+				fmt.Fprintf(w, "  %*s", column.Width, "-")
+				continue
+			}
+			value := column.Value(*reading)
+			cell := fmt.Sprintf("%*s", column.Width, formatReading(value))
+			if status.Up {
+				cell = watchColors[severityBands[column.Sensor].classify(value)] + cell + watchColorReset
+			}
+			fmt.Fprintf(w, "  %s", cell)
+		}
+		if !status.Up {
+			fmt.Fprintf(w, "  %s", status.LastError)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func (app *App) renderWatchLines(w io.Writer) {
+	now := time.Now().Format(time.RFC3339)
+	for _, device := range app.Devices() {
+		status := device.Status()
+		reading := device.LastReading()
+
+		if !status.Up || reading == nil {
+			fmt.Fprintf(w, "%s %s down %s\n", now, status.Name, status.LastError)
+			continue
+		}
+
+		fields := []string{}
+		for _, column := range watchColumns {
+			fields = append(fields, fmt.Sprintf("%s=%s", column.Sensor, formatReading(column.Value(*reading))))
+		}
+		fmt.Fprintf(w, "%s %s up %s\n", now, status.Name, strings.Join(fields, " "))
+	}
+}
+
+func formatReading(value float64) string {
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", value), ".0")
+}
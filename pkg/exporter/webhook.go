@@ -0,0 +1,257 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const webhookQueueSize = 64
+
+// threshold is an entry of thresholds_file: a sensor limit that must be
+// breached for at least For before it fires, and that resolves once the
+// sensor is back past Clear, or within the limit if Clear isn't set. A
+// threshold listing Devices applies only to them, and replaces the
+// threshold of the same name that doesn't for them.
+type threshold struct {
+	Name     string   `json:"name,omitempty"`
+	Sensor   string   `json:"sensor"`
+	Above    *float64 `json:"above,omitempty"`
+	Below    *float64 `json:"below,omitempty"`
+	Clear    *float64 `json:"clear,omitempty"`
+	For      string   `json:"for,omitempty"`
+	Severity string   `json:"severity,omitempty"`
+	Devices  []string `json:"devices,omitempty"`
+
+	forDuration time.Duration
+	named       bool
+}
+
+func (t threshold) breached(value float64) bool {
+	return (t.Above != nil && value > *t.Above) || (t.Below != nil && value < *t.Below)
+}
+
+// cleared reports whether a firing threshold resolves at value.
+func (t threshold) cleared(value float64) bool {
+	switch {
+	case t.Clear == nil:
+		return !t.breached(value)
+	case t.Above != nil:
+		return value < *t.Clear
+	default:
+		return value > *t.Clear
+	}
+}
+
+func (t threshold) describe() (string, float64) {
+	if t.Above != nil {
+		return ">", *t.Above
+	}
+	return "<", *t.Below
+}
+
+// loadThresholds reads the JSON list of thresholds in thresholds_file.
+func (app *App) loadThresholds() error {
+	if app.ThresholdsFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(app.ThresholdsFile)
+	if err != nil {
+		return fmt.Errorf("thresholds_file (%q): %w", app.ThresholdsFile, err)
+	}
+	thresholds := []threshold{}
+	if err := json.Unmarshal(data, &thresholds); err != nil {
+		return fmt.Errorf("thresholds_file (%q): %w", app.ThresholdsFile, err)
+	}
+
+	for i := range thresholds {
+		t := &thresholds[i]
+		if !validHistorySensor(t.Sensor) {
+			return fmt.Errorf("thresholds_file (%q): entry %d: sensor (%q) must be one of temp, humid, co2, voc, pm25, score", app.ThresholdsFile, i, t.Sensor)
+		}
+		if (t.Above == nil) == (t.Below == nil) {
+			return fmt.Errorf("thresholds_file (%q): entry %d: exactly one of above and below is required", app.ThresholdsFile, i)
+		}
+		if t.Clear != nil && ((t.Above != nil && *t.Clear > *t.Above) || (t.Below != nil && *t.Clear < *t.Below)) {
+			return fmt.Errorf("thresholds_file (%q): entry %d: clear (%v) must be within the limit, at most above or at least below", app.ThresholdsFile, i, *t.Clear)
+		}
+		if t.For != "" {
+			t.forDuration, err = time.ParseDuration(t.For)
+			if err != nil || t.forDuration < 0 {
+				return fmt.Errorf("thresholds_file (%q): entry %d: for (%q) must be a duration", app.ThresholdsFile, i, t.For)
+			}
+		}
+		if t.Severity == "" {
+			t.Severity = defaultThresholdSeverity
+		}
+		t.named = t.Name != ""
+		if !t.named {
+			operator, limit := t.describe()
+			t.Name = fmt.Sprintf("%s %s %v", t.Sensor, operator, limit)
+		}
+	}
+	if err := checkThresholdOverrides(thresholds); err != nil {
+		return fmt.Errorf("thresholds_file (%q): %w", app.ThresholdsFile, err)
+	}
+
+	app.thresholds = thresholds
+	return nil
+}
+
+type webhookPayload struct {
+	Status    string    `json:"status"`
+	Threshold string    `json:"threshold"`
+	Severity  string    `json:"severity"`
+	Device    string    `json:"device"`
+	Sensor    string    `json:"sensor"`
+	Value     float64   `json:"value"`
+	Operator  string    `json:"operator"`
+	Limit     float64   `json:"limit"`
+	For       string    `json:"for,omitempty"`
+	StartsAt  time.Time `json:"starts_at"`
+	Time      time.Time `json:"time"`
+}
+
+// webhookOutput posts a notification when a threshold starts firing for a
+// device and again when it resolves.
+type webhookOutput struct {
+	app *App
+
+	// closed is set under lock once the queue is closed, after which
+	// notifications, such as of a polling group still finishing a poll,
+	// are dropped.
+	lock   sync.Mutex
+	closed bool
+	queue  chan webhookPayload
+	done   chan struct{}
+
+	notifications *prometheus.CounterVec
+}
+
+func (app *App) newWebhookOutput() *webhookOutput {
+	out := &webhookOutput{
+		app:   app,
+		queue: make(chan webhookPayload, webhookQueueSize),
+		done:  make(chan struct{}),
+		notifications: promauto.With(app.Registerer).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "awair",
+			Subsystem: "webhook",
+			Name:      "notifications_total",
+			Help:      "Threshold notifications, by delivery result",
+		}, []string{"result"}),
+	}
+	go out.run()
+	return out
+}
+
+// Record is a no-op: the exporter evaluates the thresholds against every
+// reading and calls notify when one fires or resolves.
+func (out *webhookOutput) Record(device *Device, stats AwairStats) {}
+
+// notify queues a notification, and must be called with thresholdsLock
+// held so that notifications are queued in order.
+func (out *webhookOutput) notify(status string, device *Device, t threshold, value float64, since time.Time, now time.Time) {
+	operator, limit := t.describe()
+	payload := webhookPayload{
+		Status:    status,
+		Threshold: t.Name,
+		Severity:  t.Severity,
+		Device:    device.Name,
+		Sensor:    t.Sensor,
+		Value:     value,
+		Operator:  operator,
+		Limit:     limit,
+		For:       t.For,
+		StartsAt:  since,
+		Time:      now,
+	}
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	if out.closed {
+		return
+	}
+	select {
+	case out.queue <- payload:
+	default:
+		out.notifications.WithLabelValues("dropped").Inc()
+		out.app.Logger.Warnf("Dropped webhook notification for (%+v), the queue is full", t.Name)
+	}
+}
+
+// Flush is a no-op: notifications are queued as soon as they're due.
+func (out *webhookOutput) Flush() {}
+
+func (out *webhookOutput) Close(ctx context.Context) {
+	out.lock.Lock()
+	out.closed = true
+	close(out.queue)
+	out.lock.Unlock()
+
+	select {
+	case <-out.done:
+	case <-ctx.Done():
+	}
+}
+
+func (out *webhookOutput) run() {
+	defer close(out.done)
+	for payload := range out.queue {
+		if err := out.deliver(payload); err != nil {
+			out.notifications.WithLabelValues("failure").Inc()
+			out.app.Logger.Errorf("Failed to deliver webhook notification for (%+v): %+v", payload.Threshold, err)
+			continue
+		}
+		out.notifications.WithLabelValues("success").Inc()
+	}
+}
+
+// deliver posts a notification, retrying network errors, 429s and 5xx
+// responses with backoff.
+func (out *webhookOutput) deliver(payload webhookPayload) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	// Keep operators readable rather than escaped as \u003e
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(payload); err != nil {
+		return err
+	}
+	body := buf.Bytes()
+
+	backoff := outputRetryBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := out.post(body)
+		if err == nil {
+			return nil
+		}
+		if attempt == outputMaxAttempts || (resp != nil && !retryableStatus(resp.StatusCode)) {
+			return err
+		}
+		time.Sleep(retryAfter(resp, backoff))
+		backoff *= 2
+	}
+}
+
+func (out *webhookOutput) post(body []byte) (*http.Response, error) {
+	resp, err := out.app.pushClient.Post(out.app.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return resp, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return resp, nil
+}